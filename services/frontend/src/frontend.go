@@ -1,10 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"os"
+
 	"landtitle/server"
 )
 
+//go:embed routes.yaml
+var routes []byte
+
+//go:embed templates
+var templates embed.FS
+
+//go:embed static
+var static embed.FS
+
 func main() {
 	println("this is the frontend")
-	server.NewServer()
+	var config server.TemplateConfig
+	//FRONTEND_TEMPLATES points at the templates directory while developing,
+	//pages are read from disk on every request
+	if dir := os.Getenv("FRONTEND_TEMPLATES"); dir != "" {
+		config.FS = os.DirFS(dir)
+		config.Reload = true
+	} else {
+		sub, err := fs.Sub(templates, "templates")
+		if err != nil {
+			panic(err)
+		}
+		config.FS = sub
+	}
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	s, err := server.NewServer(
+		bytes.NewReader(routes), nil,
+		server.WithTemplates(config), server.WithStaticFS("assets", assets),
+		server.WithCompression(server.CompressionConfig{}),
+	)
+	if err != nil {
+		panic(err)
+	}
+	if err = s.StartServer(8080); err != nil {
+		panic(err)
+	}
 }
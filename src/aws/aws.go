@@ -41,6 +41,7 @@ func NewSession(pRegion, pProfile *string) (*Session, error) {
 			"AWS SDK returned a nil pointer when calling NewSession, can't continue.",
 		)
 	}
+	addTracingHandlers(&sess.Handlers)
 	temp_sess := Session(*sess)
 	return &temp_sess, nil
 }
@@ -1,7 +1,9 @@
 package aws
 
 import (
+	"context"
 	"fmt"
+	"landtitle/tracing"
 
 	oSession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rekognition"
@@ -9,8 +11,8 @@ import (
 )
 
 type RekognitionClient interface {
-	AnalyzeFromDisk(string) error
-	AnalyzeFromS3(string, string) error
+	AnalyzeFromDisk(context.Context, string) error
+	AnalyzeFromS3(context.Context, string, string) error
 }
 
 type rekognitionClient struct {
@@ -37,10 +39,25 @@ func BuildRekognitionClient(client rekognitioniface.RekognitionAPI) RekognitionC
 	}
 }
 
-func (r *rekognitionClient) AnalyzeFromDisk(path string) error {
+func (r *rekognitionClient) AnalyzeFromDisk(ctx context.Context, path string) error {
+	_, span := tracing.Start(
+		ctx, "rekognition.AnalyzeFromDisk",
+		tracing.WithKind(tracing.SpanKindClient),
+		tracing.WithAttributes(tracing.Attribute{Key: "file.path", Value: path}),
+	)
+	defer span.End()
 	return nil
 }
 
-func (r *rekognitionClient) AnalyzeFromS3(bucket, key string) error {
+func (r *rekognitionClient) AnalyzeFromS3(ctx context.Context, bucket, key string) error {
+	_, span := tracing.Start(
+		ctx, "rekognition.AnalyzeFromS3",
+		tracing.WithKind(tracing.SpanKindClient),
+		tracing.WithAttributes(
+			tracing.Attribute{Key: "s3.bucket", Value: bucket},
+			tracing.Attribute{Key: "s3.key", Value: key},
+		),
+	)
+	defer span.End()
 	return nil
 }
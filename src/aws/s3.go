@@ -1,34 +1,90 @@
 package aws
 
-/*
 import (
+	"context"
 	"fmt"
+	"io"
+	"landtitle/tracing"
 
+	oAWS "github.com/aws/aws-sdk-go/aws"
 	oSession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-type S3Client interface{}
+type S3Client interface {
+	// streams body in parts, it's never held in memory whole
+	Upload(ctx context.Context, bucket, key, contentType string, body io.Reader) error
+	Delete(ctx context.Context, bucket, key string) error
+}
 
-type s3Client struct{}
+type s3Client struct {
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+}
 
 // this should ONLY be called from main()
 func NewS3Client(session *Session) (S3Client, error) {
 	if session == nil {
 		return nil, fmt.Errorf(
-			"Passed session to aws.NewRekognitionClient can't be nil.",
+			"Passed session to aws.NewS3Client can't be nil.",
 		)
 	}
 	tSess := oSession.Session((*session))
-	rClient := s3.New(&tSess)
-	return BuildS3Client(rClient), nil
+	sClient := s3.New(&tSess)
+	return BuildS3Client(sClient), nil
 }
 
 // convenience function, mostly for dependency injection
 // while testing
-func BuildS3Client(client s3iface.) S3Client {
+func BuildS3Client(client s3iface.S3API) S3Client {
 	return &s3Client{
-		client: client,
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}
+}
+
+func (s *s3Client) Upload(
+	ctx context.Context, bucket, key, contentType string, body io.Reader,
+) error {
+	ctx, span := tracing.Start(
+		ctx, "s3.Upload",
+		tracing.WithKind(tracing.SpanKindClient),
+		tracing.WithAttributes(
+			tracing.Attribute{Key: "s3.bucket", Value: bucket},
+			tracing.Attribute{Key: "s3.key", Value: key},
+		),
+	)
+	defer span.End()
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      oAWS.String(bucket),
+		Key:         oAWS.String(key),
+		ContentType: oAWS.String(contentType),
+		Body:        body,
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (s *s3Client) Delete(ctx context.Context, bucket, key string) error {
+	ctx, span := tracing.Start(
+		ctx, "s3.Delete",
+		tracing.WithKind(tracing.SpanKindClient),
+		tracing.WithAttributes(
+			tracing.Attribute{Key: "s3.bucket", Value: bucket},
+			tracing.Attribute{Key: "s3.key", Value: key},
+		),
+	)
+	defer span.End()
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: oAWS.String(bucket),
+		Key:    oAWS.String(key),
+	})
+	if err != nil {
+		span.RecordError(err)
 	}
+	return err
 }
-*/
@@ -0,0 +1,52 @@
+package aws
+
+import (
+	"fmt"
+	"landtitle/tracing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	startSpanHandlerName string = "landtitle.tracing.StartSpan"
+	endSpanHandlerName          = "landtitle.tracing.EndSpan"
+)
+
+// every client built off a session inherits its handlers, so this gets a
+// span around every SDK call, retries included, parented on whatever
+// context the call was made WithContext
+func addTracingHandlers(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: startSpanHandlerName,
+		Fn: func(r *request.Request) {
+			ctx, span := tracing.Start(
+				r.Context(),
+				fmt.Sprintf("%s.%s", r.ClientInfo.ServiceName, r.Operation.Name),
+				tracing.WithKind(tracing.SpanKindClient),
+				tracing.WithAttributes(
+					tracing.Attribute{Key: "aws.service", Value: r.ClientInfo.ServiceName},
+					tracing.Attribute{Key: "aws.operation", Value: r.Operation.Name},
+				),
+			)
+			r.SetContext(ctx)
+			if span != nil && r.Config.Region != nil {
+				span.SetAttribute("aws.region", *r.Config.Region)
+			}
+		},
+	})
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: endSpanHandlerName,
+		Fn: func(r *request.Request) {
+			span := tracing.SpanFromContext(r.Context())
+			if r.HTTPResponse != nil {
+				span.SetAttribute("http.status_code", r.HTTPResponse.StatusCode)
+			}
+			span.SetAttribute("aws.retry_count", r.RetryCount)
+			if r.RequestID != "" {
+				span.SetAttribute("aws.request_id", r.RequestID)
+			}
+			span.RecordError(r.Error)
+			span.End()
+		},
+	})
+}
@@ -3,9 +3,12 @@ module landtitle
 go 1.21.6
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/aws/aws-sdk-go v1.49.15
 	github.com/buhduh42/go-logger v0.0.0-20240201235147-c08ccbf70c2e
+	golang.org/x/crypto v0.18.0
 	golang.org/x/exp v0.0.0-20240112132812-db7319d0e0e3
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
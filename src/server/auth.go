@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+authentication, schemes are declared once under the top level auth: key of
+routes.yaml and routes pick the ones that apply, eg
+
+	auth:
+	  default: [tokens]
+	  schemes:
+	    keys:
+	      type: api_key
+	      header: X-Api-Key
+	      keys_file: /etc/landtitle/api_keys
+	    staff:
+	      type: basic
+	      realm: landtitle
+	      password_file: /etc/landtitle/htpasswd
+	    tokens:
+	      type: jwt
+	      jwks: /etc/landtitle/jwks.json
+	      algorithms: [RS256, ES256]
+	      issuer: https://idp.example.com
+	      audience: landtitle
+	/deeds:
+	  auth: [keys, tokens]
+	  callbacks:
+	    - deeds
+	/status:
+	  auth: []
+	  callbacks:
+	    - status
+
+routes without auth: get the default, an empty list makes a route public,
+builtin routes are public unless they list schemes themselves. Passing any
+one scheme is enough, but credentials that are presented and fail are a
+401 whatever the others would say. Callbacks get who it was from
+RequestPrincipal.
+
+keys_file lines are name:key, password_file lines are user:bcrypt-hash as
+htpasswd -B writes them, # starts a comment in both. See jwt.go for tokens.
+*/
+
+// the top level key in routes.yaml, it can't be a route
+const authKey string = "auth"
+
+type authSchemeType string
+
+const (
+	apiKeyAuth authSchemeType = "api_key"
+	basicAuth                 = "basic"
+	jwtAuth                   = "jwt"
+	//logged in through oidc, see oidc.go
+	sessionAuth = "session"
+)
+
+func newAuthSchemeType(a string) (*authSchemeType, error) {
+	toRet := authSchemeType(a)
+	switch toRet {
+	case apiKeyAuth:
+		fallthrough
+	case basicAuth:
+		fallthrough
+	case jwtAuth:
+		fallthrough
+	case sessionAuth:
+		return &toRet, nil
+	}
+	return nil, fmt.Errorf("unrecognized auth scheme type: '%s'", a)
+}
+
+type AuthYaml struct {
+	//schemes for routes that don't set auth:
+	Default []string                   `yaml:"default,omitempty"`
+	Schemes map[string]*AuthSchemeYaml `yaml:"schemes"`
+}
+
+type AuthSchemeYaml struct {
+	Type string `yaml:"type"`
+	//api_key, one of header or query
+	Header   string `yaml:"header,omitempty"`
+	Query    string `yaml:"query,omitempty"`
+	KeysFile string `yaml:"keys_file,omitempty"`
+	//basic and jwt
+	Realm string `yaml:"realm,omitempty"`
+	//basic
+	PasswordFile string `yaml:"password_file,omitempty"`
+	//jwt, keys from any of jwks, pem and secret_file
+	JWKS       string   `yaml:"jwks,omitempty"`
+	PEM        string   `yaml:"pem,omitempty"`
+	SecretFile string   `yaml:"secret_file,omitempty"`
+	Algorithms []string `yaml:"algorithms,omitempty"`
+	Issuer     string   `yaml:"issuer,omitempty"`
+	Audience   string   `yaml:"audience,omitempty"`
+	//go duration, defaults to 30s
+	Leeway string `yaml:"leeway,omitempty"`
+	//jwt and session, where roles and permissions are in the claims, see
+	//authz.go
+	RolesClaim       string `yaml:"roles_claim,omitempty"`
+	PermissionsClaim string `yaml:"permissions_claim,omitempty"`
+	//any scheme, roles and permissions by subject
+	Grants map[string]*AccessYaml `yaml:"grants,omitempty"`
+}
+
+// Who made the request, see RequestPrincipal
+type Principal struct {
+	//the api key's name, the user or the token's sub
+	Subject string
+	//the scheme's name in routes.yaml
+	Scheme string
+	//the token's claims, just sub for the other schemes
+	Claims map[string]interface{}
+	//from the token and the scheme's grants, see authz.go
+	Roles       []string
+	Permissions []string
+}
+
+var errNoCredentials error = errors.New("no credentials")
+
+type authScheme interface {
+	//errNoCredentials when the request didn't try this scheme
+	authenticate(r *http.Request) (*Principal, error)
+	//for WWW-Authenticate, err is why authenticate failed, nil when the
+	//request didn't try
+	challenge(err error) string
+}
+
+// name:value lines, what's on each side is up to the scheme
+func readCredentialFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	toRet := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, val, ok := strings.Cut(line, ":")
+		if !ok || name == "" || val == "" {
+			return nil, fmt.Errorf("'%s' line %d isn't name:value", path, i)
+		}
+		if _, ok = toRet[name]; ok {
+			return nil, fmt.Errorf("'%s' line %d repeats '%s'", path, i, name)
+		}
+		toRet[name] = val
+	}
+	return toRet, scanner.Err()
+}
+
+type apiKeyScheme struct {
+	name   string
+	header string
+	query  string
+	//sha256 of the key to its name, keys aren't kept around in the clear
+	keys map[string]string
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeyScheme(name string, s *AuthSchemeYaml) (*apiKeyScheme, error) {
+	if (s.Header == "") == (s.Query == "") {
+		return nil, fmt.Errorf("api_key scheme '%s' needs exactly one of header or query", name)
+	}
+	if s.KeysFile == "" {
+		return nil, fmt.Errorf("api_key scheme '%s' needs a keys_file", name)
+	}
+	names, err := readCredentialFile(s.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &apiKeyScheme{
+		name:   name,
+		header: s.Header,
+		query:  s.Query,
+		keys:   make(map[string]string),
+	}
+	for keyName, key := range names {
+		hashed := hashAPIKey(key)
+		if _, ok := toRet.keys[hashed]; ok {
+			return nil, fmt.Errorf("'%s' has the same key more than once", s.KeysFile)
+		}
+		toRet.keys[hashed] = keyName
+	}
+	return toRet, nil
+}
+
+// a key in the query is removed once it checks out so it doesn't trip
+// unknown_params or end up in front of callbacks
+func (a *apiKeyScheme) authenticate(r *http.Request) (*Principal, error) {
+	var key string
+	if a.header != "" {
+		key = r.Header.Get(a.header)
+	} else {
+		key = r.URL.Query().Get(a.query)
+	}
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	name, ok := a.keys[hashAPIKey(key)]
+	if !ok {
+		return nil, fmt.Errorf("unknown api key")
+	}
+	if a.query != "" {
+		query := r.URL.Query()
+		query.Del(a.query)
+		r.URL.RawQuery = query.Encode()
+	}
+	return &Principal{
+		Subject: name,
+		Scheme:  a.name,
+		Claims:  map[string]interface{}{"sub": name},
+	}, nil
+}
+
+func (a *apiKeyScheme) challenge(err error) string {
+	if a.header != "" {
+		return fmt.Sprintf(`APIKey header="%s"`, a.header)
+	}
+	return fmt.Sprintf(`APIKey query="%s"`, a.query)
+}
+
+type basicScheme struct {
+	name  string
+	realm string
+	//user to bcrypt hash
+	users map[string][]byte
+}
+
+// compared against for unknown users so they take as long as known ones
+var unknownUserHash = sync.OnceValue(func() []byte {
+	toRet, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return toRet
+})
+
+func newBasicScheme(name string, s *AuthSchemeYaml) (*basicScheme, error) {
+	if s.PasswordFile == "" {
+		return nil, fmt.Errorf("basic scheme '%s' needs a password_file", name)
+	}
+	users, err := readCredentialFile(s.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &basicScheme{
+		name:  name,
+		realm: s.Realm,
+		users: make(map[string][]byte),
+	}
+	for user, hash := range users {
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf(
+				"'%s' hash for '%s' isn't bcrypt: %w", s.PasswordFile, user, err,
+			)
+		}
+		toRet.users[user] = []byte(hash)
+	}
+	return toRet, nil
+}
+
+func (b *basicScheme) authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+	hash, known := b.users[user]
+	if !known {
+		hash = unknownUserHash()
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !known {
+		return nil, fmt.Errorf("bad user or password")
+	}
+	return &Principal{
+		Subject: user,
+		Scheme:  b.name,
+		Claims:  map[string]interface{}{"sub": user},
+	}, nil
+}
+
+func (b *basicScheme) challenge(err error) string {
+	return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, b.realm)
+}
+
+type jwtScheme struct {
+	name             string
+	realm            string
+	verifier         *jwtVerifier
+	rolesClaim       string
+	permissionsClaim string
+}
+
+func newJWTScheme(name string, s *AuthSchemeYaml) (*jwtScheme, error) {
+	verifier, err := newJWTVerifier(s)
+	if err != nil {
+		return nil, fmt.Errorf("jwt scheme '%s': %w", name, err)
+	}
+	return &jwtScheme{
+		name:             name,
+		realm:            s.Realm,
+		verifier:         verifier,
+		rolesClaim:       s.RolesClaim,
+		permissionsClaim: s.PermissionsClaim,
+	}, nil
+}
+
+func (j *jwtScheme) authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, errNoCredentials
+	}
+	claims, err := j.verifier.verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	toRet := &Principal{
+		Subject: sub,
+		Scheme:  j.name,
+		Claims:  claims,
+	}
+	toRet.Roles, toRet.Permissions = claimsAccess(
+		claims, j.rolesClaim, j.permissionsClaim,
+	)
+	return toRet, nil
+}
+
+func (j *jwtScheme) challenge(err error) string {
+	if err == nil {
+		return fmt.Sprintf(`Bearer realm="%s"`, j.realm)
+	}
+	return fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, j.realm)
+}
+
+func newAuthScheme(name string, s *AuthSchemeYaml) (authScheme, error) {
+	if s == nil {
+		return nil, fmt.Errorf("auth scheme '%s' is empty", name)
+	}
+	sType, err := newAuthSchemeType(s.Type)
+	if err != nil {
+		return nil, err
+	}
+	switch *sType {
+	case apiKeyAuth:
+		return newAPIKeyScheme(name, s)
+	case basicAuth:
+		return newBasicScheme(name, s)
+	case sessionAuth:
+		return newSessionScheme(name, s)
+	}
+	return newJWTScheme(name, s)
+}
+
+// every scheme routes.yaml declares and the ones routes get by default
+type authConfig struct {
+	schemes map[string]authScheme
+	grants  map[string]accessGrants
+	def     *routeAuth
+}
+
+func newAuthConfig(a *AuthYaml) (*authConfig, error) {
+	toRet := &authConfig{
+		schemes: make(map[string]authScheme),
+		grants:  make(map[string]accessGrants),
+	}
+	if a == nil {
+		return toRet, nil
+	}
+	for name, s := range a.Schemes {
+		scheme, err := newAuthScheme(name, s)
+		if err != nil {
+			return nil, err
+		}
+		toRet.schemes[name] = scheme
+		toRet.grants[name] = s.Grants
+	}
+	def, err := toRet.resolve(a.Default)
+	if err != nil {
+		return nil, err
+	}
+	toRet.def = def
+	return toRet, nil
+}
+
+// true when one of the route's schemes reads the session
+func (a *routeAuth) usesSessions() bool {
+	if a == nil {
+		return false
+	}
+	for _, scheme := range a.schemes {
+		if _, ok := scheme.(*sessionScheme); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nil for public routes
+type routeAuth struct {
+	names   []string
+	schemes []authScheme
+	grants  []accessGrants
+}
+
+func (a *authConfig) resolve(names []string) (*routeAuth, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	toRet := &routeAuth{names: names}
+	for _, name := range names {
+		scheme, ok := a.schemes[name]
+		if !ok {
+			return nil, fmt.Errorf("auth scheme '%s' not declared under auth: schemes", name)
+		}
+		toRet.schemes = append(toRet.schemes, scheme)
+		toRet.grants = append(toRet.grants, a.grants[name])
+	}
+	return toRet, nil
+}
+
+// names is the route's auth:, nil when it didn't set one
+func (a *authConfig) forRoute(names *[]string, builtin bool) (*routeAuth, error) {
+	if names != nil {
+		return a.resolve(*names)
+	}
+	if builtin {
+		return nil, nil
+	}
+	return a.def, nil
+}
+
+func loadAuthYaml(rawBytes []byte) (*AuthYaml, error) {
+	var toRet struct {
+		Auth *AuthYaml `yaml:"auth"`
+	}
+	if err := yaml.Unmarshal(rawBytes, &toRet); err != nil {
+		return nil, err
+	}
+	return toRet.Auth, nil
+}
+
+type principalKey struct{}
+
+// RequestPrincipal returns who authenticated the request, nil on public
+// routes
+func RequestPrincipal(r *http.Request) *Principal {
+	if r == nil {
+		return nil
+	}
+	toRet, _ := r.Context().Value(principalKey{}).(*Principal)
+	return toRet
+}
+
+func (m *myHandler) authenticate(
+	w http.ResponseWriter, r *http.Request,
+) (*http.Request, *handlerError) {
+	auth := m.route.auth
+	if auth == nil {
+		return r, nil
+	}
+	failed := -1
+	var failure error
+	for i, scheme := range auth.schemes {
+		principal, err := scheme.authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			failed, failure = i, err
+			break
+		}
+		auth.grants[i].apply(principal)
+		myLogger.Debugf(
+			"authenticated '%s' with scheme '%s'", principal.Subject, principal.Scheme,
+		)
+		return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), nil
+	}
+	for i, scheme := range auth.schemes {
+		var challenge string
+		if i == failed {
+			challenge = scheme.challenge(failure)
+		} else {
+			challenge = scheme.challenge(nil)
+		}
+		if challenge != "" {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	if failed < 0 {
+		m.metrics.authFailed(m.path, "none")
+		return nil, &handlerError{http.StatusUnauthorized, "authentication required"}
+	}
+	myLogger.Debugf("authentication failed with error: '%s'", failure)
+	m.metrics.authFailed(m.path, auth.names[failed])
+	return nil, &handlerError{http.StatusUnauthorized, "authentication failed"}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+authorization, once a request is authenticated routes can ask for roles and
+permissions from the principal, eg
+
+	/deeds:
+	  methods: [get, post]
+	  auth: [tokens]
+	  roles: [clerk, officer]
+	  access:
+	    post:
+	      roles: [officer]
+	      permissions: [deeds:write]
+
+any one of roles is enough, every one of permissions is needed. An access:
+entry replaces the route's roles and permissions for that method rather than
+adding to them, head follows get's unless it has its own. Routes with roles
+or permissions need auth, a public route can't check who it is. Failing is a
+403 application/problem+json, RFC 9457. NewServer logs which routes are
+public and what the rest ask for.
+
+jwt principals get theirs from the roles claim and the permissions claim or,
+without one, the space separated scope claim, roles_claim and
+permissions_claim change which. Any scheme can grant more by subject, mostly
+for api keys and basic users that have no claims, eg
+
+	keys:
+	  type: api_key
+	  header: X-Api-Key
+	  keys_file: /etc/landtitle/api_keys
+	  grants:
+	    ci:
+	      roles: [clerk]
+*/
+
+type AccessYaml struct {
+	Roles       []string `yaml:"roles,omitempty,flow"`
+	Permissions []string `yaml:"permissions,omitempty,flow"`
+}
+
+type accessRule struct {
+	//any of
+	roles []string
+	//all of
+	permissions []string
+}
+
+func newAccessRule(roles, permissions []string) (*accessRule, error) {
+	if len(roles) == 0 && len(permissions) == 0 {
+		return nil, nil
+	}
+	for _, name := range append(append([]string{}, roles...), permissions...) {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("roles and permissions can't be blank")
+		}
+	}
+	return &accessRule{roles: roles, permissions: permissions}, nil
+}
+
+// the empty string when p is allowed, otherwise why not
+func (a *accessRule) deny(p *Principal) string {
+	if a == nil {
+		return ""
+	}
+	if len(a.roles) > 0 {
+		found := false
+		for _, role := range a.roles {
+			if p.HasRole(role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("requires one of the roles: %s", strings.Join(a.roles, ", "))
+		}
+	}
+	var missing []string
+	for _, perm := range a.permissions {
+		if !p.HasPermission(perm) {
+			missing = append(missing, perm)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("missing permissions: %s", strings.Join(missing, ", "))
+	}
+	return ""
+}
+
+func (a *accessRule) String() string {
+	var parts []string
+	if len(a.roles) > 0 {
+		parts = append(parts, fmt.Sprintf("roles %v", a.roles))
+	}
+	if len(a.permissions) > 0 {
+		parts = append(parts, fmt.Sprintf("permissions %v", a.permissions))
+	}
+	return strings.Join(parts, " ")
+}
+
+// nil when the route doesn't check roles or permissions
+type routeAccess struct {
+	//nil for methods only an access: entry restricts
+	def     *accessRule
+	methods map[httpMethod]*accessRule
+}
+
+func newRouteAccess(r *RouteYaml, methods []httpMethod) (*routeAccess, error) {
+	def, err := newAccessRule(r.Roles, r.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &routeAccess{
+		def:     def,
+		methods: make(map[httpMethod]*accessRule),
+	}
+	for m, access := range r.Access {
+		method, err := newHttpMethod(strings.ToLower(m))
+		if err != nil {
+			return nil, fmt.Errorf("access: %w", err)
+		}
+		found := false
+		for _, allowed := range methods {
+			found = found || allowed == *method
+		}
+		if !found {
+			return nil, fmt.Errorf("access: method '%s' isn't one of the route's methods", m)
+		}
+		if access == nil {
+			access = &AccessYaml{}
+		}
+		if toRet.methods[*method], err = newAccessRule(
+			access.Roles, access.Permissions,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if toRet.def == nil && len(toRet.methods) == 0 {
+		return nil, nil
+	}
+	return toRet, nil
+}
+
+func (a *routeAccess) forMethod(method string) *accessRule {
+	if a == nil {
+		return nil
+	}
+	m := httpMethod(strings.ToLower(method))
+	if rule, ok := a.methods[m]; ok {
+		return rule
+	}
+	//a HEAD is a GET without the body, it shouldn't get around get's rule
+	if rule, ok := a.methods[getMethod]; ok && m == headMethod {
+		return rule
+	}
+	return a.def
+}
+
+// HasRole reports if the principal was given role, by its token or the
+// scheme's grants
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && containsString(p.Roles, role)
+}
+
+// HasPermission reports if the principal was given perm, by its token or
+// the scheme's grants
+func (p *Principal) HasPermission(perm string) bool {
+	return p != nil && containsString(p.Permissions, perm)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appends what's missing from add, keeps the order they were found in
+func mergeStrings(list, add []string) []string {
+	for _, s := range add {
+		if !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// a claim as a list, tokens carry them as arrays or space separated strings
+func claimStrings(claims map[string]interface{}, name string) ([]string, bool) {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v), true
+	case []interface{}:
+		toRet := make([]string, 0, len(v))
+		for _, elem := range v {
+			if s, ok := elem.(string); ok && s != "" {
+				toRet = append(toRet, s)
+			}
+		}
+		return toRet, true
+	}
+	return nil, false
+}
+
+// roles from rolesClaim, roles when empty, permissions from
+// permissionsClaim or when it's empty permissions then scope
+func claimsAccess(
+	claims map[string]interface{}, rolesClaim, permissionsClaim string,
+) (roles []string, permissions []string) {
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	roles, _ = claimStrings(claims, rolesClaim)
+	if permissionsClaim != "" {
+		permissions, _ = claimStrings(claims, permissionsClaim)
+		return roles, permissions
+	}
+	if perms, ok := claimStrings(claims, "permissions"); ok {
+		return roles, perms
+	}
+	permissions, _ = claimStrings(claims, "scope")
+	return roles, permissions
+}
+
+// roles and permissions by subject from a scheme's grants:
+type accessGrants map[string]*AccessYaml
+
+func (g accessGrants) apply(p *Principal) {
+	grant, ok := g[p.Subject]
+	if !ok || grant == nil {
+		return
+	}
+	p.Roles = mergeStrings(p.Roles, grant.Roles)
+	p.Permissions = mergeStrings(p.Permissions, grant.Permissions)
+}
+
+// always a json problem, unlike Error, clients that get this far are
+// talking to an api
+func writeProblem(w http.ResponseWriter, r *http.Request, hErr *handlerError) {
+	writeProblemJSON(w, newProblem(r, hErr.code, hErr.message))
+	myLogger.Errorf(
+		"ServerHTTP failed with error message: '%s', http code: %d",
+		hErr.message, hErr.code,
+	)
+}
+
+// after authenticate, so the principal is on the request when there's one
+func (m *myHandler) authorize(r *http.Request) *handlerError {
+	rule := m.route.access.forMethod(r.Method)
+	if rule == nil {
+		return nil
+	}
+	principal := RequestPrincipal(r)
+	reason := rule.deny(principal)
+	if reason == "" {
+		return nil
+	}
+	myLogger.Debugf(
+		"'%s' denied %s '%s': %s", principal.Subject, r.Method, r.URL.Path, reason,
+	)
+	m.metrics.accessDenied(m.path, r.Method)
+	return &handlerError{http.StatusForbidden, reason}
+}
+
+// one line per route saying who can get at it, public ones first since
+// they're the ones worth a second look, admin endpoints are always public
+func accessReport(routes map[string]*route, adminPaths []string) []string {
+	var public, protected []string
+	for _, path := range adminPaths {
+		public = append(public, fmt.Sprintf("%s: public (admin)", path))
+	}
+	for path, rte := range routes {
+		if rte.auth == nil {
+			public = append(public, fmt.Sprintf("%s: public", path))
+			continue
+		}
+		line := fmt.Sprintf("%s: auth %v", path, rte.auth.names)
+		if a := rte.access; a != nil {
+			if a.def != nil {
+				line += " " + a.def.String()
+			}
+			methods := make([]string, 0, len(a.methods))
+			for m := range a.methods {
+				methods = append(methods, string(m))
+			}
+			sort.Strings(methods)
+			for _, m := range methods {
+				rule := a.methods[httpMethod(m)]
+				if rule == nil {
+					line += fmt.Sprintf(", %s any principal", m)
+					continue
+				}
+				line += fmt.Sprintf(", %s %s", m, rule)
+			}
+		}
+		protected = append(protected, line)
+	}
+	sort.Strings(public)
+	sort.Strings(protected)
+	return append(public, protected...)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLoading(t *testing.T) {
+	authYaml := writeAuthFiles(t)
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{authYaml + "/a:\n  roles: [clerk]\n  callbacks: [cb1]\n", false, "roles"},
+		//1
+		{
+			authYaml + "/a:\n  methods: [get, post]\n  access:\n    POST:\n" +
+				"      permissions: [deeds:write]\n  callbacks: [cb1]\n",
+			false, "access by method",
+		},
+		//2
+		{
+			authYaml + "/a:\n  auth: []\n  roles: [clerk]\n  callbacks: [cb1]\n",
+			true, "roles on a public route",
+		},
+		//3
+		{"/a:\n  permissions: [x]\n  callbacks: [cb1]\n", true, "no auth at all"},
+		//4
+		{
+			authYaml + "/a:\n  access:\n    post:\n      roles: [clerk]\n  callbacks: [cb1]\n",
+			true, "method the route doesn't take",
+		},
+		//5
+		{
+			authYaml + "/a:\n  access:\n    patch:\n      roles: [clerk]\n  callbacks: [cb1]\n",
+			true, "unknown method",
+		},
+		//6
+		{authYaml + "/a:\n  roles: ['']\n  callbacks: [cb1]\n", true, "blank role"},
+		//7
+		{
+			authYaml + "/a:\n  builtin: readiness\n  auth: [keys]\n  roles: [ops]\n",
+			false, "builtin",
+		},
+	}
+	for i, td := range testData {
+		_, err := loadRoutes(strings.NewReader(td.yamlString))
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestServerAccess(t *testing.T) {
+	authYaml := strings.Replace(
+		writeAuthFiles(t),
+		"      header: X-Api-Key\n",
+		"      header: X-Api-Key\n      grants:\n        ci:\n          roles: [clerk]\n",
+		1,
+	)
+	authYaml = strings.Replace(
+		authYaml,
+		"      audience: landtitle\n",
+		"      audience: landtitle\n      roles_claim: groups\n",
+		1,
+	)
+	routesYaml := authYaml + `/deeds:
+  methods: [get, head, post, put]
+  auth: [keys, tokens]
+  roles: [clerk, officer]
+  access:
+    post:
+      roles: [officer]
+      permissions: [deeds:write]
+    put: {}
+  callbacks: [ok]
+/scoped:
+  auth: [tokens]
+  permissions: [deeds:read]
+  callbacks: [ok]
+/open:
+  auth: []
+  callbacks: [ok]
+`
+	tmpServer, err := NewServer(
+		strings.NewReader(routesYaml),
+		map[string]Callback{
+			"ok": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				return true, nil
+			},
+		},
+		WithMetricsPath("/metrics"),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	token := func(claims map[string]interface{}) string {
+		claims["iss"], claims["aud"] = "test", "landtitle"
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		return "Bearer " + signJWT(t, hs256, []byte("s3cret"), "", claims)
+	}
+	officer := token(map[string]interface{}{
+		"sub": "officer", "groups": []string{"officer"}, "permissions": []string{"deeds:write"},
+	})
+	testData := []struct {
+		handlePath string
+		method     string
+		header     string
+		value      string
+		expCode    int
+		msg        string
+	}{
+		//0
+		{"/deeds", http.MethodGet, "X-Api-Key", "k3y", http.StatusOK, "granted role"},
+		//1
+		{"/deeds", http.MethodGet, "X-Api-Key", "other", http.StatusForbidden, "no role"},
+		//2
+		{"/deeds", http.MethodHead, "X-Api-Key", "other", http.StatusForbidden, "head"},
+		//3
+		{"/deeds", http.MethodPost, "X-Api-Key", "k3y", http.StatusForbidden, "post role"},
+		//4
+		{"/deeds", http.MethodPost, "Authorization", officer, http.StatusOK, "officer"},
+		//5
+		{
+			"/deeds", http.MethodPost, "Authorization",
+			token(map[string]interface{}{"sub": "x", "groups": "officer"}),
+			http.StatusForbidden, "missing permission",
+		},
+		//6
+		{"/deeds", http.MethodPut, "X-Api-Key", "other", http.StatusOK, "put any principal"},
+		//7
+		{"/deeds", http.MethodGet, "", "", http.StatusUnauthorized, "authentication first"},
+		//8
+		{
+			"/scoped", http.MethodGet, "Authorization",
+			token(map[string]interface{}{"sub": "x", "scope": "deeds:read titles:read"}),
+			http.StatusOK, "scope",
+		},
+		//9
+		{
+			"/scoped", http.MethodGet, "Authorization",
+			token(map[string]interface{}{"sub": "x", "scope": "titles:read"}),
+			http.StatusForbidden, "scope without it",
+		},
+		//10
+		{"/open", http.MethodGet, "", "", http.StatusOK, "public"},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(td.method, "http://example.com"+td.handlePath, nil)
+		if td.header != "" {
+			r.Header.Set(td.header, td.value)
+		}
+		testServer.pathHandlers[td.handlePath].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if w.Code != http.StatusForbidden || td.method == http.MethodHead {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf(getTestMessage(i, td.msg, "exp a problem, got content type: '%s'", got))
+		}
+		var res problem
+		if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad problem body: '%s'", err))
+			continue
+		}
+		if res.Status != http.StatusForbidden || res.Title != "Forbidden" ||
+			res.Instance != td.handlePath || res.Detail == "" {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected problem: %+v", res))
+		}
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	for _, line := range []string{
+		`landtitle_access_denied_total{route="/deeds",method="get"} 1`,
+		`landtitle_access_denied_total{route="/deeds",method="post"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics missing line: '%s'", line)
+		}
+	}
+}
+
+func TestAccessReport(t *testing.T) {
+	routes, err := loadRoutes(strings.NewReader(writeAuthFiles(t) + `/deeds:
+  methods: [get, post]
+  roles: [clerk]
+  access:
+    post:
+      permissions: [deeds:write]
+  callbacks: [cb1]
+/status:
+  auth: []
+  callbacks: [cb1]
+/healthz:
+  builtin: liveness
+`))
+	if err != nil {
+		t.Fatalf("failed loading routes with error: '%s'", err)
+	}
+	exp := []string{
+		"/healthz: public",
+		"/metrics: public (admin)",
+		"/status: public",
+		"/deeds: auth [keys] roles [clerk], post permissions [deeds:write]",
+	}
+	got := accessReport(routes, []string{"/metrics"})
+	if fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Errorf("exp report:\n%s\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+}
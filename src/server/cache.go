@@ -0,0 +1,554 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+HTTP caching for a route's GET responses, eg analysis results that never
+change once computed
+
+	/deeds/{id}/analysis:
+	  params:
+	    id:
+	      type: integer
+	      source: url
+	  callbacks: [analysis]
+	  cache:
+	    max_age: 1h
+	    store: true
+	    ttl: 24h
+	    tags: ["deed:{id}"]
+
+max_age: goes out as Cache-Control, public unless private: or the route
+has auth, without it responses get no-cache so clients revalidate. 200s
+get an ETag over the body unless a callback set one, If-None-Match and
+If-Modified-Since are answered with a 304. The callbacks' response is held
+back until they're done to do that, a flush sends it as it is.
+
+store: keeps responses in the server's in-process LRU, see
+WithResponseCache, keyed on the route, the normalized params, the media
+type picked from produces: and the principal's subject. A hit skips the
+callbacks and render: altogether. Entries live for ttl:, max_age: when
+it's not set, or until evicted or invalidated. Responses setting cookies,
+starting or changing a session, carrying its CSRF token or sent with
+Cache-Control: no-store aren't kept. Entries are tagged with tags:,
+{name} is the param's value, and whatever the callbacks add with CacheTag,
+InvalidateCache from any route's callbacks drops every entry with a tag,
+eg the PUT that changes deed 7 dropping deed:7. Clients sending
+Cache-Control: no-cache skip the lookup and refresh the entry.
+*/
+
+const (
+	defCacheEntries int   = 1024
+	defCacheBytes   int64 = 64 << 20
+	cacheHit              = "hit"
+	cacheMiss             = "miss"
+)
+
+var cacheTagParamRegex *regexp.Regexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type CacheYaml struct {
+	//go duration for Cache-Control max-age, none sends no-cache
+	MaxAge string `yaml:"max_age,omitempty"`
+	//defaults to true on routes with auth
+	Private   *bool `yaml:"private,omitempty"`
+	Immutable bool  `yaml:"immutable,omitempty"`
+	//keep responses in the server's cache
+	Store bool `yaml:"store,omitempty"`
+	//go duration stored responses live, defaults to max_age, none keeps
+	//them until they're evicted or invalidated
+	TTL  string   `yaml:"ttl,omitempty"`
+	Tags []string `yaml:"tags,omitempty,flow"`
+}
+
+type routeCache struct {
+	cacheControl string
+	store        bool
+	//zero for no expiry
+	ttl  time.Duration
+	tags []string
+}
+
+func newRouteCache(c *CacheYaml, r *route) (*routeCache, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if r.static != nil || r.proxy != nil || r.builtin != noBuiltin {
+		return nil, fmt.Errorf("cache is for callback and render routes")
+	}
+	get := false
+	for _, m := range r.methods {
+		get = get || m == getMethod
+	}
+	if !get {
+		return nil, fmt.Errorf("cache needs the route to allow get")
+	}
+	maxAge, err := parseLimitDuration("cache max_age", c.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := parseLimitDuration("cache ttl", c.TTL)
+	if err != nil {
+		return nil, err
+	}
+	private := r.auth != nil
+	if c.Private != nil {
+		private = *c.Private
+	}
+	directives := []string{"public"}
+	if private {
+		directives[0] = "private"
+	}
+	if maxAge != nil {
+		directives = append(directives, fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	} else {
+		directives = append(directives, "no-cache")
+	}
+	if c.Immutable {
+		directives = append(directives, "immutable")
+	}
+	toRet := &routeCache{
+		cacheControl: strings.Join(directives, ", "),
+		store:        c.Store,
+		tags:         c.Tags,
+	}
+	if ttl != nil {
+		toRet.ttl = *ttl
+	} else if maxAge != nil {
+		toRet.ttl = *maxAge
+	}
+	if (len(c.Tags) > 0 || c.TTL != "") && !c.Store {
+		return nil, fmt.Errorf("cache tags and ttl need store")
+	}
+	for _, tag := range c.Tags {
+		for _, match := range cacheTagParamRegex.FindAllStringSubmatch(tag, -1) {
+			if _, ok := r.params[match[1]]; !ok {
+				return nil, fmt.Errorf(
+					"cache tag '%s' uses '%s' which isn't a param", tag, match[1],
+				)
+			}
+		}
+	}
+	return toRet, nil
+}
+
+// the route's tags with the params filled in
+func (c *routeCache) expandTags(params map[string]string) []string {
+	toRet := make([]string, 0, len(c.tags))
+	for _, tag := range c.tags {
+		toRet = append(toRet, cacheTagParamRegex.ReplaceAllStringFunc(
+			tag, func(m string) string {
+				return params[strings.Trim(m, "{}")]
+			},
+		))
+	}
+	return toRet
+}
+
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	etag   string
+	stored time.Time
+	//zero never expires
+	expires time.Time
+	tags    []string
+	size    int64
+}
+
+// bounded by entry count and body bytes, least recently used goes first
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	//front is the most recently used
+	order   *list.List
+	entries map[string]*list.Element
+	//tag -> keys
+	tags map[string]map[string]struct{}
+	now  func() time.Time
+}
+
+func newResponseCache(maxEntries int, maxBytes int64) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		tags:       make(map[string]map[string]struct{}),
+		now:        time.Now,
+	}
+}
+
+// nil on a miss
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return e
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	if e.size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	c.size += e.size
+	for _, tag := range e.tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][e.key] = struct{}{}
+	}
+	for c.order.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// drops every entry with any of tags, returns how many went
+func (c *responseCache) invalidate(tags ...string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	toRet := 0
+	for _, tag := range tags {
+		for key := range c.tags[tag] {
+			if el, ok := c.entries[key]; ok {
+				c.remove(el)
+				toRet++
+			}
+		}
+	}
+	return toRet
+}
+
+// caller holds mu
+func (c *responseCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	for _, tag := range e.tags {
+		delete(c.tags[tag], e.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+// what a request's callbacks can do to the cache, see CacheTag and
+// InvalidateCache
+type cacheState struct {
+	mu    sync.Mutex
+	cache *responseCache
+	tags  []string
+}
+
+// CacheTag adds invalidation tags to the response the callbacks for r are
+// writing, ignored unless the route stores responses
+func CacheTag(r *http.Request, tags ...string) {
+	state := getRequestState(r)
+	if state == nil || state.cache == nil {
+		return
+	}
+	state.cache.mu.Lock()
+	defer state.cache.mu.Unlock()
+	state.cache.tags = append(state.cache.tags, tags...)
+}
+
+// InvalidateCache drops every stored response tagged with any of tags,
+// returns how many were dropped
+func InvalidateCache(r *http.Request, tags ...string) int {
+	state := getRequestState(r)
+	if state == nil || state.cache == nil || state.cache.cache == nil {
+		return 0
+	}
+	return state.cache.cache.invalidate(tags...)
+}
+
+// the route, the normalized params, the media type picked for the
+// response and who it's for
+func (m *myHandler) cacheKey(r *http.Request, params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	query := make([]string, 0, len(names))
+	for _, k := range names {
+		query = append(query, url.QueryEscape(k)+"="+url.QueryEscape(params[k]))
+	}
+	subject := ""
+	if principal := RequestPrincipal(r); principal != nil {
+		subject = principal.Subject
+	}
+	return strings.Join([]string{
+		m.path, strings.Join(query, "&"), Negotiate(r, m.route.produces...), subject,
+	}, "\n")
+}
+
+// the suffixes compression puts on ETags, see compress.go
+func (m *myHandler) etagSuffixes() []string {
+	if m.compressor == nil {
+		return nil
+	}
+	return m.compressor.encodings
+}
+
+// true when the response came from the cache and has been written, a nil
+// writer when the route doesn't cache
+func (m *myHandler) startCache(
+	w http.ResponseWriter, r *http.Request, params map[string]string,
+) (*cacheWriter, bool) {
+	if m.route.cache == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return nil, false
+	}
+	toRet := &cacheWriter{ResponseWriter: w, m: m, r: r}
+	if r.Method == http.MethodHead && (!m.route.cache.store || m.cache == nil) {
+		return nil, false
+	}
+	if !m.route.cache.store || m.cache == nil {
+		return toRet, false
+	}
+	toRet.key = m.cacheKey(r, params)
+	toRet.tags = m.route.cache.expandTags(params)
+	if !hasDirective(r.Header.Get("Cache-Control"), "no-cache") {
+		if e := m.cache.get(toRet.key); e != nil {
+			m.metrics.cacheLookup(m.path, cacheHit)
+			m.serveEntry(w, r, e)
+			return nil, true
+		}
+	}
+	m.metrics.cacheLookup(m.path, cacheMiss)
+	//callbacks don't write a body to hash for HEAD
+	if r.Method == http.MethodHead {
+		return nil, false
+	}
+	return toRet, false
+}
+
+func (m *myHandler) serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.Itoa(int(m.cache.now().Sub(e.stored).Seconds())))
+	if notModified(r, e.etag, e.stored, m.etagSuffixes()) {
+		writeNotModified(w)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// holds the callbacks' response until they're done
+type cacheWriter struct {
+	http.ResponseWriter
+	m *myHandler
+	r *http.Request
+	//"" when the route doesn't store
+	key  string
+	tags []string
+	//zero until set or written
+	status int
+	buf    bytes.Buffer
+	//flushed, everything goes straight through
+	streaming bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.streaming {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *cacheWriter) Write(data []byte) (int, error) {
+	if cw.streaming {
+		return cw.ResponseWriter.Write(data)
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	return cw.buf.Write(data)
+}
+
+// gives up on caching, what's held goes out now
+func (cw *cacheWriter) Flush() {
+	if !cw.streaming {
+		cw.streaming = true
+		if cw.status != 0 {
+			cw.ResponseWriter.WriteHeader(cw.status)
+		}
+		cw.ResponseWriter.Write(cw.buf.Bytes())
+		cw.buf.Reset()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController get at the underlying writer
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// the request's cache state for CacheTag and InvalidateCache
+func (m *myHandler) newCacheState(cw *cacheWriter) *cacheState {
+	toRet := &cacheState{cache: m.cache}
+	if cw == nil || cw.key == "" {
+		//only invalidating
+		return toRet
+	}
+	toRet.tags = cw.tags
+	return toRet
+}
+
+// sends the response once the callbacks are done, with an ETag,
+// Cache-Control and a 304 when the client has it, storing it on the way
+func (cw *cacheWriter) finish(state *cacheState) {
+	if cw.streaming {
+		return
+	}
+	if cw.status == 0 {
+		//nothing written, net/http sends the default 200
+		return
+	}
+	h := cw.Header()
+	if cw.status != http.StatusOK {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.ResponseWriter.Write(cw.buf.Bytes())
+		return
+	}
+	body := cw.buf.Bytes()
+	noStore := hasDirective(h.Get("Cache-Control"), "no-store")
+	if h.Get("Etag") == "" && !noStore {
+		sum := sha256.Sum256(body)
+		h.Set("Etag", `"`+hex.EncodeToString(sum[:])[:fingerprintLen]+`"`)
+	}
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", cw.m.route.cache.cacheControl)
+	}
+	modified, _ := http.ParseTime(h.Get("Last-Modified"))
+	//a timed out or cancelled chain may have written half a response, the
+	//session's cookie is only added once this writes the header
+	if cw.key != "" && !noStore && len(h.Values("Set-Cookie")) == 0 &&
+		!RequestSession(cw.r).private() && cw.r.Context().Err() == nil {
+		now := cw.m.cache.now()
+		if modified.IsZero() {
+			modified = now
+			h.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+		}
+		e := &cacheEntry{
+			key:    cw.key,
+			status: cw.status,
+			header: h.Clone(),
+			body:   append([]byte(nil), body...),
+			etag:   h.Get("Etag"),
+			stored: now,
+		}
+		if cw.m.route.cache.ttl > 0 {
+			e.expires = now.Add(cw.m.route.cache.ttl)
+		}
+		state.mu.Lock()
+		e.tags = append([]string(nil), state.tags...)
+		state.mu.Unlock()
+		e.size = int64(len(e.body))
+		for k, v := range e.header {
+			e.size += int64(len(k))
+			for _, val := range v {
+				e.size += int64(len(val))
+			}
+		}
+		cw.m.cache.put(e)
+	}
+	if notModified(cw.r, h.Get("Etag"), modified, cw.m.etagSuffixes()) {
+		writeNotModified(cw.ResponseWriter)
+		return
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.ResponseWriter.Write(body)
+}
+
+// whether the request's validators match, If-None-Match wins over
+// If-Modified-Since, tags compression added a suffix to still match
+func notModified(r *http.Request, etag string, modified time.Time, suffixes []string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+			for _, s := range suffixes {
+				if candidate == strings.TrimSuffix(etag, `"`)+"-"+s+`"` {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// what's left of the headers for a 304, same as http.ServeContent
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	if h.Get("Etag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func hasDirective(cacheControl, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
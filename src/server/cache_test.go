@@ -0,0 +1,473 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerCache(t *testing.T) {
+	var calls atomic.Int64
+	tmpServer, err := NewServer(
+		strings.NewReader(`/analysis/{id}:
+  methods: [get, head]
+  params:
+    id:
+      type: integer
+      source: url
+  callbacks: [analysis]
+  cache:
+    max_age: 1h
+    store: true
+    tags: ["deed:{id}"]
+/deeds/{id}:
+  methods: [put]
+  params:
+    id:
+      type: integer
+      source: url
+  callbacks: [update]
+/revalidate:
+  callbacks: [analysis]
+  cache: {}
+/tagged:
+  callbacks: [tagged]
+  cache:
+    store: true
+/cookie:
+  callbacks: [cookie]
+  cache:
+    store: true
+/stream:
+  callbacks: [stream]
+  cache:
+    store: true
+`),
+		map[string]Callback{
+			"analysis": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				n := calls.Add(1)
+				w.Header().Set("Content-Type", MediaJSON)
+				fmt.Fprintf(w, `{"deed":"%s","run":%d}`, p["id"], n)
+				return true, nil
+			},
+			"update": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				fmt.Fprintf(w, "%d", InvalidateCache(r, "deed:"+p["id"], "owner:jane"))
+				return true, nil
+			},
+			"tagged": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				CacheTag(r, "owner:jane")
+				fmt.Fprintf(w, "run %d", calls.Add(1))
+				return true, nil
+			},
+			"cookie": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				http.SetCookie(w, &http.Cookie{Name: "a", Value: "b"})
+				fmt.Fprintf(w, "run %d", calls.Add(1))
+				return true, nil
+			},
+			"stream": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				fmt.Fprintf(w, "run %d", calls.Add(1))
+				w.(http.Flusher).Flush()
+				return true, nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	//replaced with the last ETag seen
+	const lastEtag string = "LAST_ETAG"
+	etag := ""
+	testData := []struct {
+		method   string
+		target   string
+		header   http.Header
+		expCode  int
+		expCalls int64
+		expBody  string
+		expHdr   http.Header
+		msg      string
+	}{
+		//0
+		{
+			http.MethodGet, "/analysis/7", nil, http.StatusOK, 1, `{"deed":"7","run":1}`,
+			http.Header{"Cache-Control": {"public, max-age=3600"}}, "miss",
+		},
+		//1
+		{
+			http.MethodGet, "/analysis/7", nil, http.StatusOK, 1, `{"deed":"7","run":1}`,
+			http.Header{"Age": {"0"}, "Content-Type": {MediaJSON}}, "hit",
+		},
+		//2
+		{
+			http.MethodGet, "/analysis/7", http.Header{"If-None-Match": {lastEtag}},
+			http.StatusNotModified, 1, "", nil, "hit not modified",
+		},
+		//3
+		{
+			http.MethodHead, "/analysis/7", nil, http.StatusOK, 1, "", nil, "head hit",
+		},
+		//4
+		{
+			http.MethodGet, "/analysis/8", nil, http.StatusOK, 2, `{"deed":"8","run":2}`,
+			nil, "other params",
+		},
+		//5
+		{http.MethodPut, "/deeds/7", nil, http.StatusOK, 2, "1", nil, "invalidated"},
+		//6
+		{
+			http.MethodGet, "/analysis/7", nil, http.StatusOK, 3, `{"deed":"7","run":3}`,
+			nil, "miss after invalidation",
+		},
+		//7
+		{
+			http.MethodGet, "/analysis/8", nil, http.StatusOK, 3, `{"deed":"8","run":2}`,
+			nil, "other tag kept",
+		},
+		//8
+		{
+			http.MethodGet, "/analysis/7", http.Header{"Cache-Control": {"no-cache"}},
+			http.StatusOK, 4, `{"deed":"7","run":4}`, nil, "client no-cache",
+		},
+		//9
+		{
+			http.MethodGet, "/revalidate", nil, http.StatusOK, 5, `"run":5`,
+			http.Header{"Cache-Control": {"public, no-cache"}}, "not stored",
+		},
+		//10
+		{
+			http.MethodGet, "/revalidate", http.Header{"If-None-Match": {`"nope", *`}},
+			http.StatusNotModified, 6, "", nil, "star matches",
+		},
+		//11
+		{http.MethodGet, "/tagged", nil, http.StatusOK, 7, "run 7", nil, "callback tag"},
+		//12
+		{http.MethodGet, "/tagged", nil, http.StatusOK, 7, "run 7", nil, "callback tag hit"},
+		//13
+		{http.MethodPut, "/deeds/1", nil, http.StatusOK, 7, "1", nil, "invalidate owner"},
+		//14
+		{http.MethodGet, "/tagged", nil, http.StatusOK, 8, "run 8", nil, "tag dropped"},
+		//15
+		{http.MethodGet, "/cookie", nil, http.StatusOK, 9, "run 9", nil, "cookie"},
+		//16
+		{http.MethodGet, "/cookie", nil, http.StatusOK, 10, "run 10", nil, "cookie not kept"},
+		//17
+		{
+			http.MethodGet, "/stream", nil, http.StatusOK, 11, "run 11",
+			http.Header{"Etag": {""}}, "flushed",
+		},
+		//18
+		{http.MethodGet, "/stream", nil, http.StatusOK, 12, "run 12", nil, "flushed not kept"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(td.method, td.target, nil)
+		for k, vals := range td.header {
+			for _, v := range vals {
+				r.Header.Add(k, strings.Replace(v, lastEtag, etag, 1))
+			}
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if got := calls.Load(); got != td.expCalls {
+			t.Errorf(getTestMessage(i, td.msg, "exp calls: %d, got: %d", td.expCalls, got))
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) ||
+			(td.expBody == "" && w.Body.Len() > 0) {
+			t.Errorf(getTestMessage(i, td.msg, "exp '%s' in: '%s'", td.expBody, w.Body))
+		}
+		for k := range td.expHdr {
+			if got := w.Header().Get(k); got != td.expHdr.Get(k) {
+				t.Errorf(getTestMessage(
+					i, td.msg, "exp %s: '%s', got: '%s'", k, td.expHdr.Get(k), got,
+				))
+			}
+		}
+		if got := w.Header().Get("Etag"); got != "" {
+			etag = got
+		}
+	}
+}
+
+func TestServerCacheCompressed(t *testing.T) {
+	tmpServer, err := NewServer(
+		strings.NewReader("/a:\n  callbacks: [cb1]\n  cache:\n    store: true\n"),
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				w.Header().Set("Content-Type", MediaText)
+				w.Write([]byte(strings.Repeat("lot 7 ", 400)))
+				return true, nil
+			},
+		},
+		WithCompression(CompressionConfig{}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	h := tmpServer.(*server).pathHandlers["/a"]
+	etag := ""
+	for i, exp := range []int{http.StatusOK, http.StatusOK, http.StatusNotModified} {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != exp {
+			t.Errorf(getTestMessage(i, "compressed", "exp code: %d, got: %d", exp, w.Code))
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf(getTestMessage(i, "compressed", "exp gzip, got: %v", w.Header()))
+		}
+		//the second, a hit, is what the client revalidates with
+		if i == 1 {
+			etag = w.Header().Get("Etag")
+		}
+	}
+	if !strings.HasSuffix(etag, `-gzip"`) {
+		t.Errorf("exp a gzip etag, got: '%s'", etag)
+	}
+}
+
+func TestServerCacheSessions(t *testing.T) {
+	var calls atomic.Int64
+	tmpServer, err := NewServer(
+		strings.NewReader(`/form:
+  callbacks: [form]
+  cache:
+    store: true
+/plain:
+  callbacks: [plain]
+  cache:
+    store: true
+`),
+		map[string]Callback{
+			"form": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				calls.Add(1)
+				fmt.Fprint(w, CSRFToken(r))
+				return true, nil
+			},
+			"plain": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				fmt.Fprintf(w, "run %d", calls.Add(1))
+				return true, nil
+			},
+		},
+		WithSessions(SessionConfig{Keys: [][]byte{testSessionKey}}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	handlers := tmpServer.(*server).pathHandlers
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handlers[target].ServeHTTP(w, r)
+		return w
+	}
+
+	//each anonymous visitor gets their own session and token
+	first, second := get("/form"), get("/form")
+	for i, w := range []*httptest.ResponseRecorder{first, second} {
+		if len(w.Result().Cookies()) != 1 || w.Header().Get("Age") != "" {
+			t.Errorf(getTestMessage(
+				i, "new session", "exp a cookie and no hit, got: %v", w.Header(),
+			))
+		}
+	}
+	if first.Body.String() == "" || first.Body.String() == second.Body.String() {
+		t.Errorf("exp different tokens, got: '%s' '%s'", first.Body, second.Body)
+	}
+	//the token's out already, the response is still this session's
+	cookie := first.Result().Cookies()[0]
+	before := calls.Load()
+	if w := get("/form", cookie); w.Body.String() != first.Body.String() ||
+		calls.Load() != before+1 {
+		t.Errorf("exp the session's token from the callbacks, got: '%s'", w.Body)
+	}
+
+	//responses that don't touch the session are still kept
+	if w1, w2 := get("/plain"), get("/plain"); w1.Body.String() != w2.Body.String() ||
+		w2.Header().Get("Age") == "" {
+		t.Errorf("exp a hit, got: '%s' then '%s'", w1.Body, w2.Body)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newResponseCache(2, 10)
+	c.now = func() time.Time { return now }
+	entry := func(key string, size int64, tags ...string) *cacheEntry {
+		return &cacheEntry{key: key, size: size, tags: tags, stored: now}
+	}
+	c.put(entry("a", 3, "t1"))
+	c.put(entry("b", 3, "t1", "t2"))
+	c.get("a")
+	c.put(entry("c", 3))
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Errorf("exp the least recently used evicted, got: %v", c.entries)
+	}
+	c.put(entry("d", 9))
+	if c.order.Len() != 1 || c.get("d") == nil || c.size != 9 {
+		t.Errorf("exp the byte bound to evict, got: %v", c.entries)
+	}
+	c.put(entry("e", 11))
+	if c.get("e") != nil {
+		t.Errorf("exp an entry over the byte bound not kept")
+	}
+	c = newResponseCache(10, 100)
+	c.now = func() time.Time { return now }
+	c.put(entry("a", 1, "t1"))
+	c.put(entry("b", 1, "t1", "t2"))
+	c.put(entry("c", 1, "t2"))
+	if n := c.invalidate("t1"); n != 2 || c.get("c") == nil || len(c.tags["t2"]) != 1 {
+		t.Errorf("exp t1 dropped, got: %d %v %v", n, c.entries, c.tags)
+	}
+	expiring := entry("x", 1)
+	expiring.expires = now.Add(time.Minute)
+	c.put(expiring)
+	now = now.Add(time.Minute)
+	if c.get("x") != nil || c.size != 1 {
+		t.Errorf("exp the expired entry gone, got: %v", c.entries)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 500, time.UTC)
+	testData := []struct {
+		header http.Header
+		etag   string
+		exp    bool
+		msg    string
+	}{
+		//0
+		{nil, `"a"`, false, "no validators"},
+		//1
+		{http.Header{"If-None-Match": {`"a"`}}, `"a"`, true, "etag"},
+		//2
+		{http.Header{"If-None-Match": {`"b", W/"a"`}}, `"a"`, true, "weak in a list"},
+		//3
+		{http.Header{"If-None-Match": {`"a-gzip"`}}, `"a"`, true, "compressed"},
+		//4
+		{http.Header{"If-None-Match": {`"a-zstd"`}}, `"a"`, false, "unknown suffix"},
+		//5
+		{
+			http.Header{
+				"If-None-Match":     {`"b"`},
+				"If-Modified-Since": {modified.Format(http.TimeFormat)},
+			},
+			`"a"`, false, "etag wins",
+		},
+		//6
+		{
+			http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}},
+			`"a"`, true, "not modified since",
+		},
+		//7
+		{
+			http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}},
+			`"a"`, false, "modified since",
+		},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = td.header
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := notModified(r, td.etag, modified, []string{"gzip"}); got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp: %t, got: %t", td.exp, got))
+		}
+	}
+}
+
+func TestCacheLoading(t *testing.T) {
+	keys := writeTestFile(t, t.TempDir(), "api_keys", []byte("a:b\n"))
+	cb := map[string]Callback{
+		"cb1": func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			return true, nil
+		},
+	}
+	testData := []struct {
+		yamlString string
+		expCC      string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  callbacks: [cb1]\n  cache: {}\n", "public, no-cache", false, "defaults"},
+		//1
+		{
+			"/a:\n  callbacks: [cb1]\n  cache:\n    max_age: 1m\n    private: true\n" +
+				"    immutable: true\n",
+			"private, max-age=60, immutable", false, "private immutable",
+		},
+		//2
+		{
+			"auth:\n  schemes:\n    k:\n      type: api_key\n      header: X-Key\n" +
+				"      keys_file: " + keys + "\n/a:\n  auth: [k]\n  callbacks: [cb1]\n" +
+				"  cache: {}\n",
+			"private, no-cache", false, "private with auth",
+		},
+		//3
+		{"/a:\n  callbacks: [cb1]\n  cache:\n    max_age: x\n", "", true, "bad max age"},
+		//4
+		{"/a:\n  callbacks: [cb1]\n  cache:\n    ttl: 1m\n", "", true, "ttl without store"},
+		//5
+		{
+			"/a:\n  callbacks: [cb1]\n  cache:\n    store: true\n    tags: ['d:{id}']\n",
+			"", true, "tag without param",
+		},
+		//6
+		{
+			"/a:\n  methods: [post]\n  callbacks: [cb1]\n  cache: {}\n", "", true,
+			"post only",
+		},
+		//7
+		{"/a:\n  static:\n    dir: .\n  cache: {}\n", "", true, "static"},
+	}
+	for i, td := range testData {
+		s, err := NewServer(strings.NewReader(td.yamlString), cb)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+		if err != nil {
+			continue
+		}
+		got := s.(*server).pathHandlers["/a"].route.cache.cacheControl
+		if got != td.expCC {
+			t.Errorf(getTestMessage(i, td.msg, "exp: '%s', got: '%s'", td.expCC, got))
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+/*
+responses compressed on the fly for clients that accept it, on for every
+route with WithCompression, routes can turn it off or change when it
+applies, eg
+
+	/deeds/{id}/ocr:
+	  compress:
+	    min_size: 4096
+	    types: [application/json]
+	/deeds/{id}/scan:
+	  compress:
+	    enabled: false
+
+a compress: block turns it on for its route when the server has it off.
+Only responses of a compressible type and at least min_size bytes are
+compressed, anything with a Content-Encoding, Content-Range or
+Cache-Control: no-transform already goes out as written. Callbacks write
+as usual, the response is held back until min_size bytes are written, the
+callbacks return or flush, a flush before then compresses unless
+Content-Length says it's small. Compressible responses get
+Vary: Accept-Encoding either way, strong ETags get the encoding added like
+static: variants.
+
+gzip and brotli are built in, br is picked over gzip when the client takes
+both, WithEncoder adds other codings or replaces these, eg with a different
+compression level.
+*/
+
+const (
+	defCompressMinSize int    = 1024
+	gzipEncoding       string = "gzip"
+	brotliEncoding            = "br"
+)
+
+// images, video and archives are compressed already
+var defCompressTypes []string = []string{
+	MediaHTML, MediaText, "text/css", "text/csv", "text/javascript", "text/xml",
+	"application/javascript", MediaJSON, MediaXML, MediaNDJSON,
+	mediaProblemJSON, mediaProblemXML, "image/svg+xml",
+}
+
+// br first, it's smaller for the same cpu
+var defCompressEncodings []string = []string{brotliEncoding, gzipEncoding}
+
+// Wraps w so what's written is compressed, closing finishes the stream but
+// not w, encoders with a Flush() error method are flushed along with the
+// response
+type Encoder func(w io.Writer) io.WriteCloser
+
+// Server wide settings for WithCompression, zero values use the defaults
+type CompressionConfig struct {
+	//bytes, smaller responses go out uncompressed, defaults to 1024
+	MinSize int
+	//media types without parameters, type/* matches the whole type,
+	//defaults to text, json, xml, javascript and svg
+	Types []string
+	//content codings, best first, each needs an encoder, defaults to br
+	//then gzip
+	Encodings []string
+}
+
+type CompressYaml struct {
+	//defaults to true when the block is there
+	Enabled *bool `yaml:"enabled,omitempty"`
+	MinSize *int  `yaml:"min_size,omitempty"`
+	//replaces the server's
+	Types []string `yaml:"types,omitempty,flow"`
+}
+
+// nil fields use the server's
+type routeCompression struct {
+	enabled *bool
+	minSize *int
+	types   []string
+}
+
+func checkCompressTypes(types []string) error {
+	for _, t := range types {
+		mediaType, params, err := mime.ParseMediaType(t)
+		if err != nil || len(params) > 0 || !strings.Contains(mediaType, "/") ||
+			strings.HasPrefix(mediaType, "*") {
+			return fmt.Errorf("invalid compress type: '%s'", t)
+		}
+	}
+	return nil
+}
+
+func newRouteCompression(c *CompressYaml) (*routeCompression, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MinSize != nil && *c.MinSize < 0 {
+		return nil, fmt.Errorf("compress min_size can't be negative")
+	}
+	if err := checkCompressTypes(c.Types); err != nil {
+		return nil, err
+	}
+	enabled := true
+	if c.Enabled != nil {
+		enabled = *c.Enabled
+	}
+	return &routeCompression{
+		enabled: &enabled,
+		minSize: c.MinSize,
+		types:   c.Types,
+	}, nil
+}
+
+var gzipWriters sync.Pool
+
+// hands the writer back to the pool once closed
+type pooledGzip struct {
+	*gzip.Writer
+}
+
+func (p *pooledGzip) Close() error {
+	err := p.Writer.Close()
+	gzipWriters.Put(p.Writer)
+	return err
+}
+
+func gzipEncoder(w io.Writer) io.WriteCloser {
+	if gz, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return &pooledGzip{gz}
+	}
+	return &pooledGzip{gzip.NewWriter(w)}
+}
+
+var brotliWriters sync.Pool
+
+// same as pooledGzip
+type pooledBrotli struct {
+	*brotli.Writer
+}
+
+func (p *pooledBrotli) Close() error {
+	err := p.Writer.Close()
+	brotliWriters.Put(p.Writer)
+	return err
+}
+
+func brotliEncoder(w io.Writer) io.WriteCloser {
+	if br, ok := brotliWriters.Get().(*brotli.Writer); ok {
+		br.Reset(w)
+		return &pooledBrotli{br}
+	}
+	return &pooledBrotli{brotli.NewWriterLevel(w, brotli.DefaultCompression)}
+}
+
+type compressor struct {
+	minSize   int
+	types     []string
+	encodings []string
+	encoders  map[string]Encoder
+}
+
+func newCompressor(c CompressionConfig, encoders map[string]Encoder) (*compressor, error) {
+	if c.MinSize < 0 {
+		return nil, fmt.Errorf("compression min size can't be negative")
+	}
+	if err := checkCompressTypes(c.Types); err != nil {
+		return nil, err
+	}
+	toRet := &compressor{
+		minSize:  c.MinSize,
+		types:    c.Types,
+		encoders: encoders,
+	}
+	if toRet.minSize == 0 {
+		toRet.minSize = defCompressMinSize
+	}
+	if len(toRet.types) == 0 {
+		toRet.types = defCompressTypes
+	}
+	if len(c.Encodings) == 0 {
+		for _, e := range defCompressEncodings {
+			if _, ok := encoders[e]; ok {
+				toRet.encodings = append(toRet.encodings, e)
+			}
+		}
+		return toRet, nil
+	}
+	for _, e := range c.Encodings {
+		if _, ok := encoders[e]; !ok {
+			return nil, fmt.Errorf("no encoder for compression encoding '%s', see WithEncoder", e)
+		}
+		toRet.encodings = append(toRet.encodings, e)
+	}
+	return toRet, nil
+}
+
+// nil when the route's responses aren't compressed, on is whether the
+// server compresses by default
+func (c *compressor) forRoute(rc *routeCompression, on bool) *compressor {
+	if rc != nil {
+		on = *rc.enabled
+	}
+	if !on {
+		return nil
+	}
+	if rc == nil || (rc.minSize == nil && len(rc.types) == 0) {
+		return c
+	}
+	toRet := *c
+	if rc.minSize != nil {
+		toRet.minSize = *rc.minSize
+	}
+	if len(rc.types) > 0 {
+		toRet.types = rc.types
+	}
+	return &toRet
+}
+
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType {
+			return true
+		}
+		if major, ok := strings.CutSuffix(t, "/*"); ok &&
+			strings.HasPrefix(mediaType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// the caller closes the writer once the handler is done, nil for requests
+// that never get a compressed response, c can be nil
+func (c *compressor) newWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	if c == nil || r.Method == http.MethodHead {
+		return nil
+	}
+	toRet := &compressWriter{ResponseWriter: w, c: c}
+	if accepted := acceptedCodings(
+		r.Header.Get("Accept-Encoding"), c.encodings,
+	); len(accepted) > 0 {
+		toRet.encoding = accepted[0]
+	}
+	return toRet
+}
+
+// holds the response back until it knows whether to compress it
+type compressWriter struct {
+	http.ResponseWriter
+	c *compressor
+	//"" when the client accepts none of the encodings
+	encoding string
+	//zero until set or written
+	status  int
+	buf     []byte
+	decided bool
+	//nil when the response goes out as written
+	enc io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	//informational responses go straight out
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(data)
+		}
+		return cw.ResponseWriter.Write(data)
+	}
+	cw.buf = append(cw.buf, data...)
+	if len(cw.buf) >= cw.c.minSize {
+		if err := cw.decide(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController get at the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// whether what's been written so far, and how it's described, can be
+// compressed, streaming is whether it's being flushed before min size
+func (cw *compressWriter) eligible(streaming bool) bool {
+	h := cw.Header()
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" ||
+		strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if !cw.c.compressible(h.Get("Content-Type")) {
+		return false
+	}
+	//worth a Vary even when this one goes out as it is
+	addVary(h, "Accept-Encoding")
+	if !streaming {
+		return len(cw.buf) >= cw.c.minSize
+	}
+	length, err := strconv.Atoi(h.Get("Content-Length"))
+	return err != nil || length >= cw.c.minSize
+}
+
+// sends the headers and what's buffered, compressing from here on when it
+// can
+func (cw *compressWriter) decide(streaming bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	//what net/http would have sniffed
+	if _, ok := h["Content-Type"]; !ok && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if cw.eligible(streaming) && cw.encoding != "" {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("Etag"); strings.HasSuffix(etag, `"`) {
+			h.Set("Etag", fmt.Sprintf(`%s-%s"`, etag[:len(etag)-1], cw.encoding))
+		}
+		cw.enc = cw.c.encoders[cw.encoding](cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// sends anything still held back and finishes the compressed stream,
+// leaves responses nothing was written to for net/http
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return
+		}
+		if err := cw.decide(false); err != nil {
+			myLogger.Debugf("writing held back response failed with error: '%s'", err)
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Close(); err != nil {
+			myLogger.Debugf("finishing compressed response failed with error: '%s'", err)
+		}
+	}
+}
+
+// adds value to Vary unless it's already there
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// replaces the built in br, marks the stream so tests can tell it was used
+type testEncoder struct {
+	w io.Writer
+}
+
+func (t *testEncoder) Write(data []byte) (int, error) {
+	return t.w.Write([]byte(strings.ToUpper(string(data))))
+}
+
+func (t *testEncoder) Close() error {
+	_, err := t.w.Write([]byte("<end>"))
+	return err
+}
+
+func TestServerCompression(t *testing.T) {
+	big := strings.Repeat(`{"page":1,"text":"lot 7 of block 12"}`, 10)
+	write := func(contentType, body string, hdr http.Header) Callback {
+		return func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			for k, v := range hdr {
+				w.Header()[k] = v
+			}
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Write([]byte(body[:len(body)/2]))
+			w.Write([]byte(body[len(body)/2:]))
+			return true, nil
+		}
+	}
+	tmpServer, err := NewServer(
+		strings.NewReader(`/json:
+  callbacks: [json]
+/small:
+  callbacks: [small]
+/png:
+  callbacks: [png]
+/sniff:
+  callbacks: [sniff]
+/etag:
+  callbacks: [etag]
+/no-transform:
+  callbacks: [noTransform]
+/off:
+  callbacks: [json]
+  compress:
+    enabled: false
+/only-text:
+  callbacks: [json]
+  compress:
+    types: [text/*]
+/stream:
+  callbacks: [stream]
+`),
+		map[string]Callback{
+			"json":  write(MediaJSON, big, nil),
+			"small": write(MediaJSON, `{"a":1}`, nil),
+			"png":   write("image/png", big, nil),
+			"sniff": write("", "<html>"+big, nil),
+			"etag":  write(MediaText, big, http.Header{"Etag": {`"v1"`}}),
+			"noTransform": write(
+				MediaJSON, big, http.Header{"Cache-Control": {"no-transform"}},
+			),
+			"stream": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				enc := NDJSON(w, http.StatusOK)
+				for i := 0; i < 3; i++ {
+					if err := enc.Encode(map[string]int{"page": i}); err != nil {
+						return false, err
+					}
+				}
+				return true, nil
+			},
+		},
+		WithCompression(CompressionConfig{MinSize: 64}),
+		WithEncoder("br", func(w io.Writer) io.WriteCloser { return &testEncoder{w} }),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	testData := []struct {
+		target  string
+		accept  string
+		expEnc  string
+		expVary bool
+		expBody string
+		expEtag string
+		msg     string
+	}{
+		//0
+		{"/json", "gzip", "gzip", true, big, "", "gzip"},
+		//1
+		{"/json", "gzip, br", "br", true, strings.ToUpper(big) + "<end>", "", "br preferred"},
+		//2
+		{"/json", "br;q=0, gzip", "gzip", true, big, "", "br refused"},
+		//3
+		{"/json", "", "", true, big, "", "not accepted"},
+		//4
+		{"/small", "gzip", "", true, `{"a":1}`, "", "under min size"},
+		//5
+		{"/png", "gzip", "", false, big, "", "not compressible"},
+		//6
+		{"/sniff", "gzip", "gzip", true, "<html>" + big, "", "sniffed type"},
+		//7
+		{"/etag", "gzip", "gzip", true, big, `"v1-gzip"`, "etag"},
+		//8
+		{"/no-transform", "gzip", "", false, big, "", "no-transform"},
+		//9
+		{"/off", "gzip", "", false, big, "", "route off"},
+		//10
+		{"/only-text", "gzip", "", false, big, "", "route types"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, td.target, nil)
+		if td.accept != "" {
+			r.Header.Set("Accept-Encoding", td.accept)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: 200, got: %d", w.Code))
+		}
+		if got := w.Header().Get("Content-Encoding"); got != td.expEnc {
+			t.Errorf(getTestMessage(i, td.msg, "exp encoding: '%s', got: '%s'", td.expEnc, got))
+		}
+		if got := w.Header().Get("Vary") == "Accept-Encoding"; got != td.expVary {
+			t.Errorf(getTestMessage(i, td.msg, "exp vary: %t, got: %v", td.expVary, w.Header()))
+		}
+		if td.expEtag != "" && w.Header().Get("Etag") != td.expEtag {
+			t.Errorf(getTestMessage(
+				i, td.msg, "exp etag: '%s', got: '%s'", td.expEtag, w.Header().Get("Etag"),
+			))
+		}
+		if td.expEnc != "" && w.Header().Get("Content-Length") != "" {
+			t.Errorf(getTestMessage(i, td.msg, "exp no content length on a compressed body"))
+		}
+		body := w.Body.String()
+		if td.expEnc == "gzip" {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf(getTestMessage(i, td.msg, "invalid gzip: '%s'", err))
+			}
+			b, _ := io.ReadAll(gz)
+			body = string(b)
+		}
+		if body != td.expBody {
+			t.Errorf(getTestMessage(i, td.msg, "exp body: '%s', got: '%s'", td.expBody, body))
+		}
+	}
+
+	//each flush ends up in the gzip stream, the lines come out whole
+	front := httptest.NewServer(mux)
+	defer front.Close()
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("stream failed with error: '%s'", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("exp a gzipped stream, got: %v", res.Header)
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip stream: '%s'", err)
+	}
+	lines := bufio.NewScanner(gz)
+	for i := 0; lines.Scan(); i++ {
+		if exp := `{"page":` + string(rune('0'+i)) + `}`; lines.Text() != exp {
+			t.Errorf(getTestMessage(i, "stream", "exp: '%s', got: '%s'", exp, lines.Text()))
+		}
+	}
+}
+
+func TestServerCompressionBrotli(t *testing.T) {
+	big := strings.Repeat(`{"page":1,"text":"lot 7 of block 12"}`, 100)
+	tmpServer, err := NewServer(
+		strings.NewReader("/a:\n  callbacks: [cb1]\n"),
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				w.Header().Set("Content-Type", MediaJSON)
+				w.Write([]byte(big))
+				return true, nil
+			},
+		},
+		WithCompression(CompressionConfig{}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	h := tmpServer.(*server).pathHandlers["/a"]
+	testData := []struct {
+		accept string
+		expEnc string
+		msg    string
+	}{
+		//0
+		{"br, gzip", "br", "br preferred"},
+		//1
+		{"gzip, br", "br", "br preferred in any order"},
+		//2
+		{"br", "br", "br only"},
+		//3
+		{"gzip", "gzip", "gzip only"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		r.Header.Set("Accept-Encoding", td.accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding"); got != td.expEnc {
+			t.Errorf(getTestMessage(i, td.msg, "exp encoding: '%s', got: '%s'", td.expEnc, got))
+			continue
+		}
+		var body io.Reader = brotli.NewReader(w.Body)
+		if td.expEnc == "gzip" {
+			if body, err = gzip.NewReader(w.Body); err != nil {
+				t.Fatalf(getTestMessage(i, td.msg, "invalid gzip: '%s'", err))
+			}
+		}
+		if got, err := io.ReadAll(body); err != nil || string(got) != big {
+			t.Errorf(getTestMessage(i, td.msg, "body didn't decode, error: '%v'", err))
+		}
+	}
+}
+
+func TestCompressionLoading(t *testing.T) {
+	cb := map[string]Callback{
+		"cb1": func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			return true, nil
+		},
+	}
+	testData := []struct {
+		yamlString string
+		opts       []Option
+		expOn      bool
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  callbacks: [cb1]\n", nil, false, false, "off by default"},
+		//1
+		{"/a:\n  callbacks: [cb1]\n  compress: {}\n", nil, true, false, "route turns it on"},
+		//2
+		{
+			"/a:\n  callbacks: [cb1]\n", []Option{WithCompression(CompressionConfig{})},
+			true, false, "server wide",
+		},
+		//3
+		{
+			"/a:\n  callbacks: [cb1]\n  compress:\n    min_size: -1\n", nil, false, true,
+			"negative min size",
+		},
+		//4
+		{
+			"/a:\n  callbacks: [cb1]\n  compress:\n    types: [json]\n", nil, false, true,
+			"bad type",
+		},
+		//5
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithCompression(CompressionConfig{Encodings: []string{"zstd"}})},
+			false, true, "no zstd encoder",
+		},
+		//6
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithCompression(CompressionConfig{Types: []string{"*/*"}})},
+			false, true, "wildcard type",
+		},
+	}
+	for i, td := range testData {
+		s, err := NewServer(strings.NewReader(td.yamlString), cb, td.opts...)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+		if err != nil {
+			continue
+		}
+		if on := s.(*server).pathHandlers["/a"].compressor != nil; on != td.expOn {
+			t.Errorf(getTestMessage(i, td.msg, "exp compression: %t, got: %t", td.expOn, on))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+caps how many requests a route works on at once, eg
+
+	/analyze:
+	  max_concurrent: 4
+	  queue:
+	    size: 16
+	    timeout: 30s
+
+requests past max_concurrent wait in the queue for up to timeout, once the
+queue is full, or the wait runs out, they get a 503 with Retry-After.
+Without a queue they're turned away as soon as every slot is taken. Queue
+depth is in the http_requests_queued gauge and the readiness response.
+*/
+
+const defQueueTimeout time.Duration = 10 * time.Second
+
+type QueueYaml struct {
+	Size int `yaml:"size"`
+	//go duration, defaults to 10s
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+type concurrencyLimiter struct {
+	//a token per request being worked on
+	slots     chan struct{}
+	queueSize int
+	timeout   time.Duration
+	mu        sync.Mutex
+	queued    int
+}
+
+func newConcurrencyLimiter(maxConcurrent *int, q *QueueYaml) (*concurrencyLimiter, error) {
+	if maxConcurrent == nil {
+		if q != nil {
+			return nil, fmt.Errorf("queue requires max_concurrent")
+		}
+		return nil, nil
+	}
+	if *maxConcurrent <= 0 {
+		return nil, fmt.Errorf("max_concurrent must be positive")
+	}
+	toRet := &concurrencyLimiter{
+		slots:   make(chan struct{}, *maxConcurrent),
+		timeout: defQueueTimeout,
+	}
+	if q == nil {
+		return toRet, nil
+	}
+	if q.Size < 0 {
+		return nil, fmt.Errorf("queue size can't be negative")
+	}
+	toRet.queueSize = q.Size
+	if q.Timeout != "" {
+		timeout, err := time.ParseDuration(q.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid queue timeout: '%s'", q.Timeout)
+		}
+		toRet.timeout = timeout
+	}
+	return toRet, nil
+}
+
+func (c *concurrencyLimiter) depth() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued
+}
+
+// false when the queue is full
+func (c *concurrencyLimiter) enqueue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued >= c.queueSize {
+		return false
+	}
+	c.queued++
+	return true
+}
+
+func (c *concurrencyLimiter) dequeue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queued--
+}
+
+// blocks until there's a slot, the queue timeout runs out or ctx is done,
+// release must be called once the request is done when ok
+func (c *concurrencyLimiter) acquire(
+	ctx context.Context, queueChanged func(depth int),
+) (release func(), ok bool) {
+	release = func() { <-c.slots }
+	select {
+	case c.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if !c.enqueue() {
+		return nil, false
+	}
+	queueChanged(c.depth())
+	defer func() {
+		c.dequeue()
+		queueChanged(c.depth())
+	}()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, false
+}
+
+// nil release when the request was turned away, the error is already set up
+// for writeError
+func (m *myHandler) acquireSlot(w http.ResponseWriter, r *http.Request) (func(), *handlerError) {
+	c := m.route.concurrency
+	if c == nil {
+		return func() {}, nil
+	}
+	release, ok := c.acquire(r.Context(), func(depth int) {
+		m.metrics.queueChanged(m.path, depth)
+	})
+	if ok {
+		return release, nil
+	}
+	m.metrics.limitExceeded(m.path, concurrencyLimit)
+	//about as long as the oldest queued request might still wait
+	w.Header().Set("Retry-After", retryAfterSeconds(c.timeout))
+	return nil, &handlerError{http.StatusServiceUnavailable, "server busy"}
+}
+
+// what readiness shows for each queued route
+type queueStatus struct {
+	Depth int `json:"depth"`
+	Size  int `json:"size"`
+}
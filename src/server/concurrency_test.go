@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConcurrencyLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"max_concurrent: 2", false, "no queue"},
+		//1
+		{"max_concurrent: 2\nqueue: {size: 8, timeout: 5s}", false, "queue"},
+		//2
+		{"max_concurrent: 0", true, "no slots"},
+		//3
+		{"queue: {size: 8}", true, "queue without max_concurrent"},
+		//4
+		{"max_concurrent: 2\nqueue: {size: -1}", true, "negative queue"},
+		//5
+		{"max_concurrent: 2\nqueue: {size: 8, timeout: soon}", true, "bad timeout"},
+		//6
+		{"builtin: liveness\nmax_concurrent: 2", true, "builtin"},
+	}
+	for i, td := range testData {
+		rYaml := &RouteYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), rYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if rYaml.Builtin == "" {
+			rYaml.Callbacks = []string{"cb1"}
+		}
+		_, err := newRoute(rYaml)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestServerConcurrency(t *testing.T) {
+	serverYaml, err := os.Open("testdata/concurrency.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	tmpServer, err := NewServer(serverYaml, map[string]Callback{
+		"slow": func(
+			p map[string]string, w http.ResponseWriter, r *http.Request,
+		) (bool, error) {
+			started <- struct{}{}
+			<-finish
+			return true, nil
+		},
+	}, WithMetricsPath("/metrics"))
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	serve := func(handlePath string) chan *httptest.ResponseRecorder {
+		toRet := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			testServer.pathHandlers[handlePath].ServeHTTP(
+				w, httptest.NewRequest(http.MethodGet, "http://example.com"+handlePath, nil),
+			)
+			toRet <- w
+		}()
+		return toRet
+	}
+	waitForDepth := func(depth int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for testServer.pathHandlers["/analyze"].route.concurrency.depth() != depth {
+			if time.Now().After(deadline) {
+				t.Fatalf("queue never reached depth %d", depth)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	checkBusy := func(w *httptest.ResponseRecorder, msg string) {
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s, exp code: 503, got: %d", msg, w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s, missing Retry-After", msg)
+		}
+	}
+
+	first := serve("/analyze")
+	<-started
+	second := serve("/analyze")
+	waitForDepth(1)
+	checkBusy(<-serve("/analyze"), "queue full")
+
+	w := httptest.NewRecorder()
+	testServer.pathHandlers["/ready"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/ready", nil),
+	)
+	res := &healthResponse{}
+	if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatalf("bad readiness response: '%s'", w.Body.String())
+	}
+	if res.Queues["/analyze"] != (queueStatus{Depth: 1, Size: 1}) {
+		t.Errorf("unexpected readiness queues: %+v", res.Queues)
+	}
+	if res.Status != healthOK {
+		t.Errorf("a queue shouldn't make the server unready, got: '%s'", res.Status)
+	}
+	w = httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	expLine := `landtitle_http_requests_queued{route="/analyze"} 1` + "\n"
+	if !strings.Contains(w.Body.String(), expLine) {
+		t.Errorf("metrics missing line: '%s', got:\n%s", expLine, w.Body.String())
+	}
+
+	finish <- struct{}{}
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("first, exp code: 200, got: %d", w.Code)
+	}
+	<-started
+	waitForDepth(0)
+	//the queued request has the slot now, the next one waits out the timeout
+	checkBusy(<-serve("/analyze"), "queue timeout")
+	finish <- struct{}{}
+	if w := <-second; w.Code != http.StatusOK {
+		t.Errorf("second, exp code: 200, got: %d", w.Code)
+	}
+
+	busy := serve("/busy")
+	<-started
+	checkBusy(<-serve("/busy"), "no queue")
+	finish <- struct{}{}
+	if w := <-busy; w.Code != http.StatusOK {
+		t.Errorf("busy, exp code: 200, got: %d", w.Code)
+	}
+}
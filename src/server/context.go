@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// everything the handler works out about a request that callbacks might
+// want beyond the plain string parameters, rides along in the request's
+// context so the Callback signature doesn't have to change
+type requestState struct {
+	typed Values
+	//before transforms and defaults
+	raw map[string]string
+	//deprecated names the client used, keyed to the real name
+	aliases map[string]string
+	//by param, also in typed, kept to clean up after the callbacks
+	uploads map[string][]*FileUpload
+	//the route's produces:, what Respond picks from
+	produces []string
+	store    *Store
+	//never nil once the callbacks have the request
+	cache *cacheState
+}
+
+type requestStateKey struct{}
+
+func withRequestState(r *http.Request, state *requestState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey{}, state))
+}
+
+// nil when r didn't come through a route handler
+func getRequestState(r *http.Request) *requestState {
+	if r == nil {
+		return nil
+	}
+	toRet, _ := r.Context().Value(requestStateKey{}).(*requestState)
+	return toRet
+}
+
+// TypedParams returns the parameters of the request handed to a callback
+// converted to their declared types, see Values for the mapping, nil when
+// r wasn't handed to a callback by the server
+func TypedParams(r *http.Request) Values {
+	state := getRequestState(r)
+	if state == nil {
+		return nil
+	}
+	return state.typed
+}
+
+// RawParams returns the parameters exactly as the client sent them, before
+// any transform: steps, defaults aren't included, nil when r wasn't handed
+// to a callback by the server
+func RawParams(r *http.Request) map[string]string {
+	state := getRequestState(r)
+	if state == nil {
+		return nil
+	}
+	return state.raw
+}
+
+// Store holds what a request's callbacks leave for the ones after them and
+// for the route's render: template, see RequestStore
+type Store struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func newStore() *Store {
+	return &Store{values: make(map[string]interface{})}
+}
+
+// Set puts v under key, replacing anything already there
+func (s *Store) Set(key string, v interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = v
+}
+
+// Get returns what's under key, false when nothing is
+func (s *Store) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// a copy of everything in the store
+func (s *Store) all() map[string]interface{} {
+	toRet := make(map[string]interface{})
+	if s == nil {
+		return toRet
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.values {
+		toRet[k] = v
+	}
+	return toRet
+}
+
+// RequestStore returns the store the callbacks for r share, nil, which
+// ignores Set, when r wasn't handed to a callback by the server
+func RequestStore(r *http.Request) *Store {
+	state := getRequestState(r)
+	if state == nil {
+		return nil
+	}
+	return state.store
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"landtitle/util"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defLivenessPath  string        = "/healthz"
+	defReadinessPath               = "/readyz"
+	defVersionPath                 = "/version"
+	readinessTimeout time.Duration = 5 * time.Second
+)
+
+// handlers the server provides itself, set with builtin: in routes.yaml
+// instead of callbacks
+type builtinType string
+
+const (
+	noBuiltin        builtinType = ""
+	livenessBuiltin              = "liveness"
+	readinessBuiltin             = "readiness"
+	versionBuiltin               = "version"
+	metricsBuiltin               = "metrics"
+)
+
+func newBuiltinType(b string) (*builtinType, error) {
+	toRet := builtinType(b)
+	switch toRet {
+	case livenessBuiltin:
+		fallthrough
+	case readinessBuiltin:
+		fallthrough
+	case versionBuiltin:
+		fallthrough
+	case metricsBuiltin:
+		return util.Ptr(toRet), nil
+	}
+	return nil, fmt.Errorf("unrecognized builtin: '%s'", b)
+}
+
+// A ReadinessCheck returns nil when whatever it checks is ready to serve,
+// eg the AWS session is valid or the job store is open, ctx carries a deadline
+type ReadinessCheck func(context.Context) error
+
+type readinessChecks struct {
+	sync.RWMutex
+	checks map[string]ReadinessCheck
+	//by route, depth is reported but never makes the server unready
+	queues map[string]*concurrencyLimiter
+}
+
+func newReadinessChecks() *readinessChecks {
+	return &readinessChecks{
+		checks: make(map[string]ReadinessCheck),
+		queues: make(map[string]*concurrencyLimiter),
+	}
+}
+
+func (r *readinessChecks) addQueue(route string, c *concurrencyLimiter) {
+	r.Lock()
+	defer r.Unlock()
+	r.queues[route] = c
+}
+
+func (r *readinessChecks) add(name string, check ReadinessCheck) error {
+	if check == nil {
+		return fmt.Errorf("readiness check '%s' can't be nil", name)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.checks[name]; ok {
+		return fmt.Errorf("readiness check '%s' already registered", name)
+	}
+	r.checks[name] = check
+	return nil
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]string      `json:"checks,omitempty"`
+	Queues map[string]queueStatus `json:"queues,omitempty"`
+}
+
+const (
+	healthOK          string = "ok"
+	healthUnavailable        = "unavailable"
+)
+
+// runs every check concurrently, any failure makes the whole thing unready
+func (r *readinessChecks) run(ctx context.Context) *healthResponse {
+	r.RLock()
+	names := make([]string, 0, len(r.checks))
+	for n := range r.checks {
+		names = append(names, n)
+	}
+	r.RUnlock()
+	sort.Strings(names)
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	results := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, n := range names {
+		r.RLock()
+		check := r.checks[n]
+		r.RUnlock()
+		wg.Add(1)
+		go func(i int, check ReadinessCheck) {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+	toRet := &healthResponse{
+		Status: healthOK,
+		Checks: make(map[string]string),
+	}
+	for i, n := range names {
+		if results[i] != nil {
+			//the error stays in the log, it can say more than callers
+			//should see
+			toRet.Status = healthUnavailable
+			toRet.Checks[n] = healthUnavailable
+			myLogger.Errorf(
+				"readiness check '%s' failed with error: '%s'", n, results[i],
+			)
+			continue
+		}
+		toRet.Checks[n] = healthOK
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.queues) > 0 {
+		toRet.Queues = make(map[string]queueStatus)
+	}
+	for route, c := range r.queues {
+		toRet.Queues[route] = queueStatus{Depth: c.depth(), Size: c.queueSize}
+	}
+	return toRet
+}
+
+func writeJSON(w http.ResponseWriter, code int, toWrite interface{}) {
+	data, err := json.Marshal(toWrite)
+	if err != nil {
+		myLogger.Errorf("failed marshaling json response with error: '%s'", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &healthResponse{Status: healthOK})
+}
+
+func (r *readinessChecks) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	res := r.run(req.Context())
+	code := http.StatusOK
+	if res.Status != healthOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, res)
+}
+
+type versionResponse struct {
+	Path      string            `json:"path,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	GoVersion string            `json:"go_version,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+// the build settings /version reports, the rest, flags and paths mostly,
+// say more about the build machine than callers need
+var versionSettings []string = []string{"vcs.revision", "vcs.time", "vcs.modified"}
+
+// read once, it can't change while the binary is running
+var buildInfo = sync.OnceValue(func() *versionResponse {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		myLogger.Errorf("build info unavailable, binary built without module support")
+		return &versionResponse{}
+	}
+	toRet := &versionResponse{
+		Path:      info.Main.Path,
+		Version:   info.Main.Version,
+		GoVersion: info.GoVersion,
+		Settings:  make(map[string]string),
+	}
+	for _, s := range info.Settings {
+		if slices.Contains(versionSettings, s.Key) {
+			toRet.Settings[s.Key] = s.Value
+		}
+	}
+	return toRet
+})
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildInfo())
+}
+
+func (s *server) builtinHandler(b builtinType) http.Handler {
+	switch b {
+	case livenessBuiltin:
+		return http.HandlerFunc(livenessHandler)
+	case readinessBuiltin:
+		return s.readiness
+	case versionBuiltin:
+		return http.HandlerFunc(versionHandler)
+	case metricsBuiltin:
+		return s.metrics.registry
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"landtitle/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinRoutes(t *testing.T) {
+	serverYaml, err := os.Open("testdata/health.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	jobsReady := false
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+		WithReadinessCheck("aws", func(ctx context.Context) error {
+			return nil
+		}),
+		WithReadinessCheck("jobs", func(ctx context.Context) error {
+			if !jobsReady {
+				return fmt.Errorf("job store closed")
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		handlePath string
+		target     string
+		method     string
+		setup      func()
+		expCode    int
+		expBody    string
+		msg        string
+	}{
+		//0
+		{
+			"/healthz", "http://example.com/healthz", "GET", nil,
+			http.StatusOK, `"status":"ok"`, "liveness",
+		},
+		//1
+		{
+			"/healthz", "http://example.com/healthz?cache=123", "HEAD", nil,
+			http.StatusOK, "", "builtins skip param validation, head allowed",
+		},
+		//2
+		{
+			"/readyz", "http://example.com/readyz", "GET", nil,
+			http.StatusServiceUnavailable,
+			`"checks":{"aws":"ok","jobs":"unavailable"}`,
+			"failing readiness check, the error isn't sent",
+		},
+		//3
+		{
+			"/readyz", "http://example.com/readyz?ignored=notanumber", "GET",
+			func() { jobsReady = true },
+			http.StatusOK, `"status":"ok"`,
+			"declared params on builtins aren't validated",
+		},
+		//4
+		{
+			"/version", "http://example.com/version", "GET", nil,
+			http.StatusOK, `"go_version":"go`, "build info",
+		},
+		//5
+		{
+			"/version", "http://example.com/version", "HEAD", nil,
+			http.StatusMethodNotAllowed, "", "methods are still enforced",
+		},
+		//6
+		{
+			"/stats", "http://example.com/stats", "GET", nil,
+			http.StatusOK, `landtitle_http_requests_total{route="/healthz",method="get",status="200"} 1`,
+			"metrics builtin",
+		},
+	}
+	for i, td := range testData {
+		if td.setup != nil {
+			td.setup()
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(td.method, td.target, nil)
+		testServer.pathHandlers[td.handlePath].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d",
+					td.expCode, w.Code,
+				),
+			)
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "body missing '%s', got: '%s'",
+					td.expBody, w.Body.String(),
+				),
+			)
+		}
+	}
+}
+
+func TestVersionSettings(t *testing.T) {
+	//test binaries carry build flags and the like, none of them go out
+	for k := range buildInfo().Settings {
+		if !slices.Contains(versionSettings, k) {
+			t.Errorf("unexpected version setting: '%s'", k)
+		}
+	}
+}
+
+func TestBuiltinRouteYaml(t *testing.T) {
+	testData := []struct {
+		routeYaml *RouteYaml
+		expError  bool
+		msg       string
+	}{
+		{&RouteYaml{Builtin: "liveness"}, false, "no callbacks needed"},
+		{&RouteYaml{Builtin: "blarg"}, true, "unknown builtin"},
+		{
+			&RouteYaml{Builtin: "readiness", Callbacks: []string{"foo"}},
+			true, "builtins can't have callbacks",
+		},
+		{
+			&RouteYaml{Builtin: "version", Methods: []string{"yolo"}},
+			true, "methods are still checked",
+		},
+		{
+			&RouteYaml{
+				Builtin:   "liveness",
+				RateLimit: &RateLimitYaml{Requests: 1, Per: "1s"},
+			},
+			true, "builtins can't be rate limited",
+		},
+		{
+			&RouteYaml{Builtin: "liveness", CSRF: util.Ptr(true)},
+			true, "builtins can't set csrf",
+		},
+	}
+	for i, td := range testData {
+		_, err := newRoute(td.routeYaml)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestAdminHealthOptions(t *testing.T) {
+	serverYaml, err := os.Open("testdata/basic.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	callbacks := map[string]Callback{
+		"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+		"cb2": makeCallback(myLogger, "cb2", true, nil, nil),
+		"cb5": makeCallback(myLogger, "cb5", true, nil, nil),
+	}
+	tmpServer, err := NewServer(
+		serverYaml, callbacks, WithAdminPort(9091), WithLivenessPath("/live"),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	for _, path := range []string{"/live", "/readyz", "/version", "/metrics"} {
+		if _, ok := testServer.adminHandlers[path]; !ok {
+			t.Errorf("admin handler missing for '%s'", path)
+		}
+	}
+	if _, ok := testServer.adminHandlers[defLivenessPath]; ok {
+		t.Errorf("liveness option should override the default path")
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/readyz"].ServeHTTP(
+		w, httptest.NewRequest("GET", "http://example.com/readyz", nil),
+	)
+	res := &healthResponse{}
+	if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatalf("readiness response not json: '%s'", w.Body.String())
+	}
+	if w.Code != http.StatusOK || res.Status != healthOK {
+		t.Errorf("no checks should be ready, got: %d, '%s'", w.Code, w.Body.String())
+	}
+	_, err = NewServer(
+		strings.NewReader("/:\n  callbacks:\n    - cb1\n"), callbacks,
+		WithReadinessCheck("dup", func(context.Context) error { return nil }),
+		WithReadinessCheck("dup", func(context.Context) error { return nil }),
+	)
+	if err == nil {
+		t.Errorf("duplicate readiness checks should error")
+	}
+}
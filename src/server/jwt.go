@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+JWT bearer tokens checked against keys from local files, nothing is fetched
+at runtime. Keys come from any mix of a JWKS file, PEM public keys or
+certificates, and a shared secret for the HS algorithms. The algorithm in
+the token has to be one the scheme allows and match the kind of key it's
+checked with, "none" never is. Tokens must carry exp, iss and aud are
+checked when the scheme sets issuer and audience.
+*/
+
+type jwtAlgorithm string
+
+const (
+	hs256 jwtAlgorithm = "HS256"
+	hs384              = "HS384"
+	hs512              = "HS512"
+	rs256              = "RS256"
+	rs384              = "RS384"
+	rs512              = "RS512"
+	es256              = "ES256"
+	es384              = "ES384"
+	es512              = "ES512"
+)
+
+// 30s either side of exp and nbf for clock skew
+const defJWTLeeway time.Duration = 30 * time.Second
+
+func newJWTAlgorithm(a string) (*jwtAlgorithm, error) {
+	toRet := jwtAlgorithm(a)
+	switch toRet {
+	case hs256:
+		fallthrough
+	case hs384:
+		fallthrough
+	case hs512:
+		fallthrough
+	case rs256:
+		fallthrough
+	case rs384:
+		fallthrough
+	case rs512:
+		fallthrough
+	case es256:
+		fallthrough
+	case es384:
+		fallthrough
+	case es512:
+		return &toRet, nil
+	}
+	return nil, fmt.Errorf("unrecognized jwt algorithm: '%s'", a)
+}
+
+func (a jwtAlgorithm) hash() crypto.Hash {
+	switch a[2:] {
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+// the curve an ES algorithm signs with
+func (a jwtAlgorithm) curve() elliptic.Curve {
+	switch a {
+	case es384:
+		return elliptic.P384()
+	case es512:
+		return elliptic.P521()
+	}
+	return elliptic.P256()
+}
+
+// one verification key, exactly one of the key fields is set
+type jwtKey struct {
+	kid    string
+	secret []byte
+	rsa    *rsa.PublicKey
+	ec     *ecdsa.PublicKey
+}
+
+func (k *jwtKey) fits(alg jwtAlgorithm) bool {
+	switch alg[:2] {
+	case "HS":
+		return k.secret != nil
+	case "RS":
+		return k.rsa != nil
+	case "ES":
+		return k.ec != nil && k.ec.Curve == alg.curve()
+	}
+	return false
+}
+
+func (k *jwtKey) verify(alg jwtAlgorithm, signed, sig []byte) bool {
+	if alg[:2] == "HS" {
+		mac := hmac.New(alg.hash().New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	h := alg.hash().New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	if k.rsa != nil {
+		return rsa.VerifyPKCS1v15(k.rsa, alg.hash(), digest, sig) == nil
+	}
+	//r and s back to back, each the size of the curve
+	size := (k.ec.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	return ecdsa.Verify(k.ec, digest, r, s)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	//RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	//EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	//oct
+	K string `json:"k"`
+}
+
+func decodeJWKInt(name, val string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid jwk '%s'", name)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (j *jsonWebKey) key() (*jwtKey, error) {
+	toRet := &jwtKey{kid: j.Kid}
+	switch j.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid jwk 'k'")
+		}
+		toRet.secret = secret
+	case "RSA":
+		n, err := decodeJWKInt("n", j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt("e", j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid jwk 'e'")
+		}
+		toRet.rsa = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported jwk curve: '%s'", j.Crv)
+		}
+		x, err := decodeJWKInt("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt("y", j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("jwk point isn't on curve '%s'", j.Crv)
+		}
+		toRet.ec = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return nil, fmt.Errorf("unsupported jwk key type: '%s'", j.Kty)
+	}
+	return toRet, nil
+}
+
+func loadJWKS(path string) ([]*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	toRet, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwks file '%s': %w", path, err)
+	}
+	return toRet, nil
+}
+
+func parseJWKS(data []byte) ([]*jwtKey, error) {
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+	toRet := make([]*jwtKey, 0, len(jwks.Keys))
+	for i, j := range jwks.Keys {
+		//encryption keys have no business verifying anything
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		toRet = append(toRet, key)
+	}
+	return toRet, nil
+}
+
+// public keys and certificates, as many blocks as the file has
+func loadPEMKeys(path string) ([]*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	toRet := make([]*jwtKey, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var pub interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pem block '%s' in '%s'", block.Type, path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pem block in '%s': %w", path, err)
+		}
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			toRet = append(toRet, &jwtKey{rsa: k})
+		case *ecdsa.PublicKey:
+			toRet = append(toRet, &jwtKey{ec: k})
+		default:
+			return nil, fmt.Errorf("unsupported public key type in '%s'", path)
+		}
+	}
+	if len(toRet) == 0 {
+		return nil, fmt.Errorf("no keys found in pem file '%s'", path)
+	}
+	return toRet, nil
+}
+
+func loadJWTSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("secret file '%s' is empty", path)
+	}
+	return data, nil
+}
+
+type jwtVerifier struct {
+	keys       []*jwtKey
+	algorithms map[jwtAlgorithm]bool
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+func newJWTVerifier(s *AuthSchemeYaml) (*jwtVerifier, error) {
+	toRet := &jwtVerifier{
+		algorithms: make(map[jwtAlgorithm]bool),
+		issuer:     s.Issuer,
+		audience:   s.Audience,
+		leeway:     defJWTLeeway,
+		now:        time.Now,
+	}
+	if s.JWKS != "" {
+		keys, err := loadJWKS(s.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		toRet.keys = append(toRet.keys, keys...)
+	}
+	if s.PEM != "" {
+		keys, err := loadPEMKeys(s.PEM)
+		if err != nil {
+			return nil, err
+		}
+		toRet.keys = append(toRet.keys, keys...)
+	}
+	if s.SecretFile != "" {
+		secret, err := loadJWTSecret(s.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		toRet.keys = append(toRet.keys, &jwtKey{secret: secret})
+	}
+	if len(toRet.keys) == 0 {
+		return nil, fmt.Errorf("jwt schemes need keys from jwks, pem or secret_file")
+	}
+	if len(s.Algorithms) == 0 {
+		return nil, fmt.Errorf("jwt schemes need algorithms")
+	}
+	for _, a := range s.Algorithms {
+		alg, err := newJWTAlgorithm(a)
+		if err != nil {
+			return nil, err
+		}
+		toRet.algorithms[*alg] = true
+	}
+	if s.Leeway != "" {
+		leeway, err := time.ParseDuration(s.Leeway)
+		if err != nil || leeway < 0 {
+			return nil, fmt.Errorf("invalid jwt leeway: '%s'", s.Leeway)
+		}
+		toRet.leeway = leeway
+	}
+	return toRet, nil
+}
+
+var errInvalidToken error = errors.New("invalid token")
+
+// none of the keys verify it, possibly one the issuer rotated in since
+var errBadSignature error = fmt.Errorf("%w, bad signature", errInvalidToken)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NumericDate, 0 when the claim isn't there
+func numericClaim(claims map[string]interface{}, name string) (int64, error) {
+	val, ok := claims[name]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := val.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%w, '%s' is not a number", errInvalidToken, name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, fmt.Errorf("%w, '%s' is not a number", errInvalidToken, name)
+	}
+	return int64(f), nil
+}
+
+func audienceMatches(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the token's claims once the signature and the registered claims check out
+func (j *jwtVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w, malformed", errInvalidToken)
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w, malformed header", errInvalidToken)
+	}
+	header := &jwtHeader{}
+	if err = json.Unmarshal(rawHeader, header); err != nil {
+		return nil, fmt.Errorf("%w, malformed header", errInvalidToken)
+	}
+	alg := jwtAlgorithm(header.Alg)
+	if !j.algorithms[alg] {
+		return nil, fmt.Errorf("%w, algorithm '%s' not allowed", errInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w, malformed signature", errInvalidToken)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range j.keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.fits(alg) && k.verify(alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errBadSignature
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w, malformed claims", errInvalidToken)
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(rawClaims))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w, malformed claims", errInvalidToken)
+	}
+	if err = j.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (j *jwtVerifier) checkClaims(claims map[string]interface{}) error {
+	now := j.now()
+	exp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	//tokens that never expire aren't accepted
+	if exp == 0 {
+		return fmt.Errorf("%w, missing exp", errInvalidToken)
+	}
+	if now.After(time.Unix(exp, 0).Add(j.leeway)) {
+		return fmt.Errorf("%w, expired", errInvalidToken)
+	}
+	nbf, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if nbf != 0 && now.Add(j.leeway).Before(time.Unix(nbf, 0)) {
+		return fmt.Errorf("%w, not valid yet", errInvalidToken)
+	}
+	if j.issuer != "" && claims["iss"] != j.issuer {
+		return fmt.Errorf("%w, wrong issuer", errInvalidToken)
+	}
+	if j.audience != "" && !audienceMatches(claims["aud"], j.audience) {
+		return fmt.Errorf("%w, wrong audience", errInvalidToken)
+	}
+	return nil
+}
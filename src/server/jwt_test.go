@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signs claims the way an IdP would, key is a []byte secret or a private key
+func signJWT(
+	t *testing.T, alg jwtAlgorithm, key interface{}, kid string,
+	claims map[string]interface{},
+) string {
+	t.Helper()
+	header := map[string]string{"alg": string(alg), "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	rawHeader, _ := json.Marshal(header)
+	rawClaims, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(rawHeader) + "." +
+		base64.RawURLEncoding.EncodeToString(rawClaims)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(alg.hash().New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := alg.hash().New()
+		h.Write([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, alg.hash(), h.Sum(nil))
+	case *ecdsa.PrivateKey:
+		h := alg.hash().New()
+		h.Write([]byte(signed))
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k, h.Sum(nil)); err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	case nil:
+	default:
+		t.Fatalf("unsupported signing key %T", key)
+	}
+	if err != nil {
+		t.Fatalf("failed signing test token with error: '%s'", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func b64Int(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed writing '%s' with error: '%s'", name, err)
+	}
+	return path
+}
+
+func TestJWTVerify(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating rsa key with error: '%s'", err)
+	}
+	ec256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	secret := []byte("correct horse battery staple")
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa1", "use": "sig",
+				"n": b64Int(rsaKey.N), "e": b64Int(big.NewInt(int64(rsaKey.E))),
+			},
+			{
+				"kty": "EC", "kid": "ec1", "crv": "P-256",
+				"x": b64Int(ec256.X), "y": b64Int(ec256.Y),
+			},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": "bad", "e": "bad"},
+		},
+	})
+	der, _ := x509.MarshalPKIXPublicKey(&ec384.PublicKey)
+	verifier, err := newJWTVerifier(&AuthSchemeYaml{
+		JWKS: writeTestFile(t, dir, "jwks.json", jwks),
+		PEM: writeTestFile(
+			t, dir, "key.pem",
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		),
+		SecretFile: writeTestFile(t, dir, "secret", append(secret, '\n')),
+		Algorithms: []string{"HS256", "RS256", "RS512", "ES256", "ES384"},
+		Issuer:     "https://idp.example.com",
+		Audience:   "landtitle",
+	})
+	if err != nil {
+		t.Fatalf("failed creating verifier with error: '%s'", err)
+	}
+	now := time.Unix(1700000000, 0)
+	verifier.now = func() time.Time { return now }
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		toRet := map[string]interface{}{
+			"sub": "officer", "iss": "https://idp.example.com", "aud": "landtitle",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(toRet, k)
+				continue
+			}
+			toRet[k] = v
+		}
+		return toRet
+	}
+	valid := signJWT(t, rs256, rsaKey, "rsa1", claims(nil))
+	testData := []struct {
+		token    string
+		expError bool
+		msg      string
+	}{
+		//0
+		{valid, false, "rs256"},
+		//1
+		{signJWT(t, rs512, rsaKey, "", claims(nil)), false, "rs512 without kid"},
+		//2
+		{signJWT(t, es256, ec256, "ec1", claims(nil)), false, "es256 from jwks"},
+		//3
+		{signJWT(t, es384, ec384, "", claims(nil)), false, "es384 from pem"},
+		//4
+		{signJWT(t, hs256, secret, "", claims(nil)), false, "hs256 from secret"},
+		//5
+		{
+			signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{
+				"aud": []string{"other", "landtitle"},
+			})),
+			false, "audience list",
+		},
+		//6
+		{
+			signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{
+				"exp": now.Add(-time.Minute).Unix(),
+			})),
+			true, "expired",
+		},
+		//7
+		{
+			signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{
+				"exp": now.Add(-10 * time.Second).Unix(),
+			})),
+			false, "expired within leeway",
+		},
+		//8
+		{
+			signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{
+				"nbf": now.Add(time.Minute).Unix(),
+			})),
+			true, "not valid yet",
+		},
+		//9
+		{signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{"exp": nil})), true, "no exp"},
+		//10
+		{signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{"iss": "evil"})), true, "issuer"},
+		//11
+		{signJWT(t, rs256, rsaKey, "", claims(map[string]interface{}{"aud": "other"})), true, "audience"},
+		//12
+		{signJWT(t, "none", nil, "", claims(nil)), true, "alg none"},
+		//13
+		{signJWT(t, hs512, secret, "", claims(nil)), true, "algorithm not allowed"},
+		//14
+		{signJWT(t, hs256, der, "", claims(nil)), true, "public key as hmac secret"},
+		//15
+		{signJWT(t, es256, ec384, "", claims(nil)), true, "wrong curve"},
+		//16
+		{signJWT(t, rs256, rsaKey, "ec1", claims(nil)), true, "kid of another key"},
+		//17
+		{valid[:len(valid)-4] + "AAAA", true, "tampered signature"},
+		//18
+		{"not.a.token", true, "malformed"},
+		//19
+		{"header.only", true, "two parts"},
+	}
+	for i, td := range testData {
+		_, err := verifier.verify(td.token)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if td.expError && err != nil && !errors.Is(err, errInvalidToken) {
+			t.Errorf(getTestMessage(i, td.msg, "exp errInvalidToken, got: '%s'", err))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestJWTSchemeLoading(t *testing.T) {
+	dir := t.TempDir()
+	secret := writeTestFile(t, dir, "secret", []byte("s3cret"))
+	testData := []struct {
+		scheme *AuthSchemeYaml
+		msg    string
+	}{
+		//0
+		{&AuthSchemeYaml{Algorithms: []string{"HS256"}}, "no keys"},
+		//1
+		{&AuthSchemeYaml{SecretFile: secret}, "no algorithms"},
+		//2
+		{&AuthSchemeYaml{SecretFile: secret, Algorithms: []string{"none"}}, "alg none"},
+		//3
+		{&AuthSchemeYaml{SecretFile: secret, Algorithms: []string{"PS256"}}, "unsupported alg"},
+		//4
+		{
+			&AuthSchemeYaml{SecretFile: secret, Algorithms: []string{"HS256"}, Leeway: "-1s"},
+			"bad leeway",
+		},
+		//5
+		{
+			&AuthSchemeYaml{SecretFile: filepath.Join(dir, "nope"), Algorithms: []string{"HS256"}},
+			"missing file",
+		},
+		//6
+		{
+			&AuthSchemeYaml{
+				JWKS:       writeTestFile(t, dir, "bad.json", []byte("{")),
+				Algorithms: []string{"RS256"},
+			},
+			"bad jwks",
+		},
+		//7
+		{
+			&AuthSchemeYaml{
+				PEM:        writeTestFile(t, dir, "empty.pem", []byte("nothing")),
+				Algorithms: []string{"RS256"},
+			},
+			"no pem blocks",
+		},
+		//8
+		{
+			&AuthSchemeYaml{
+				SecretFile: writeTestFile(t, dir, "empty", []byte("\n")),
+				Algorithms: []string{"HS256"},
+			},
+			"empty secret",
+		},
+	}
+	for i, td := range testData {
+		if _, err := newJWTVerifier(td.scheme); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Request hardening, server wide with WithLimits and per route in
+routes.yaml, anything the route leaves out falls back to the server's, eg
+
+	/deeds:
+	  limits:
+	    max_body: 52428800
+	    max_query_params: 10
+	    read_timeout: 2m
+
+idle_timeout and read_header_timeout are per connection so they're server
+wide only. max_header_bytes can only be lowered, net/http reads the headers
+before there's a route, it gets the server's with some slack so headers a
+bit over still reach the route and are counted, ones well over are cut off
+there.
+*/
+
+const (
+	defMaxHeaderBytes    int           = http.DefaultMaxHeaderBytes
+	defMaxQueryParams                  = 100
+	defMaxPathSegments                 = 32
+	defReadHeaderTimeout time.Duration = 10 * time.Second
+	defIdleTimeout                     = 2 * time.Minute
+	//what net/http lets through over MaxHeaderBytes for the route to reject
+	maxHeaderSlack int = 64 << 10
+)
+
+// Limits applied to every request, zero values mean no limit except where
+// a default is noted
+type Limits struct {
+	//413 when the body is larger, includes uploads
+	MaxBodyBytes int64
+	//431 when the headers are larger, defaults to 1MB
+	MaxHeaderBytes int
+	//414 when there are more query keys, defaults to 100
+	MaxQueryParams int
+	//414 when the path has more segments, defaults to 32
+	MaxPathSegments int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	//defaults to 2 minutes
+	IdleTimeout time.Duration
+	//defaults to 10 seconds
+	ReadHeaderTimeout time.Duration
+}
+
+// the limits servers start with, change fields on these for WithLimits
+func DefaultLimits() Limits {
+	return Limits{
+		MaxHeaderBytes:    defMaxHeaderBytes,
+		MaxQueryParams:    defMaxQueryParams,
+		MaxPathSegments:   defMaxPathSegments,
+		IdleTimeout:       defIdleTimeout,
+		ReadHeaderTimeout: defReadHeaderTimeout,
+	}
+}
+
+func (l *Limits) check() error {
+	if l.MaxBodyBytes < 0 || l.MaxHeaderBytes < 0 ||
+		l.MaxQueryParams < 0 || l.MaxPathSegments < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if l.MaxPathSegments > pathBits {
+		return fmt.Errorf("max path segments can't be more than %d", pathBits)
+	}
+	if l.ReadTimeout < 0 || l.WriteTimeout < 0 ||
+		l.IdleTimeout < 0 || l.ReadHeaderTimeout < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	return nil
+}
+
+type LimitsYaml struct {
+	MaxBody         *int64 `yaml:"max_body,omitempty"`
+	MaxHeaderBytes  *int   `yaml:"max_header_bytes,omitempty"`
+	MaxQueryParams  *int   `yaml:"max_query_params,omitempty"`
+	MaxPathSegments *int   `yaml:"max_path_segments,omitempty"`
+	//go durations, eg 30s
+	ReadTimeout  string `yaml:"read_timeout,omitempty"`
+	WriteTimeout string `yaml:"write_timeout,omitempty"`
+}
+
+// per route overrides, nil fields use the server's
+type routeLimits struct {
+	maxBody         *int64
+	maxHeaderBytes  *int
+	maxQueryParams  *int
+	maxPathSegments *int
+	readTimeout     *time.Duration
+	writeTimeout    *time.Duration
+}
+
+func parseLimitDuration(name, d string) (*time.Duration, error) {
+	if d == "" {
+		return nil, nil
+	}
+	toRet, err := time.ParseDuration(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: '%s'", name, d)
+	}
+	if toRet < 0 {
+		return nil, fmt.Errorf("%s can't be negative", name)
+	}
+	return &toRet, nil
+}
+
+func newRouteLimits(l *LimitsYaml) (*routeLimits, error) {
+	if l == nil {
+		return &routeLimits{}, nil
+	}
+	for _, v := range []*int{l.MaxHeaderBytes, l.MaxQueryParams, l.MaxPathSegments} {
+		if v != nil && *v < 0 {
+			return nil, fmt.Errorf("limits can't be negative")
+		}
+	}
+	if l.MaxBody != nil && *l.MaxBody < 0 {
+		return nil, fmt.Errorf("limits can't be negative")
+	}
+	if l.MaxPathSegments != nil && *l.MaxPathSegments > pathBits {
+		return nil, fmt.Errorf("max_path_segments can't be more than %d", pathBits)
+	}
+	readTimeout, err := parseLimitDuration("read_timeout", l.ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := parseLimitDuration("write_timeout", l.WriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &routeLimits{
+		maxBody:         l.MaxBody,
+		maxHeaderBytes:  l.MaxHeaderBytes,
+		maxQueryParams:  l.MaxQueryParams,
+		maxPathSegments: l.MaxPathSegments,
+		readTimeout:     readTimeout,
+		writeTimeout:    writeTimeout,
+	}, nil
+}
+
+// what net/http would read with l.MaxHeaderBytes, 0 is its default
+func (l *Limits) headerCap() int {
+	if l.MaxHeaderBytes == 0 {
+		return http.DefaultMaxHeaderBytes
+	}
+	return l.MaxHeaderBytes
+}
+
+// routes can't take more header bytes than the server reads
+func (r *routeLimits) check(server *Limits) error {
+	if r != nil && r.maxHeaderBytes != nil && *r.maxHeaderBytes > server.headerCap() {
+		return fmt.Errorf(
+			"max_header_bytes %d is over the server's %d, see WithLimits",
+			*r.maxHeaderBytes, server.headerCap(),
+		)
+	}
+	return nil
+}
+
+// the route's limits over the server's
+func (r *routeLimits) resolve(server *Limits) *Limits {
+	toRet := *server
+	if r == nil {
+		return &toRet
+	}
+	if r.maxBody != nil {
+		toRet.MaxBodyBytes = *r.maxBody
+	}
+	if r.maxHeaderBytes != nil {
+		toRet.MaxHeaderBytes = *r.maxHeaderBytes
+	}
+	if r.maxQueryParams != nil {
+		toRet.MaxQueryParams = *r.maxQueryParams
+	}
+	if r.maxPathSegments != nil {
+		toRet.MaxPathSegments = *r.maxPathSegments
+	}
+	if r.readTimeout != nil {
+		toRet.ReadTimeout = *r.readTimeout
+	}
+	if r.writeTimeout != nil {
+		toRet.WriteTimeout = *r.writeTimeout
+	}
+	return &toRet
+}
+
+// names for the limit_rejections_total label
+const (
+	bodyLimit         string = "body"
+	headerLimit              = "header_bytes"
+	queryParamsLimit         = "query_params"
+	pathSegmentsLimit        = "path_segments"
+	requestRateLimit         = "rate"
+	concurrencyLimit         = "concurrency"
+	timeoutLimit             = "timeout"
+)
+
+// what the headers cost against MaxHeaderBytes, roughly as they came over
+// the wire
+func headerBytes(r *http.Request) int {
+	toRet := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			toRet += len(k) + len(v) + 4
+		}
+	}
+	return toRet
+}
+
+func queryParamCount(rawQuery string) int {
+	if rawQuery == "" {
+		return 0
+	}
+	return strings.Count(rawQuery, "&") + 1
+}
+
+func pathSegmentCount(path string) int {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return 0
+	}
+	return strings.Count(trimmed, "/") + 1
+}
+
+// everything that can be checked before reading the body, the body limit
+// is enforced as it's read, see bodyTooLarge
+func (m *myHandler) enforceLimits(w http.ResponseWriter, r *http.Request) *handlerError {
+	limits := m.limits
+	if limits == nil {
+		defaults := DefaultLimits()
+		limits = m.route.limits.resolve(&defaults)
+	}
+	if limits.MaxPathSegments > 0 && pathSegmentCount(r.URL.Path) > limits.MaxPathSegments {
+		m.metrics.limitExceeded(m.path, pathSegmentsLimit)
+		return &handlerError{http.StatusRequestURITooLong, "too many path segments"}
+	}
+	if limits.MaxQueryParams > 0 && queryParamCount(r.URL.RawQuery) > limits.MaxQueryParams {
+		m.metrics.limitExceeded(m.path, queryParamsLimit)
+		return &handlerError{http.StatusRequestURITooLong, "too many query parameters"}
+	}
+	if limits.MaxHeaderBytes > 0 && headerBytes(r) > limits.MaxHeaderBytes {
+		m.metrics.limitExceeded(m.path, headerLimit)
+		return &handlerError{
+			http.StatusRequestHeaderFieldsTooLarge, "request headers too large",
+		}
+	}
+	if limits.MaxBodyBytes > 0 {
+		if r.ContentLength > limits.MaxBodyBytes {
+			m.metrics.limitExceeded(m.path, bodyLimit)
+			return &handlerError{http.StatusRequestEntityTooLarge, "request body too large"}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+	}
+	//the server's timeouts already cover routes that don't set their own
+	rc := http.NewResponseController(w)
+	if m.route.limits != nil && m.route.limits.readTimeout != nil {
+		if err := rc.SetReadDeadline(deadline(*m.route.limits.readTimeout)); err != nil {
+			myLogger.Debugf("couldn't set read deadline: '%s'", err)
+		}
+	}
+	if m.route.limits != nil && m.route.limits.writeTimeout != nil {
+		if err := rc.SetWriteDeadline(deadline(*m.route.limits.writeTimeout)); err != nil {
+			myLogger.Debugf("couldn't set write deadline: '%s'", err)
+		}
+	}
+	return nil
+}
+
+// zero means no deadline
+func deadline(d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// the body was cut off by MaxBodyBytes, counts it when it was
+func (m *myHandler) bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	m.metrics.limitExceeded(m.path, bodyLimit)
+	return true
+}
+
+func (l *Limits) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		MaxHeaderBytes:    l.headerCap() + maxHeaderSlack,
+		ReadTimeout:       l.ReadTimeout,
+		WriteTimeout:      l.WriteTimeout,
+		IdleTimeout:       l.IdleTimeout,
+		ReadHeaderTimeout: l.ReadHeaderTimeout,
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestLimitsLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"max_body: 1024\nread_timeout: 30s", false, "valid"},
+		//1
+		{"max_body: -1", true, "negative body"},
+		//2
+		{"max_query_params: -1", true, "negative query params"},
+		//3
+		{"max_path_segments: 300", true, "deeper than a route can be"},
+		//4
+		{"read_timeout: soon", true, "bad duration"},
+		//5
+		{"write_timeout: -1s", true, "negative duration"},
+	}
+	for i, td := range testData {
+		lYaml := &LimitsYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), lYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		_, err := newRouteLimits(lYaml)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+	deep := "/" + strings.Repeat("a/", pathBits) + "b:\n  callbacks:\n    - cb1\n"
+	if _, err := loadRoutes(strings.NewReader(deep)); err == nil {
+		t.Errorf("expected an error for a route deeper than %d segments", pathBits)
+	}
+}
+
+func TestWithLimits(t *testing.T) {
+	withLimits := func(f func(*Limits)) Limits {
+		toRet := DefaultLimits()
+		f(&toRet)
+		return toRet
+	}
+	testData := []struct {
+		limits   Limits
+		expError bool
+		msg      string
+	}{
+		//0
+		{DefaultLimits(), false, "defaults"},
+		//1
+		{Limits{}, false, "no limits"},
+		//2
+		{withLimits(func(l *Limits) { l.MaxBodyBytes = -1 }), true, "negative body"},
+		//3
+		{withLimits(func(l *Limits) { l.MaxPathSegments = pathBits + 1 }), true, "too deep"},
+		//4
+		{withLimits(func(l *Limits) { l.IdleTimeout = -1 }), true, "negative timeout"},
+	}
+	for i, td := range testData {
+		serverYaml, err := os.Open("testdata/limits.yaml")
+		if err != nil {
+			t.Fatalf("failed opening test yaml with error: '%s'", err)
+		}
+		_, err = NewServer(serverYaml, map[string]Callback{
+			"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+		}, WithLimits(td.limits))
+		serverYaml.Close()
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+	//net/http reads the headers before the route, it can't take more
+	_, err := NewServer(
+		strings.NewReader("/a:\n  limits:\n    max_header_bytes: 4096\n  callbacks: [cb1]\n"),
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+		WithLimits(withLimits(func(l *Limits) { l.MaxHeaderBytes = 2048 })),
+	)
+	if err == nil {
+		t.Errorf("expected an error for a route max_header_bytes over the server's")
+	}
+}
+
+// hides the length from httptest.NewRequest so the body is sent chunked
+type unsizedReader struct {
+	io.Reader
+}
+
+func queryOf(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d=%d", i, i)
+	}
+	return strings.Join(params, "&")
+}
+
+func TestLimits(t *testing.T) {
+	serverYaml, err := os.Open("testdata/limits.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	limits := DefaultLimits()
+	limits.MaxHeaderBytes = 2048
+	limits.MaxPathSegments = 4
+	limits.MaxBodyBytes = 1024
+	tmpServer, err := NewServer(serverYaml, map[string]Callback{
+		"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+	}, WithLimits(limits), WithMetricsPath("/metrics"))
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	form := "application/x-www-form-urlencoded"
+	testData := []struct {
+		handlePath  string
+		method      string
+		target      string
+		body        io.Reader
+		contentType string
+		header      string
+		expCode     int
+		msg         string
+	}{
+		//0
+		{
+			"/parcel/", http.MethodGet, "http://example.com/parcel/1", nil, "", "",
+			http.StatusOK, "within limits",
+		},
+		//1
+		{
+			"/parcel/", http.MethodGet, "http://example.com/parcel/1/2", nil, "", "",
+			http.StatusBadRequest, "more segments than the route has",
+		},
+		//2
+		{
+			"/parcel/", http.MethodGet, "http://example.com/parcel/1/2/3/4", nil, "", "",
+			http.StatusRequestURITooLong, "too many path segments",
+		},
+		//3
+		{
+			"/parcel/", http.MethodGet, "http://example.com/parcel/1?" + queryOf(defMaxQueryParams),
+			nil, "", "", http.StatusOK, "default query params",
+		},
+		//4
+		{
+			"/parcel/", http.MethodGet,
+			"http://example.com/parcel/1?" + queryOf(defMaxQueryParams+1),
+			nil, "", "", http.StatusRequestURITooLong, "too many query params",
+		},
+		//5
+		{
+			"/parcel/", http.MethodGet, "http://example.com/parcel/1", nil, "",
+			strings.Repeat("x", 3000), http.StatusRequestHeaderFieldsTooLarge,
+			"headers too large",
+		},
+		//6
+		{
+			"/deeds", http.MethodPost, "http://example.com/deeds",
+			strings.NewReader("name=Kern"), form, "", http.StatusOK, "small body",
+		},
+		//7
+		{
+			"/deeds", http.MethodPost, "http://example.com/deeds",
+			strings.NewReader("name=" + strings.Repeat("x", 20)), form, "",
+			http.StatusRequestEntityTooLarge, "route's max body",
+		},
+		//8
+		{
+			"/deeds", http.MethodPost, "http://example.com/deeds",
+			unsizedReader{strings.NewReader("name=" + strings.Repeat("x", 20))}, form, "",
+			http.StatusRequestEntityTooLarge, "chunked body",
+		},
+		//9
+		{
+			"/deeds", http.MethodPost, "http://example.com/deeds",
+			unsizedReader{strings.NewReader(`{"name": "` + strings.Repeat("x", 20) + `"}`)},
+			"application/json", "", http.StatusRequestEntityTooLarge, "chunked json body",
+		},
+		//10
+		{
+			"/deeds", http.MethodPost, "http://example.com/deeds?a=1&b=2",
+			strings.NewReader("name=Kern"), form, "", http.StatusRequestURITooLong,
+			"route's max query params",
+		},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(td.method, td.target, td.body)
+		if td.contentType != "" {
+			r.Header.Set("Content-Type", td.contentType)
+		}
+		if td.header != "" {
+			r.Header.Set("X-Padding", td.header)
+		}
+		testServer.pathHandlers[td.handlePath].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "exp code: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+		}
+	}
+	//over the wire headers past net/http's own slack still get the route's
+	//431 and are counted
+	mux := http.NewServeMux()
+	mux.Handle("/parcel/", testServer.pathHandlers["/parcel/"])
+	front := httptest.NewUnstartedServer(mux)
+	front.Config = limits.newHTTPServer("", mux)
+	front.Start()
+	defer front.Close()
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/parcel/1", nil)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8000))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed with error: '%s'", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("exp code: %d, got: %d", http.StatusRequestHeaderFieldsTooLarge, res.StatusCode)
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	body := w.Body.String()
+	expLines := []string{
+		`landtitle_limit_rejections_total{route="/parcel/{id}",limit="path_segments"} 1`,
+		`landtitle_limit_rejections_total{route="/parcel/{id}",limit="query_params"} 1`,
+		`landtitle_limit_rejections_total{route="/parcel/{id}",limit="header_bytes"} 2`,
+		`landtitle_limit_rejections_total{route="/deeds",limit="body"} 3`,
+		`landtitle_limit_rejections_total{route="/deeds",limit="query_params"} 1`,
+	}
+	for i, line := range expLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("index: %d, metrics missing line: '%s'", i, line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics output:\n%s", body)
+	}
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// just enough of the prometheus text exposition format (0.0.4) to get
+// counters, gauges and histograms out the door without dragging in
+// the full client library
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	metricsNamespace   string = "landtitle"
+	metricsContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	defMetricsPath            = "/metrics"
+)
+
+type metricType string
+
+const (
+	counterMetric   metricType = "counter"
+	gaugeMetric                = "gauge"
+	histogramMetric            = "histogram"
+)
+
+// same as the prometheus client defaults, in seconds
+var defMetricBuckets []float64 = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	//histograms only
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+type metricFamily struct {
+	sync.Mutex
+	name    string
+	help    string
+	mType   metricType
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// label values are joined with a byte that can't show up in a url path
+// or method, good enough for a map key
+func (f *metricFamily) getSeries(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		//programming error, don't blow up the request over it
+		myLogger.Errorf(
+			"metric '%s' expects %d label values, got %d",
+			f.name, len(f.labels), len(labelValues),
+		)
+		return nil
+	}
+	key := strings.Join(labelValues, "\xff")
+	toRet, ok := f.series[key]
+	if !ok {
+		toRet = &metricSeries{
+			labelValues: append([]string(nil), labelValues...),
+		}
+		if f.mType == histogramMetric {
+			toRet.bucketCounts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = toRet
+	}
+	return toRet
+}
+
+func (f *metricFamily) add(val float64, labelValues ...string) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if s := f.getSeries(labelValues); s != nil {
+		s.value += val
+	}
+}
+
+func (f *metricFamily) inc(labelValues ...string) {
+	f.add(1, labelValues...)
+}
+
+func (f *metricFamily) set(val float64, labelValues ...string) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if s := f.getSeries(labelValues); s != nil {
+		s.value = val
+	}
+}
+
+func (f *metricFamily) observe(val float64, labelValues ...string) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	s := f.getSeries(labelValues)
+	if s == nil {
+		return
+	}
+	for i, bound := range f.buckets {
+		if val <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.sum += val
+	s.count++
+}
+
+func escapeLabelValue(val string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(val)
+}
+
+func formatMetricValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func (f *metricFamily) formatLabels(
+	labelValues []string, extraName, extraValue string,
+) string {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, l := range f.labels {
+		pairs = append(
+			pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabelValue(labelValues[i])),
+		)
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *metricFamily) write(w io.Writer) error {
+	f.Lock()
+	defer f.Unlock()
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)
+	if _, err := fmt.Fprintf(
+		w, "# HELP %s %s\n# TYPE %s %s\n", f.name, help, f.name, f.mType,
+	); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var err error
+	for _, k := range keys {
+		s := f.series[k]
+		if f.mType != histogramMetric {
+			_, err = fmt.Fprintf(
+				w, "%s%s %s\n",
+				f.name, f.formatLabels(s.labelValues, "", ""),
+				formatMetricValue(s.value),
+			)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for i, bound := range f.buckets {
+			_, err = fmt.Fprintf(
+				w, "%s_bucket%s %d\n",
+				f.name,
+				f.formatLabels(s.labelValues, "le", formatMetricValue(bound)),
+				s.bucketCounts[i],
+			)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(
+			w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			f.name, f.formatLabels(s.labelValues, "le", "+Inf"), s.count,
+			f.name, f.formatLabels(s.labelValues, "", ""), formatMetricValue(s.sum),
+			f.name, f.formatLabels(s.labelValues, "", ""), s.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type metricsRegistry struct {
+	sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (m *metricsRegistry) register(
+	name, help string, mType metricType, buckets []float64, labels ...string,
+) *metricFamily {
+	m.Lock()
+	defer m.Unlock()
+	fullName := fmt.Sprintf("%s_%s", metricsNamespace, name)
+	if toRet, ok := m.families[fullName]; ok {
+		return toRet
+	}
+	toRet := &metricFamily{
+		name:    fullName,
+		help:    help,
+		mType:   mType,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	m.families[fullName] = toRet
+	return toRet
+}
+
+func (m *metricsRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return m.register(name, help, counterMetric, nil, labels...)
+}
+
+func (m *metricsRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return m.register(name, help, gaugeMetric, nil, labels...)
+}
+
+func (m *metricsRegistry) histogram(
+	name, help string, buckets []float64, labels ...string,
+) *metricFamily {
+	if buckets == nil {
+		buckets = defMetricBuckets
+	}
+	return m.register(name, help, histogramMetric, buckets, labels...)
+}
+
+func (m *metricsRegistry) write(w io.Writer) error {
+	m.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f)
+	}
+	m.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := m.write(w); err != nil {
+		myLogger.Errorf("failed writing metrics with error: '%s'", err)
+	}
+}
+
+// every instrument the handlers touch, all methods are nil safe so
+// handlers built without a server (tests mostly) don't need one
+type serverMetrics struct {
+	registry           *metricsRegistry
+	requests           *metricFamily
+	requestDuration    *metricFamily
+	inFlight           *metricFamily
+	queued             *metricFamily
+	callbackDuration   *metricFamily
+	callbackFailures   *metricFamily
+	validationFailures *metricFamily
+	limitRejections    *metricFamily
+	authFailures       *metricFamily
+	accessDenials      *metricFamily
+	cacheLookups       *metricFamily
+}
+
+func newServerMetrics() *serverMetrics {
+	reg := newMetricsRegistry()
+	return &serverMetrics{
+		registry: reg,
+		requests: reg.counter(
+			"http_requests_total",
+			"Count of HTTP requests by route template, method and status.",
+			"route", "method", "status",
+		),
+		requestDuration: reg.histogram(
+			"http_request_duration_seconds",
+			"HTTP request latency by route template and method.",
+			nil, "route", "method",
+		),
+		inFlight: reg.gauge(
+			"http_requests_in_flight",
+			"HTTP requests currently being served by route template.",
+			"route",
+		),
+		queued: reg.gauge(
+			"http_requests_queued",
+			"HTTP requests waiting for a max_concurrent slot by route template.",
+			"route",
+		),
+		callbackDuration: reg.histogram(
+			"callback_duration_seconds",
+			"Route callback latency.",
+			nil, "route", "callback",
+		),
+		callbackFailures: reg.counter(
+			"callback_failures_total",
+			"Count of callbacks that returned false or an error.",
+			"route", "callback",
+		),
+		validationFailures: reg.counter(
+			"param_validation_failures_total",
+			"Count of params that failed validation, each failing param of a request counts.",
+			"route", "param",
+		),
+		limitRejections: reg.counter(
+			"limit_rejections_total",
+			"Count of requests rejected for exceeding a size or count limit.",
+			"route", "limit",
+		),
+		authFailures: reg.counter(
+			"auth_failures_total",
+			"Count of requests that failed authentication by the scheme that failed.",
+			"route", "scheme",
+		),
+		accessDenials: reg.counter(
+			"access_denied_total",
+			"Count of authenticated requests refused for missing roles or permissions.",
+			"route", "method",
+		),
+		cacheLookups: reg.counter(
+			"response_cache_lookups_total",
+			"Count of response cache lookups by route template and hit or miss.",
+			"route", "result",
+		),
+	}
+}
+
+func (s *serverMetrics) requestStarted(route string) {
+	if s == nil {
+		return
+	}
+	s.inFlight.add(1, route)
+}
+
+func (s *serverMetrics) requestFinished(
+	route, method string, status int, elapsed time.Duration,
+) {
+	if s == nil {
+		return
+	}
+	s.inFlight.add(-1, route)
+	method = strings.ToLower(method)
+	s.requests.inc(route, method, strconv.Itoa(status))
+	s.requestDuration.observe(elapsed.Seconds(), route, method)
+}
+
+func (s *serverMetrics) callbackFinished(
+	route, callback string, elapsed time.Duration, failed bool,
+) {
+	if s == nil {
+		return
+	}
+	s.callbackDuration.observe(elapsed.Seconds(), route, callback)
+	if failed {
+		s.callbackFailures.inc(route, callback)
+	}
+}
+
+func (s *serverMetrics) validationFailed(route, param string) {
+	if s == nil {
+		return
+	}
+	s.validationFailures.inc(route, param)
+}
+
+func (s *serverMetrics) queueChanged(route string, depth int) {
+	if s == nil {
+		return
+	}
+	s.queued.set(float64(depth), route)
+}
+
+// scheme is none when no credentials were sent
+func (s *serverMetrics) authFailed(route, scheme string) {
+	if s == nil {
+		return
+	}
+	s.authFailures.inc(route, scheme)
+}
+
+func (s *serverMetrics) accessDenied(route, method string) {
+	if s == nil {
+		return
+	}
+	s.accessDenials.inc(route, strings.ToLower(method))
+}
+
+func (s *serverMetrics) limitExceeded(route, limit string) {
+	if s == nil {
+		return
+	}
+	s.limitRejections.inc(route, limit)
+}
+
+// result is hit or miss
+func (s *serverMetrics) cacheLookup(route, result string) {
+	if s == nil {
+		return
+	}
+	s.cacheLookups.inc(route, result)
+}
+
+// captures the status code for metrics, callbacks write straight to the
+// ResponseWriter so this is the only place to find out what they sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+	}
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.written {
+		s.status = code
+		s.written = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	s.written = true
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Flush() {
+	s.written = true
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController get at the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
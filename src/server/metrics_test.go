@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistryWrite(t *testing.T) {
+	reg := newMetricsRegistry()
+	counter := reg.counter("things_total", "Count of things.", "kind")
+	gauge := reg.gauge("level", "A level.")
+	hist := reg.histogram("wait_seconds", "Waiting.", []float64{1, 5}, "route")
+	counter.inc("a")
+	counter.inc("a")
+	counter.add(3, `b"\`)
+	gauge.set(7)
+	gauge.add(-2)
+	hist.observe(0.5, "/foo")
+	hist.observe(3, "/foo")
+	hist.observe(9, "/foo")
+	//wrong label count is dropped rather than panicking
+	counter.inc()
+
+	builder := new(strings.Builder)
+	if err := reg.write(builder); err != nil {
+		t.Fatalf("failed writing metrics with error: '%s'", err)
+	}
+	exp := `# HELP landtitle_level A level.
+# TYPE landtitle_level gauge
+landtitle_level 5
+# HELP landtitle_things_total Count of things.
+# TYPE landtitle_things_total counter
+landtitle_things_total{kind="a"} 2
+landtitle_things_total{kind="b\"\\"} 3
+# HELP landtitle_wait_seconds Waiting.
+# TYPE landtitle_wait_seconds histogram
+landtitle_wait_seconds_bucket{route="/foo",le="1"} 1
+landtitle_wait_seconds_bucket{route="/foo",le="5"} 2
+landtitle_wait_seconds_bucket{route="/foo",le="+Inf"} 3
+landtitle_wait_seconds_sum{route="/foo"} 12.5
+landtitle_wait_seconds_count{route="/foo"} 3
+`
+	if builder.String() != exp {
+		t.Errorf("metrics output mismatch, exp:\n%s\ngot:\n%s", exp, builder.String())
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	serverYaml, err := os.Open("testdata/advanced_get.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	callbacks := make(map[string]Callback)
+	for name, cb := range callbackDataMap {
+		callbacks[name] = makeCallback(myLogger, name, cb.res, cb.err, cb.code)
+	}
+	tmpServer, err := NewServer(
+		serverYaml, callbacks, WithMetricsPath("/metrics"),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	requests := []struct {
+		handlePath string
+		target     string
+	}{
+		{"/foo/", "http://example.com/foo/1?biff=yolo"},
+		{"/foo/", "http://example.com/foo/1?biff=yolo"},
+		{"/foo/", "http://example.com/foo/1"},
+		//both params fail, both are counted
+		{"/foo/", "http://example.com/foo/abc"},
+		{"/baz", "http://example.com/baz?foo=123-12-1234"},
+		{"/biff", "http://example.com/biff?foo=nope"},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, req.target, nil)
+		testServer.pathHandlers[req.handlePath].ServeHTTP(w, r)
+	}
+	metricsHandler, ok := testServer.adminHandlers["/metrics"]
+	if !ok {
+		t.Fatalf("metrics handler not registered")
+	}
+	w := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	if w.Header().Get("Content-Type") != metricsContentType {
+		t.Errorf("unexpected content type: '%s'", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	expLines := []string{
+		`landtitle_http_requests_total{route="/foo/{blarg}",method="get",status="200"} 2`,
+		`landtitle_http_requests_total{route="/foo/{blarg}",method="get",status="400"} 2`,
+		`landtitle_http_requests_total{route="/baz",method="get",status="400"} 1`,
+		`landtitle_http_requests_in_flight{route="/foo/{blarg}"} 0`,
+		`landtitle_http_request_duration_seconds_count{route="/foo/{blarg}",method="get"} 4`,
+		`landtitle_callback_duration_seconds_count{route="/foo/{blarg}",callback="cb1"} 2`,
+		`landtitle_callback_failures_total{route="/baz",callback="cb2"} 1`,
+		`landtitle_param_validation_failures_total{route="/foo/{blarg}",param="biff"} 2`,
+		`landtitle_param_validation_failures_total{route="/foo/{blarg}",param="blarg"} 1`,
+		`landtitle_param_validation_failures_total{route="/biff",param="foo"} 1`,
+	}
+	for i, line := range expLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("index: %d, metrics missing line: '%s'", i, line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics output:\n%s", body)
+	}
+}
+
+func TestMetricsOptions(t *testing.T) {
+	testData := []struct {
+		opts     []Option
+		expPath  string
+		expPort  bool
+		expError bool
+		msg      string
+	}{
+		{nil, "", false, false, "metrics are opt in"},
+		{[]Option{WithMetricsPath("/stats")}, "/stats", false, false, "custom path"},
+		{[]Option{WithAdminPort(9090)}, defMetricsPath, true, false, "admin port default path"},
+		{[]Option{WithMetricsPath("stats")}, "", false, true, "relative path"},
+		{[]Option{WithAdminPort(0)}, "", false, true, "bad port"},
+		{[]Option{WithMetricsPath("/")}, "", false, true, "collides with a route"},
+	}
+	for i, td := range testData {
+		serverYaml, err := os.Open("testdata/basic.yaml")
+		if err != nil {
+			t.Fatalf("failed opening test yaml with error: '%s'", err)
+		}
+		tmpServer, err := NewServer(serverYaml, map[string]Callback{
+			"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+			"cb2": makeCallback(myLogger, "cb2", true, nil, nil),
+			"cb5": makeCallback(myLogger, "cb5", true, nil, nil),
+		}, td.opts...)
+		serverYaml.Close()
+		if td.expError {
+			if err == nil {
+				t.Errorf(getTestMessage(i, td.msg, "expected error"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		testServer := tmpServer.(*server)
+		if testServer.metricsPath != td.expPath {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "metrics path mismatch, exp: '%s', got: '%s'",
+					td.expPath, testServer.metricsPath,
+				),
+			)
+		}
+		if _, ok := testServer.adminHandlers[td.expPath]; td.expPath != "" && !ok {
+			t.Errorf(getTestMessage(i, td.msg, "metrics handler not registered"))
+		}
+		if (testServer.adminPort != nil) != td.expPort {
+			t.Errorf(getTestMessage(i, td.msg, "admin port mismatch"))
+		}
+	}
+}
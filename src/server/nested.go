@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+object and array params, eg
+
+	filter:
+	  type: object
+	  properties:
+	    county:
+	      enum: [Kern, Inyo]
+	    year:
+	      type: integer
+	      required: false
+	sort:
+	  type: array
+	  max_length: 3
+	  items:
+	    enum: [date, apn]
+
+sent in the query or form with brackets, filter[county]=Kern&sort[0]=date
+or sort[]=date&sort[]=apn, or as a JSON body, which is flattened into the
+same bracket keys and counts as the form source. JSON bodies are capped
+at the route's max_body, or 10MB like form bodies when it has none.
+Callbacks get the bracket keys in the string params and nested Values and
+[]interface{} in TypedParams.
+*/
+
+const (
+	jsonContentType string = "application/json"
+	//a key's path can only go so deep, filter[a][b][c]...
+	maxNestingDepth int = 32
+	//without a max_body, what ParseForm allows a form body
+	maxJSONBodyBytes int64 = 10 << 20
+)
+
+// filter[county] -> filter, [county], sort[] -> sort, [""]
+func splitBracketKey(key string) (string, []string, error) {
+	open := strings.IndexByte(key, '[')
+	if open < 0 {
+		return key, nil, nil
+	}
+	base := key[:open]
+	if base == "" {
+		return "", nil, fmt.Errorf("key '%s' has no parameter name", key)
+	}
+	path := make([]string, 0)
+	rest := key[open:]
+	for rest != "" {
+		end := strings.IndexByte(rest, ']')
+		if rest[0] != '[' || end < 0 {
+			return "", nil, fmt.Errorf("malformed key: '%s'", key)
+		}
+		seg := rest[1:end]
+		if strings.ContainsAny(seg, "[") {
+			return "", nil, fmt.Errorf("malformed key: '%s'", key)
+		}
+		path = append(path, seg)
+		rest = rest[end+1:]
+	}
+	if len(path) > maxNestingDepth {
+		return "", nil, fmt.Errorf("key '%s' nested too deeply", key)
+	}
+	for i, seg := range path[:len(path)-1] {
+		if seg == "" {
+			return "", nil, fmt.Errorf(
+				"empty brackets only allowed last, segment %d of '%s'", i, key,
+			)
+		}
+	}
+	return base, path, nil
+}
+
+func joinBracketKey(base string, path []string) string {
+	builder := new(strings.Builder)
+	builder.WriteString(base)
+	for _, seg := range path {
+		fmt.Fprintf(builder, "[%s]", seg)
+	}
+	return builder.String()
+}
+
+// base name of a possibly bracketed key, the whole key when it isn't one
+func bracketBase(key string) string {
+	if open := strings.IndexByte(key, '['); open > 0 {
+		return key[:open]
+	}
+	return key
+}
+
+func isNestedType(p httpParameterType) bool {
+	return p == objectParameterType || p == arrayParameterType
+}
+
+// resolves a bracketed key to the param declaring it, nil when nothing does
+func (params routeParameterMap) lookup(key string) *routeParameter {
+	base, path, err := splitBracketKey(key)
+	if err != nil {
+		return nil
+	}
+	toRet, ok := params[base]
+	if !ok {
+		return nil
+	}
+	for _, seg := range path {
+		switch toRet.pType {
+		case objectParameterType:
+			if toRet, ok = toRet.properties[seg]; !ok {
+				return nil
+			}
+		case arrayParameterType:
+			toRet = toRet.items
+		default:
+			return nil
+		}
+	}
+	return toRet
+}
+
+// children of a param's properties or items, none of the per request
+// source handling applies below the top level
+func newChildParam(name string, p *ParamYaml) (*routeParameter, error) {
+	if p == nil {
+		p = &ParamYaml{}
+	}
+	if p.SourceType != "" || len(p.Aliases) > 0 ||
+		len(p.Precedence) > 0 || p.Conflict != "" {
+		return nil, fmt.Errorf(
+			"'%s' is nested, source, aliases, precedence and conflict only "+
+				"apply to top level parameters", name,
+		)
+	}
+	if p.Type == "" {
+		p.Type = defParameterType
+	}
+	if p.Type == fileParameterType {
+		return nil, fmt.Errorf("'%s' is nested, file parameters must be top level", name)
+	}
+	toRet, err := newParam(p)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", name, err)
+	}
+	return toRet, nil
+}
+
+func (r *routeParameter) setChildren(p *ParamYaml) error {
+	switch r.pType {
+	case objectParameterType:
+		if len(p.Properties) == 0 {
+			return fmt.Errorf("object parameters require properties")
+		}
+		if p.Items != nil {
+			return fmt.Errorf("items only apply to array parameters")
+		}
+		r.properties = make(routeParameterMap)
+		for name, prop := range p.Properties {
+			if strings.ContainsAny(name, "[]") {
+				return fmt.Errorf("property name '%s' can't contain brackets", name)
+			}
+			child, err := newChildParam(name, prop)
+			if err != nil {
+				return err
+			}
+			r.properties[name] = child
+		}
+	case arrayParameterType:
+		if p.Items == nil {
+			return fmt.Errorf("array parameters require items")
+		}
+		if len(p.Properties) > 0 {
+			return fmt.Errorf("properties only apply to object parameters")
+		}
+		child, err := newChildParam("items", p.Items)
+		if err != nil {
+			return err
+		}
+		r.items = child
+	default:
+		if len(p.Properties) > 0 || p.Items != nil {
+			return fmt.Errorf(
+				"properties and items only apply to object and array parameters",
+			)
+		}
+	}
+	return nil
+}
+
+// the values for one object or array param, arranged by bracket path
+type paramTree struct {
+	value    *string
+	children map[string]*paramTree
+}
+
+func (t *paramTree) insert(key string, path []string, val string) error {
+	node := t
+	for _, seg := range path {
+		if node.value != nil {
+			return fmt.Errorf("'%s' is both a value and a container", key)
+		}
+		if node.children == nil {
+			node.children = make(map[string]*paramTree)
+		}
+		child, ok := node.children[seg]
+		if !ok {
+			child = &paramTree{}
+			node.children[seg] = child
+		}
+		node = child
+	}
+	if node.value != nil || node.children != nil {
+		return fmt.Errorf("'%s' is both a value and a container", key)
+	}
+	node.value = &val
+	return nil
+}
+
+func (params routeParameterMap) buildTree(
+	pName string, values map[string]string,
+) (*paramTree, error) {
+	var toRet *paramTree
+	for k, v := range values {
+		if k != pName && !strings.HasPrefix(k, pName+"[") {
+			continue
+		}
+		if toRet == nil {
+			toRet = &paramTree{}
+		}
+		_, path, err := splitBracketKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if err = toRet.insert(k, path, v); err != nil {
+			return nil, err
+		}
+	}
+	return toRet, nil
+}
+
+// validates the tree below r recursively, name is the bracket key so far
+// so errors point at the offending value
+func (r *routeParameter) parseTree(name string, t *paramTree) (interface{}, error) {
+	if !isNestedType(r.pType) {
+		if t.value == nil {
+			return nil, fmt.Errorf("'%s' must be a single %s value", name, r.pType)
+		}
+		if err := r.isValid(*t.value); err != nil {
+			return nil, fmt.Errorf("'%s' is not valid, %s", name, err)
+		}
+		return r.typedValue(*t.value)
+	}
+	if t.value != nil {
+		return nil, fmt.Errorf("'%s' must be an %s, use brackets", name, r.pType)
+	}
+	if r.pType == objectParameterType {
+		toRet := make(Values)
+		for k := range t.children {
+			if _, ok := r.properties[k]; !ok {
+				return nil, fmt.Errorf("'%s' has no property '%s'", name, k)
+			}
+		}
+		for k, prop := range r.properties {
+			childName := joinBracketKey(name, []string{k})
+			child, ok := t.children[k]
+			if !ok && prop.def != nil {
+				child, ok = &paramTree{value: prop.def}, true
+			}
+			//optional and left empty, same as the top level
+			if ok && child.value != nil && *child.value == "" && !prop.required {
+				continue
+			}
+			if !ok {
+				if prop.required {
+					return nil, fmt.Errorf("required property '%s' missing", childName)
+				}
+				continue
+			}
+			val, err := prop.parseTree(childName, child)
+			if err != nil {
+				return nil, err
+			}
+			toRet[k] = val
+		}
+		return toRet, nil
+	}
+	indices := make([]int, 0, len(t.children))
+	for k := range t.children {
+		//01 and 1 would be the same item
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || strconv.Itoa(i) != k {
+			return nil, fmt.Errorf("'%s' index '%s' is not a non negative integer", name, k)
+		}
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	if r.minLength != nil && len(indices) < *r.minLength {
+		return nil, fmt.Errorf(
+			"'%s' has %d items, fewer than the minimum of %d",
+			name, len(indices), *r.minLength,
+		)
+	}
+	if r.maxLength != nil && len(indices) > *r.maxLength {
+		return nil, fmt.Errorf(
+			"'%s' has %d items, more than the maximum of %d",
+			name, len(indices), *r.maxLength,
+		)
+	}
+	//sparse indices keep their order but not their gaps
+	toRet := make([]interface{}, len(indices))
+	for j, i := range indices {
+		childName := joinBracketKey(name, []string{strconv.Itoa(i)})
+		val, err := r.items.parseTree(childName, t.children[strconv.Itoa(i)])
+		if err != nil {
+			return nil, err
+		}
+		toRet[j] = val
+	}
+	return toRet, nil
+}
+
+// JSON bodies are only read for routes that take something from the form,
+// the rest leave the body alone for callbacks
+func (params routeParameterMap) fromForm() bool {
+	for _, param := range params {
+		if param.source&sourceForm != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == jsonContentType
+}
+
+// reads a JSON object body of at most maxBytes into bracket keyed form
+// values, the body is put back so callbacks can still read it themselves
+func jsonFormValues(r *http.Request, maxBytes int64) (url.Values, error) {
+	toRet := make(url.Values)
+	if r.Body == nil || r.Body == http.NoBody {
+		return toRet, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBytes))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return toRet, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var decoded map[string]interface{}
+	if err = decoder.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("request body is not a json object: %w", err)
+	}
+	for k, v := range decoded {
+		if strings.ContainsAny(k, "[]") {
+			return nil, fmt.Errorf("json key '%s' can't contain brackets", k)
+		}
+		if err = flattenJSON(k, v, 0, toRet); err != nil {
+			return nil, err
+		}
+	}
+	return toRet, nil
+}
+
+func flattenJSON(key string, val interface{}, depth int, into url.Values) error {
+	if depth > maxNestingDepth {
+		return fmt.Errorf("json nested too deeply at '%s'", key)
+	}
+	switch v := val.(type) {
+	case nil:
+		//null is the same as not sent
+	case string:
+		into.Set(key, v)
+	case json.Number:
+		into.Set(key, v.String())
+	case bool:
+		into.Set(key, strconv.FormatBool(v))
+	case map[string]interface{}:
+		for k, child := range v {
+			if strings.ContainsAny(k, "[]") {
+				return fmt.Errorf("json key '%s' can't contain brackets", k)
+			}
+			if err := flattenJSON(
+				joinBracketKey(key, []string{k}), child, depth+1, into,
+			); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := flattenJSON(
+				joinBracketKey(key, []string{strconv.Itoa(i)}), child, depth+1, into,
+			); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported json value at '%s'", key)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"landtitle/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestSplitBracketKey(t *testing.T) {
+	testData := []struct {
+		key      string
+		expBase  string
+		expPath  []string
+		expError bool
+		msg      string
+	}{
+		//0
+		{"plain", "plain", nil, false, "no brackets"},
+		//1
+		{"filter[county]", "filter", []string{"county"}, false, "one level"},
+		//2
+		{"a[b][0][c]", "a", []string{"b", "0", "c"}, false, "deep"},
+		//3
+		{"sort[]", "sort", []string{""}, false, "append"},
+		//4
+		{"[county]", "", nil, true, "no name"},
+		//5
+		{"a[b", "", nil, true, "unclosed"},
+		//6
+		{"a[b]c", "", nil, true, "trailing characters"},
+		//7
+		{"a[][b]", "", nil, true, "empty brackets not last"},
+		//8
+		{"a[[b]]", "", nil, true, "nested brackets"},
+		//9
+		{"a" + strings.Repeat("[x]", maxNestingDepth+1), "", nil, true, "too deep"},
+	}
+	for i, td := range testData {
+		base, path, err := splitBracketKey(td.key)
+		if td.expError {
+			if err == nil {
+				t.Errorf(getTestMessage(i, td.msg, "expected an error for '%s'", td.key))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		if base != td.expBase || !reflect.DeepEqual(path, td.expPath) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "exp: '%s' %v, got: '%s' %v", td.expBase, td.expPath, base, path,
+				),
+			)
+		}
+	}
+}
+
+func TestNestedParamLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		msg        string
+	}{
+		//0
+		{"type: object", "objects need properties"},
+		//1
+		{"type: array", "arrays need items"},
+		//2
+		{"type: object\nproperties: {a: {}}\nitems: {}", "items on an object"},
+		//3
+		{"type: string\nitems: {}", "items on a string"},
+		//4
+		{"type: array\nsource: url\nitems: {}", "nested params from the url"},
+		//5
+		{"type: array\nitems: {source: form}", "source on a nested param"},
+		//6
+		{"type: object\nproperties: {'a[b]': {}}", "brackets in a property"},
+		//7
+		{"type: array\nitems: {type: number, min: 2, max: 1}", "bad item constraints"},
+		//8
+		{"type: object\nproperties: {a: {}}\nmin_length: 1", "length on an object"},
+		//9
+		{"type: array\nitems: {}\nregex: x", "regex on an array"},
+	}
+	for i, td := range testData {
+		pYaml := &ParamYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), pYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if _, err := newParam(pYaml); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+	}
+}
+
+func TestNestedParams(t *testing.T) {
+	serverYaml, err := os.Open("testdata/nested.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	var typed Values
+	var params map[string]string
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				params, typed = p, TypedParams(r)
+				return true, nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		target      string
+		body        *string
+		contentType string
+		expCode     int
+		exp         Values
+		msg         string
+	}{
+		//0
+		{
+			"http://example.com/search?filter[county]=Kern&filter[year]=1952&sort[0]=DATE",
+			nil, "", http.StatusOK,
+			Values{
+				"filter": Values{"county": "Kern", "year": int64(1952)},
+				"sort":   []interface{}{"date"},
+			},
+			"bracket notation",
+		},
+		//1
+		{
+			"http://example.com/search?filter[county]=Inyo&sort[]=apn&sort[]=date",
+			nil, "", http.StatusOK,
+			Values{
+				"filter": Values{"county": "Inyo"},
+				"sort":   []interface{}{"apn", "date"},
+			},
+			"appended array values",
+		},
+		//2
+		{
+			"http://example.com/search?filter[county]=Kern&filter[range][from]=2020-01-01&filter[range][to]=2021-01-01",
+			nil, "", http.StatusOK,
+			Values{
+				"filter": Values{
+					"county": "Kern",
+					"range": Values{
+						"from": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+						"to":   time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+				},
+			},
+			"nested objects",
+		},
+		//3
+		{
+			"http://example.com/search?filter[county]=Fresno", nil, "",
+			http.StatusBadRequest, nil, "nested enum",
+		},
+		//4
+		{
+			"http://example.com/search?filter[year]=1952", nil, "",
+			http.StatusBadRequest, nil, "missing required property",
+		},
+		//5
+		{
+			"http://example.com/search?filter[county]=Kern&filter[town]=Taft", nil, "",
+			http.StatusBadRequest, nil, "unknown property",
+		},
+		//6
+		{
+			"http://example.com/search?filter=Kern", nil, "",
+			http.StatusBadRequest, nil, "object without brackets",
+		},
+		//7
+		{
+			"http://example.com/search?filter[county]=Kern&sort[]=date&sort[]=apn&sort[]=date",
+			nil, "", http.StatusBadRequest, nil, "too many items",
+		},
+		//8
+		{
+			"http://example.com/search?filter[county]=Kern&sort[x]=date", nil, "",
+			http.StatusBadRequest, nil, "non numeric index",
+		},
+		//9
+		{
+			"http://example.com/search", nil, "",
+			http.StatusBadRequest, nil, "required object missing",
+		},
+		//10
+		{
+			"http://example.com/search",
+			util.Ptr(`{"filter": {"county": "Kern", "year": 1952, "range": null}, "sort": ["Apn"]}`),
+			"application/json", http.StatusOK,
+			Values{
+				"filter": Values{"county": "Kern", "year": int64(1952)},
+				"sort":   []interface{}{"apn"},
+			},
+			"json body",
+		},
+		//11
+		{
+			"http://example.com/search", util.Ptr(`["not", "an", "object"]`),
+			"application/json", http.StatusBadRequest, nil, "json array body",
+		},
+		//12
+		{
+			"http://example.com/search", util.Ptr(`{"filter": {"county": ["Kern"]}}`),
+			"application/json", http.StatusBadRequest, nil, "json array for a scalar",
+		},
+		//13
+		{
+			"http://example.com/search", util.Ptr(`filter[county]=Kern&sort[1]=apn`),
+			"application/x-www-form-urlencoded", http.StatusOK,
+			Values{
+				"filter": Values{"county": "Kern"},
+				"sort":   []interface{}{"apn"},
+			},
+			"form body",
+		},
+		//14
+		{
+			"http://example.com/search",
+			util.Ptr(`{"filter": {"county": "` + strings.Repeat("x", int(maxJSONBodyBytes)) + `"}}`),
+			"application/json", http.StatusRequestEntityTooLarge, nil, "json body too large",
+		},
+		//15
+		{
+			"http://example.com/search?filter[county]=Kern&sort[01]=date", nil, "",
+			http.StatusBadRequest, nil, "leading zero index",
+		},
+		//16
+		{
+			"http://example.com/search?filter[county]=Kern&sort[01]=date&sort[1]=apn", nil, "",
+			http.StatusBadRequest, nil, "index colliding once parsed",
+		},
+	}
+	for i, td := range testData {
+		typed, params = nil, nil
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if td.body != nil {
+			r = httptest.NewRequest("POST", td.target, strings.NewReader(*td.body))
+			r.Header.Set("Content-Type", td.contentType)
+		} else {
+			r = httptest.NewRequest("GET", td.target, nil)
+		}
+		testServer.pathHandlers["/search"].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		if td.exp == nil {
+			continue
+		}
+		if !reflect.DeepEqual(typed, td.exp) {
+			t.Errorf(getTestMessage(i, td.msg, "exp: %#v, got: %#v", td.exp, typed))
+		}
+		if _, ok := params["filter[county]"]; !ok {
+			t.Errorf(getTestMessage(i, td.msg, "bracket keys missing: %v", params))
+		}
+	}
+}
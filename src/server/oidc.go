@@ -0,0 +1,515 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+OpenID Connect logins, the authorization code flow with PKCE. NewOIDC reads
+the provider's discovery document and its Login, Callback and Logout are
+callbacks to hand NewServer, eg
+
+	sso, err := server.NewOIDC(ctx, server.OIDCConfig{
+		Issuer:      "https://idp.example.com",
+		ClientID:    "landtitle",
+		RedirectURL: "https://landtitle.example.com/auth/callback",
+	})
+	callbacks["login"] = sso.Login
+	callbacks["login_callback"] = sso.Callback
+	callbacks["logout"] = sso.Logout
+
+with routes
+
+	/auth/login:
+	  auth: []
+	  unknown_params: ignore
+	  callbacks: [login]
+	/auth/callback:
+	  auth: []
+	  unknown_params: ignore
+	  callbacks: [login_callback]
+	/auth/logout:
+	  methods: [post]
+	  csrf: true
+	  callbacks: [logout]
+
+the server needs WithSessions, the flow's state and who logged in are kept
+in the session. Login takes an optional return_to path to come back to
+afterwards. Once the id token checks out the session is rotated and the
+principal saved in it, routes pick it up with a session auth scheme
+
+	auth:
+	  schemes:
+	    sso:
+	      type: session
+	      roles_claim: groups
+*/
+
+const (
+	defOIDCTimeout         time.Duration = 10 * time.Second
+	oidcKeysRefetchBackoff time.Duration = time.Minute
+	oidcDiscoveryPath      string        = "/.well-known/openid-configuration"
+	//pending login, cleared by the callback
+	oidcStateKey    string = "_oidc_state"
+	oidcNonceKey    string = "_oidc_nonce"
+	oidcVerifierKey string = "_oidc_verifier"
+	oidcReturnKey   string = "_oidc_return"
+	//kept for the logout's id_token_hint
+	oidcIDTokenKey string = "_oidc_id_token"
+	//the logged in principal, see sessionScheme
+	sessionPrincipalKey string = "_principal"
+)
+
+// How NewOIDC talks to the provider, Issuer, ClientID and RedirectURL are
+// required
+type OIDCConfig struct {
+	//discovery is read from Issuer/.well-known/openid-configuration
+	Issuer   string
+	ClientID string
+	//empty for public clients, PKCE is used either way
+	ClientSecret string
+	//the absolute url of the route running Callback, as registered with
+	//the provider
+	RedirectURL string
+	//openid is always asked for, profile and email by default
+	Scopes []string
+	//where Callback sends the browser without a return_to, / by default
+	AfterLogin string
+	//where Logout sends the browser, or has the provider send it back
+	//to, / by default
+	AfterLogout string
+	//defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// OIDC is a provider read by NewOIDC, see Login, Callback and Logout
+type OIDC struct {
+	config    OIDCConfig
+	client    *http.Client
+	discovery *oidcDiscovery
+
+	mu          sync.Mutex
+	verifier    *jwtVerifier
+	keysFetched time.Time
+}
+
+// NewOIDC reads the provider's discovery document and keys
+func NewOIDC(ctx context.Context, c OIDCConfig) (*OIDC, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc needs an issuer, client id and redirect url")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("oidc redirect url must be absolute, got: '%s'", c.RedirectURL)
+	}
+	if c.AfterLogin == "" {
+		c.AfterLogin = "/"
+	}
+	if c.AfterLogout == "" {
+		c.AfterLogout = "/"
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"profile", "email"}
+	}
+	toRet := &OIDC{config: c, client: c.HTTPClient}
+	if toRet.client == nil {
+		toRet.client = &http.Client{Timeout: defOIDCTimeout}
+	}
+	discovery := &oidcDiscovery{}
+	if err := toRet.getJSON(
+		ctx, strings.TrimSuffix(c.Issuer, "/")+oidcDiscoveryPath, discovery,
+	); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	//the document has to be the issuer's own, OpenID Connect Discovery 4.3
+	if discovery.Issuer != c.Issuer {
+		return nil, fmt.Errorf(
+			"oidc discovery issuer '%s' doesn't match '%s'", discovery.Issuer, c.Issuer,
+		)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" ||
+		discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery is missing endpoints")
+	}
+	toRet.discovery = discovery
+	if err := toRet.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	return toRet, nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, target string, toFill interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("'%s' answered %d", target, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(toFill)
+}
+
+// RS256 unless the provider says otherwise, never none or the HMACs, the
+// client secret isn't something the provider should be signing with
+func (o *OIDC) algorithms() (map[jwtAlgorithm]bool, error) {
+	toRet := make(map[jwtAlgorithm]bool)
+	for _, a := range o.discovery.SigningAlgorithms {
+		alg, err := newJWTAlgorithm(a)
+		if err != nil || strings.HasPrefix(a, "HS") {
+			continue
+		}
+		toRet[*alg] = true
+	}
+	if len(o.discovery.SigningAlgorithms) == 0 {
+		toRet[rs256] = true
+	}
+	if len(toRet) == 0 {
+		return nil, fmt.Errorf(
+			"oidc provider signs with none of the supported algorithms: %v",
+			o.discovery.SigningAlgorithms,
+		)
+	}
+	return toRet, nil
+}
+
+func (o *OIDC) fetchKeys(ctx context.Context) error {
+	var raw json.RawMessage
+	if err := o.getJSON(ctx, o.discovery.JWKSURI, &raw); err != nil {
+		return fmt.Errorf("oidc jwks fetch failed: %w", err)
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return fmt.Errorf("oidc jwks: %w", err)
+	}
+	algorithms, err := o.algorithms()
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.verifier = &jwtVerifier{
+		keys:       keys,
+		algorithms: algorithms,
+		issuer:     o.discovery.Issuer,
+		audience:   o.config.ClientID,
+		leeway:     defJWTLeeway,
+		now:        time.Now,
+	}
+	o.keysFetched = time.Now()
+	return nil
+}
+
+// a signature that doesn't check out might be from a key the provider
+// rotated in since, the keys are fetched again at most once a minute
+func (o *OIDC) verifyIDToken(
+	ctx context.Context, token string,
+) (map[string]interface{}, error) {
+	o.mu.Lock()
+	verifier, fetched := o.verifier, o.keysFetched
+	o.mu.Unlock()
+	claims, err := verifier.verify(token)
+	if err == nil || !errors.Is(err, errBadSignature) ||
+		time.Since(fetched) < oidcKeysRefetchBackoff {
+		return claims, err
+	}
+	if fetchErr := o.fetchKeys(ctx); fetchErr != nil {
+		myLogger.Warnf("failed refetching oidc keys with error: '%s'", fetchErr)
+		return nil, err
+	}
+	o.mu.Lock()
+	verifier = o.verifier
+	o.mu.Unlock()
+	return verifier.verify(token)
+}
+
+// only paths on this site, //host and /\host are other sites to browsers,
+// which also drop tabs and newlines, so /<tab>/host is too
+func localPath(p string) bool {
+	for _, c := range p {
+		if c < ' ' || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+	if strings.HasPrefix(p, "//") {
+		return false
+	}
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme == "" && u.Host == "" &&
+		strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//")
+}
+
+func oidcError(w http.ResponseWriter, code int, err error) (bool, error) {
+	http.Error(w, http.StatusText(code), code)
+	return false, err
+}
+
+// Login sends the browser to the provider, a callback for routes.yaml
+func (o *OIDC) Login(
+	p map[string]string, w http.ResponseWriter, r *http.Request,
+) (bool, error) {
+	s := RequestSession(r)
+	if s == nil {
+		return oidcError(
+			w, http.StatusInternalServerError, fmt.Errorf("oidc login needs WithSessions"),
+		)
+	}
+	state := randomToken(csrfTokenLen)
+	nonce := randomToken(csrfTokenLen)
+	//RFC 7636 4.1, 43 to 128 characters
+	verifier := randomToken(sessionIDLen)
+	s.Set(oidcStateKey, state)
+	s.Set(oidcNonceKey, nonce)
+	s.Set(oidcVerifierKey, verifier)
+	if back := r.URL.Query().Get("return_to"); localPath(back) {
+		s.Set(oidcReturnKey, back)
+	} else {
+		s.Delete(oidcReturnKey)
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	target, err := url.Parse(o.discovery.AuthorizationEndpoint)
+	if err != nil {
+		return oidcError(w, http.StatusInternalServerError, err)
+	}
+	q := target.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", o.config.ClientID)
+	q.Set("redirect_uri", o.config.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, o.config.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	target.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusFound)
+	return true, nil
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (o *OIDC) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if o.config.ClientSecret == "" {
+		form.Set("client_id", o.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, o.discovery.TokenEndpoint, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		//client_secret_basic, RFC 6749 2.3.1 wants both form encoded first
+		req.SetBasicAuth(
+			url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret),
+		)
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	tokens := &oidcTokenResponse{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(tokens); err != nil {
+		return "", fmt.Errorf("token endpoint answered %d with a bad body: %w", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf(
+			"token endpoint answered %d: '%s' '%s'",
+			res.StatusCode, tokens.Error, tokens.ErrorDescription,
+		)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint didn't return an id token")
+	}
+	return tokens.IDToken, nil
+}
+
+type sessionPrincipal struct {
+	Subject string                 `json:"sub"`
+	Claims  map[string]interface{} `json:"claims"`
+}
+
+// Callback finishes the login the provider sent the browser back from, a
+// callback for the route RedirectURL points at
+func (o *OIDC) Callback(
+	p map[string]string, w http.ResponseWriter, r *http.Request,
+) (bool, error) {
+	s := RequestSession(r)
+	if s == nil {
+		return oidcError(
+			w, http.StatusInternalServerError, fmt.Errorf("oidc callback needs WithSessions"),
+		)
+	}
+	q := r.URL.Query()
+	state, _ := s.Get(oidcStateKey)
+	nonce, _ := s.Get(oidcNonceKey)
+	verifier, _ := s.Get(oidcVerifierKey)
+	back, _ := s.Get(oidcReturnKey)
+	//one go per login whatever happens
+	for _, k := range []string{oidcStateKey, oidcNonceKey, oidcVerifierKey, oidcReturnKey} {
+		s.Delete(k)
+	}
+	if state == "" ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		return oidcError(w, http.StatusBadRequest, fmt.Errorf("oidc state doesn't match"))
+	}
+	if e := q.Get("error"); e != "" {
+		return oidcError(
+			w, http.StatusBadRequest,
+			fmt.Errorf("oidc provider refused the login: '%s' '%s'", e, q.Get("error_description")),
+		)
+	}
+	if q.Get("code") == "" {
+		return oidcError(w, http.StatusBadRequest, fmt.Errorf("oidc callback without a code"))
+	}
+	idToken, err := o.exchange(r.Context(), q.Get("code"), verifier)
+	if err != nil {
+		return oidcError(w, http.StatusBadGateway, err)
+	}
+	claims, err := o.verifyIDToken(r.Context(), idToken)
+	if err != nil {
+		return oidcError(w, http.StatusBadGateway, fmt.Errorf("oidc id token: %w", err))
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare(
+		[]byte(got), []byte(nonce),
+	) != 1 {
+		return oidcError(w, http.StatusBadGateway, fmt.Errorf("oidc id token nonce doesn't match"))
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return oidcError(w, http.StatusBadGateway, fmt.Errorf("oidc id token has no sub"))
+	}
+	principal, err := json.Marshal(&sessionPrincipal{Subject: sub, Claims: claims})
+	if err != nil {
+		return oidcError(w, http.StatusInternalServerError, err)
+	}
+	s.Rotate()
+	s.Set(sessionPrincipalKey, string(principal))
+	s.Set(oidcIDTokenKey, idToken)
+	myLogger.Debugf("oidc login for '%s'", sub)
+	if back == "" {
+		back = o.config.AfterLogin
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, back, http.StatusFound)
+	return true, nil
+}
+
+// Logout ends the session and, when the provider has an end session
+// endpoint, the provider's too
+func (o *OIDC) Logout(
+	p map[string]string, w http.ResponseWriter, r *http.Request,
+) (bool, error) {
+	target := o.config.AfterLogout
+	s := RequestSession(r)
+	if s == nil {
+		return oidcError(
+			w, http.StatusInternalServerError, fmt.Errorf("oidc logout needs WithSessions"),
+		)
+	}
+	idToken, _ := s.Get(oidcIDTokenKey)
+	s.Destroy()
+	if end, err := url.Parse(o.discovery.EndSessionEndpoint); err == nil && end.IsAbs() {
+		q := end.Query()
+		q.Set("client_id", o.config.ClientID)
+		if idToken != "" {
+			q.Set("id_token_hint", idToken)
+		}
+		//the provider wants it absolute, relative to where the login came back to
+		if redirect, err := url.Parse(o.config.RedirectURL); err == nil {
+			if after, err := redirect.Parse(o.config.AfterLogout); err == nil {
+				q.Set("post_logout_redirect_uri", after.String())
+			}
+		}
+		end.RawQuery = q.Encode()
+		target = end.String()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+	return true, nil
+}
+
+// the principal an oidc login left in the request's session, roles and
+// permissions come from its claims like a jwt's
+type sessionScheme struct {
+	name             string
+	rolesClaim       string
+	permissionsClaim string
+}
+
+func newSessionScheme(name string, s *AuthSchemeYaml) (*sessionScheme, error) {
+	return &sessionScheme{
+		name:             name,
+		rolesClaim:       s.RolesClaim,
+		permissionsClaim: s.PermissionsClaim,
+	}, nil
+}
+
+func (s *sessionScheme) authenticate(r *http.Request) (*Principal, error) {
+	session := RequestSession(r)
+	if session == nil {
+		return nil, errNoCredentials
+	}
+	raw, ok := session.Get(sessionPrincipalKey)
+	if !ok {
+		return nil, errNoCredentials
+	}
+	saved := &sessionPrincipal{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(saved); err != nil {
+		return nil, fmt.Errorf("session principal is corrupt: %w", err)
+	}
+	toRet := &Principal{
+		Subject: saved.Subject,
+		Scheme:  s.name,
+		Claims:  saved.Claims,
+	}
+	toRet.Roles, toRet.Permissions = claimsAccess(
+		saved.Claims, s.rolesClaim, s.permissionsClaim,
+	)
+	return toRet, nil
+}
+
+// browsers don't answer challenges, logging in is up to the login route
+func (s *sessionScheme) challenge(err error) string {
+	return ""
+}
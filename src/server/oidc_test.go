@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"landtitle/server/oidctest"
+)
+
+// follows one redirect to the fake provider and returns where it sends
+// the browser back to, as a path and query on this server
+func followIdP(t *testing.T, location string) string {
+	t.Helper()
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(location)
+	if err != nil {
+		t.Fatalf("failed calling the provider with error: '%s'", err)
+	}
+	res.Body.Close()
+	back, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || res.StatusCode != http.StatusFound {
+		t.Fatalf("exp a redirect back from the provider, got: %d '%s'", res.StatusCode, back)
+	}
+	return back.RequestURI()
+}
+
+func TestOIDC(t *testing.T) {
+	idp := oidctest.NewIdP("landtitle", "s3cret")
+	defer idp.Close()
+	idp.SignIn("clerk@example.com", map[string]interface{}{"groups": []string{"clerk"}})
+	if _, err := NewOIDC(context.Background(), OIDCConfig{
+		Issuer: idp.URL + "/other", ClientID: "landtitle", RedirectURL: "http://a/cb",
+	}); err == nil {
+		t.Errorf("expected an error for an issuer without discovery")
+	}
+	if _, err := NewOIDC(context.Background(), OIDCConfig{
+		Issuer: idp.URL, ClientID: "landtitle", RedirectURL: "/cb",
+	}); err == nil {
+		t.Errorf("expected an error for a relative redirect url")
+	}
+	sso, err := NewOIDC(context.Background(), OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "landtitle",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://example.com/auth/callback",
+	})
+	if err != nil {
+		t.Fatalf("failed creating oidc with error: '%s'", err)
+	}
+	tmpServer, err := NewServer(
+		strings.NewReader(`auth:
+  default: [sso]
+  schemes:
+    sso:
+      type: session
+      roles_claim: groups
+/auth/login:
+  auth: []
+  unknown_params: ignore
+  callbacks: [login]
+/auth/callback:
+  auth: []
+  unknown_params: ignore
+  callbacks: [callback]
+/auth/logout:
+  callbacks: [logout]
+/records:
+  roles: [clerk]
+  callbacks: [who]
+`),
+		map[string]Callback{
+			"login":    sso.Login,
+			"callback": sso.Callback,
+			"logout":   sso.Logout,
+			"who": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				w.Header().Set("X-Principal", RequestPrincipal(r).Subject)
+				return true, nil
+			},
+		},
+		WithSessions(SessionConfig{Keys: [][]byte{testSessionKey}}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	b := &testBrowser{handler: mux, cookies: make(map[string]*http.Cookie)}
+
+	w := b.do(http.MethodGet, "/records", nil, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("exp 401 before logging in, got: %d", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != "" {
+		t.Errorf("exp no challenge for a session scheme, got: '%s'", got)
+	}
+	w = b.do(http.MethodGet, "/auth/login?return_to=/records", nil, nil)
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), idp.URL) {
+		t.Fatalf("exp a redirect to the provider, got: %d '%s'", w.Code, w.Header().Get("Location"))
+	}
+	preLogin := b.cookies[defSessionCookie].Value
+	callback := followIdP(t, w.Header().Get("Location"))
+	if w = b.do(http.MethodGet, callback, nil, nil); w.Code != http.StatusFound ||
+		w.Header().Get("Location") != "/records" {
+		t.Fatalf("exp a redirect to return_to, got: %d '%s'", w.Code, w.Header().Get("Location"))
+	}
+	if b.cookies[defSessionCookie].Value == preLogin {
+		t.Errorf("exp the session rotated on login")
+	}
+	w = b.do(http.MethodGet, "/records", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Principal") != "clerk@example.com" {
+		t.Errorf("exp the logged in clerk, got: %d '%s'", w.Code, w.Header().Get("X-Principal"))
+	}
+	//codes and state are good for one go
+	if w = b.do(http.MethodGet, callback, nil, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("exp a replayed callback refused, got: %d", w.Code)
+	}
+
+	//a login someone else started doesn't match this session's state
+	other := &testBrowser{handler: mux, cookies: make(map[string]*http.Cookie)}
+	w = other.do(http.MethodGet, "/auth/login", nil, nil)
+	forged := followIdP(t, w.Header().Get("Location"))
+	if w = b.do(http.MethodGet, forged, nil, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("exp a forged callback refused, got: %d", w.Code)
+	}
+
+	//off site return_to is ignored
+	w = other.do(http.MethodGet, "/auth/login?return_to=//evil.example.com", nil, nil)
+	w = other.do(http.MethodGet, followIdP(t, w.Header().Get("Location")), nil, nil)
+	if w.Header().Get("Location") != "/" {
+		t.Errorf("exp the default after login, got: '%s'", w.Header().Get("Location"))
+	}
+	idp.SignIn("visitor", nil)
+	w = other.do(http.MethodGet, "/auth/login", nil, nil)
+	other.do(http.MethodGet, followIdP(t, w.Header().Get("Location")), nil, nil)
+	if w = other.do(http.MethodGet, "/records", nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("exp 403 without the clerk role, got: %d", w.Code)
+	}
+
+	w = b.do(http.MethodGet, "/auth/logout", nil, nil)
+	end, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(end.String(), idp.URL+"/logout") ||
+		end.Query().Get("id_token_hint") == "" ||
+		end.Query().Get("post_logout_redirect_uri") != "http://example.com/" {
+		t.Errorf("exp a redirect to end the provider's session, got: '%s'", end)
+	}
+	if w = b.do(http.MethodGet, "/records", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("exp 401 after logging out, got: %d", w.Code)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	testData := []struct {
+		returnTo string
+		exp      bool
+		msg      string
+	}{
+		//0
+		{"/records", true, "local"},
+		//1
+		{"/records?page=2#top", true, "query and fragment"},
+		//2
+		{"//evil.com", false, "other host"},
+		//3
+		{"/%5C/evil.com", false, "escaped backslash"},
+		//4
+		{"/%09/evil.com", false, "escaped tab"},
+		//5
+		{"/\t/evil.com", false, "tab"},
+		//6
+		{"/\r\n//evil.com", false, "newline"},
+		//7
+		{"https://evil.com/", false, "absolute"},
+		//8
+		{"records", false, "relative"},
+		//9
+		{"", false, "empty"},
+	}
+	for i, td := range testData {
+		//as the login callback gets it
+		query, err := url.ParseQuery("return_to=" + strings.ReplaceAll(td.returnTo, "#", "%23"))
+		if err != nil {
+			t.Fatalf(getTestMessage(i, td.msg, "bad test query: '%s'", err))
+		}
+		if got := localPath(query.Get("return_to")); got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp local: %t, got: %t", td.exp, got))
+		}
+	}
+}
@@ -0,0 +1,268 @@
+/*
+An OpenID provider that runs in process for testing logins against, in the
+spirit of net/http/httptest. Discovery, authorize, token, jwks and end
+session endpoints, enough for the authorization code flow with PKCE.
+*/
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const keyID string = "oidctest"
+
+// IdP signs in whoever SignIn last named, user to start with, without
+// asking. It checks what a real provider would of the client: its
+// credentials, the redirect uri and the PKCE verifier, codes work once
+type IdP struct {
+	//the issuer, discovery is at URL/.well-known/openid-configuration
+	URL          string
+	ClientID     string
+	ClientSecret string
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+
+	mu      sync.Mutex
+	subject string
+	claims  map[string]interface{}
+	codes   map[string]*grant
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	subject     string
+	claims      map[string]interface{}
+}
+
+// NewIdP starts a provider for one client, an empty secret makes it a
+// public client. Close it when done
+func NewIdP(clientID, clientSecret string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: could not generate a key: '%s'", err))
+	}
+	toRet := &IdP{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		subject:      "user",
+		codes:        make(map[string]*grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", toRet.discovery)
+	mux.HandleFunc("/authorize", toRet.authorize)
+	mux.HandleFunc("/token", toRet.token)
+	mux.HandleFunc("/jwks", toRet.jwks)
+	mux.HandleFunc("/logout", toRet.logout)
+	toRet.server = httptest.NewServer(mux)
+	toRet.URL = toRet.server.URL
+	return toRet
+}
+
+// Close shuts the provider down
+func (i *IdP) Close() {
+	i.server.Close()
+}
+
+// SignIn sets who the next logins are for and the extra claims their id
+// tokens carry
+func (i *IdP) SignIn(subject string, claims map[string]interface{}) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.subject = subject
+	i.claims = claims
+}
+
+func writeJSON(w http.ResponseWriter, code int, toWrite interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(toWrite)
+}
+
+// the error response of RFC 6749 5.2
+func tokenError(w http.ResponseWriter, code int, oauthErr, desc string) {
+	writeJSON(w, code, map[string]string{"error": oauthErr, "error_description": desc})
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (i *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"end_session_endpoint":                  i.URL + "/logout",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != i.ClientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "redirect_uri must be absolute", http.StatusBadRequest)
+		return
+	}
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		back.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		back.Set("error", "invalid_request")
+		back.Set("error_description", "PKCE with S256 is required")
+	default:
+		code := randomString()
+		i.mu.Lock()
+		i.codes[code] = &grant{
+			clientID:    i.ClientID,
+			redirectURI: redirect.String(),
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			subject:     i.subject,
+			claims:      i.claims,
+		}
+		i.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != i.ClientID ||
+		subtle.ConstantTimeCompare([]byte(secret), []byte(i.ClientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "bad client credentials")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	code := r.PostForm.Get("code")
+	i.mu.Lock()
+	g, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+	if !ok {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or used code")
+		return
+	}
+	if g.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match")
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+	claims["iss"] = i.URL
+	claims["sub"] = g.subject
+	claims["aud"] = g.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	idToken, err := i.Sign(claims)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// Sign makes an RS256 token with the provider's key, for tests that need
+// tokens the provider wouldn't hand out
+func (i *IdP) Sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (i *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := i.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *IdP) logout(w http.ResponseWriter, r *http.Request) {
+	if back := r.URL.Query().Get("post_logout_redirect_uri"); back != "" {
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+	w.Write([]byte("signed out\n"))
+}
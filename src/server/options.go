@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"landtitle/tracing"
+	"strings"
+)
+
+// Options are applied in order by NewServer after the routes are loaded
+type Option func(*server) error
+
+func checkAdminPath(name, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s path must start with '/', got: '%s'", name, path)
+	}
+	return nil
+}
+
+// Exposes prometheus metrics on path, on the admin port if one is set,
+// otherwise alongside the routes
+func WithMetricsPath(path string) Option {
+	return func(s *server) error {
+		if err := checkAdminPath("metrics", path); err != nil {
+			return err
+		}
+		s.metricsPath = path
+		return nil
+	}
+}
+
+// Liveness probe on path, always 200 while the process is serving
+func WithLivenessPath(path string) Option {
+	return func(s *server) error {
+		if err := checkAdminPath("liveness", path); err != nil {
+			return err
+		}
+		s.livenessPath = path
+		return nil
+	}
+}
+
+// Readiness probe on path, 503 unless every readiness check passes
+func WithReadinessPath(path string) Option {
+	return func(s *server) error {
+		if err := checkAdminPath("readiness", path); err != nil {
+			return err
+		}
+		s.readinessPath = path
+		return nil
+	}
+}
+
+// Build info from runtime/debug.ReadBuildInfo on path
+func WithVersionPath(path string) Option {
+	return func(s *server) error {
+		if err := checkAdminPath("version", path); err != nil {
+			return err
+		}
+		s.versionPath = path
+		return nil
+	}
+}
+
+// Adds a named check to every readiness route, whether it came from
+// routes.yaml or WithReadinessPath, responses only say whether it passed,
+// the error is logged
+func WithReadinessCheck(name string, check ReadinessCheck) Option {
+	return func(s *server) error {
+		return s.readiness.add(name, check)
+	}
+}
+
+// Serves the admin endpoints on their own listener when StartServer is
+// called, each defaults to its usual path (/metrics, /healthz, /readyz,
+// /version) when no option set one
+func WithAdminPort(port int) Option {
+	return func(s *server) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid admin port: %d", port)
+		}
+		s.adminPort = &port
+		return nil
+	}
+}
+
+// Replaces the server wide limits, start from DefaultLimits, routes can
+// override most of them with limits: in routes.yaml
+func WithLimits(l Limits) Option {
+	return func(s *server) error {
+		if err := l.check(); err != nil {
+			return err
+		}
+		s.limits = &l
+		return nil
+	}
+}
+
+// Replaces the in memory store rate_limit: routes share, use one backed by
+// something shared when running more than one instance
+func WithRateLimitStore(store RateLimitStore) Option {
+	return func(s *server) error {
+		if store == nil {
+			return fmt.Errorf("rate limit store can't be nil")
+		}
+		s.limiter = store
+		return nil
+	}
+}
+
+// Turns on sessions and with them CSRF checks, see session.go
+func WithSessions(c SessionConfig) Option {
+	return func(s *server) error {
+		sessions, err := newSessionManager(c)
+		if err != nil {
+			return err
+		}
+		s.sessions = sessions
+		return nil
+	}
+}
+
+// Pages for routes with render:, see render.go
+func WithTemplates(c TemplateConfig) Option {
+	return func(s *server) error {
+		s.templateConfig = &c
+		return nil
+	}
+}
+
+// Names fsys for static: routes with fs: name, for an embed.FS use fs.Sub
+// to drop the directory it was embedded from
+func WithStaticFS(name string, fsys fs.FS) Option {
+	return func(s *server) error {
+		if fsys == nil {
+			return fmt.Errorf("static fs '%s' can't be nil", name)
+		}
+		if s.staticFS == nil {
+			s.staticFS = make(map[string]fs.FS)
+		}
+		s.staticFS[name] = fsys
+		return nil
+	}
+}
+
+// File params are streamed to sink, NewTempDirSink("") when not set
+func WithUploadSink(sink UploadSink) Option {
+	return func(s *server) error {
+		if sink == nil {
+			return fmt.Errorf("upload sink can't be nil")
+		}
+		s.uploadSink = sink
+		return nil
+	}
+}
+
+// Spans for requests, parameter parsing and callbacks go to t instead of
+// the global tracer, see tracing.SetTracer
+func WithTracer(t *tracing.Tracer) Option {
+	return func(s *server) error {
+		s.tracer = t
+		return nil
+	}
+}
+
+// Compresses responses for clients that accept it on every route, routes
+// can opt out with compress:, see compress.go
+func WithCompression(c CompressionConfig) Option {
+	return func(s *server) error {
+		s.compression = &c
+		return nil
+	}
+}
+
+// Registers an encoder for a content coding, name is what clients send in
+// Accept-Encoding, eg zstd, the built in gzip and br can be replaced
+func WithEncoder(name string, e Encoder) Option {
+	return func(s *server) error {
+		if name == "" || e == nil {
+			return fmt.Errorf("encoder needs a name and a func")
+		}
+		s.encoders[strings.ToLower(name)] = e
+		return nil
+	}
+}
+
+// Replaces the bounds on the response cache routes with cache: store
+// share, defaults to 1024 entries and 64MB of bodies
+func WithResponseCache(maxEntries int, maxBytes int64) Option {
+	return func(s *server) error {
+		if maxEntries <= 0 || maxBytes <= 0 {
+			return fmt.Errorf("response cache bounds must be positive")
+		}
+		s.responseCache = newResponseCache(maxEntries, maxBytes)
+		return nil
+	}
+}
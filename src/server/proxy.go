@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"landtitle/tracing"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+requests forwarded to an upstream in place of callbacks, the route's path
+is a prefix like static:, eg the frontend handing api calls to the
+controller
+
+	/api:
+	  timeout: 30s
+	  proxy:
+	    upstream: http://controller:8080/v1
+	    rewrite:
+	      - match: ^/deeds/(\d+)/history$
+	        replace: /history?deed=$1
+	    headers:
+	      X-Client: frontend
+	      Cookie: ""
+	    retries: 2
+
+the route's path comes off the front unless keep_prefix, rewrite: steps
+run on what's left, still escaped as the client sent it, the first that
+matches wins and its replace can add a query, then it goes on the end
+of the upstream's path, /api/deeds/7 is http://controller:8080/v1/deeds/7
+above. headers: are set on the forwarded request, an empty value removes
+the header.
+
+Forwarded requests always get
+  - X-Request-Id, the client's when it sent a sane one, also on the response
+  - X-Forwarded-For, -Host and -Proto
+  - X-Authenticated-Subject and -Roles from the principal, removed when the
+    route is public so clients can't set them
+  - traceparent, see tracing.NewTransport
+
+Bodies stream both ways, responses are flushed as they arrive so server
+sent events and ndjson work. The route's timeout: covers the whole
+exchange, 504 when it or the proxy's own timeouts run out, 502 when the
+upstream can't be reached. retries: are extra attempts for idempotent
+requests, GET, HEAD and PUT, without a body when the upstream can't be
+reached or answers 502, 503 or 504, waiting retry_backoff, doubled each
+time, in between.
+
+Bodies aren't parsed so csrf: true only takes the X-CSRF-Token header, with
+sessions on POST and PUT without it are refused before anything is
+forwarded, it's off unless the route sets it.
+*/
+
+const (
+	requestIDHeader       string        = "X-Request-Id"
+	subjectHeader                       = "X-Authenticated-Subject"
+	rolesHeader                         = "X-Authenticated-Roles"
+	defProxyConnect       time.Duration = 5 * time.Second
+	defProxyRetryBackoff                = 100 * time.Millisecond
+	maxRequestIDLen       int           = 128
+	generatedRequestIDLen               = 16
+)
+
+var requestIDRegex *regexp.Regexp = regexp.MustCompile(`^[\w.:/+=-]+$`)
+
+type ProxyYaml struct {
+	//base url, required
+	Upstream   string         `yaml:"upstream"`
+	KeepPrefix bool           `yaml:"keep_prefix,omitempty"`
+	Rewrite    []*RewriteYaml `yaml:"rewrite,omitempty"`
+	//set on forwarded requests, "" removes
+	Headers map[string]string `yaml:"headers,omitempty"`
+	//go durations, to connect, default 5s, and from sending the request to
+	//the response headers, none by default
+	ConnectTimeout  string `yaml:"connect_timeout,omitempty"`
+	ResponseTimeout string `yaml:"response_timeout,omitempty"`
+	Retries         int    `yaml:"retries,omitempty"`
+	//go duration, default 100ms
+	RetryBackoff string `yaml:"retry_backoff,omitempty"`
+}
+
+type RewriteYaml struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+type pathRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+type proxyRoute struct {
+	upstream   *url.URL
+	keepPrefix bool
+	rewrites   []*pathRewrite
+	headers    map[string]string
+	connect    time.Duration
+	//zero for none
+	response time.Duration
+	retries  int
+	backoff  time.Duration
+}
+
+func newProxyRoute(r *RouteYaml) (*route, error) {
+	p := r.Proxy
+	if r.Builtin != "" || r.Static != nil {
+		return nil, fmt.Errorf("proxy routes can't be builtin or static")
+	}
+	if len(r.Callbacks) > 0 || len(r.Params) > 0 || len(r.Rules) > 0 {
+		return nil, fmt.Errorf("proxy routes can't have callbacks, params or rules")
+	}
+	if r.Render != "" || len(r.Produces) > 0 {
+		return nil, fmt.Errorf("proxy routes can't have render or produces")
+	}
+	upstream, err := url.Parse(p.Upstream)
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") ||
+		upstream.Host == "" {
+		return nil, fmt.Errorf("proxy upstream must be an http(s) url, got: '%s'", p.Upstream)
+	}
+	if upstream.RawQuery != "" || upstream.Fragment != "" {
+		return nil, fmt.Errorf("proxy upstream can't have a query: '%s'", p.Upstream)
+	}
+	toRet := &proxyRoute{
+		upstream:   upstream,
+		keepPrefix: p.KeepPrefix,
+		headers:    make(map[string]string),
+		connect:    defProxyConnect,
+		retries:    p.Retries,
+		backoff:    defProxyRetryBackoff,
+	}
+	for _, rw := range p.Rewrite {
+		if rw == nil {
+			continue
+		}
+		match, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy rewrite match '%s': %w", rw.Match, err)
+		}
+		toRet.rewrites = append(toRet.rewrites, &pathRewrite{match, rw.Replace})
+	}
+	for k, v := range p.Headers {
+		toRet.headers[http.CanonicalHeaderKey(k)] = v
+	}
+	if p.Retries < 0 {
+		return nil, fmt.Errorf("proxy retries can't be negative")
+	}
+	for _, d := range []struct {
+		name, value string
+		dest        *time.Duration
+	}{
+		{"connect_timeout", p.ConnectTimeout, &toRet.connect},
+		{"response_timeout", p.ResponseTimeout, &toRet.response},
+		{"retry_backoff", p.RetryBackoff, &toRet.backoff},
+	} {
+		parsed, err := parseLimitDuration(d.name, d.value)
+		if err != nil {
+			return nil, err
+		}
+		if parsed != nil {
+			*d.dest = *parsed
+		}
+	}
+	methods, err := newMethods(r.Methods)
+	if err != nil {
+		return nil, err
+	}
+	//everything goes through unless the route says otherwise
+	if len(r.Methods) == 0 {
+		methods = []httpMethod{getMethod, headMethod, postMethod, putMethod}
+	}
+	limits, err := newRouteLimits(r.Limits)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := newRouteRateLimit(r.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := newConcurrencyLimiter(r.MaxConcurrent, r.Queue)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseLimitDuration("timeout", r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == nil {
+		timeout = new(time.Duration)
+	}
+	return &route{
+		methods:     methods,
+		callbacks:   []string{},
+		params:      routeParameterMap{},
+		aliases:     map[string]string{},
+		limits:      limits,
+		rateLimit:   rateLimit,
+		concurrency: concurrency,
+		timeout:     *timeout,
+		csrf:        r.CSRF,
+		proxy:       toRet,
+	}, nil
+}
+
+// the path the upstream gets, before its own path goes on the front
+// urlPath is escaped, so is what's returned, rewritten is whether a
+// rewrite matched
+func (p *proxyRoute) forwardPath(prefix, urlPath string) (string, bool) {
+	if !p.keepPrefix {
+		urlPath = strings.TrimPrefix(urlPath, prefix)
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = "/" + urlPath
+		}
+	}
+	for _, rw := range p.rewrites {
+		if rw.match.MatchString(urlPath) {
+			return rw.match.ReplaceAllString(urlPath, rw.replace), true
+		}
+	}
+	return urlPath, false
+}
+
+// the client's id when it looks like one, a new one otherwise
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(id) <= maxRequestIDLen && requestIDRegex.MatchString(id) {
+		return id
+	}
+	b := make([]byte, generatedRequestIDLen)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+		return true
+	}
+	return false
+}
+
+// retries requests that can't have had an effect on the upstream, or that
+// wouldn't matter if they did
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retry := t.retries > 0 && idempotent(req.Method) &&
+		(req.Body == nil || req.Body == http.NoBody)
+	wait := t.backoff
+	for attempt := 0; ; attempt++ {
+		res, err := t.base.RoundTrip(req)
+		if !retry || attempt >= t.retries || req.Context().Err() != nil {
+			return res, err
+		}
+		if err == nil {
+			switch res.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable,
+				http.StatusGatewayTimeout:
+				res.Body.Close()
+			default:
+				return res, nil
+			}
+		}
+		myLogger.Debugf(
+			"retrying %s '%s' after attempt %d, error: '%v'",
+			req.Method, req.URL, attempt+1, err,
+		)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		wait *= 2
+	}
+}
+
+// prefix is the route's path without a trailing slash
+func newProxyHandler(prefix string, p *proxyRoute) http.Handler {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = (&net.Dialer{
+		Timeout: p.connect, KeepAlive: 30 * time.Second,
+	}).DialContext
+	base.ResponseHeaderTimeout = p.response
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			id := requestID(pr.In)
+			escaped, rewritten := p.forwardPath(prefix, pr.In.URL.EscapedPath())
+			//a rewrite can add a query, an escaped ? from the client stays
+			//in the path
+			if path, query, ok := strings.Cut(escaped, "?"); ok && rewritten {
+				escaped = path
+				pr.Out.URL.RawQuery = joinQuery(query, pr.In.URL.RawQuery)
+			}
+			pr.Out.URL.Path, pr.Out.URL.RawPath = escaped, ""
+			if path, err := url.PathUnescape(escaped); err == nil {
+				pr.Out.URL.Path, pr.Out.URL.RawPath = path, escaped
+			}
+			pr.SetURL(p.upstream)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(requestIDHeader, id)
+			pr.Out.Header.Del(subjectHeader)
+			pr.Out.Header.Del(rolesHeader)
+			if principal := RequestPrincipal(pr.In); principal != nil {
+				pr.Out.Header.Set(subjectHeader, principal.Subject)
+				if len(principal.Roles) > 0 {
+					pr.Out.Header.Set(rolesHeader, strings.Join(principal.Roles, ","))
+				}
+			}
+			for k, v := range p.headers {
+				if v == "" {
+					pr.Out.Header.Del(k)
+					continue
+				}
+				pr.Out.Header.Set(k, v)
+			}
+		},
+		Transport: &retryTransport{
+			base:    tracing.NewTransport(base),
+			retries: p.retries,
+			backoff: p.backoff,
+		},
+		FlushInterval: -1,
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Set(requestIDHeader, res.Request.Header.Get(requestIDHeader))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) ||
+				(errors.As(err, &netErr) && netErr.Timeout()) {
+				myLogger.Errorf("proxy to '%s' timed out: '%s'", p.upstream, err)
+				Error(w, r, http.StatusGatewayTimeout, "")
+				return
+			}
+			if errors.Is(err, context.Canceled) {
+				myLogger.Debugf("client went away during proxy to '%s'", p.upstream)
+				return
+			}
+			myLogger.Errorf("proxy to '%s' failed with error: '%s'", p.upstream, err)
+			Error(w, r, http.StatusBadGateway, "")
+		},
+	}
+}
+
+func joinQuery(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "&" + b
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// what the upstream saw of a forwarded request
+type proxiedRequest struct {
+	Path    string
+	Query   string
+	Body    string
+	Headers map[string]string
+}
+
+func TestServerProxy(t *testing.T) {
+	var flaky atomic.Int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/flaky"):
+			if flaky.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case strings.HasSuffix(r.URL.Path, "/slow"):
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		case strings.HasSuffix(r.URL.Path, "/stream"):
+			w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("second\n"))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		seen := proxiedRequest{
+			Path: r.URL.EscapedPath(), Query: r.URL.RawQuery, Body: string(body),
+			Headers: map[string]string{},
+		}
+		for _, k := range []string{
+			requestIDHeader, subjectHeader, rolesHeader, "X-Client", "Cookie",
+			"X-Forwarded-For", "X-Forwarded-Host",
+		} {
+			seen.Headers[k] = r.Header.Get(k)
+		}
+		json.NewEncoder(w).Encode(seen)
+	}))
+	defer upstream.Close()
+	keys := writeTestFile(t, t.TempDir(), "api_keys", []byte("ci:k3y\n"))
+	tmpServer, err := NewServer(
+		strings.NewReader(fmt.Sprintf(`auth:
+  schemes:
+    keys:
+      type: api_key
+      header: X-Api-Key
+      keys_file: %s
+      grants:
+        ci:
+          roles: [clerk, auditor]
+/api:
+  proxy:
+    upstream: %s/v1
+    rewrite:
+      - match: ^/old/(\w+)$
+        replace: /echo/$1?legacy=1
+    headers:
+      x-client: frontend
+      Cookie: ""
+    retries: 2
+    retry_backoff: 1ms
+/private:
+  auth: [keys]
+  proxy:
+    upstream: %s
+    keep_prefix: true
+/slow:
+  timeout: 50ms
+  proxy:
+    upstream: %s
+/down:
+  proxy:
+    upstream: http://127.0.0.1:1
+    retries: 1
+    retry_backoff: 1ms
+`, keys, upstream.URL, upstream.URL, upstream.URL)),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	front := httptest.NewServer(mux)
+	defer front.Close()
+
+	testData := []struct {
+		method   string
+		target   string
+		body     string
+		header   http.Header
+		expCode  int
+		expSeen  *proxiedRequest
+		expExtra func(*http.Response, *proxiedRequest) string
+		msg      string
+	}{
+		//0
+		{
+			http.MethodGet, "/api/deeds/7?a=1", "", http.Header{"Cookie": {"s=1"}},
+			http.StatusOK,
+			&proxiedRequest{Path: "/v1/deeds/7", Query: "a=1", Headers: map[string]string{
+				"X-Client": "frontend", "Cookie": "", "X-Forwarded-For": "127.0.0.1",
+			}},
+			func(res *http.Response, seen *proxiedRequest) string {
+				if len(seen.Headers[requestIDHeader]) != 2*generatedRequestIDLen ||
+					res.Header.Get(requestIDHeader) != seen.Headers[requestIDHeader] {
+					return "exp a generated request id on both sides"
+				}
+				return ""
+			},
+			"prefix stripped, headers set and removed",
+		},
+		//1
+		{
+			http.MethodPost, "/api/old/deed?b=2", "name=a", nil, http.StatusOK,
+			&proxiedRequest{Path: "/v1/echo/deed", Query: "legacy=1&b=2", Body: "name=a"},
+			nil, "rewrite with a body",
+		},
+		//2
+		{
+			http.MethodGet, "/api/x", "",
+			http.Header{requestIDHeader: {"abc-123"}, subjectHeader: {"root"}},
+			http.StatusOK,
+			&proxiedRequest{Path: "/v1/x", Headers: map[string]string{
+				requestIDHeader: "abc-123", subjectHeader: "",
+			}},
+			nil, "client request id kept, identity not spoofable",
+		},
+		//3
+		{
+			http.MethodGet, "/api/x", "", http.Header{requestIDHeader: {"a b"}},
+			http.StatusOK, nil,
+			func(res *http.Response, seen *proxiedRequest) string {
+				if seen.Headers[requestIDHeader] == "a b" {
+					return "exp a bad request id replaced"
+				}
+				return ""
+			},
+			"bad request id",
+		},
+		//4
+		{
+			http.MethodGet, "/private/x", "", http.Header{"X-Api-Key": {"k3y"}}, http.StatusOK,
+			&proxiedRequest{Path: "/private/x", Headers: map[string]string{
+				subjectHeader: "ci", rolesHeader: "clerk,auditor",
+			}},
+			nil, "identity and keep_prefix",
+		},
+		//5
+		{http.MethodGet, "/private/x", "", nil, http.StatusUnauthorized, nil, nil, "auth"},
+		//6
+		{http.MethodGet, "/api/flaky", "", nil, http.StatusOK, nil, nil, "retried"},
+		//7
+		{http.MethodGet, "/slow/slow", "", nil, http.StatusGatewayTimeout, nil, nil, "timeout"},
+		//8
+		{http.MethodGet, "/down/x", "", nil, http.StatusBadGateway, nil, nil, "unreachable"},
+		//9
+		{
+			http.MethodGet, "/api/deeds%3Fadmin=1", "", nil, http.StatusOK,
+			&proxiedRequest{Path: "/v1/deeds%3Fadmin=1"}, nil, "escaped ? stays in the path",
+		},
+		//10
+		{
+			http.MethodGet, "/api/a%2Fb", "", nil, http.StatusOK,
+			&proxiedRequest{Path: "/v1/a%2Fb"}, nil, "escaped / stays escaped",
+		},
+	}
+	for i, td := range testData {
+		req, _ := http.NewRequest(td.method, front.URL+td.target, strings.NewReader(td.body))
+		for k, vals := range td.header {
+			req.Header[k] = vals
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf(getTestMessage(i, td.msg, "request failed with error: '%s'", err))
+		}
+		var seen proxiedRequest
+		json.NewDecoder(res.Body).Decode(&seen)
+		res.Body.Close()
+		if res.StatusCode != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, res.StatusCode))
+		}
+		if td.expSeen != nil {
+			if seen.Path != td.expSeen.Path || seen.Query != td.expSeen.Query ||
+				seen.Body != td.expSeen.Body {
+				t.Errorf(getTestMessage(i, td.msg, "exp: %+v, got: %+v", td.expSeen, seen))
+			}
+			for k, v := range td.expSeen.Headers {
+				if seen.Headers[k] != v {
+					t.Errorf(getTestMessage(
+						i, td.msg, "exp %s: '%s', got: '%s'", k, v, seen.Headers[k],
+					))
+				}
+			}
+		}
+		if td.expExtra != nil {
+			if msg := td.expExtra(res, &seen); msg != "" {
+				t.Errorf(getTestMessage(i, td.msg, msg))
+			}
+		}
+	}
+
+	//a post isn't retried
+	flaky.Store(0)
+	res, err := http.Post(front.URL+"/api/flaky", "text/plain", strings.NewReader("x"))
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("exp the post's 503 passed on, got: %v '%v'", res, err)
+	}
+	res.Body.Close()
+
+	//the first line arrives before the upstream is done
+	res, err = http.Get(front.URL + "/api/stream")
+	if err != nil {
+		t.Fatalf("stream failed with error: '%s'", err)
+	}
+	defer res.Body.Close()
+	lines := bufio.NewReader(res.Body)
+	if line, err := lines.ReadString('\n'); err != nil || line != "first\n" {
+		t.Errorf("exp the first line streamed, got: '%s' '%v'", line, err)
+	}
+	close(release)
+	if line, _ := lines.ReadString('\n'); line != "second\n" {
+		t.Errorf("exp the second line, got: '%s'", line)
+	}
+}
+
+func TestProxyLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  proxy:\n    upstream: http://b:8080/v1\n", false, "valid"},
+		//1
+		{"/a:\n  proxy: {}\n", true, "no upstream"},
+		//2
+		{"/a:\n  proxy:\n    upstream: /v1\n", true, "relative upstream"},
+		//3
+		{"/a:\n  proxy:\n    upstream: http://b?x=1\n", true, "upstream query"},
+		//4
+		{
+			"/a:\n  proxy:\n    upstream: http://b\n    rewrite:\n      - match: '('\n",
+			true, "bad rewrite",
+		},
+		//5
+		{"/a:\n  proxy:\n    upstream: http://b\n    retries: -1\n", true, "negative retries"},
+		//6
+		{"/a:\n  proxy:\n    upstream: http://b\n    retry_backoff: x\n", true, "bad backoff"},
+		//7
+		{"/a:\n  callbacks: [cb1]\n  proxy:\n    upstream: http://b\n", true, "callbacks"},
+		//8
+		{"/a/{id}:\n  proxy:\n    upstream: http://b\n", true, "dynamic path"},
+		//9
+		{
+			"/a:\n  static:\n    dir: .\n  proxy:\n    upstream: http://b\n", true,
+			"static too",
+		},
+	}
+	for i, td := range testData {
+		_, err := NewServer(strings.NewReader(td.yamlString), nil)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
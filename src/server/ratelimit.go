@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+per client rate limits, eg
+
+	/rekognition:
+	  rate_limit:
+	    algorithm: token_bucket
+	    requests: 10
+	    per: 1m
+	    burst: 20
+	    key: header:X-Api-Key
+
+key is ip (the default), header:<name> or param:<name>, requests missing
+the header or param are limited by ip instead. The ip is the connection's,
+X-Forwarded-For and friends are never trusted. Each route counts
+separately, state lives in the server's RateLimitStore, see
+WithRateLimitStore.
+*/
+
+type RateLimitAlgorithm string
+
+const (
+	// refills requests tokens every per, up to burst
+	TokenBucket RateLimitAlgorithm = "token_bucket"
+	// requests per rolling per, weighted over the previous window
+	SlidingWindow         RateLimitAlgorithm = "sliding_window"
+	defRateLimitAlgorithm                    = TokenBucket
+)
+
+func newRateLimitAlgorithm(a string) (*RateLimitAlgorithm, error) {
+	if a == "" {
+		a = string(defRateLimitAlgorithm)
+	}
+	toRet := RateLimitAlgorithm(a)
+	switch toRet {
+	case TokenBucket:
+		fallthrough
+	case SlidingWindow:
+		return &toRet, nil
+	}
+	return nil, fmt.Errorf("unrecognized rate limit algorithm: '%s'", a)
+}
+
+// what a store is asked to enforce for a key
+type RateLimit struct {
+	Algorithm RateLimitAlgorithm
+	Requests  int
+	Per       time.Duration
+	//token buckets only, at least Requests
+	Burst int
+}
+
+// A RateLimitStore keeps the count for every key, the in memory one is per
+// process, swap in a shared one when running more than one
+type RateLimitStore interface {
+	// counts a request against key, allowed is false when it's over the
+	// limit and retryAfter is how long until it wouldn't be
+	Take(ctx context.Context, key string, limit RateLimit) (
+		allowed bool, retryAfter time.Duration, err error,
+	)
+}
+
+type RateLimitYaml struct {
+	Algorithm string `yaml:"algorithm,omitempty"`
+	Requests  int    `yaml:"requests"`
+	//go duration, eg 1m
+	Per   string `yaml:"per"`
+	Burst *int   `yaml:"burst,omitempty"`
+	Key   string `yaml:"key,omitempty"`
+}
+
+type rateLimitKeyKind string
+
+const (
+	ipRateLimitKey     rateLimitKeyKind = "ip"
+	headerRateLimitKey                  = "header"
+	paramRateLimitKey                   = "param"
+)
+
+type routeRateLimit struct {
+	limit RateLimit
+	kind  rateLimitKeyKind
+	//the header or param, empty for ip
+	name string
+}
+
+func newRateLimitKey(k string) (rateLimitKeyKind, string, error) {
+	if k == "" || k == string(ipRateLimitKey) {
+		return ipRateLimitKey, "", nil
+	}
+	kind, name, _ := strings.Cut(k, ":")
+	switch rateLimitKeyKind(kind) {
+	case headerRateLimitKey:
+		fallthrough
+	case paramRateLimitKey:
+		if name == "" {
+			return "", "", fmt.Errorf("rate limit key '%s' needs a name", k)
+		}
+		return rateLimitKeyKind(kind), name, nil
+	}
+	return "", "", fmt.Errorf(
+		"unrecognized rate limit key: '%s', use ip, header:<name> or param:<name>", k,
+	)
+}
+
+func newRouteRateLimit(r *RateLimitYaml, params routeParameterMap) (*routeRateLimit, error) {
+	if r == nil {
+		return nil, nil
+	}
+	algorithm, err := newRateLimitAlgorithm(r.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if r.Requests <= 0 {
+		return nil, fmt.Errorf("rate limit requests must be positive")
+	}
+	per, err := time.ParseDuration(r.Per)
+	if err != nil || per <= 0 {
+		return nil, fmt.Errorf("invalid rate limit per: '%s'", r.Per)
+	}
+	burst := r.Requests
+	if r.Burst != nil {
+		if *algorithm != TokenBucket {
+			return nil, fmt.Errorf("burst only applies to token_bucket rate limits")
+		}
+		if *r.Burst < r.Requests {
+			return nil, fmt.Errorf("rate limit burst can't be less than requests")
+		}
+		burst = *r.Burst
+	}
+	kind, name, err := newRateLimitKey(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	if kind == paramRateLimitKey {
+		param, ok := params[name]
+		if !ok {
+			return nil, fmt.Errorf("rate limit key param '%s' not found in params", name)
+		}
+		if isNestedType(param.pType) || param.pType == fileParameterType {
+			return nil, fmt.Errorf(
+				"rate limit key param '%s' can't be a %s", name, param.pType,
+			)
+		}
+	}
+	return &routeRateLimit{
+		limit: RateLimit{
+			Algorithm: *algorithm,
+			Requests:  r.Requests,
+			Per:       per,
+			Burst:     burst,
+		},
+		kind: kind,
+		name: name,
+	}, nil
+}
+
+// the connection's address, nothing the client can set
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// the store key, params are only there once they've been parsed
+func (r *routeRateLimit) key(path string, req *http.Request, params map[string]string) string {
+	switch r.kind {
+	case headerRateLimitKey:
+		if v := req.Header.Get(r.name); v != "" {
+			return fmt.Sprintf("%s|header:%s", path, v)
+		}
+	case paramRateLimitKey:
+		if v := params[r.name]; v != "" {
+			return fmt.Sprintf("%s|param:%s", path, v)
+		}
+	}
+	return fmt.Sprintf("%s|ip:%s", path, clientIP(req))
+}
+
+// param keys wait for the params, everything else is limited before the
+// body is read
+func (r *routeRateLimit) afterParse() bool {
+	return r != nil && r.kind == paramRateLimitKey
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+func (m *myHandler) checkRateLimit(
+	w http.ResponseWriter, r *http.Request, params map[string]string,
+) *handlerError {
+	rl := m.route.rateLimit
+	if rl == nil || m.limiter == nil {
+		return nil
+	}
+	allowed, retryAfter, err := m.limiter.Take(
+		r.Context(), rl.key(m.path, r, params), rl.limit,
+	)
+	if err != nil {
+		//a broken store shouldn't take the route down with it
+		myLogger.Errorf("rate limit store failed with error: '%s'", err)
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+	m.metrics.limitExceeded(m.path, requestRateLimit)
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	return &handlerError{http.StatusTooManyRequests, "rate limit exceeded"}
+}
+
+// how often idle keys are dropped from the memory store
+const rateLimitSweepInterval time.Duration = time.Minute
+
+type rateLimitState struct {
+	//token bucket
+	tokens float64
+	//sliding window, counts for the current and previous fixed windows
+	current  int
+	previous int
+	//the last refill for token buckets, the window start for sliding windows
+	at time.Time
+	//when the state is back to where a new key starts, safe to drop
+	idleAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	states    map[string]*rateLimitState
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Keeps rate limit state in this process, idle keys are dropped as it goes
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		states: make(map[string]*rateLimitState),
+		now:    time.Now,
+	}
+}
+
+func (s *memoryRateLimitStore) Take(
+	ctx context.Context, key string, limit RateLimit,
+) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+	state, ok := s.states[key]
+	if !ok {
+		state = &rateLimitState{tokens: float64(limit.Burst), at: now}
+		s.states[key] = state
+	}
+	switch limit.Algorithm {
+	case TokenBucket:
+		allowed, retryAfter := state.takeToken(now, limit)
+		return allowed, retryAfter, nil
+	case SlidingWindow:
+		allowed, retryAfter := state.takeWindow(now, limit)
+		return allowed, retryAfter, nil
+	}
+	return false, 0, fmt.Errorf("unrecognized rate limit algorithm: '%s'", limit.Algorithm)
+}
+
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for k, state := range s.states {
+		if !now.Before(state.idleAt) {
+			delete(s.states, k)
+		}
+	}
+}
+
+func (s *rateLimitState) takeToken(now time.Time, limit RateLimit) (bool, time.Duration) {
+	//tokens per nanosecond
+	rate := float64(limit.Requests) / float64(limit.Per)
+	s.tokens = math.Min(
+		float64(limit.Burst), s.tokens+float64(now.Sub(s.at))*rate,
+	)
+	s.at = now
+	var retryAfter time.Duration
+	allowed := s.tokens >= 1
+	if allowed {
+		s.tokens--
+	} else {
+		retryAfter = time.Duration((1 - s.tokens) / rate)
+	}
+	s.idleAt = now.Add(time.Duration((float64(limit.Burst) - s.tokens) / rate))
+	return allowed, retryAfter
+}
+
+// the usual approximation, the previous window's count is weighted by how
+// much of it still falls in the rolling window
+func (s *rateLimitState) takeWindow(now time.Time, limit RateLimit) (bool, time.Duration) {
+	start := now.Truncate(limit.Per)
+	if !s.at.Equal(start) {
+		if start.Sub(s.at) == limit.Per {
+			s.previous = s.current
+		} else {
+			s.previous = 0
+		}
+		s.current = 0
+		s.at = start
+	}
+	s.idleAt = start.Add(2 * limit.Per)
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(limit.Per)
+	if float64(s.previous)*weight+float64(s.current) < float64(limit.Requests) {
+		s.current++
+		return true, 0
+	}
+	//room opens up once enough of the previous window has rolled off, or
+	//not until the next window when this one is full on its own
+	room := limit.Requests - s.current
+	if room <= 0 || s.previous == 0 {
+		return false, limit.Per - elapsed
+	}
+	needed := time.Duration((1 - float64(room)/float64(s.previous)) * float64(limit.Per))
+	return false, needed - elapsed
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRateLimitLoading(t *testing.T) {
+	params := routeParameterMap{
+		"api_key": &routeParameter{pType: stringParameterType},
+		"filter":  &routeParameter{pType: objectParameterType},
+	}
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"requests: 10\nper: 1m", false, "defaults"},
+		//1
+		{"requests: 10\nper: 1m\nburst: 20\nkey: header:X-Api-Key", false, "burst and header"},
+		//2
+		{"algorithm: sliding_window\nrequests: 10\nper: 1m\nkey: param:api_key", false, "param"},
+		//3
+		{"algorithm: leaky\nrequests: 10\nper: 1m", true, "unknown algorithm"},
+		//4
+		{"requests: 0\nper: 1m", true, "no requests"},
+		//5
+		{"requests: 10\nper: often", true, "bad per"},
+		//6
+		{"requests: 10\nper: 1m\nburst: 5", true, "burst below requests"},
+		//7
+		{"algorithm: sliding_window\nrequests: 10\nper: 1m\nburst: 20", true, "burst on a window"},
+		//8
+		{"requests: 10\nper: 1m\nkey: cookie:id", true, "unknown key"},
+		//9
+		{"requests: 10\nper: 1m\nkey: header", true, "key without a name"},
+		//10
+		{"requests: 10\nper: 1m\nkey: param:nope", true, "undeclared param"},
+		//11
+		{"requests: 10\nper: 1m\nkey: param:filter", true, "object param"},
+	}
+	for i, td := range testData {
+		rYaml := &RateLimitYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), rYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		_, err := newRouteRateLimit(rYaml, params)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	store.now = func() time.Time { return now }
+	bucket := RateLimit{Algorithm: TokenBucket, Requests: 2, Per: time.Second, Burst: 3}
+	window := RateLimit{Algorithm: SlidingWindow, Requests: 2, Per: 10 * time.Second}
+	testData := []struct {
+		at            time.Duration
+		key           string
+		limit         RateLimit
+		expAllowed    bool
+		expRetryAfter time.Duration
+		msg           string
+	}{
+		//0
+		{0, "a", bucket, true, 0, "first token"},
+		//1
+		{0, "a", bucket, true, 0, "second token"},
+		//2
+		{0, "a", bucket, true, 0, "burst token"},
+		//3
+		{0, "a", bucket, false, 500 * time.Millisecond, "bucket empty"},
+		//4
+		{0, "b", bucket, true, 0, "keys are separate"},
+		//5
+		{500 * time.Millisecond, "a", bucket, true, 0, "refilled"},
+		//6
+		{500 * time.Millisecond, "a", bucket, false, 500 * time.Millisecond, "empty again"},
+		//7
+		{0, "w", window, true, 0, "first in window"},
+		//8
+		{time.Second, "w", window, true, 0, "second in window"},
+		//9
+		{2 * time.Second, "w", window, false, 8 * time.Second, "window full"},
+		//10
+		{12 * time.Second, "w", window, true, 0, "previous window partly rolled off"},
+		//11
+		{13 * time.Second, "w", window, false, 2 * time.Second, "previous window still counts"},
+		//12
+		{16 * time.Second, "w", window, true, 0, "more rolled off"},
+		//13
+		{17 * time.Second, "w", window, false, 3 * time.Second, "current window full"},
+	}
+	for i, td := range testData {
+		now = start.Add(td.at)
+		allowed, retryAfter, err := store.Take(context.Background(), td.key, td.limit)
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		//token math is floating point
+		diff := retryAfter - td.expRetryAfter
+		if allowed != td.expAllowed || diff > time.Millisecond || diff < -time.Millisecond {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "exp: %t %s, got: %t %s",
+					td.expAllowed, td.expRetryAfter, allowed, retryAfter,
+				),
+			)
+		}
+	}
+	now = start.Add(time.Hour)
+	store.Take(context.Background(), "new", bucket)
+	if len(store.states) != 1 {
+		t.Errorf("expected idle keys to be swept, %d left", len(store.states))
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (f failingRateLimitStore) Take(
+	ctx context.Context, key string, limit RateLimit,
+) (bool, time.Duration, error) {
+	return false, 0, context.DeadlineExceeded
+}
+
+func TestServerRateLimit(t *testing.T) {
+	newTestServer := func(opts ...Option) *server {
+		serverYaml, err := os.Open("testdata/ratelimit.yaml")
+		if err != nil {
+			t.Fatalf("failed opening test yaml with error: '%s'", err)
+		}
+		defer serverYaml.Close()
+		tmpServer, err := NewServer(serverYaml, map[string]Callback{
+			"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+		}, opts...)
+		if err != nil {
+			t.Fatalf("failed creating server with error: '%s'", err)
+		}
+		return tmpServer.(*server)
+	}
+	testServer := newTestServer(WithMetricsPath("/metrics"))
+	testData := []struct {
+		handlePath string
+		target     string
+		remoteAddr string
+		apiKey     string
+		expCode    int
+		msg        string
+	}{
+		//0
+		{"/ip", "http://example.com/ip", "10.0.0.1:1234", "", http.StatusOK, "first"},
+		//1
+		{"/ip", "http://example.com/ip", "10.0.0.1:4321", "", http.StatusOK, "second, new port"},
+		//2
+		{"/ip", "http://example.com/ip", "10.0.0.1:1234", "", http.StatusTooManyRequests, "third"},
+		//3
+		{"/ip", "http://example.com/ip", "10.0.0.2:1234", "", http.StatusOK, "other client"},
+		//4
+		{"/header", "http://example.com/header", "10.0.0.1:1234", "a", http.StatusOK, "key a"},
+		//5
+		{"/header", "http://example.com/header", "10.0.0.1:1234", "b", http.StatusOK, "key b"},
+		//6
+		{
+			"/header", "http://example.com/header", "10.0.0.2:1234", "a",
+			http.StatusTooManyRequests, "key a from elsewhere",
+		},
+		//7
+		{
+			"/header", "http://example.com/header", "10.0.0.1:1234", "", http.StatusOK,
+			"no key falls back to ip",
+		},
+		//8
+		{"/param", "http://example.com/param?api_key=a", "10.0.0.1:1234", "", http.StatusOK, "param a"},
+		//9
+		{
+			"/param", "http://example.com/param?api_key=a", "10.0.0.2:1234", "",
+			http.StatusTooManyRequests, "param a again",
+		},
+		//10
+		{"/param", "http://example.com/param?api_key=b", "10.0.0.1:1234", "", http.StatusOK, "param b"},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, td.target, nil)
+		r.RemoteAddr = td.remoteAddr
+		if td.apiKey != "" {
+			r.Header.Set("X-Api-Key", td.apiKey)
+		}
+		testServer.pathHandlers[td.handlePath].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		retryAfter := w.Header().Get("Retry-After")
+		if td.expCode == http.StatusTooManyRequests && retryAfter == "" {
+			t.Errorf(getTestMessage(i, td.msg, "missing Retry-After"))
+		}
+		if td.expCode != http.StatusTooManyRequests && retryAfter != "" {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected Retry-After: '%s'", retryAfter))
+		}
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	expLine := `landtitle_limit_rejections_total{route="/ip",limit="rate"} 1` + "\n"
+	if body := w.Body.String(); !strings.Contains(body, expLine) {
+		t.Errorf("metrics missing line: '%s', got:\n%s", expLine, body)
+	}
+	//the store failing lets requests through
+	failing := newTestServer(WithRateLimitStore(failingRateLimitStore{}))
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		failing.pathHandlers["/ip"].ServeHTTP(
+			w, httptest.NewRequest(http.MethodGet, "http://example.com/ip", nil),
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("index: %d, failing store, exp code: 200, got: %d", i, w.Code)
+		}
+	}
+	serverYaml, err := os.Open("testdata/ratelimit.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	if _, err = NewServer(serverYaml, map[string]Callback{
+		"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+	}, WithRateLimitStore(nil)); err == nil {
+		t.Errorf("expected an error for a nil store")
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+/*
+html pages from templates, WithTemplates loads layouts, partials and pages
+from an fs.FS, an embed.FS in production, os.DirFS with Reload while
+developing so edits show without a restart
+
+	templates/
+	  layouts/base.html      {{define "base"}}<html>{{block "content" .}}{{end}}</html>{{end}}
+	  partials/deed.html     {{define "deed"}}<p>{{.ID}}</p>{{end}}
+	  pages/deeds/show.html  {{template "base" .}}{{define "content"}}...{{end}}
+
+every page is parsed with all of the layouts and partials, so each can
+define the blocks a layout leaves open. render: on a route names a page
+under the pages directory, it's rendered once the callbacks are done,
+unless one of them wrote the response itself, callbacks aren't required
+
+	/deeds/{id}:
+	  params:
+	    id:
+	      type: integer
+	  callbacks: [loadDeed]
+	  render: deeds/show.html
+
+pages are executed with a *TemplateData, the typed params, what the
+callbacks put in RequestStore, the principal and the csrf token, and have
+these on top of html/template's funcs
+
+	{{url "/deeds/{id}" "id" .Params.id "tab" "history"}}  /deeds/7?tab=history
+	{{asset "/assets/app.js"}}  /assets/app.<hash>.js, see static.go
+	{{csrfField .}}  the hidden csrf_token input for forms
+
+url only builds paths to routes in routes.yaml, filling {name} segments
+from the pairs and putting the rest in the query
+*/
+
+const (
+	defTemplateLayouts  string = "layouts/*.html"
+	defTemplatePartials        = "partials/*.html"
+	defTemplatePages           = "pages"
+)
+
+// TemplateConfig is for WithTemplates
+type TemplateConfig struct {
+	//required, paths below are inside it
+	FS fs.FS
+	//globs, parsed into every page, default layouts/*.html and
+	//partials/*.html, matching nothing is fine
+	Layouts  string
+	Partials string
+	//directory render: names pages in, default pages
+	Pages string
+	//parses the page again on every render, for os.DirFS while developing
+	Reload bool
+	//extra funcs for every template, can't replace url, asset or csrfField
+	Funcs template.FuncMap
+}
+
+// TemplateData is what pages are executed with
+type TemplateData struct {
+	Params Values
+	//what the callbacks put in RequestStore
+	Data map[string]interface{}
+	//nil on public routes
+	Principal *Principal
+	Request   *http.Request
+}
+
+// CSRFToken is the token forms on the page post back, "" without sessions,
+// see csrfField
+func (d *TemplateData) CSRFToken() string {
+	return CSRFToken(d.Request)
+}
+
+func newTemplateData(r *http.Request) *TemplateData {
+	return &TemplateData{
+		Params:    TypedParams(r),
+		Data:      RequestStore(r).all(),
+		Principal: RequestPrincipal(r),
+		Request:   r,
+	}
+}
+
+type templateSet struct {
+	config TemplateConfig
+	funcs  template.FuncMap
+	//by name under the pages directory, with Reload only which pages exist
+	pages map[string]*template.Template
+}
+
+// routes are the paths from routes.yaml, for url, asset fingerprints
+// static files
+func newTemplateSet(
+	c TemplateConfig, routes []string, asset func(string) (string, error),
+) (*templateSet, error) {
+	if c.FS == nil {
+		return nil, fmt.Errorf("templates need an FS")
+	}
+	if c.Layouts == "" {
+		c.Layouts = defTemplateLayouts
+	}
+	if c.Partials == "" {
+		c.Partials = defTemplatePartials
+	}
+	if c.Pages == "" {
+		c.Pages = defTemplatePages
+	}
+	c.Pages = path.Clean(c.Pages)
+	funcs := template.FuncMap{}
+	for name, f := range c.Funcs {
+		funcs[name] = f
+	}
+	for name, f := range (template.FuncMap{
+		"url":       routeURL(routes),
+		"asset":     asset,
+		"csrfField": csrfField,
+	}) {
+		if _, ok := funcs[name]; ok {
+			return nil, fmt.Errorf("template func '%s' is built in", name)
+		}
+		funcs[name] = f
+	}
+	toRet := &templateSet{config: c, funcs: funcs}
+	pages, err := toRet.load()
+	if err != nil {
+		return nil, err
+	}
+	toRet.pages = pages
+	return toRet, nil
+}
+
+// the layouts and partials, never executed so pages can clone it
+func (t *templateSet) parseShared() (*template.Template, error) {
+	toRet := template.New("").Funcs(t.funcs)
+	for _, glob := range []string{t.config.Layouts, t.config.Partials} {
+		matches, err := fs.Glob(t.config.FS, glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range matches {
+			if err = parseTemplateFile(toRet, t.config.FS, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return toRet, nil
+}
+
+func parseTemplateFile(t *template.Template, fsys fs.FS, name string) error {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if _, err = t.New(name).Parse(string(content)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *templateSet) parsePage(shared *template.Template, name string) (
+	*template.Template, error,
+) {
+	page, err := shared.Clone()
+	if err != nil {
+		return nil, err
+	}
+	file := path.Join(t.config.Pages, name)
+	if err = parseTemplateFile(page, t.config.FS, file); err != nil {
+		return nil, err
+	}
+	return page.Lookup(file), nil
+}
+
+// every page under the pages directory, by its path in there
+func (t *templateSet) load() (map[string]*template.Template, error) {
+	shared, err := t.parseShared()
+	if err != nil {
+		return nil, err
+	}
+	toRet := make(map[string]*template.Template)
+	err = fs.WalkDir(t.config.FS, t.config.Pages, func(
+		name string, d fs.DirEntry, err error,
+	) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		page := strings.TrimPrefix(name, t.config.Pages+"/")
+		toRet[page], err = t.parsePage(shared, page)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toRet, nil
+}
+
+// with Reload the page and everything it uses is read again, pages added
+// since the server started aren't picked up
+func (t *templateSet) page(name string) (*template.Template, error) {
+	page, ok := t.pages[name]
+	if !ok {
+		return nil, fmt.Errorf("no template page '%s'", name)
+	}
+	if !t.config.Reload {
+		return page, nil
+	}
+	shared, err := t.parseShared()
+	if err != nil {
+		return nil, err
+	}
+	return t.parsePage(shared, name)
+}
+
+func (t *templateSet) has(name string) bool {
+	_, ok := t.pages[name]
+	return ok
+}
+
+// the url template func, builds a path to one of routes
+func routeURL(routes []string) func(string, ...interface{}) (string, error) {
+	known := make(map[string]bool)
+	for _, r := range routes {
+		known[r] = true
+	}
+	return func(route string, pairs ...interface{}) (string, error) {
+		if !known[route] {
+			return "", fmt.Errorf("url: no route '%s'", route)
+		}
+		if len(pairs)%2 != 0 {
+			return "", fmt.Errorf("url: '%s' needs name value pairs", route)
+		}
+		values := make(map[string]string)
+		for i := 0; i < len(pairs); i += 2 {
+			name, ok := pairs[i].(string)
+			if !ok {
+				return "", fmt.Errorf("url: param names must be strings, got: %v", pairs[i])
+			}
+			values[name] = fmt.Sprint(pairs[i+1])
+		}
+		segments := strings.Split(route, "/")
+		for i, s := range segments {
+			if !dynamicPathRegex.MatchString(s) {
+				continue
+			}
+			name := strings.Trim(s, "{}")
+			v, ok := values[name]
+			if !ok {
+				return "", fmt.Errorf("url: '%s' needs a value for '%s'", route, name)
+			}
+			segments[i] = url.PathEscape(v)
+			delete(values, name)
+		}
+		toRet := strings.Join(segments, "/")
+		if len(values) == 0 {
+			return toRet, nil
+		}
+		query := url.Values{}
+		for name, v := range values {
+			query.Set(name, v)
+		}
+		return toRet + "?" + query.Encode(), nil
+	}
+}
+
+// the csrfField template func, nothing without sessions
+func csrfField(d *TemplateData) template.HTML {
+	token := d.CSRFToken()
+	if token == "" {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(
+		`<input type="hidden" name="%s" value="%s">`,
+		csrfFormField, template.HTMLEscapeString(token),
+	))
+}
+
+// tells render: whether a callback answered the request itself
+type renderWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (rw *renderWriter) WriteHeader(code int) {
+	rw.wrote = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *renderWriter) Write(data []byte) (int, error) {
+	rw.wrote = true
+	return rw.ResponseWriter.Write(data)
+}
+
+func (rw *renderWriter) Flush() {
+	rw.wrote = true
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *renderWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (m *myHandler) renderPage(w http.ResponseWriter, r *http.Request) {
+	name := m.route.render
+	ctx, span := m.tracer.Start(r.Context(), fmt.Sprintf("render %s", name))
+	defer span.End()
+	page, err := m.templates.page(name)
+	if err == nil {
+		err = HTML(w, http.StatusOK, page, newTemplateData(r.WithContext(ctx)))
+	}
+	if err != nil {
+		myLogger.Errorf("rendering '%s' failed with error: '%s'", name, err)
+		span.RecordError(err)
+		Error(w, r, http.StatusInternalServerError, "")
+	}
+}
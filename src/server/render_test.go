@@ -0,0 +1,226 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testTemplateFuncs template.FuncMap = template.FuncMap{"shout": strings.ToUpper}
+
+func testTemplateFS() fstest.MapFS {
+	return fstest.MapFS{
+		"layouts/base.html": {Data: []byte(
+			`{{define "base"}}<main>{{block "content" .}}{{end}}</main>{{end}}`,
+		)},
+		"partials/deed.html": {Data: []byte(`{{define "deed"}}<b>{{.}}</b>{{end}}`)},
+		"pages/deeds/show.html": {Data: []byte(
+			`{{template "base" .}}{{define "content"}}` +
+				`{{template "deed" .Data.owner}} {{.Params.id}} ` +
+				`<a href="{{url "/deeds/{id}" "id" .Params.id "tab" "a b"}}">` +
+				`{{if .Principal}}{{.Principal.Subject}}{{end}}{{end}}`,
+		)},
+		"pages/form.html": {Data: []byte(
+			`<form>{{csrfField .}}</form>{{shout "x"}}`,
+		)},
+		"pages/broken.html": {Data: []byte(`{{url "/nowhere"}}`)},
+	}
+}
+
+func TestServerRender(t *testing.T) {
+	tmpServer, err := NewServer(
+		strings.NewReader(`/deeds/{id}:
+  params:
+    id:
+      type: integer
+      source: url
+  callbacks: [load]
+  render: deeds/show.html
+/form:
+  render: form.html
+/broken:
+  render: broken.html
+/redirect:
+  callbacks: [redirect]
+  render: form.html
+`),
+		map[string]Callback{
+			"load": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				RequestStore(r).Set("owner", "<Jane>")
+				return true, nil
+			},
+			"redirect": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				http.Redirect(w, r, "/form", http.StatusSeeOther)
+				return true, nil
+			},
+		},
+		WithSessions(SessionConfig{Keys: [][]byte{testSessionKey}}),
+		WithTemplates(TemplateConfig{FS: testTemplateFS(), Funcs: testTemplateFuncs}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	b := &testBrowser{handler: mux, cookies: make(map[string]*http.Cookie)}
+	testData := []struct {
+		target  string
+		expCode int
+		expBody string
+		msg     string
+	}{
+		//0
+		{
+			"/deeds/7", http.StatusOK,
+			`<main><b>&lt;Jane&gt;</b> 7 <a href="/deeds/7?tab=a&#43;b"></main>`,
+			"layout, partial, store and url",
+		},
+		//1
+		{"/form", http.StatusOK, `<input type="hidden" name="csrf_token" value="`, "csrf"},
+		//2
+		{"/form", http.StatusOK, `</form>X`, "extra funcs"},
+		//3
+		{"/broken", http.StatusInternalServerError, "Internal Server Error", "exec error"},
+		//4
+		{"/redirect", http.StatusSeeOther, "", "callback wrote"},
+	}
+	for i, td := range testData {
+		w := b.do(http.MethodGet, td.target, nil, nil)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) {
+			t.Errorf(getTestMessage(i, td.msg, "exp '%s' in: '%s'", td.expBody, w.Body))
+		}
+	}
+	w := b.do(http.MethodGet, "/form", nil, nil)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), MediaHTML) {
+		t.Errorf("exp an html response, got: %v", w.Header())
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	fsys := fstest.MapFS{"pages/a.html": {Data: []byte("one")}}
+	tmpServer, err := NewServer(
+		strings.NewReader("/a:\n  render: a.html\n"), nil,
+		WithTemplates(TemplateConfig{FS: fsys, Reload: true}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	h := tmpServer.(*server).pathHandlers["/a"]
+	for i, exp := range []string{"one", "two"} {
+		fsys["pages/a.html"].Data = []byte(exp)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		if w.Body.String() != exp {
+			t.Errorf(getTestMessage(i, "reload", "exp: '%s', got: '%s'", exp, w.Body))
+		}
+	}
+}
+
+func TestRouteURL(t *testing.T) {
+	url := routeURL([]string{"/deeds", "/deeds/{id}/{part}"})
+	testData := []struct {
+		route    string
+		pairs    []interface{}
+		exp      string
+		expError bool
+		msg      string
+	}{
+		//0
+		{"/deeds", nil, "/deeds", false, "plain"},
+		//1
+		{
+			"/deeds", []interface{}{"q", "a&b", "page", 2}, "/deeds?page=2&q=a%26b",
+			false, "query",
+		},
+		//2
+		{
+			"/deeds/{id}/{part}", []interface{}{"id", "a/b", "part", "c"}, "/deeds/a%2Fb/c",
+			false, "dynamic",
+		},
+		//3
+		{"/deeds/{id}/{part}", []interface{}{"id", 1}, "", true, "missing segment"},
+		//4
+		{"/titles", nil, "", true, "unknown route"},
+		//5
+		{"/deeds", []interface{}{"q"}, "", true, "odd pairs"},
+		//6
+		{"/deeds", []interface{}{1, 2}, "", true, "name not a string"},
+	}
+	for i, td := range testData {
+		got, err := url(td.route, td.pairs...)
+		if td.expError != (err != nil) {
+			t.Errorf(getTestMessage(i, td.msg, "exp error: %t, got: '%v'", td.expError, err))
+		}
+		if got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp: '%s', got: '%s'", td.exp, got))
+		}
+	}
+}
+
+func TestTemplateLoading(t *testing.T) {
+	noop := map[string]Callback{
+		"cb1": func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			return true, nil
+		},
+	}
+	withTemplates := []Option{
+		WithTemplates(TemplateConfig{FS: testTemplateFS(), Funcs: testTemplateFuncs}),
+	}
+	testData := []struct {
+		yamlString string
+		opts       []Option
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  render: form.html\n", withTemplates, false, "render only"},
+		//1
+		{"/a:\n  render: form.html\n", nil, true, "no templates"},
+		//2
+		{"/a:\n  render: missing.html\n", withTemplates, true, "missing page"},
+		//3
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithTemplates(TemplateConfig{
+				FS: fstest.MapFS{"pages/a.html": {Data: []byte("{{")}},
+			})},
+			true, "parse error",
+		},
+		//4
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithTemplates(TemplateConfig{
+				FS:    testTemplateFS(),
+				Funcs: template.FuncMap{"shout": strings.ToUpper, "url": strings.ToLower},
+			})},
+			true, "replaced builtin func",
+		},
+		//5
+		{"/a:\n  callbacks: [cb1]\n", []Option{WithTemplates(TemplateConfig{})}, true, "no fs"},
+		//6
+		{"/a:\n  builtin: liveness\n  render: form.html\n", withTemplates, true, "builtin"},
+		//7
+		{"/a:\n  methods: [get]\n", withTemplates, true, "no callbacks or render"},
+	}
+	for i, td := range testData {
+		_, err := NewServer(strings.NewReader(td.yamlString), noop, td.opts...)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
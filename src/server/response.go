@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+helpers for callbacks writing responses, eg
+
+	return true, server.Respond(w, r, http.StatusOK, deed)
+
+JSON, XML and HTML write one format, Respond picks JSON or XML by the
+request's Accept header, NDJSON streams a line at a time. Error writes an
+RFC 9457 problem in whatever the client asked for, plain text when it didn't
+say, which is also what the server answers with when it turns a request away.
+
+produces: on a route lists the media types its callbacks write, requests
+that accept none of them get a 406 before the callbacks run and Respond only
+picks from those
+
+	/deeds/{id}:
+	  produces: [application/json, application/xml]
+*/
+
+const (
+	MediaJSON        string = "application/json"
+	MediaXML                = "application/xml"
+	MediaNDJSON             = "application/x-ndjson"
+	MediaHTML               = "text/html"
+	MediaText               = "text/plain"
+	mediaProblemJSON        = "application/problem+json"
+	mediaProblemXML         = "application/problem+xml"
+)
+
+// what Respond can write
+var respondOffers []string = []string{MediaJSON, MediaXML}
+
+// plain text first, clients that don't say get what http.Error would have
+// given them
+var problemOffers []string = []string{
+	MediaText, mediaProblemJSON, MediaJSON, mediaProblemXML, MediaXML,
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// the media ranges of an Accept header, q=0 included, nil when there's no
+// header or none of it parses, which accepts anything
+func parseAccept(header string) []acceptRange {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	var toRet []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		//*, sent by some old clients, means */*
+		if mediaType == "*" {
+			mediaType = "*/*"
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		toRet = append(toRet, acceptRange{mediaType: mediaType, q: q})
+	}
+	return toRet
+}
+
+// 2 for an exact match, 1 for type/*, 0 for */*, -1 for no match
+func (a acceptRange) specificity(offer string) int {
+	if a.mediaType == offer {
+		return 2
+	}
+	if a.mediaType == "*/*" {
+		return 0
+	}
+	if base, ok := strings.CutSuffix(a.mediaType, "/*"); ok &&
+		strings.HasPrefix(offer, base+"/") {
+		return 1
+	}
+	return -1
+}
+
+// Negotiate returns the offer the request's Accept header likes best,
+// earlier offers win ties, "" when it accepts none of them
+func Negotiate(r *http.Request, offers ...string) string {
+	ranges := parseAccept(r.Header.Get("Accept"))
+	if ranges == nil {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		//the most specific range decides, text/html;q=0 beats */*
+		q, specificity := 0.0, -1
+		for _, a := range ranges {
+			if s := a.specificity(offer); s > specificity {
+				q, specificity = a.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// media types from a route's produces:, bare types, no wildcards
+func newProduces(produces []string) ([]string, error) {
+	toRet := make([]string, 0, len(produces))
+	for _, p := range produces {
+		mediaType, _, err := mime.ParseMediaType(p)
+		if err == nil && !strings.Contains(mediaType, "/") {
+			err = fmt.Errorf("no subtype")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid produces media type '%s': %w", p, err)
+		}
+		if strings.Contains(mediaType, "*") {
+			return nil, fmt.Errorf("produces media type can't be a wildcard: '%s'", p)
+		}
+		for _, seen := range toRet {
+			if seen == mediaType {
+				return nil, fmt.Errorf("produces lists '%s' more than once", p)
+			}
+		}
+		toRet = append(toRet, mediaType)
+	}
+	return toRet, nil
+}
+
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+// JSON writes v as the response with status, nothing is written when v
+// doesn't marshal
+func JSON(w http.ResponseWriter, status int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, status, MediaJSON+"; charset=utf-8", append(body, '\n'))
+}
+
+// XML writes v as the response with status, nothing is written when v
+// doesn't marshal
+func XML(w http.ResponseWriter, status int, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBody(
+		w, status, MediaXML+"; charset=utf-8", append([]byte(xml.Header), body...),
+	)
+}
+
+// HTML executes t with data as the response with status, it's executed in
+// full first so a template error doesn't leave half a page behind
+func HTML(w http.ResponseWriter, status int, t *template.Template, data interface{}) error {
+	var body bytes.Buffer
+	if err := t.Execute(&body, data); err != nil {
+		return err
+	}
+	return writeBody(w, status, MediaHTML+"; charset=utf-8", body.Bytes())
+}
+
+// Respond writes v as JSON or XML, whichever the request prefers out of
+// what the route produces, 406 when it accepts neither
+func Respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	offers := respondOffers
+	if state := getRequestState(r); state != nil && len(state.produces) > 0 {
+		offers = nil
+		for _, p := range state.produces {
+			if p == MediaJSON || p == MediaXML {
+				offers = append(offers, p)
+			}
+		}
+		if len(offers) == 0 {
+			Error(w, r, http.StatusInternalServerError, "")
+			return fmt.Errorf("route produces neither json nor xml: %v", state.produces)
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+	switch Negotiate(r, offers...) {
+	case MediaJSON:
+		return JSON(w, status, v)
+	case MediaXML:
+		return XML(w, status, v)
+	}
+	Error(
+		w, r, http.StatusNotAcceptable,
+		fmt.Sprintf("available: %s", strings.Join(offers, ", ")),
+	)
+	return nil
+}
+
+// NDJSONEncoder streams newline delimited json, see NDJSON
+type NDJSONEncoder struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+	rc  *http.ResponseController
+}
+
+// NDJSON starts a streamed response with status, each Encode is a line
+// the client gets straight away
+func NDJSON(w http.ResponseWriter, status int) *NDJSONEncoder {
+	w.Header().Set("Content-Type", MediaNDJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	return &NDJSONEncoder{w: w, enc: json.NewEncoder(w), rc: http.NewResponseController(w)}
+}
+
+// Encode writes v as a line and flushes it
+func (n *NDJSONEncoder) Encode(v interface{}) error {
+	if err := n.enc.Encode(v); err != nil {
+		return err
+	}
+	if err := n.rc.Flush(); err != nil && err != http.ErrNotSupported {
+		return err
+	}
+	return nil
+}
+
+// RFC 9457 problem details
+type problem struct {
+	XMLName  xml.Name `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type     string   `json:"type" xml:"type"`
+	Title    string   `json:"title" xml:"title"`
+	Status   int      `json:"status" xml:"status"`
+	Detail   string   `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty" xml:"instance,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, detail string) *problem {
+	return &problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+}
+
+func writeProblemJSON(w http.ResponseWriter, p *problem) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	//details quote what the client sent, they're not going into html
+	enc.SetEscapeHTML(false)
+	enc.Encode(p)
+	writeBody(w, p.Status, mediaProblemJSON, body.Bytes())
+}
+
+// Error writes status and detail as a problem, json or xml if the request
+// accepts them, otherwise plain text like http.Error
+func Error(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if detail == "" {
+		detail = http.StatusText(status)
+	}
+	p := newProblem(r, status, detail)
+	switch Negotiate(r, problemOffers...) {
+	case mediaProblemJSON, MediaJSON:
+		writeProblemJSON(w, p)
+	case mediaProblemXML, MediaXML:
+		body, _ := xml.Marshal(p)
+		writeBody(w, status, mediaProblemXML, append([]byte(xml.Header), body...))
+	default:
+		http.Error(w, detail, status)
+	}
+}
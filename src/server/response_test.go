@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	testData := []struct {
+		accept string
+		offers []string
+		exp    string
+		msg    string
+	}{
+		//0
+		{"", []string{MediaJSON, MediaXML}, MediaJSON, "no header"},
+		//1
+		{"application/xml", []string{MediaJSON, MediaXML}, MediaXML, "exact"},
+		//2
+		{"*/*", []string{MediaJSON, MediaXML}, MediaJSON, "anything"},
+		//3
+		{
+			"application/json;q=0.5, application/xml", []string{MediaJSON, MediaXML},
+			MediaXML, "quality",
+		},
+		//4
+		{"text/*", []string{MediaJSON, MediaHTML}, MediaHTML, "type wildcard"},
+		//5
+		{"text/html", []string{MediaJSON, MediaXML}, "", "nothing acceptable"},
+		//6
+		{"*/*, application/json;q=0", []string{MediaJSON, MediaXML}, MediaXML, "refused"},
+		//7
+		{"*", []string{MediaXML}, MediaXML, "bare star"},
+		//8
+		{"application/json;q=2", []string{MediaXML}, MediaXML, "unparsable ignored"},
+		//9
+		{"*/*", nil, "", "no offers"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if td.accept != "" {
+			r.Header.Set("Accept", td.accept)
+		}
+		if got := Negotiate(r, td.offers...); got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp: '%s', got: '%s'", td.exp, got))
+		}
+	}
+}
+
+type testDeed struct {
+	XMLName xml.Name `json:"-" xml:"deed"`
+	ID      string   `json:"id" xml:"id"`
+}
+
+func TestResponseWriters(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := JSON(w, http.StatusCreated, testDeed{ID: "a<b"}); err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":"a\u003cb"}`+"\n" ||
+		w.Header().Get("Content-Type") != "application/json; charset=utf-8" ||
+		w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("unexpected json response: %d %v '%s'", w.Code, w.Header(), w.Body)
+	}
+	w = httptest.NewRecorder()
+	if err := JSON(w, http.StatusOK, func() {}); err == nil || w.Body.Len() != 0 {
+		t.Errorf("exp an error and nothing written, got: '%v' '%s'", err, w.Body)
+	}
+	w = httptest.NewRecorder()
+	XML(w, http.StatusOK, testDeed{ID: "a"})
+	if !strings.HasSuffix(w.Body.String(), "<deed><id>a</id></deed>") ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), MediaXML) {
+		t.Errorf("unexpected xml response: %v '%s'", w.Header(), w.Body)
+	}
+
+	page := template.Must(template.New("").Parse(`<p>{{.}}</p>{{if eq . "x"}}{{.No}}{{end}}`))
+	w = httptest.NewRecorder()
+	HTML(w, http.StatusOK, page, "<b>")
+	if w.Body.String() != "<p>&lt;b&gt;</p>" {
+		t.Errorf("exp escaped html, got: '%s'", w.Body)
+	}
+	w = httptest.NewRecorder()
+	if err := HTML(w, http.StatusOK, page, "x"); err == nil || w.Body.Len() != 0 {
+		t.Errorf("exp a template error and nothing written, got: '%v' '%s'", err, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	enc := NDJSON(w, http.StatusOK)
+	enc.Encode(testDeed{ID: "a"})
+	enc.Encode(testDeed{ID: "b"})
+	if w.Body.String() != "{\"id\":\"a\"}\n{\"id\":\"b\"}\n" || !w.Flushed {
+		t.Errorf("exp flushed lines, got: '%s'", w.Body)
+	}
+}
+
+func TestError(t *testing.T) {
+	testData := []struct {
+		accept      string
+		expType     string
+		expContains string
+		msg         string
+	}{
+		//0
+		{"", "text/plain; charset=utf-8", "no such deed\n", "plain by default"},
+		//1
+		{"application/json", mediaProblemJSON, `"detail":"no such deed"`, "json"},
+		//2
+		{"application/problem+json", mediaProblemJSON, `"status":404`, "problem json"},
+		//3
+		{"application/xml", mediaProblemXML, "<detail>no such deed</detail>", "xml"},
+		//4
+		{"text/html, */*;q=0.1", "text/plain; charset=utf-8", "no such deed", "browser"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, "/deeds/7", nil)
+		r.Header.Set("Accept", td.accept)
+		w := httptest.NewRecorder()
+		Error(w, r, http.StatusNotFound, "no such deed")
+		if w.Code != http.StatusNotFound {
+			t.Errorf(getTestMessage(i, td.msg, "exp 404, got: %d", w.Code))
+		}
+		if got := w.Header().Get("Content-Type"); got != td.expType {
+			t.Errorf(getTestMessage(i, td.msg, "exp type: '%s', got: '%s'", td.expType, got))
+		}
+		if !strings.Contains(w.Body.String(), td.expContains) {
+			t.Errorf(getTestMessage(i, td.msg, "exp '%s' in: '%s'", td.expContains, w.Body))
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/deeds/7", nil)
+	r.Header.Set("Accept", MediaJSON)
+	w := httptest.NewRecorder()
+	Error(w, r, http.StatusTeapot, "")
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil ||
+		p.Title != "I'm a teapot" || p.Detail != p.Title || p.Instance != "/deeds/7" {
+		t.Errorf("unexpected problem: %+v '%v'", p, err)
+	}
+}
+
+func TestServerProduces(t *testing.T) {
+	tmpServer, err := NewServer(
+		strings.NewReader(`/deeds:
+  callbacks: [respond]
+/xml:
+  produces: [application/xml]
+  callbacks: [respond]
+/html:
+  produces: [text/html]
+  callbacks: [respond]
+`),
+		map[string]Callback{
+			"respond": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				return true, Respond(w, r, http.StatusOK, testDeed{ID: "a"})
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		target  string
+		accept  string
+		expCode int
+		expType string
+		msg     string
+	}{
+		//0
+		{"/deeds", "", http.StatusOK, MediaJSON, "json by default"},
+		//1
+		{"/deeds", "application/xml", http.StatusOK, MediaXML, "xml asked for"},
+		//2
+		{"/deeds", "text/csv", http.StatusNotAcceptable, "text/plain", "respond refuses"},
+		//3
+		{"/xml", "", http.StatusOK, MediaXML, "limited to produces"},
+		//4
+		{
+			"/xml", "application/json", http.StatusNotAcceptable, mediaProblemJSON,
+			"route refuses",
+		},
+		//5
+		{"/html", "", http.StatusInternalServerError, "text/plain", "respond can't"},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(http.MethodGet, td.target, nil)
+		if td.accept != "" {
+			r.Header.Set("Accept", td.accept)
+		}
+		w := httptest.NewRecorder()
+		testServer.pathHandlers[td.target].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, td.expType) {
+			t.Errorf(getTestMessage(i, td.msg, "exp type: '%s', got: '%s'", td.expType, got))
+		}
+		if td.expCode != http.StatusInternalServerError && w.Header().Get("Vary") != "Accept" {
+			t.Errorf(getTestMessage(i, td.msg, "exp Vary: Accept, got: %v", w.Header()))
+		}
+	}
+}
+
+func TestProducesLoading(t *testing.T) {
+	noop := map[string]Callback{
+		"cb1": func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			return true, nil
+		},
+	}
+	testData := []struct {
+		yamlString string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  produces: [application/json, text/csv]\n  callbacks: [cb1]\n", false, "valid"},
+		//1
+		{"/a:\n  produces: [json]\n  callbacks: [cb1]\n", true, "not a media type"},
+		//2
+		{"/a:\n  produces: [text/*]\n  callbacks: [cb1]\n", true, "wildcard"},
+		//3
+		{
+			"/a:\n  produces: [text/csv, TEXT/CSV]\n  callbacks: [cb1]\n", true,
+			"duplicate",
+		},
+		//4
+		{"/a:\n  builtin: liveness\n  produces: [text/plain]\n", true, "builtin"},
+	}
+	for i, td := range testData {
+		_, err := NewServer(strings.NewReader(td.yamlString), noop)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
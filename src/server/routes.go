@@ -1,12 +1,17 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"landtitle/util"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v2"
 )
@@ -21,7 +26,8 @@ type sourceType byte
 sourceURL would be /foo/{bar}
 sourceForm is embedded in the POST form
 sourceQuery is the GET parameter
-precedence in increasing order, url -> form  -> query
+by default when a param arrives from more than one source query wins over
+url which wins over form, see precedence: and conflict: on ParamYaml
 */
 const (
 	sourceURL sourceType = 1 << iota
@@ -39,11 +45,143 @@ const (
 	defSourceName                  = sourceQueryName
 )
 
+// highest first
+var defPrecedence []sourceType = []sourceType{sourceQuery, sourceURL, sourceForm}
+
+var sourceNames map[sourceType]sourceTypeName = map[sourceType]sourceTypeName{
+	sourceURL:   sourceURLName,
+	sourceForm:  sourceFormName,
+	sourceQuery: sourceQueryName,
+}
+
+// what to do when a param arrives from more than one source with different
+// values, first and last are by the param's precedence
+type conflictMode string
+
+const (
+	errorConflict conflictMode = "error"
+	firstConflict              = "first"
+	lastConflict               = "last"
+	defConflict                = firstConflict
+)
+
+func newConflictMode(c string) (*conflictMode, error) {
+	if c == "" {
+		return util.Ptr(conflictMode(defConflict)), nil
+	}
+	toRet := conflictMode(c)
+	switch toRet {
+	case errorConflict:
+		fallthrough
+	case firstConflict:
+		fallthrough
+	case lastConflict:
+		return util.Ptr(toRet), nil
+	}
+	return nil, fmt.Errorf("unrecognized conflict mode: '%s'", c)
+}
+
+// sources highest first, any the param allows but that aren't listed
+// follow in the default order
+func newPrecedence(names []string, allowed sourceType) ([]sourceType, error) {
+	toRet := make([]sourceType, 0, len(defPrecedence))
+	var seen sourceType
+	for _, name := range names {
+		source, err := getSourceMask(name)
+		if err != nil {
+			return nil, err
+		}
+		if source&(source-1) != 0 {
+			return nil, fmt.Errorf("precedence takes one source per entry, got: '%s'", name)
+		}
+		if seen&source != 0 {
+			return nil, fmt.Errorf("source '%s' listed twice in precedence", name)
+		}
+		if allowed&source == 0 {
+			return nil, fmt.Errorf(
+				"precedence lists '%s' but the parameter isn't allowed from it", name,
+			)
+		}
+		seen |= source
+		toRet = append(toRet, source)
+	}
+	for _, source := range defPrecedence {
+		if allowed&source != 0 && seen&source == 0 {
+			toRet = append(toRet, source)
+		}
+	}
+	return toRet, nil
+}
+
+// what to do with query and form keys the route doesn't declare
+type unknownParamsPolicy string
+
+const (
+	rejectUnknownParams      unknownParamsPolicy = "reject"
+	ignoreUnknownParams                          = "ignore"
+	passthroughUnknownParams                     = "passthrough"
+	defUnknownParams                             = rejectUnknownParams
+)
+
+func newUnknownParamsPolicy(p string) (*unknownParamsPolicy, error) {
+	if p == "" {
+		return util.Ptr(unknownParamsPolicy(defUnknownParams)), nil
+	}
+	toRet := unknownParamsPolicy(p)
+	switch toRet {
+	case rejectUnknownParams:
+		fallthrough
+	case ignoreUnknownParams:
+		fallthrough
+	case passthroughUnknownParams:
+		return util.Ptr(toRet), nil
+	}
+	return nil, fmt.Errorf("unrecognized unknown_params policy: '%s'", p)
+}
+
+// regex must match the whole value, for string params it replaces the
+// default word character pattern, for every other type it's checked on top
+// of the type's own parsing
 type ParamYaml struct {
 	Type       string `yaml:"type,omitempty"`
 	Regex      string `yaml:"regex,omitempty"`
 	Required   *bool  `yaml:"required,omitempty"`
 	SourceType string `yaml:"source,omitempty"`
+	//numeric bounds, inclusive, number and integer params only
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+	//in characters, not bytes, string and email params only, or the
+	//number of items for arrays
+	MinLength *int     `yaml:"min_length,omitempty"`
+	MaxLength *int     `yaml:"max_length,omitempty"`
+	Enum      []string `yaml:"enum,omitempty,flow"`
+	//filled in when the param is missing, implies required: false
+	Default *string `yaml:"default,omitempty"`
+	//go time layout for date and datetime params, eg 01/02/2006, the
+	//defaults are ISO or US dates and RFC 3339 datetimes
+	Layout string `yaml:"layout,omitempty"`
+	//sources highest first for when the param is sent more than once,
+	//defaults to query, url then form
+	Precedence []string `yaml:"precedence,omitempty,flow"`
+	//error answers 400 when the sources disagree, first, the default, takes
+	//the highest precedence value and last the lowest
+	Conflict string `yaml:"conflict,omitempty"`
+	//the members of object params and the element of array params,
+	//see nested.go
+	Properties map[string]*ParamYaml `yaml:"properties,omitempty"`
+	Items      *ParamYaml            `yaml:"items,omitempty"`
+	//file params only, see upload.go, max_size is in bytes and max_count
+	//defaults to 1, accept entries are media types or type/* wildcards
+	//checked against the sniffed content
+	MaxSize  *int64   `yaml:"max_size,omitempty"`
+	MaxCount *int     `yaml:"max_count,omitempty"`
+	Accept   []string `yaml:"accept,omitempty,flow"`
+	//old names still accepted in the query or form, using one adds a
+	//deprecation Warning header to the response
+	Aliases []string `yaml:"aliases,omitempty,flow"`
+	//normalization steps run on the raw value before anything else,
+	//see transform.go
+	Transform []*TransformYaml `yaml:"transform,omitempty"`
 }
 
 func (p *ParamYaml) String() string {
@@ -56,10 +194,19 @@ const dynamicPathPattern string = `^\{[a-z]\w*\}$`
 type httpParameterType string
 
 const (
-	numberParameterType  httpParameterType = "number"
-	stringParameterType                    = "string"
-	booleanParameterType                   = "boolean"
-	defParameterType                       = stringParameterType
+	numberParameterType   httpParameterType = "number"
+	integerParameterType                    = "integer"
+	stringParameterType                     = "string"
+	booleanParameterType                    = "boolean"
+	dateParameterType                       = "date"
+	dateTimeParameterType                   = "datetime"
+	uuidParameterType                       = "uuid"
+	emailParameterType                      = "email"
+	durationParameterType                   = "duration"
+	objectParameterType                     = "object"
+	arrayParameterType                      = "array"
+	fileParameterType                       = "file"
+	defParameterType                        = stringParameterType
 )
 
 func newHttpParameterType(p string) (*httpParameterType, error) {
@@ -67,23 +214,50 @@ func newHttpParameterType(p string) (*httpParameterType, error) {
 	switch toRet {
 	case numberParameterType:
 		fallthrough
+	case integerParameterType:
+		fallthrough
 	case stringParameterType:
 		fallthrough
 	case booleanParameterType:
+		fallthrough
+	case dateParameterType:
+		fallthrough
+	case dateTimeParameterType:
+		fallthrough
+	case uuidParameterType:
+		fallthrough
+	case emailParameterType:
+		fallthrough
+	case durationParameterType:
+		fallthrough
+	case objectParameterType:
+		fallthrough
+	case arrayParameterType:
+		fallthrough
+	case fileParameterType:
 		return util.Ptr(toRet), nil
 	}
 	return nil, fmt.Errorf("unrecognized httpParameterType: '%s'", p)
 }
 
+// every pattern, built in or from routes.yaml, has to match the whole value
+func fullMatchRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+}
+
 var (
 	dynamicPathRegex         *regexp.Regexp = regexp.MustCompile(dynamicPathPattern)
-	defStringParameterRegex                 = regexp.MustCompile(`\w+`)
-	defNumberParameterRegex                 = regexp.MustCompile(`[+-]?([0-9]*[.])?[0-9]+`)
-	defBooleanParameterRegex                = regexp.MustCompile(`(?i)((true)|(false))`)
+	defStringParameterRegex                 = regexp.MustCompile(`^\w+$`)
+	defNumberParameterRegex                 = regexp.MustCompile(`^[+-]?([0-9]*[.])?[0-9]+$`)
+	defIntegerParameterRegex                = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	defBooleanParameterRegex                = regexp.MustCompile(`^(?i)(true|false)$`)
 )
 
+// types without an entry are checked by their parser alone, the string
+// pattern is only a default and is replaced by a param's own regex
 var parameterRegexpMap map[httpParameterType]*regexp.Regexp = map[httpParameterType]*regexp.Regexp{
 	numberParameterType:  defNumberParameterRegex,
+	integerParameterType: defIntegerParameterRegex,
 	stringParameterType:  defStringParameterRegex,
 	booleanParameterType: defBooleanParameterRegex,
 }
@@ -96,6 +270,47 @@ type RouteYaml struct {
 	Methods   []string              `yaml:"methods,omitempty,flow"`
 	Params    map[string]*ParamYaml `yaml:"params,omitempty,flow"`
 	Callbacks []string              `yaml:"callbacks,flow"`
+	//reject, the default, answers 400 to undeclared query and form params,
+	//ignore drops them, passthrough hands them to callbacks unvalidated
+	UnknownParams string `yaml:"unknown_params,omitempty"`
+	//overrides the server's limits for this route, see limits.go
+	Limits *LimitsYaml `yaml:"limits,omitempty"`
+	//per client, see ratelimit.go
+	RateLimit *RateLimitYaml `yaml:"rate_limit,omitempty"`
+	//requests worked on at once and the queue for the rest, see
+	//concurrency.go
+	MaxConcurrent *int       `yaml:"max_concurrent,omitempty"`
+	Queue         *QueueYaml `yaml:"queue,omitempty"`
+	//go duration, deadline for the request's context, see timeout.go
+	Timeout string `yaml:"timeout,omitempty"`
+	//scheme names from the top level auth:, empty for public, see auth.go
+	Auth *[]string `yaml:"auth,omitempty"`
+	//asked of the principal, any one of roles and all of permissions,
+	//access: replaces both per method, see authz.go
+	Roles       []string               `yaml:"roles,omitempty,flow"`
+	Permissions []string               `yaml:"permissions,omitempty,flow"`
+	Access      map[string]*AccessYaml `yaml:"access,omitempty"`
+	//defaults to on for POST and PUT routes with form params when the
+	//server has sessions, see session.go
+	CSRF *bool `yaml:"csrf,omitempty"`
+	//media types the callbacks write, requests accepting none get a 406,
+	//see response.go
+	Produces []string `yaml:"produces,omitempty,flow"`
+	//a page to render once the callbacks are done, see render.go
+	Render string `yaml:"render,omitempty"`
+	//files under the route's path, in place of callbacks, see static.go
+	Static *StaticYaml `yaml:"static,omitempty"`
+	//forwards to an upstream, in place of callbacks, see proxy.go
+	Proxy *ProxyYaml `yaml:"proxy,omitempty"`
+	//overrides the server's response compression, see compress.go
+	Compress *CompressYaml `yaml:"compress,omitempty"`
+	//Cache-Control, ETags and the server's response cache, see cache.go
+	Cache *CacheYaml `yaml:"cache,omitempty"`
+	//cross field checks over the typed params, see rules.go
+	Rules []*RuleYaml `yaml:"rules,omitempty"`
+	//liveness, readiness, version or metrics, served by the server
+	//itself in place of callbacks, params aren't parsed or validated
+	Builtin string `yaml:"builtin,omitempty"`
 }
 
 func (r *RouteYaml) String() string {
@@ -107,6 +322,36 @@ type route struct {
 	methods   []httpMethod
 	callbacks []string
 	params    routeParameterMap
+	rules     routeRules
+	builtin   builtinType
+	//alias -> declared name
+	aliases       map[string]string
+	unknownParams unknownParamsPolicy
+	limits        *routeLimits
+	//nil when the route isn't rate limited
+	rateLimit *routeRateLimit
+	//nil without max_concurrent
+	concurrency *concurrencyLimiter
+	//zero for none
+	timeout time.Duration
+	//nil for public routes
+	auth *routeAuth
+	//nil without roles or permissions
+	access *routeAccess
+	//nil to go by the route's params and methods
+	csrf *bool
+	//empty for anything
+	produces []string
+	//"" when the callbacks write the response
+	render string
+	//nil unless the route serves files
+	static *staticRoute
+	//nil unless the route forwards to an upstream
+	proxy *proxyRoute
+	//nil to go by the server's
+	compress *routeCompression
+	//nil when responses aren't cached
+	cache *routeCache
 }
 
 func (r *route) String() string {
@@ -115,46 +360,284 @@ func (r *route) String() string {
 }
 
 type routeParameter struct {
-	pType    httpParameterType `json:"type"`
-	regex    *regexp.Regexp
-	required bool
-	source   sourceType `json:"source"`
+	pType      httpParameterType
+	regex      *regexp.Regexp
+	required   bool
+	source     sourceType
+	min        *float64
+	max        *float64
+	minLength  *int
+	maxLength  *int
+	enum       []string
+	def        *string
+	layouts    []string
+	transforms transforms
+	precedence []sourceType
+	conflict   conflictMode
+	properties routeParameterMap
+	items      *routeParameter
+	maxSize    *int64
+	maxCount   *int
+	accept     []string
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
-func (r *routeParameter) isValid(check string) bool {
+// nil when check satisfies the type and every constraint on the param
+func (r *routeParameter) isValid(check string) error {
 	if !r.required {
 		if check == "" {
-			return true
+			return nil
 		}
 	}
-	if !parameterRegexpMap[r.pType].MatchString(check) {
-		return false
+	typeRegex, ok := parameterRegexpMap[r.pType]
+	if r.pType == stringParameterType && r.regex != nil {
+		ok = false
+	}
+	if ok && !typeRegex.MatchString(check) {
+		return fmt.Errorf("value '%s' is not a valid %s", check, r.pType)
+	}
+	if _, err := parameterParsers[r.pType](r, check); err != nil {
+		myLogger.Tracef("parsing '%s' as %s failed: '%s'", check, r.pType, err)
+		return fmt.Errorf("value '%s' is not a valid %s", check, r.pType)
 	}
 	if r.regex != nil {
 		if !r.regex.MatchString(check) {
-			return false
+			return fmt.Errorf(
+				"value '%s' does not match pattern '%s'", check, r.regex,
+			)
 		}
 	}
-	return true
+	if r.min != nil || r.max != nil {
+		num, err := strconv.ParseFloat(check, 64)
+		if err != nil {
+			return fmt.Errorf("value '%s' is not a valid %s", check, r.pType)
+		}
+		if r.min != nil && num < *r.min {
+			return fmt.Errorf(
+				"value %s is less than the minimum of %s",
+				check, formatFloat(*r.min),
+			)
+		}
+		if r.max != nil && num > *r.max {
+			return fmt.Errorf(
+				"value %s is greater than the maximum of %s",
+				check, formatFloat(*r.max),
+			)
+		}
+	}
+	length := utf8.RuneCountInString(check)
+	if r.minLength != nil && length < *r.minLength {
+		return fmt.Errorf(
+			"value '%s' is shorter than the minimum length of %d",
+			check, *r.minLength,
+		)
+	}
+	if r.maxLength != nil && length > *r.maxLength {
+		return fmt.Errorf(
+			"value '%s' is longer than the maximum length of %d",
+			check, *r.maxLength,
+		)
+	}
+	if len(r.enum) > 0 {
+		found := false
+		for _, e := range r.enum {
+			if e == check {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf(
+				"value '%s' is not one of: '%s'",
+				check, strings.Join(r.enum, "', '"),
+			)
+		}
+	}
+	return nil
+}
+
+// the parsed value for TypedParams, check must already be valid
+func (r *routeParameter) typedValue(check string) (interface{}, error) {
+	return parameterParsers[r.pType](r, check)
+}
+
+// names the offending parameter so callers can count failures per param
+type parameterError struct {
+	param string
+	msg   string
+}
+
+func (p *parameterError) Error() string {
+	return p.msg
+}
+
+// every param that failed, each is counted
+type parameterErrors []*parameterError
+
+func (p parameterErrors) Error() string {
+	msgs := make([]string, len(p))
+	for i, e := range p {
+		msgs[i] = e.msg
+	}
+	return strings.Join(msgs, "; ")
 }
 
 type routeParameterMap map[string]*routeParameter
 
-func (params routeParameterMap) validate(values map[string]string) error {
-	var value string
-	var ok bool
+// combines the values from each source into one, passthrough params the
+// route doesn't declare get the default precedence, values are compared
+// after transforms but kept as sent
+func (params routeParameterMap) merge(
+	bySource map[sourceType]map[string]string,
+) (map[string]string, error) {
+	toRet := make(map[string]string)
+	names := make(map[string]struct{})
+	for _, values := range bySource {
+		for k := range values {
+			names[k] = struct{}{}
+		}
+	}
+	for name := range names {
+		precedence, conflict := defPrecedence, conflictMode(defConflict)
+		if param, ok := params[bracketBase(name)]; ok {
+			precedence, conflict = param.precedence, param.conflict
+		}
+		//values that normalize the same aren't a conflict
+		var ts transforms
+		if param := params.lookup(name); param != nil {
+			ts = param.transforms
+		}
+		var from sourceType
+		for _, source := range precedence {
+			val, ok := bySource[source][name]
+			if !ok {
+				continue
+			}
+			prev, set := toRet[name]
+			switch {
+			case !set:
+			case ts.apply(prev) == ts.apply(val):
+				continue
+			case conflict == errorConflict:
+				return nil, &parameterError{
+					name,
+					fmt.Sprintf(
+						"parameter '%s' sent with different values in %s and %s",
+						name, sourceNames[from], sourceNames[source],
+					),
+				}
+			case conflict == firstConflict:
+				continue
+			}
+			toRet[name], from = val, source
+		}
+	}
+	return toRet, nil
+}
+
+// fills in defaults for missing params, before validation so a bad default
+// can't sneak past, though newParam already checked them
+func (params routeParameterMap) applyDefaults(values map[string]string) {
 	for pName, param := range params {
-		if value, ok = values[pName]; param.required && !ok {
-			return fmt.Errorf("required parameter '%s' missing", pName)
+		if param.def == nil {
+			continue
 		}
-		if !param.isValid(value) {
-			return fmt.Errorf(
-				"parameter '%s' is not valid, value: '%s'",
-				pName, value,
+		if _, ok := values[pName]; !ok {
+			myLogger.Tracef(
+				"setting default for parameter '%s' to '%s'", pName, *param.def,
 			)
+			values[pName] = *param.def
 		}
 	}
-	return nil
+}
+
+func (params routeParameterMap) validate(values map[string]string) error {
+	_, err := params.parse(values)
+	return err
+}
+
+// validates then converts values to their typed equivalents, optional
+// params that were left empty don't show up in the typed values, every
+// param is checked, the error is a parameterErrors naming each that failed
+func (params routeParameterMap) parse(values map[string]string) (Values, error) {
+	toRet := make(Values)
+	var errs parameterErrors
+	for pName, param := range params {
+		//streamed before parsing, see upload.go
+		if param.pType == fileParameterType {
+			continue
+		}
+		typed, ok, err := params.parseParam(pName, param, values)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			toRet[pName] = typed
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].param < errs[j].param })
+		return nil, errs
+	}
+	return toRet, nil
+}
+
+// false when the param is left out of the typed values
+func (params routeParameterMap) parseParam(
+	pName string, param *routeParameter, values map[string]string,
+) (interface{}, bool, *parameterError) {
+	if isNestedType(param.pType) {
+		tree, err := params.buildTree(pName, values)
+		if err != nil {
+			return nil, false, &parameterError{
+				pName,
+				fmt.Sprintf("parameter '%s' is not valid, %s", pName, err),
+			}
+		}
+		if tree == nil {
+			if param.required {
+				return nil, false, &parameterError{
+					pName, fmt.Sprintf("required parameter '%s' missing", pName),
+				}
+			}
+			return nil, false, nil
+		}
+		typed, err := param.parseTree(pName, tree)
+		if err != nil {
+			return nil, false, &parameterError{
+				pName,
+				fmt.Sprintf("parameter '%s' is not valid, %s", pName, err),
+			}
+		}
+		return typed, true, nil
+	}
+	value, ok := values[pName]
+	if param.required && !ok {
+		return nil, false, &parameterError{
+			pName, fmt.Sprintf("required parameter '%s' missing", pName),
+		}
+	}
+	if err := param.isValid(value); err != nil {
+		return nil, false, &parameterError{
+			pName,
+			fmt.Sprintf("parameter '%s' is not valid, %s", pName, err),
+		}
+	}
+	if !ok || value == "" && !param.required {
+		return nil, false, nil
+	}
+	typed, err := param.typedValue(value)
+	if err != nil {
+		return nil, false, &parameterError{
+			pName,
+			fmt.Sprintf("parameter '%s' is not valid, %s", pName, err),
+		}
+	}
+	return typed, true, nil
 }
 
 func newMethods(ms []string) ([]httpMethod, error) {
@@ -173,6 +656,14 @@ func newMethods(ms []string) ([]httpMethod, error) {
 	return toRet, nil
 }
 
+// params with a default are optional unless explicitly marked otherwise
+func defaultRequired(p *ParamYaml) bool {
+	if p.Default != nil {
+		return false
+	}
+	return defRequiredParameter
+}
+
 func newParam(p *ParamYaml) (*routeParameter, error) {
 	if p == nil {
 		p = &ParamYaml{
@@ -180,7 +671,7 @@ func newParam(p *ParamYaml) (*routeParameter, error) {
 		}
 	}
 	if p.Required == nil {
-		p.Required = util.Ptr(true)
+		p.Required = util.Ptr(defaultRequired(p))
 	}
 	pType, err := newHttpParameterType(p.Type)
 	if err != nil {
@@ -191,20 +682,134 @@ func newParam(p *ParamYaml) (*routeParameter, error) {
 	}
 	var regex *regexp.Regexp = nil
 	if p.Regex != "" {
-		if regex, err = regexp.Compile(p.Regex); err != nil {
+		if regex, err = fullMatchRegex(p.Regex); err != nil {
 			return nil, err
 		}
 	}
+	var layouts []string
+	switch *pType {
+	case dateParameterType:
+		layouts = defDateLayouts
+	case dateTimeParameterType:
+		layouts = defDateTimeLayouts
+	}
+	if p.Layout != "" {
+		if layouts == nil {
+			return nil, fmt.Errorf(
+				"layout only applies to date and datetime parameters",
+			)
+		}
+		layouts = []string{p.Layout}
+	}
 	reqSourceType, err := getSourceMask(p.SourceType)
 	if err != nil {
 		return nil, err
 	}
-	return &routeParameter{
-		pType:    *pType,
-		regex:    regex,
-		required: *p.Required,
-		source:   reqSourceType,
-	}, nil
+	transforms, err := newTransforms(p.Transform)
+	if err != nil {
+		return nil, err
+	}
+	precedence, err := newPrecedence(p.Precedence, reqSourceType)
+	if err != nil {
+		return nil, err
+	}
+	conflict, err := newConflictMode(p.Conflict)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &routeParameter{
+		pType:      *pType,
+		regex:      regex,
+		required:   *p.Required,
+		source:     reqSourceType,
+		min:        p.Min,
+		max:        p.Max,
+		minLength:  p.MinLength,
+		maxLength:  p.MaxLength,
+		enum:       p.Enum,
+		def:        p.Default,
+		layouts:    layouts,
+		transforms: transforms,
+		precedence: precedence,
+		conflict:   *conflict,
+		maxSize:    p.MaxSize,
+		maxCount:   p.MaxCount,
+		accept:     p.Accept,
+	}
+	if err = toRet.setChildren(p); err != nil {
+		return nil, err
+	}
+	if err = toRet.checkConstraints(); err != nil {
+		return nil, err
+	}
+	return toRet, nil
+}
+
+// catches constraints that can never be satisfied or make no sense for
+// the type at load time rather than on every request
+func (r *routeParameter) checkConstraints() error {
+	if (r.min != nil || r.max != nil) &&
+		r.pType != numberParameterType && r.pType != integerParameterType {
+		return fmt.Errorf("min and max only apply to number and integer parameters")
+	}
+	if r.min != nil && r.max != nil && *r.min > *r.max {
+		return fmt.Errorf(
+			"min %s is greater than max %s",
+			formatFloat(*r.min), formatFloat(*r.max),
+		)
+	}
+	if (r.minLength != nil || r.maxLength != nil) && r.pType != stringParameterType &&
+		r.pType != emailParameterType && r.pType != arrayParameterType {
+		return fmt.Errorf(
+			"min_length and max_length only apply to string, email and array parameters",
+		)
+	}
+	if err := r.checkFileConstraints(); err != nil {
+		return err
+	}
+	if isNestedType(r.pType) {
+		if r.source&sourceURL != 0 {
+			return fmt.Errorf("%s parameters can't come from the url", r.pType)
+		}
+		if r.regex != nil || len(r.enum) > 0 || r.def != nil || len(r.transforms) > 0 {
+			return fmt.Errorf(
+				"regex, enum, default and transform don't apply to %s parameters",
+				r.pType,
+			)
+		}
+	}
+	if r.minLength != nil && *r.minLength < 0 {
+		return fmt.Errorf("min_length can't be negative")
+	}
+	if r.maxLength != nil && *r.maxLength < 0 {
+		return fmt.Errorf("max_length can't be negative")
+	}
+	if r.minLength != nil && r.maxLength != nil && *r.minLength > *r.maxLength {
+		return fmt.Errorf(
+			"min_length %d is greater than max_length %d",
+			*r.minLength, *r.maxLength,
+		)
+	}
+	for _, e := range r.enum {
+		//a required param so empty enum values aren't waved through
+		toCheck := *r
+		toCheck.enum = nil
+		toCheck.required = true
+		if err := toCheck.isValid(e); err != nil {
+			return fmt.Errorf("enum value not valid, %s", err)
+		}
+	}
+	if r.def != nil {
+		if r.required {
+			return fmt.Errorf("required parameters can't have a default")
+		}
+		toCheck := *r
+		toCheck.required = true
+		if err := toCheck.isValid(*r.def); err != nil {
+			return fmt.Errorf("default not valid, %s", err)
+		}
+	}
+	return nil
 }
 
 func getSourceMask(yamlSourceName string) (sourceType, error) {
@@ -230,8 +835,17 @@ func getSourceMask(yamlSourceName string) (sourceType, error) {
 }
 
 func newRoute(r *RouteYaml) (*route, error) {
-	if len(r.Callbacks) == 0 {
-		return nil, fmt.Errorf("at least one callback is required")
+	if r.Proxy != nil {
+		return newProxyRoute(r)
+	}
+	if r.Static != nil {
+		return newStaticRoute(r)
+	}
+	if r.Builtin != "" {
+		return newBuiltinRoute(r)
+	}
+	if len(r.Callbacks) == 0 && r.Render == "" {
+		return nil, fmt.Errorf("at least one callback or render is required")
 	}
 	methods, err := newMethods(r.Methods)
 	if err != nil {
@@ -245,10 +859,110 @@ func newRoute(r *RouteYaml) (*route, error) {
 		}
 		params[pKey] = tmp
 	}
+	aliases := make(map[string]string)
+	for pKey, param := range r.Params {
+		if param == nil {
+			continue
+		}
+		for _, alias := range param.Aliases {
+			if _, ok := params[alias]; ok {
+				return nil, fmt.Errorf(
+					"alias '%s' for parameter '%s' is already a parameter", alias, pKey,
+				)
+			}
+			if other, ok := aliases[alias]; ok {
+				return nil, fmt.Errorf(
+					"alias '%s' used by both '%s' and '%s'", alias, other, pKey,
+				)
+			}
+			aliases[alias] = pKey
+		}
+	}
+	unknownParams, err := newUnknownParamsPolicy(r.UnknownParams)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := newRouteRules(r.Rules, params)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := newRouteLimits(r.Limits)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := newRouteRateLimit(r.RateLimit, params)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := newConcurrencyLimiter(r.MaxConcurrent, r.Queue)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseLimitDuration("timeout", r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == nil {
+		timeout = new(time.Duration)
+	}
+	produces, err := newProduces(r.Produces)
+	if err != nil {
+		return nil, err
+	}
+	return &route{
+		methods:       methods,
+		callbacks:     r.Callbacks,
+		params:        params,
+		rules:         rules,
+		aliases:       aliases,
+		unknownParams: *unknownParams,
+		limits:        limits,
+		rateLimit:     rateLimit,
+		concurrency:   concurrency,
+		timeout:       *timeout,
+		csrf:          r.CSRF,
+		produces:      produces,
+		render:        r.Render,
+	}, nil
+}
+
+func newBuiltinRoute(r *RouteYaml) (*route, error) {
+	builtin, err := newBuiltinType(r.Builtin)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Callbacks) > 0 {
+		return nil, fmt.Errorf(
+			"builtin route '%s' can't have callbacks", r.Builtin,
+		)
+	}
+	if len(r.Rules) > 0 {
+		return nil, fmt.Errorf("builtin route '%s' can't have rules", r.Builtin)
+	}
+	if r.RateLimit != nil || r.MaxConcurrent != nil || r.Queue != nil || r.Timeout != "" {
+		return nil, fmt.Errorf(
+			"builtin route '%s' can't have rate, concurrency or timeout limits", r.Builtin,
+		)
+	}
+	if len(r.Produces) > 0 || r.Render != "" {
+		return nil, fmt.Errorf("builtin route '%s' can't have produces or render", r.Builtin)
+	}
+	if r.CSRF != nil {
+		return nil, fmt.Errorf("builtin route '%s' can't set csrf", r.Builtin)
+	}
+	//probes and scrapers are all GETs, HEAD is cheap to allow
+	methods := []httpMethod{getMethod, headMethod}
+	if len(r.Methods) > 0 {
+		if methods, err = newMethods(r.Methods); err != nil {
+			return nil, err
+		}
+	}
 	return &route{
 		methods:   methods,
-		callbacks: r.Callbacks,
-		params:    params,
+		callbacks: []string{},
+		params:    routeParameterMap{},
+		builtin:   *builtin,
+		aliases:   map[string]string{},
 	}, nil
 }
 
@@ -264,6 +978,8 @@ func loadRouteYaml(
 		myLogger.Errorf("failed unmarshaling yaml with error: '%s'", err)
 		return nil, err
 	}
+	//see loadAuthYaml
+	delete(yamlData, authKey)
 	for p, rte := range yamlData {
 		if err = verifyPath(p); err != nil {
 			myLogger.Errorf(
@@ -284,10 +1000,14 @@ func loadRouteYaml(
 				rte.Params[k].Type = defParameterType
 			}
 			if rte.Params[k].Required == nil {
-				rte.Params[k].Required = util.Ptr(defRequiredParameter)
+				rte.Params[k].Required = util.Ptr(defaultRequired(rte.Params[k]))
 			}
 			if rte.Params[k].SourceType == "" {
 				rte.Params[k].SourceType = string(defSourceName)
+				//files can only ever come from a multipart form
+				if rte.Params[k].Type == fileParameterType {
+					rte.Params[k].SourceType = string(sourceFormName)
+				}
 			}
 			myLogger.Tracef(
 				"loading route params for param name: '%s' and param:\n%s",
@@ -300,6 +1020,9 @@ func loadRouteYaml(
 }
 
 func verifyPath(path string) error {
+	if strings.Count(path, "/") > pathBits {
+		return fmt.Errorf("paths can't have more than %d segments", pathBits)
+	}
 	dynamic := false
 	for _, p := range strings.Split(path, "/") {
 		if len(p) == 0 {
@@ -323,7 +1046,19 @@ func verifyPath(path string) error {
 }
 
 func loadRoutes(r io.Reader) (map[string]*route, error) {
-	routeYaml, err := loadRouteYaml(r)
+	rawBytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	routeYaml, err := loadRouteYaml(bytes.NewReader(rawBytes))
+	if err != nil {
+		return nil, err
+	}
+	authYaml, err := loadAuthYaml(rawBytes)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthConfig(authYaml)
 	if err != nil {
 		return nil, err
 	}
@@ -333,6 +1068,26 @@ func loadRoutes(r io.Reader) (map[string]*route, error) {
 		if err != nil {
 			return nil, err
 		}
+		if (rte.static != nil || rte.proxy != nil) && strings.Contains(k, "{") {
+			return nil, fmt.Errorf("route '%s' can't have dynamic paths", k)
+		}
+		if rte.compress, err = newRouteCompression(v.Compress); err != nil {
+			return nil, fmt.Errorf("route '%s': %w", k, err)
+		}
+		if rte.auth, err = auth.forRoute(v.Auth, rte.builtin != noBuiltin); err != nil {
+			return nil, fmt.Errorf("route '%s': %w", k, err)
+		}
+		if rte.access, err = newRouteAccess(v, rte.methods); err != nil {
+			return nil, fmt.Errorf("route '%s': %w", k, err)
+		}
+		if rte.access != nil && rte.auth == nil {
+			return nil, fmt.Errorf(
+				"route '%s': roles and permissions need auth, the route is public", k,
+			)
+		}
+		if rte.cache, err = newRouteCache(v.Cache, rte); err != nil {
+			return nil, fmt.Errorf("route '%s': %w", k, err)
+		}
 		toRet[k] = rte
 	}
 	return toRet, nil
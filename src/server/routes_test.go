@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"landtitle/util"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -803,10 +804,10 @@ func TestRouteParameterIsValid(t *testing.T) {
 		},
 	}
 	for i, td := range testdata {
-		if td.parameter.isValid(td.value) != td.exp {
+		if err := td.parameter.isValid(td.value); (err == nil) != td.exp {
 			t.Errorf(
-				"index: %d, value: '%s', result: %t, exp: %t, msg: '%s'",
-				i, td.value, td.parameter.isValid(td.value), td.exp, td.msg,
+				"index: %d, value: '%s', result: '%v', exp: %t, msg: '%s'",
+				i, td.value, err, td.exp, td.msg,
 			)
 		}
 	}
@@ -830,13 +831,46 @@ foo:
   type: string
   required: true
 `,
-			"a string",
+			"a_string",
 			nil,
 			true,
 			"simple string test",
 		},
 		{
 			`
+foo:
+  type: string
+  required: true
+`,
+			"foo bar!",
+			nil,
+			false,
+			"built in patterns must match the whole value",
+		},
+		{
+			`
+foo:
+  type: string
+  regex: '[a-z]+ [a-z]+!'
+`,
+			"foo bar!",
+			nil,
+			true,
+			"a string regex replaces the built in pattern",
+		},
+		{
+			`
+foo:
+  type: string
+  regex: '\d{3}'
+`,
+			"12345",
+			nil,
+			false,
+			"regexes from yaml must match the whole value",
+		},
+		{
+			`
 foo:
   type: number
   required: true
@@ -889,9 +923,9 @@ foo:
 				t.Errorf("could not instantiate route parameter with error: '%s'", err)
 				continue
 			}
-			res := rteParam.isValid(td.value)
+			res := rteParam.isValid(td.value) == nil
 			if res != td.exp {
-				doError(i, td.msg, "exp: %t, got: %t", td.value, res)
+				doError(i, td.msg, "exp: %t, got: %t", td.exp, res)
 				continue
 			}
 		}
@@ -1003,3 +1037,207 @@ func TestRealRouteYaml(t *testing.T) {
 		}
 	}
 }
+
+func TestParameterConstraints(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		value      string
+		expErr     string
+		msg        string
+	}{
+		//0
+		{"type: number\nmin: 1\nmax: 10", "1", "", "inclusive min"},
+		//1
+		{"type: number\nmin: 1\nmax: 10", "10", "", "inclusive max"},
+		//2
+		{"type: number\nmin: 1\nmax: 10", "0", "less than the minimum of 1", "below min"},
+		//3
+		{"type: number\nmin: 1\nmax: 10", "10.5", "greater than the maximum of 10", "above max"},
+		//4
+		{"type: number\nmin: -2.5", "-3", "less than the minimum of -2.5", "negative float min"},
+		//5
+		{"min_length: 3\nmax_length: 5", "abc", "", "min length"},
+		//6
+		{"min_length: 3\nmax_length: 5", "ab", "shorter than the minimum length of 3", "too short"},
+		//7
+		{"min_length: 3\nmax_length: 5", "abcdef", "longer than the maximum length of 5", "too long"},
+		//8
+		{"max_length: 3\nregex: '.+'", "abé", "", "length counts characters not bytes"},
+		//9
+		{"enum: [deed, lien, plat]", "lien", "", "enum member"},
+		//10
+		{"enum: [deed, lien, plat]", "mortgage", "is not one of: 'deed', 'lien', 'plat'", "not in enum"},
+		//11
+		{"type: number\nenum: [1, 2, 3]", "2", "", "numeric enum"},
+		//12
+		{"type: boolean", "maybe", "is not a valid boolean", "type mismatch message"},
+		//13
+		{"regex: '^\\d+$'", "abc", "does not match pattern", "regex mismatch message"},
+		//14
+		{"default: deed\nenum: [deed, lien]", "", "", "optional with default"},
+	}
+	for i, td := range testData {
+		pYaml := &ParamYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), pYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if pYaml.Type == "" {
+			pYaml.Type = defParameterType
+		}
+		param, err := newParam(pYaml)
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected newParam error: '%s'", err))
+			continue
+		}
+		err = param.isValid(td.value)
+		if td.expErr == "" {
+			if err != nil {
+				t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected error"))
+			continue
+		}
+		if !strings.Contains(err.Error(), td.expErr) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "error mismatch, exp: '%s', got: '%s'",
+					td.expErr, err,
+				),
+			)
+		}
+	}
+}
+
+func TestParameterConstraintLoading(t *testing.T) {
+	testData := []struct {
+		yamlString  string
+		expError    bool
+		expRequired bool
+		msg         string
+	}{
+		//0
+		{"type: number\nmin: 10\nmax: 1", true, true, "min greater than max"},
+		//1
+		{"type: string\nmin: 1", true, true, "min on a string"},
+		//2
+		{"type: number\nmax_length: 1", true, true, "length on a number"},
+		//3
+		{"min_length: 5\nmax_length: 1", true, true, "min_length greater than max_length"},
+		//4
+		{"min_length: -1", true, true, "negative length"},
+		//5
+		{"type: number\nenum: [1, two]", true, true, "enum values must be valid"},
+		//6
+		{"max_length: 2\nenum: [ab, abc]", true, true, "enum values must satisfy constraints"},
+		//7
+		{"type: number\nmin: 1\ndefault: 0", true, false, "default must be valid"},
+		//8
+		{"default: foo\nrequired: true", true, true, "required params can't have defaults"},
+		//9
+		{"type: number\nmin: 1\ndefault: 5", false, false, "default implies not required"},
+		//10
+		{"default: ''", true, false, "empty default isn't a valid string"},
+	}
+	for i, td := range testData {
+		pYaml := &ParamYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), pYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if pYaml.Type == "" {
+			pYaml.Type = defParameterType
+		}
+		param, err := newParam(pYaml)
+		if td.expError {
+			if err == nil {
+				t.Errorf(getTestMessage(i, td.msg, "expected error"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		if param.required != td.expRequired {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "required mismatch, exp: %t, got: %t",
+					td.expRequired, param.required,
+				),
+			)
+		}
+	}
+}
+
+func TestAliasLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		msg        string
+	}{
+		//0
+		{"params:\n  a:\n    aliases: [b]\n  b: {}\ncallbacks: [cb1]", "alias shadows a param"},
+		//1
+		{"params:\n  a:\n    aliases: [c]\n  b:\n    aliases: [c]\ncallbacks: [cb1]", "alias used twice"},
+		//2
+		{"unknown_params: allow\ncallbacks: [cb1]", "bad policy"},
+	}
+	for i, td := range testData {
+		rYaml := &RouteYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), rYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if _, err := newRoute(rYaml); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+	}
+}
+
+func TestPrecedenceLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		expError   bool
+		exp        []sourceType
+		msg        string
+	}{
+		//0
+		{"source: url|query|form", false, defPrecedence, "default order"},
+		//1
+		{"source: url|query|form\nprecedence: [form]", false, []sourceType{sourceForm, sourceQuery, sourceURL}, "listed first"},
+		//2
+		{"source: url|query\nprecedence: [form]", true, nil, "source not allowed"},
+		//3
+		{"source: url|query\nprecedence: [url, url]", true, nil, "listed twice"},
+		//4
+		{"source: url|query\nprecedence: ['url|query']", true, nil, "one source per entry"},
+		//5
+		{"source: url|query\nconflict: loudest", true, nil, "bad conflict mode"},
+	}
+	for i, td := range testData {
+		pYaml := &ParamYaml{Type: defParameterType}
+		if err := yaml.Unmarshal([]byte(td.yamlString), pYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		param, err := newParam(pYaml)
+		if td.expError {
+			if err == nil {
+				t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		if !reflect.DeepEqual(param.precedence, td.exp) {
+			t.Errorf(
+				getTestMessage(i, td.msg, "exp: %v, got: %v", td.exp, param.precedence),
+			)
+		}
+	}
+}
@@ -0,0 +1,763 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+Cross field rules from routes.yaml, eg
+
+	rules:
+	  - rule: end_date > start_date
+	    message: end_date must be after start_date
+	  - rule: count(apn, address) == 1
+	    message: exactly one of apn or address is required
+
+A deliberately tiny expression language over the route's typed params, no
+loops, no assignment, no access to anything but the params. Rules are parsed
+and type checked when the routes load so a typo can't take down a request.
+
+	literals:    12, 1.5, 'single', "double", true, false
+	operators:   || && ! == != < <= > >= + - * / and ( )
+	functions:   present(param)         bool, was the param sent
+	             count(param, ...)      number of the params that were sent
+	             len(string)            length in characters
+	             duration('24h')        duration literal
+
+integer and number params are both numbers, uuid and email are strings,
+date and datetime are times, times subtract to durations and durations add
+to times, object, array and file params only work with present() and
+count().
+A rule that reads a param that wasn't sent is skipped, guard with present()
+or count() when that's not what you want. A failing rule counts toward
+param_validation_failures_total for every param it reads.
+*/
+
+type RuleYaml struct {
+	Rule    string `yaml:"rule"`
+	Message string `yaml:"message,omitempty"`
+}
+
+type exprType string
+
+const (
+	boolExpr     exprType = "bool"
+	numberExpr            = "number"
+	stringExpr            = "string"
+	timeExpr              = "time"
+	durationExpr          = "duration"
+	//only good for present() and count()
+	objectExpr = "object"
+	arrayExpr  = "array"
+	fileExpr   = "file"
+)
+
+func exprTypeForParam(p httpParameterType) exprType {
+	switch p {
+	case numberParameterType, integerParameterType:
+		return numberExpr
+	case booleanParameterType:
+		return boolExpr
+	case dateParameterType, dateTimeParameterType:
+		return timeExpr
+	case durationParameterType:
+		return durationExpr
+	case objectParameterType:
+		return objectExpr
+	case arrayParameterType:
+		return arrayExpr
+	case fileParameterType:
+		return fileExpr
+	}
+	return stringExpr
+}
+
+// converts a typed param value to what the expressions work with
+func exprValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case int64:
+		return float64(v)
+	case UUID:
+		return v.String()
+	}
+	return val
+}
+
+// reading a param that wasn't sent, skips the rule
+var errRuleMissingParam error = errors.New("rule references a missing parameter")
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var ruleOperators []string = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/",
+	"(", ")", ",",
+}
+
+func tokenizeRule(rule string) ([]token, error) {
+	toRet := make([]token, 0)
+	runes := []rune(rule)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) &&
+				(unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			toRet = append(toRet, token{tokIdent, string(runes[start:i]), start})
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			toRet = append(toRet, token{tokNumber, string(runes[start:i]), start})
+		case r == '\'' || r == '"':
+			start := i
+			i++
+			builder := new(strings.Builder)
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					builder.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == r {
+					closed = true
+					i++
+					break
+				}
+				builder.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			toRet = append(toRet, token{tokString, builder.String(), start})
+		default:
+			found := false
+			for _, op := range ruleOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					toRet = append(toRet, token{tokOp, op, i})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", r, i)
+			}
+		}
+	}
+	return append(toRet, token{tokEOF, "", len(runes)}), nil
+}
+
+type ruleNode interface {
+	// params maps names to types, checked once at load
+	check(params map[string]exprType) (exprType, error)
+	eval(values Values) (interface{}, error)
+}
+
+type literalNode struct {
+	val   interface{}
+	eType exprType
+}
+
+func (l *literalNode) check(map[string]exprType) (exprType, error) {
+	return l.eType, nil
+}
+
+func (l *literalNode) eval(Values) (interface{}, error) {
+	return l.val, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) check(params map[string]exprType) (exprType, error) {
+	toRet, ok := params[n.name]
+	if !ok {
+		return "", fmt.Errorf("unknown parameter '%s'", n.name)
+	}
+	return toRet, nil
+}
+
+func (n *identNode) eval(values Values) (interface{}, error) {
+	val, ok := values[n.name]
+	if !ok {
+		return nil, errRuleMissingParam
+	}
+	return exprValue(val), nil
+}
+
+type unaryNode struct {
+	op      string
+	operand ruleNode
+}
+
+func (u *unaryNode) check(params map[string]exprType) (exprType, error) {
+	t, err := u.operand.check(params)
+	if err != nil {
+		return "", err
+	}
+	if u.op == "!" && t == boolExpr {
+		return boolExpr, nil
+	}
+	if u.op == "-" && (t == numberExpr || t == durationExpr) {
+		return t, nil
+	}
+	return "", fmt.Errorf("operator '%s' can't be applied to %s", u.op, t)
+}
+
+func (u *unaryNode) eval(values Values) (interface{}, error) {
+	val, err := u.operand.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case bool:
+		return !v, nil
+	case float64:
+		return -v, nil
+	case time.Duration:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("operator '%s' can't be applied to %T", u.op, val)
+}
+
+type binaryNode struct {
+	op          string
+	left, right ruleNode
+	//operand type, set by check
+	operands exprType
+}
+
+func (b *binaryNode) check(params map[string]exprType) (exprType, error) {
+	lt, err := b.left.check(params)
+	if err != nil {
+		return "", err
+	}
+	rt, err := b.right.check(params)
+	if err != nil {
+		return "", err
+	}
+	mismatch := fmt.Errorf(
+		"operator '%s' can't be applied to %s and %s", b.op, lt, rt,
+	)
+	b.operands = lt
+	switch b.op {
+	case "||", "&&":
+		if lt != boolExpr || rt != boolExpr {
+			return "", mismatch
+		}
+		return boolExpr, nil
+	case "==", "!=":
+		if lt != rt || lt == objectExpr || lt == arrayExpr || lt == fileExpr {
+			return "", mismatch
+		}
+		return boolExpr, nil
+	case "<", "<=", ">", ">=":
+		if lt != rt || lt == boolExpr || lt == objectExpr || lt == arrayExpr ||
+			lt == fileExpr {
+			return "", mismatch
+		}
+		return boolExpr, nil
+	case "+":
+		switch {
+		case lt == numberExpr && rt == numberExpr:
+			return numberExpr, nil
+		case lt == durationExpr && rt == durationExpr:
+			return durationExpr, nil
+		case lt == timeExpr && rt == durationExpr:
+			return timeExpr, nil
+		case lt == stringExpr && rt == stringExpr:
+			return stringExpr, nil
+		}
+	case "-":
+		switch {
+		case lt == numberExpr && rt == numberExpr:
+			return numberExpr, nil
+		case lt == durationExpr && rt == durationExpr:
+			return durationExpr, nil
+		case lt == timeExpr && rt == durationExpr:
+			return timeExpr, nil
+		case lt == timeExpr && rt == timeExpr:
+			return durationExpr, nil
+		}
+	case "*", "/":
+		if lt == numberExpr && rt == numberExpr {
+			return numberExpr, nil
+		}
+	}
+	return "", mismatch
+}
+
+func compareOrdered[T float64 | string | time.Duration](op string, l, r T) bool {
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+func compareTimes(op string, l, r time.Time) bool {
+	switch op {
+	case "==":
+		return l.Equal(r)
+	case "!=":
+		return !l.Equal(r)
+	case "<":
+		return l.Before(r)
+	case "<=":
+		return !l.After(r)
+	case ">":
+		return l.After(r)
+	}
+	return !l.Before(r)
+}
+
+func (b *binaryNode) eval(values Values) (interface{}, error) {
+	left, err := b.left.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	//short circuit so guards like present(foo) && foo > 1 work
+	if b.op == "&&" && !left.(bool) {
+		return false, nil
+	}
+	if b.op == "||" && left.(bool) {
+		return true, nil
+	}
+	right, err := b.right.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "&&", "||":
+		return right.(bool), nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		switch l := left.(type) {
+		case bool:
+			if b.op == "==" {
+				return l == right.(bool), nil
+			}
+			return l != right.(bool), nil
+		case float64:
+			return compareOrdered(b.op, l, right.(float64)), nil
+		case string:
+			return compareOrdered(b.op, l, right.(string)), nil
+		case time.Duration:
+			return compareOrdered(b.op, l, right.(time.Duration)), nil
+		case time.Time:
+			return compareTimes(b.op, l, right.(time.Time)), nil
+		}
+	case "+":
+		switch l := left.(type) {
+		case float64:
+			return l + right.(float64), nil
+		case string:
+			return l + right.(string), nil
+		case time.Duration:
+			return l + right.(time.Duration), nil
+		case time.Time:
+			return l.Add(right.(time.Duration)), nil
+		}
+	case "-":
+		switch l := left.(type) {
+		case float64:
+			return l - right.(float64), nil
+		case time.Duration:
+			return l - right.(time.Duration), nil
+		case time.Time:
+			if r, ok := right.(time.Time); ok {
+				return l.Sub(r), nil
+			}
+			return l.Add(-right.(time.Duration)), nil
+		}
+	case "*":
+		return left.(float64) * right.(float64), nil
+	case "/":
+		if right.(float64) == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return left.(float64) / right.(float64), nil
+	}
+	return nil, fmt.Errorf("operator '%s' can't be applied to %T", b.op, left)
+}
+
+type callNode struct {
+	name string
+	args []ruleNode
+}
+
+func (c *callNode) check(params map[string]exprType) (exprType, error) {
+	switch c.name {
+	case "present", "count":
+		if len(c.args) == 0 || c.name == "present" && len(c.args) != 1 {
+			return "", fmt.Errorf("wrong number of arguments to %s()", c.name)
+		}
+		for _, a := range c.args {
+			ident, ok := a.(*identNode)
+			if !ok {
+				return "", fmt.Errorf("%s() only takes parameter names", c.name)
+			}
+			if _, err := ident.check(params); err != nil {
+				return "", err
+			}
+		}
+		if c.name == "present" {
+			return boolExpr, nil
+		}
+		return numberExpr, nil
+	case "len":
+		if len(c.args) != 1 {
+			return "", fmt.Errorf("wrong number of arguments to len()")
+		}
+		t, err := c.args[0].check(params)
+		if err != nil {
+			return "", err
+		}
+		if t != stringExpr {
+			return "", fmt.Errorf("len() can't be applied to %s", t)
+		}
+		return numberExpr, nil
+	case "duration":
+		if len(c.args) != 1 {
+			return "", fmt.Errorf("wrong number of arguments to duration()")
+		}
+		lit, ok := c.args[0].(*literalNode)
+		if !ok || lit.eType != stringExpr {
+			return "", fmt.Errorf("duration() only takes a string literal")
+		}
+		d, err := time.ParseDuration(lit.val.(string))
+		if err != nil {
+			return "", err
+		}
+		//parse once here rather than every request
+		c.args[0] = &literalNode{d, durationExpr}
+		return durationExpr, nil
+	}
+	return "", fmt.Errorf("unknown function '%s'", c.name)
+}
+
+func (c *callNode) eval(values Values) (interface{}, error) {
+	switch c.name {
+	case "present":
+		_, ok := values[c.args[0].(*identNode).name]
+		return ok, nil
+	case "count":
+		toRet := 0
+		for _, a := range c.args {
+			if _, ok := values[a.(*identNode).name]; ok {
+				toRet++
+			}
+		}
+		return float64(toRet), nil
+	case "len":
+		val, err := c.args[0].eval(values)
+		if err != nil {
+			return nil, err
+		}
+		return float64(len([]rune(val.(string)))), nil
+	case "duration":
+		return c.args[0].eval(values)
+	}
+	return nil, fmt.Errorf("unknown function '%s'", c.name)
+}
+
+type ruleParser struct {
+	tokens []token
+	pos    int
+	//the params the rule reads, in the order they first show up
+	params []string
+}
+
+func (p *ruleParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() token {
+	toRet := p.tokens[p.pos]
+	if toRet.kind != tokEOF {
+		p.pos++
+	}
+	return toRet
+}
+
+func (p *ruleParser) isOp(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *ruleParser) expect(op string) error {
+	tok := p.next()
+	if tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected '%s' at position %d, got: '%s'", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// one precedence level of left associative binary operators
+func (p *ruleParser) binary(
+	next func() (ruleNode, error), ops ...string,
+) (ruleNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.isOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	return p.binary(p.parseAnd, "||")
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	return p.binary(p.parseComparison, "&&")
+}
+
+// comparisons don't chain, a < b < c is an error
+func (p *ruleParser) parseComparison() (ruleNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.isOp("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *ruleParser) parseAdditive() (ruleNode, error) {
+	return p.binary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *ruleParser) parseMultiplicative() (ruleNode, error) {
+	return p.binary(p.parseUnary, "*", "/")
+}
+
+func (p *ruleParser) parseUnary() (ruleNode, error) {
+	if op, ok := p.isOp("!", "-"); ok {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *ruleParser) parsePrimary() (ruleNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		num, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", tok.text, tok.pos)
+		}
+		return &literalNode{num, numberExpr}, nil
+	case tokString:
+		return &literalNode{tok.text, stringExpr}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true, boolExpr}, nil
+		case "false":
+			return &literalNode{false, boolExpr}, nil
+		}
+		if _, ok := p.isOp("("); !ok {
+			if !slices.Contains(p.params, tok.text) {
+				p.params = append(p.params, tok.text)
+			}
+			return &identNode{tok.text}, nil
+		}
+		p.next()
+		call := &callNode{name: tok.text}
+		if _, ok := p.isOp(")"); ok {
+			p.next()
+			return call, nil
+		}
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.isOp(","); ok {
+				p.next()
+				continue
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return call, nil
+		}
+	case tokOp:
+		if tok.text == "(" {
+			toRet, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return toRet, nil
+		}
+	}
+	if tok.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of rule")
+	}
+	return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos)
+}
+
+type routeRule struct {
+	source  string
+	message string
+	root    ruleNode
+	params  []string
+}
+
+type routeRules []*routeRule
+
+// parses and type checks rule against the route's params, it has to
+// come out a bool
+func newRouteRule(r *RuleYaml, params routeParameterMap) (*routeRule, error) {
+	if r == nil || strings.TrimSpace(r.Rule) == "" {
+		return nil, fmt.Errorf("rules can't be empty")
+	}
+	tokens, err := tokenizeRule(r.Rule)
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s': %w", r.Rule, err)
+	}
+	parser := &ruleParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s': %w", r.Rule, err)
+	}
+	if tok := parser.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf(
+			"rule '%s': unexpected '%s' at position %d", r.Rule, tok.text, tok.pos,
+		)
+	}
+	types := make(map[string]exprType)
+	for name, param := range params {
+		types[name] = exprTypeForParam(param.pType)
+	}
+	t, err := root.check(types)
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s': %w", r.Rule, err)
+	}
+	if t != boolExpr {
+		return nil, fmt.Errorf("rule '%s' must be a bool, got: %s", r.Rule, t)
+	}
+	message := r.Message
+	if message == "" {
+		message = fmt.Sprintf("rule failed: '%s'", r.Rule)
+	}
+	return &routeRule{
+		source:  r.Rule,
+		message: message,
+		root:    root,
+		params:  parser.params,
+	}, nil
+}
+
+func newRouteRules(rs []*RuleYaml, params routeParameterMap) (routeRules, error) {
+	toRet := make(routeRules, len(rs))
+	for i, r := range rs {
+		rule, err := newRouteRule(r, params)
+		if err != nil {
+			return nil, err
+		}
+		toRet[i] = rule
+	}
+	return toRet, nil
+}
+
+type ruleError struct {
+	rule    string
+	message string
+	//what the rule reads, counted as failed
+	params []string
+}
+
+func (r *ruleError) Error() string {
+	return r.message
+}
+
+// the first failing rule, in routes.yaml order
+func (rs routeRules) check(values Values) error {
+	for _, r := range rs {
+		res, err := r.root.eval(values)
+		if errors.Is(err, errRuleMissingParam) {
+			myLogger.Tracef("skipping rule '%s', parameter missing", r.source)
+			continue
+		}
+		if err != nil {
+			return &ruleError{r.source, fmt.Sprintf("%s: %s", r.message, err), r.params}
+		}
+		if !res.(bool) {
+			return &ruleError{r.source, r.message, r.params}
+		}
+	}
+	return nil
+}
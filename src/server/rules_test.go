@@ -0,0 +1,238 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleLoading(t *testing.T) {
+	params := routeParameterMap{
+		"count":   &routeParameter{pType: integerParameterType},
+		"ratio":   &routeParameter{pType: numberParameterType},
+		"name":    &routeParameter{pType: stringParameterType},
+		"id":      &routeParameter{pType: uuidParameterType},
+		"active":  &routeParameter{pType: booleanParameterType},
+		"start":   &routeParameter{pType: dateParameterType},
+		"end":     &routeParameter{pType: dateTimeParameterType},
+		"timeout": &routeParameter{pType: durationParameterType},
+	}
+	testData := []struct {
+		rule     string
+		expError bool
+		msg      string
+	}{
+		//0
+		{"count > ratio", false, "integers and numbers compare"},
+		//1
+		{"count > name", true, "number and string don't compare"},
+		//2
+		{"count", true, "rules must be bools"},
+		//3
+		{"missing == 1", true, "unknown param"},
+		//4
+		{"end - start < timeout && active", false, "time arithmetic"},
+		//5
+		{"start + timeout < end", false, "time plus duration"},
+		//6
+		{"start + start < end", true, "times don't add"},
+		//7
+		{"present(name) || !active", false, "present and not"},
+		//8
+		{"present('name')", true, "present only takes params"},
+		//9
+		{"count(name, id, active) == 1", false, "count of params"},
+		//10
+		{"len(id) == 36 && len(name) <= 10", false, "uuids are strings"},
+		//11
+		{"len(count) == 1", true, "len of a number"},
+		//12
+		{"timeout < duration('1h')", false, "duration literal"},
+		//13
+		{"timeout < duration('forever')", true, "bad duration literal"},
+		//14
+		{"system('rm -rf /')", true, "unknown function"},
+		//15
+		{"count > 1 count < 5", true, "trailing tokens"},
+		//16
+		{"(count > 1", true, "unbalanced parens"},
+		//17
+		{"name == 'unterminated", true, "unterminated string"},
+		//18
+		{"count = 1", true, "assignment isn't an operator"},
+		//19
+		{"1 < count < 5", true, "comparisons don't chain"},
+		//20
+		{"", true, "empty rule"},
+		//21
+		{"active == true && -ratio < 0", false, "bool literals and negation"},
+	}
+	for i, td := range testData {
+		_, err := newRouteRule(&RuleYaml{Rule: td.rule}, params)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error for rule: '%s'", td.rule))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestRuleCheck(t *testing.T) {
+	params := routeParameterMap{
+		"apn":     &routeParameter{pType: stringParameterType},
+		"address": &routeParameter{pType: stringParameterType},
+		"page":    &routeParameter{pType: integerParameterType},
+		"start":   &routeParameter{pType: dateParameterType},
+		"end":     &routeParameter{pType: dateParameterType},
+	}
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	testData := []struct {
+		rule   string
+		values Values
+		expErr bool
+		msg    string
+	}{
+		//0
+		{"count(apn, address) == 1", Values{"apn": "1"}, false, "one of"},
+		//1
+		{"count(apn, address) == 1", Values{"apn": "1", "address": "x"}, true, "both"},
+		//2
+		{"count(apn, address) == 1", Values{}, true, "neither"},
+		//3
+		{"end > start", Values{"start": day(1), "end": day(2)}, false, "after"},
+		//4
+		{"end > start", Values{"start": day(2), "end": day(1)}, true, "before"},
+		//5
+		{"end > start", Values{"start": day(2)}, false, "missing params skip the rule"},
+		//6
+		{"present(end) && end > start", Values{"start": day(2)}, true, "guarded"},
+		//7
+		{"end - start <= duration('48h')", Values{"start": day(1), "end": day(4)}, true, "range too long"},
+		//8
+		{"page * 2 + 1 == 7", Values{"page": int64(3)}, false, "integer arithmetic"},
+		//9
+		{"page / 0 > 1", Values{"page": int64(3)}, true, "division by zero"},
+		//10
+		{"apn + '-' + address == 'a-b'", Values{"apn": "a", "address": "b"}, false, "concatenation"},
+		//11
+		{"page > 1 || end > start", Values{"page": int64(2)}, false, "short circuit skips missing"},
+	}
+	for i, td := range testData {
+		rules, err := newRouteRules([]*RuleYaml{{Rule: td.rule}}, params)
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "failed loading rule: '%s'", err))
+			continue
+		}
+		err = rules.check(td.values)
+		if td.expErr && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected rule '%s' to fail", td.rule))
+		}
+		if !td.expErr && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
+
+func TestServerRules(t *testing.T) {
+	serverYaml, err := os.Open("testdata/rules.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+		WithMetricsPath("/metrics"),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		target  string
+		expCode int
+		expBody string
+		msg     string
+	}{
+		//0
+		{"http://example.com/search?apn=12345678", http.StatusOK, "", "apn only"},
+		//1
+		{
+			"http://example.com/search?apn=1234&address=main",
+			http.StatusBadRequest,
+			"exactly one of apn or address is required",
+			"both apn and address",
+		},
+		//2
+		{
+			"http://example.com/search?address=main&start_date=2024-02-01&end_date=2024-01-01",
+			http.StatusBadRequest,
+			"end_date must be after start_date",
+			"dates out of order",
+		},
+		//3
+		{
+			"http://example.com/search?address=main&start_date=2020-01-01&end_date=2024-01-01",
+			http.StatusBadRequest,
+			"rule failed: 'end_date - start_date <= duration('8760h')'",
+			"default message",
+		},
+		//4
+		{
+			"http://example.com/search?address=main&start_date=2024-01-01&end_date=2024-02-01",
+			http.StatusOK,
+			"",
+			"dates in order",
+		},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", td.target, nil)
+		testServer.pathHandlers["/search"].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "body missing '%s', got: '%s'", td.expBody, w.Body.String(),
+				),
+			)
+		}
+	}
+	//each param a failed rule reads is counted
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	for _, line := range []string{
+		`landtitle_param_validation_failures_total{route="/search",param="apn"} 1`,
+		`landtitle_param_validation_failures_total{route="/search",param="address"} 1`,
+		`landtitle_param_validation_failures_total{route="/search",param="end_date"} 2`,
+		`landtitle_param_validation_failures_total{route="/search",param="start_date"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics missing line: '%s'", line)
+		}
+	}
+	yamlString := "/bad:\n  params:\n    a:\n      type: number\n  rules:\n    - rule: a == 'x'\n  callbacks: [cb1]\n"
+	_, err = NewServer(
+		strings.NewReader(yamlString),
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+	)
+	if err == nil {
+		t.Errorf("rules that don't type check should fail NewServer")
+	}
+}
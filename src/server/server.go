@@ -1,16 +1,26 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"landtitle/tracing"
 	"landtitle/util"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	logger "github.com/buhduh42/go-logger"
 )
 
+// RFC 7234 section 5.5, 299 is a miscellaneous persistent warning
+const warningHeader string = "Warning"
+
 type httpMethod string
 
 const (
@@ -49,25 +59,97 @@ type Server interface {
 
 type server struct {
 	pathHandlers map[string]*myHandler
+	//metrics and the like, served with the routes unless adminPort is set
+	adminHandlers map[string]http.Handler
+	adminPort     *int
+	metrics       *serverMetrics
+	metricsPath   string
+	tracer        *tracing.Tracer
+	readiness     *readinessChecks
+	livenessPath  string
+	readinessPath string
+	versionPath   string
+	uploadSink    UploadSink
+	limits        *Limits
+	limiter       RateLimitStore
+	//nil without WithSessions
+	sessions *sessionManager
+	//built once the routes are known, nil without WithTemplates
+	templateConfig *TemplateConfig
+	templates      *templateSet
+	//by name, for static: routes with fs:
+	staticFS map[string]fs.FS
+	//nil unless WithCompression, routes can still turn it on
+	compression *CompressionConfig
+	//by content coding, gzip and br are always there
+	encoders map[string]Encoder
+	//shared by routes with cache: store
+	responseCache *responseCache
 }
 
 func (s *server) StartServer(port int) error {
+	mux := http.NewServeMux()
 	for path, handler := range s.pathHandlers {
-		http.Handle(path, handler)
+		mux.Handle(path, handler)
+	}
+	if s.adminPort == nil {
+		for path, handler := range s.adminHandlers {
+			mux.Handle(path, handler)
+		}
+		return s.limits.newHTTPServer(fmt.Sprintf(":%d", port), mux).ListenAndServe()
+	}
+	adminMux := http.NewServeMux()
+	for path, handler := range s.adminHandlers {
+		adminMux.Handle(path, handler)
 	}
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- s.limits.newHTTPServer(
+			fmt.Sprintf(":%d", *s.adminPort), adminMux,
+		).ListenAndServe()
+	}()
+	go func() {
+		errs <- s.limits.newHTTPServer(fmt.Sprintf(":%d", port), mux).ListenAndServe()
+	}()
+	//either listener going down takes the whole thing with it
+	return <-errs
 }
 
 const pathBits int = 255
 
 type myHandler struct {
+	//the route template from routes.yaml, eg /foo/{bar}
+	path         string
 	callbacks    []Callback
 	dynamicPaths []string
-	//NOTE we probably got problems if there are more than 255 subpaths
-	//is that a security flaw if someone throws 255 slashes at a URL?
+	//verifyPath keeps routes to pathBits segments and max path segments
+	//turns away anything deeper before it gets here
 	//NOTE pathBits needs to be 2^bitcount of below
 	dynamicPathIndex uint8
 	route            *route
+	//set for builtin and static routes, runs in place of parameters and
+	//callbacks
+	builtin http.Handler
+	metrics *serverMetrics
+	//nil falls back to the global tracer
+	tracer *tracing.Tracer
+	//nil falls back to a temp dir sink
+	sink UploadSink
+	//the server's limits with the route's on top, nil uses the defaults
+	limits *Limits
+	//shared by every route, keys are prefixed with the route
+	limiter RateLimitStore
+	//nil when the server has no sessions
+	sessions *sessionManager
+	//nil when the server has no templates
+	templates *templateSet
+	//set for proxy routes, runs in place of parameters and callbacks once
+	//the request has a slot and its timeout
+	proxy http.Handler
+	//nil when the route's responses aren't compressed
+	compressor *compressor
+	//the server's, nil falls back to no storing
+	cache *responseCache
 }
 
 // TODO, rewrite ServerHTTP using this to break ServeHTTP up
@@ -86,6 +168,9 @@ func (m *myHandler) buildDynamicParameters(
 		)
 	}
 	dynamicPaths := subPaths[m.dynamicPathIndex:]
+	if len(dynamicPaths) > len(m.dynamicPaths) {
+		return nil, fmt.Errorf("too many path segments for path: '%s'", path)
+	}
 	for i, p := range dynamicPaths {
 		if _, ok := m.route.params[m.dynamicPaths[i]]; !ok {
 			return nil, fmt.Errorf(
@@ -106,139 +191,449 @@ func (m *myHandler) buildDynamicParameters(
 	return toRet, nil
 }
 
-func (m *myHandler) doQueryParameters(queryStr string) (map[string]string, error) {
+func (m *myHandler) doQueryParameters(
+	queryStr string, aliases map[string]string,
+) (map[string]string, error) {
 	values, err := url.ParseQuery(queryStr)
 	if err != nil {
 		return nil, err
 	}
+	return m.doSourceParameters(values, sourceQuery, aliases)
+}
+
+func (m *myHandler) doFormParameters(
+	values url.Values, aliases map[string]string,
+) (map[string]string, error) {
+	return m.doSourceParameters(values, sourceForm, aliases)
+}
+
+// keys are resolved through the route's aliases, aliases used are recorded
+// in aliases keyed by the name the client sent, undeclared keys are handled
+// per the route's unknown_params policy, bracketed keys for object and
+// array params are kept as sent, see nested.go
+func (m *myHandler) doSourceParameters(
+	values url.Values, source sourceType, aliases map[string]string,
+) (map[string]string, error) {
 	toRet := make(map[string]string)
 	for k, v := range values {
-		if len(v) > 1 {
-			return nil, fmt.Errorf("only single valued query parameters allowed")
+		base, path, err := splitBracketKey(k)
+		if err != nil {
+			return nil, err
+		}
+		//sort[]=a&sort[]=b is the one multi valued form allowed
+		appending := len(path) > 0 && path[len(path)-1] == ""
+		if len(v) > 1 && !appending {
+			return nil, fmt.Errorf(
+				"only single valued %s parameters allowed", sourceNames[source],
+			)
 		}
-		param, ok := m.route.params[k]
+		name := base
+		if canonical, ok := m.route.aliases[base]; ok {
+			name = canonical
+			aliases[base] = canonical
+			if _, ok = values[canonical]; ok {
+				return nil, fmt.Errorf(
+					"parameter '%s' sent as both '%s' and its alias '%s'",
+					canonical, canonical, base,
+				)
+			}
+		}
+		param, ok := m.route.params[name]
 		if !ok {
+			switch m.route.unknownParams {
+			case ignoreUnknownParams:
+				myLogger.Tracef("ignoring unknown parameter '%s'", k)
+				continue
+			case passthroughUnknownParams:
+				toRet[k] = strings.Join(v, ",")
+				continue
+			}
 			return nil, fmt.Errorf("%s not found in parameter values for route", k)
 		}
-		if sourceQuery&param.source == 0 {
-			return nil, fmt.Errorf("parameter '%s' not allowed in query", k)
-		} else {
-			toRet[k] = v[0]
+		if source&param.source == 0 {
+			return nil, fmt.Errorf(
+				"parameter '%s' not allowed in %s", name, sourceNames[source],
+			)
 		}
-	}
-	return toRet, nil
-}
-
-func (m *myHandler) doFormParameters(values url.Values) (map[string]string, error) {
-	toRet := make(map[string]string)
-	for k, v := range values {
-		if len(v) > 1 {
-			return nil, fmt.Errorf("only single valued post parameters allowed")
+		if len(path) > 0 && !isNestedType(param.pType) {
+			return nil, fmt.Errorf("parameter '%s' doesn't take brackets", name)
 		}
-		param, ok := m.route.params[k]
-		if !ok {
-			return nil, fmt.Errorf("%s not found in parameter values for route", k)
+		if !appending {
+			toRet[joinBracketKey(name, path)] = v[0]
+			continue
 		}
-		if sourceForm&param.source > 0 {
-			toRet[k] = v[0]
-		} else {
-			return nil, fmt.Errorf("parameter '%s' not allowed in form", k)
+		for _, val := range v {
+			//after any explicit indices already there
+			i := 0
+			for {
+				path[len(path)-1] = strconv.Itoa(i)
+				if _, ok := toRet[joinBracketKey(name, path)]; !ok {
+					break
+				}
+				i++
+			}
+			toRet[joinBracketKey(name, path)] = val
 		}
 	}
 	return toRet, nil
 }
 
-// TODO break this up, use buildDynamicParameters
-// TODO contexts?
 func (m *myHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	myLogger.Debugf("Serving HTTP for handler:\n%+v", m)
-	myLogger.Debugf("request:\n%+v", r)
-	validMethod := false
-	for _, method := range m.route.methods {
-		toCheck := strings.ToLower(r.Method)
-		if string(method) == toCheck {
-			validMethod = true
-			break
+	start := time.Now()
+	m.metrics.requestStarted(m.path)
+	opts := []tracing.StartOption{
+		tracing.WithKind(tracing.SpanKindServer),
+		tracing.WithAttributes(
+			tracing.Attribute{Key: "http.method", Value: r.Method},
+			tracing.Attribute{Key: "http.route", Value: m.path},
+			tracing.Attribute{Key: "http.target", Value: r.URL.RequestURI()},
+		),
+	}
+	if remote, ok := tracing.Extract(r.Header); ok {
+		opts = append(opts, tracing.WithRemoteParent(remote))
+	}
+	ctx, span := m.tracer.Start(
+		r.Context(), fmt.Sprintf("%s %s", r.Method, m.path), opts...,
+	)
+	r = r.WithContext(ctx)
+	rec := newStatusRecorder(w)
+	defer func() {
+		span.SetAttribute("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, http.StatusText(rec.status))
 		}
+		span.End()
+		m.metrics.requestFinished(m.path, r.Method, rec.status, time.Since(start))
+	}()
+	m.serveHTTP(rec, r)
+}
+
+// what the handler writes back when it fails before the callbacks run
+type handlerError struct {
+	code    int
+	message string
+}
+
+func (h *handlerError) Error() string {
+	return fmt.Sprintf("http code: %d, message: '%s'", h.code, h.message)
+}
+
+func (m *myHandler) writeError(
+	w http.ResponseWriter, r *http.Request, hErr *handlerError,
+) {
+	Error(w, r, hErr.code, hErr.message)
+	myLogger.Errorf(
+		"ServerHTTP failed with error message: '%s', http code: %d",
+		hErr.message, hErr.code,
+	)
+}
+
+// counts every param err names, a failed rule names the params it reads
+func (m *myHandler) validationFailed(err error) {
+	var pErrs parameterErrors
+	if errors.As(err, &pErrs) {
+		for _, pErr := range pErrs {
+			m.metrics.validationFailed(m.path, pErr.param)
+		}
+		return
 	}
-	if !validMethod {
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+	var rErr *ruleError
+	if errors.As(err, &rErr) {
+		for _, param := range rErr.params {
+			m.metrics.validationFailed(m.path, param)
+		}
 		return
 	}
-	myLogger.Tracef("valid method for request found, '%s'", r.Method)
-	var errorCode int
-	var message string
-	var ok bool
+	var pErr *parameterError
+	if errors.As(err, &pErr) {
+		m.metrics.validationFailed(m.path, pErr.param)
+	}
+}
+
+// builds the parameter map from the url, query and form values then
+// validates it against the route, the typed values are the same
+// parameters converted to their declared types
+// returns the normalized parameter values, the rest of what was worked
+// out along the way is in the state
+func (m *myHandler) parseParameters(
+	r *http.Request,
+) (toRet map[string]string, state *requestState, hErr *handlerError) {
 	myLogger.Tracef("building parameters for path: '%s'", r.URL.Path)
 	urlParameters, err := m.buildDynamicParameters(r.URL.Path)
-	var fValues, qValues, parameterValues map[string]string
 	if err != nil {
-		errorCode = http.StatusBadRequest
-		message = "unable to build dynamic parameter map from request url"
 		myLogger.Debugf(
 			"dynamic parameter build failed for url: '%s', error: '%s'",
 			r.URL.Path, err,
 		)
-		goto doError
+		return nil, nil, &handlerError{
+			http.StatusBadRequest,
+			"unable to build dynamic parameter map from request url",
+		}
 	}
 	myLogger.Tracef("urlParameters: '%v'", urlParameters)
-	qValues, err = m.doQueryParameters(r.URL.RawQuery)
+	aliases := make(map[string]string)
+	qValues, err := m.doQueryParameters(r.URL.RawQuery, aliases)
 	if err != nil {
-		myLogger.Errorf("invalid query parameters: %v", r.URL.Query)
-		message = "invalid query parameters"
-		errorCode = http.StatusBadRequest
-		goto doError
+		myLogger.Errorf("invalid query parameters: %v", r.URL.Query())
+		return nil, nil, &handlerError{http.StatusBadRequest, "invalid query parameters"}
 	}
 	myLogger.Tracef("query parameters: '%v'", qValues)
-	r.ParseForm()
-	fValues, err = m.doFormParameters(r.PostForm)
+	if err = r.ParseForm(); err != nil && m.bodyTooLarge(err) {
+		return nil, nil, &handlerError{http.StatusRequestEntityTooLarge, "request body too large"}
+	}
+	formValues := r.PostForm
+	var uploads map[string][]*FileUpload
+	switch {
+	case !m.route.params.fromForm():
+	case isJSONRequest(r):
+		maxBytes := maxJSONBodyBytes
+		if m.limits != nil && m.limits.MaxBodyBytes > 0 {
+			maxBytes = m.limits.MaxBodyBytes
+		}
+		if formValues, err = jsonFormValues(r, maxBytes); err != nil {
+			if m.bodyTooLarge(err) {
+				return nil, nil, &handlerError{
+					http.StatusRequestEntityTooLarge, "request body too large",
+				}
+			}
+			myLogger.Debugf("invalid json body: '%s'", err)
+			return nil, nil, &handlerError{http.StatusBadRequest, "invalid json body"}
+		}
+	case isMultipartRequest(r):
+		if formValues, uploads, hErr = m.parseMultipart(r, aliases); hErr != nil {
+			return nil, nil, hErr
+		}
+		//nothing stored survives a request that fails from here
+		defer func() {
+			if hErr != nil {
+				m.discardUploads(r.Context(), uploads)
+			}
+		}()
+	}
+	if err = m.route.params.checkUploads(uploads); err != nil {
+		m.metrics.validationFailed(m.path, err.(*parameterError).param)
+		return nil, nil, &handlerError{
+			http.StatusBadRequest,
+			fmt.Sprintf("parameter not valid, error: '%s'", err),
+		}
+	}
+	if hErr = m.checkCSRF(r, formValues); hErr != nil {
+		return nil, nil, hErr
+	}
+	fValues, err := m.doFormParameters(formValues, aliases)
 	if err != nil {
 		myLogger.Errorf("invalid form parameters: %v", r.PostForm)
-		message = "invalid form parameters"
-		errorCode = http.StatusBadRequest
-		goto doError
+		return nil, nil, &handlerError{http.StatusBadRequest, "invalid form parameters"}
 	}
 	myLogger.Tracef("form parameters: '%v'", fValues)
 
-	parameterValues = make(map[string]string)
-	for k, v := range fValues {
-		parameterValues[k] = v
+	parameterValues, err := m.route.params.merge(map[sourceType]map[string]string{
+		sourceForm:  fValues,
+		sourceURL:   urlParameters,
+		sourceQuery: qValues,
+	})
+	if err != nil {
+		m.validationFailed(err)
+		return nil, nil, &handlerError{http.StatusBadRequest, err.Error()}
 	}
-	for k, v := range urlParameters {
-		parameterValues[k] = v
+
+	raw := make(map[string]string, len(parameterValues))
+	for k, v := range parameterValues {
+		raw[k] = v
 	}
-	for k, v := range qValues {
-		parameterValues[k] = v
+	m.route.params.transform(parameterValues)
+	m.route.params.applyDefaults(parameterValues)
+	typedValues, err := m.route.params.parse(parameterValues)
+	if err != nil {
+		m.validationFailed(err)
+		return nil, nil, &handlerError{
+			http.StatusBadRequest,
+			fmt.Sprintf("parameter not valid, error: '%s'", err),
+		}
 	}
+	for pName, files := range uploads {
+		typedValues[pName] = files
+	}
+	if err = m.route.rules.check(typedValues); err != nil {
+		myLogger.Debugf("rule failed for path: '%s', error: '%s'", r.URL.Path, err)
+		m.validationFailed(err)
+		return nil, nil, &handlerError{http.StatusBadRequest, err.Error()}
+	}
+	return parameterValues, &requestState{
+		typed:    typedValues,
+		raw:      raw,
+		aliases:  aliases,
+		uploads:  uploads,
+		produces: m.route.produces,
+		store:    newStore(),
+	}, nil
+}
 
-	if err = m.route.params.validate(parameterValues); err != nil {
-		errorCode = http.StatusBadRequest
-		message = fmt.Sprintf("parameter not valid, error: '%s'", err)
-		goto doError
+func (m *myHandler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	myLogger.Debugf("Serving HTTP for handler:\n%+v", m)
+	myLogger.Debugf("request:\n%+v", r)
+	validMethod := false
+	for _, method := range m.route.methods {
+		toCheck := strings.ToLower(r.Method)
+		if string(method) == toCheck {
+			validMethod = true
+			break
+		}
+	}
+	if !validMethod {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	myLogger.Tracef("valid method for request found, '%s'", r.Method)
+	if cw := m.compressor.newWriter(w, r); cw != nil {
+		w = cw
+		defer cw.close()
+	}
+	if hErr := m.enforceLimits(w, r); hErr != nil {
+		m.writeError(w, r, hErr)
+		return
+	}
+	if !m.route.rateLimit.afterParse() {
+		if hErr := m.checkRateLimit(w, r, nil); hErr != nil {
+			m.writeError(w, r, hErr)
+			return
+		}
+	}
+	r, sw := m.startSession(w, r)
+	if sw != nil {
+		w = sw
+		defer sw.commit()
+	}
+	authed, hErr := m.authenticate(w, r)
+	if hErr != nil {
+		m.writeError(w, r, hErr)
+		return
+	}
+	r = authed
+	if hErr = m.authorize(r); hErr != nil {
+		writeProblem(w, r, hErr)
+		return
+	}
+	if len(m.route.produces) > 0 && Negotiate(r, m.route.produces...) == "" {
+		w.Header().Add("Vary", "Accept")
+		Error(w, r, http.StatusNotAcceptable, fmt.Sprintf(
+			"available: %s", strings.Join(m.route.produces, ", "),
+		))
+		return
+	}
+	if m.builtin != nil {
+		m.builtin.ServeHTTP(w, r)
+		return
+	}
+	release, hErr := m.acquireSlot(w, r)
+	if hErr != nil {
+		m.writeError(w, r, hErr)
+		return
+	}
+	//the callbacks take over the slot once they start, they can outlive
+	//this with a timeout
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	if m.route.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), m.route.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if m.proxy != nil {
+		//no form to look in, only the header token counts
+		if hErr = m.checkCSRF(r, url.Values{}); hErr != nil {
+			m.writeError(w, r, hErr)
+			return
+		}
+		m.proxy.ServeHTTP(w, r)
+		return
+	}
+	ctx, span := m.tracer.Start(r.Context(), "parse parameters")
+	parameterValues, state, hErr := m.parseParameters(r.WithContext(ctx))
+	hErr = m.parseTimedOut(r, hErr)
+	if hErr != nil {
+		span.RecordError(hErr)
+	}
+	span.End()
+	if hErr == nil && m.route.rateLimit.afterParse() {
+		if hErr = m.checkRateLimit(w, r, parameterValues); hErr != nil {
+			m.discardUploads(r.Context(), state.uploads)
+		}
+	}
+	if hErr != nil {
+		m.writeError(w, r, hErr)
+		return
+	}
+	cw, hit := m.startCache(w, r, parameterValues)
+	if hit {
+		m.discardUploads(r.Context(), state.uploads)
+		return
+	}
+	if cw != nil {
+		w = cw
+	}
+	state.cache = m.newCacheState(cw)
+	r = withRequestState(r, state)
+	for alias, name := range state.aliases {
+		w.Header().Add(
+			warningHeader,
+			fmt.Sprintf(
+				`299 - "parameter '%s' is deprecated, use '%s'"`, alias, name,
+			),
+		)
 	}
 	//NOTE it's POSSIBLE params wouldn't be updated between sequential
 	//callback calls, can't think of a clean way to test, moving on
 	//All header/response writes are delegated to the callbacks from here
 	//even if a callback fails w/o writing an error a 200 would be returned by default
-	for _, callback := range m.callbacks {
-		myLogger.Tracef("calling callback with parameters: %+v", parameterValues)
-		ok, err = callback(parameterValues, w, r)
-		myLogger.Tracef("callback returned %t", ok)
-		if !ok || err != nil {
-			//TODO logging, leaving callbacks to do their writing
-			if err != nil {
-				myLogger.Errorf("callback returned error: '%s'", err)
-			}
-			return
-		}
+	slot := release
+	release = nil
+	m.runCallbacks(w, r, parameterValues, func() {
+		m.finishUploads(context.WithoutCancel(r.Context()), state.uploads)
+		slot()
+	})
+	if cw != nil {
+		cw.finish(state.cache)
 	}
-	return
-doError:
-	http.Error(w, message, errorCode)
-	myLogger.Errorf(
-		"ServerHTTP failed with error message: '%s', http code: %d",
-		message, errorCode,
+}
+
+// false stops the callback chain
+func (m *myHandler) runCallback(
+	i int, parameterValues map[string]string,
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	name := m.callbackName(i)
+	ctx, span := m.tracer.Start(
+		r.Context(), fmt.Sprintf("callback %s", name),
+		tracing.WithAttributes(tracing.Attribute{Key: "callback", Value: name}),
+	)
+	defer span.End()
+	myLogger.Tracef("calling callback with parameters: %+v", parameterValues)
+	cbStart := time.Now()
+	ok, err := m.callbacks[i](parameterValues, w, r.WithContext(ctx))
+	m.metrics.callbackFinished(
+		m.path, name, time.Since(cbStart), !ok || err != nil,
 	)
+	myLogger.Tracef("callback returned %t", ok)
+	if err != nil {
+		//TODO logging, leaving callbacks to do their writing
+		myLogger.Errorf("callback returned error: '%s'", err)
+		span.RecordError(err)
+	} else if !ok {
+		span.SetStatus(tracing.StatusError, "callback returned false")
+	}
+	return ok && err == nil
+}
+
+// the name from routes.yaml, for logging and metrics
+func (m *myHandler) callbackName(i int) string {
+	if m.route == nil || i >= len(m.route.callbacks) {
+		return fmt.Sprintf("callback_%d", i)
+	}
+	return m.route.callbacks[i]
 }
 
 func newHandler(
@@ -277,6 +672,7 @@ func newHandler(
 		}
 	}
 	return &myHandler{
+		path:             path,
 		callbacks:        callbacks,
 		dynamicPaths:     dynamicPaths,
 		dynamicPathIndex: dynamicPathIndex,
@@ -322,13 +718,66 @@ func AddGlobalLogger(pLogger logger.Logger) {
 }
 
 func NewServer(
-	routes io.Reader, callbacks map[string]Callback,
+	routes io.Reader, callbacks map[string]Callback, opts ...Option,
 ) (Server, error) {
 	loadedRoutes, err := loadRoutes(routes)
 	if err != nil {
 		myLogger.Errorf("could not load routes with error: '%s'", err)
 		return nil, err
 	}
+	limits := DefaultLimits()
+	toRet := &server{
+		adminHandlers: make(map[string]http.Handler),
+		metrics:       newServerMetrics(),
+		readiness:     newReadinessChecks(),
+		limits:        &limits,
+		limiter:       NewMemoryRateLimitStore(),
+		encoders: map[string]Encoder{
+			gzipEncoding:   gzipEncoder,
+			brotliEncoding: brotliEncoder,
+		},
+		responseCache: newResponseCache(defCacheEntries, defCacheBytes),
+	}
+	for _, opt := range opts {
+		if err = opt(toRet); err != nil {
+			return nil, err
+		}
+	}
+	var compression CompressionConfig
+	if toRet.compression != nil {
+		compression = *toRet.compression
+	}
+	compressor, err := newCompressor(compression, toRet.encoders)
+	if err != nil {
+		return nil, err
+	}
+	statics := make(map[string]*staticHandler)
+	staticList := make([]*staticHandler, 0)
+	for path, rte := range loadedRoutes {
+		if rte.static == nil {
+			continue
+		}
+		if statics[path], err = newStaticHandler(path, rte.static, toRet.staticFS); err != nil {
+			return nil, fmt.Errorf("route '%s': %w", path, err)
+		}
+		staticList = append(staticList, statics[path])
+	}
+	//longest prefix first, like the mux
+	sort.Slice(staticList, func(i, j int) bool {
+		return len(staticList[i].prefix) > len(staticList[j].prefix)
+	})
+	if toRet.templateConfig != nil {
+		routePaths := make([]string, 0, len(loadedRoutes))
+		for path := range loadedRoutes {
+			routePaths = append(routePaths, path)
+		}
+		toRet.templates, err = newTemplateSet(
+			*toRet.templateConfig, routePaths, assetURL(staticList),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
 	pathHandlers := make(map[string]*myHandler)
 	for path, rte := range loadedRoutes {
 		handlePath := getHandlePath(path)
@@ -336,6 +785,57 @@ func NewServer(
 		if err != nil {
 			return nil, err
 		}
+		handler.metrics = toRet.metrics
+		handler.tracer = toRet.tracer
+		handler.sink = toRet.uploadSink
+		if err = rte.limits.check(toRet.limits); err != nil {
+			return nil, fmt.Errorf("route '%s' %s", path, err)
+		}
+		handler.limits = rte.limits.resolve(toRet.limits)
+		handler.limiter = toRet.limiter
+		handler.sessions = toRet.sessions
+		handler.templates = toRet.templates
+		handler.compressor = compressor.forRoute(rte.compress, toRet.compression != nil)
+		handler.cache = toRet.responseCache
+		if rte.render != "" && toRet.templates == nil {
+			return nil, fmt.Errorf(
+				"route '%s' renders a template but the server has none, see WithTemplates",
+				path,
+			)
+		}
+		if rte.render != "" && !toRet.templates.has(rte.render) {
+			return nil, fmt.Errorf(
+				"route '%s' renders '%s' which isn't a template page", path, rte.render,
+			)
+		}
+		if rte.auth.usesSessions() && toRet.sessions == nil {
+			return nil, fmt.Errorf(
+				"route '%s' uses a session auth scheme but the server has no sessions, "+
+					"see WithSessions", path,
+			)
+		}
+		if rte.csrf != nil && *rte.csrf && toRet.sessions == nil {
+			return nil, fmt.Errorf(
+				"route '%s' sets csrf but the server has no sessions, see WithSessions", path,
+			)
+		}
+		if rte.concurrency != nil {
+			toRet.readiness.addQueue(path, rte.concurrency)
+		}
+		if rte.builtin != noBuiltin {
+			handler.builtin = toRet.builtinHandler(rte.builtin)
+		}
+		if rte.static != nil {
+			statics[path].etagSuffixes = handler.etagSuffixes()
+			handler.builtin = statics[path]
+		}
+		if rte.proxy != nil {
+			handler.proxy = newProxyHandler(strings.TrimSuffix(path, "/"), rte.proxy)
+		}
+		//the mux only matches everything under a path ending in /
+		if (rte.static != nil || rte.proxy != nil) && !strings.HasSuffix(handlePath, "/") {
+			handlePath += "/"
+		}
 		var ok bool
 		if _, ok = pathHandlers[handlePath]; ok {
 			return nil, fmt.Errorf(
@@ -346,5 +846,73 @@ func NewServer(
 		pathHandlers[handlePath] = handler
 		myLogger.Tracef("adding handler for path '%s'", handlePath)
 	}
-	return &server{pathHandlers: pathHandlers}, nil
+	toRet.pathHandlers = pathHandlers
+	if err = toRet.addAdminHandlers(); err != nil {
+		return nil, err
+	}
+	adminPaths := make([]string, 0, len(toRet.adminHandlers))
+	for path := range toRet.adminHandlers {
+		adminPaths = append(adminPaths, path)
+	}
+	myLogger.Infof(
+		"route access:\n  %s",
+		strings.Join(accessReport(loadedRoutes, adminPaths), "\n  "),
+	)
+	return toRet, nil
+}
+
+// an admin port turns on every admin endpoint, at its default path
+// unless an option already set one
+func (s *server) addAdminHandlers() error {
+	if s.adminPort != nil {
+		if s.metricsPath == "" {
+			s.metricsPath = defMetricsPath
+		}
+		if s.livenessPath == "" {
+			s.livenessPath = defLivenessPath
+		}
+		if s.readinessPath == "" {
+			s.readinessPath = defReadinessPath
+		}
+		if s.versionPath == "" {
+			s.versionPath = defVersionPath
+		}
+	}
+	for _, toAdd := range []struct {
+		path    string
+		builtin builtinType
+	}{
+		{s.metricsPath, metricsBuiltin},
+		{s.livenessPath, livenessBuiltin},
+		{s.readinessPath, readinessBuiltin},
+		{s.versionPath, versionBuiltin},
+	} {
+		if toAdd.path == "" {
+			continue
+		}
+		if err := s.addAdminHandler(
+			toAdd.path, s.builtinHandler(toAdd.builtin),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// admin handlers share the route mux unless there's an admin port, so
+// they can't collide with a route's handle path either way
+func (s *server) addAdminHandler(path string, handler http.Handler) error {
+	if _, ok := s.adminHandlers[path]; ok {
+		return fmt.Errorf(
+			"multiple handlers assigned to same admin path: '%s'", path,
+		)
+	}
+	if _, ok := s.pathHandlers[path]; ok && s.adminPort == nil {
+		return fmt.Errorf(
+			"admin path '%s' collides with a route handle path", path,
+		)
+	}
+	myLogger.Tracef("adding admin handler for path '%s'", path)
+	s.adminHandlers[path] = handler
+	return nil
 }
@@ -5,13 +5,16 @@ from util.GetTestMetaData, eg write a testing library
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"landtitle/tracing"
 	"landtitle/util"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 
 	logger "github.com/buhduh42/go-logger"
@@ -979,3 +982,362 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+type recordingExporter struct {
+	sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *recordingExporter) ExportSpans(
+	ctx context.Context, spans []tracing.SpanData,
+) error {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestServerTracing(t *testing.T) {
+	serverYaml, err := os.Open("testdata/advanced_get.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	callbacks := make(map[string]Callback)
+	for name, cb := range callbackDataMap {
+		callbacks[name] = makeCallback(myLogger, name, cb.res, cb.err, cb.code)
+	}
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer("test", exporter)
+	tmpServer, err := NewServer(serverYaml, callbacks, WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("GET", "http://example.com/baz?foo=123-12-1234", nil)
+	r.Header.Set(tracing.TraceparentHeader, parent)
+	testServer.pathHandlers["/baz"].ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("GET", "http://example.com/biff?foo=nope", nil)
+	testServer.pathHandlers["/biff"].ServeHTTP(httptest.NewRecorder(), r)
+	if err = tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("tracer shutdown failed with error: '%s'", err)
+	}
+	byName := make(map[string]tracing.SpanData)
+	for _, s := range exporter.spans {
+		byName[s.Name] = s
+	}
+	if len(exporter.spans) != 5 {
+		t.Fatalf("expected 5 spans, got: %d, %v", len(exporter.spans), byName)
+	}
+	remote, _ := tracing.ParseTraceparent(parent)
+	serverSpan, ok := byName["GET /baz"]
+	if !ok {
+		t.Fatalf("missing server span for /baz")
+	}
+	if serverSpan.SpanContext.TraceID != remote.TraceID ||
+		serverSpan.Parent != remote.SpanID {
+		t.Errorf("server span not parented on incoming traceparent")
+	}
+	if serverSpan.Kind != tracing.SpanKindServer {
+		t.Errorf("server span kind mismatch, got: %d", serverSpan.Kind)
+	}
+	for _, name := range []string{"callback cb2"} {
+		cbSpan, ok := byName[name]
+		if !ok {
+			t.Errorf("missing span '%s'", name)
+			continue
+		}
+		if cbSpan.Parent != serverSpan.SpanContext.SpanID {
+			t.Errorf("span '%s' not parented on server span", name)
+		}
+		if cbSpan.Status != tracing.StatusError {
+			t.Errorf("failed callback span '%s' should be an error", name)
+		}
+	}
+	if _, ok = byName["callback cb1"]; ok {
+		t.Errorf("callbacks after a failed callback should not run")
+	}
+	biffSpan := byName["GET /biff"]
+	if biffSpan.Parent.IsValid() {
+		t.Errorf("requests without traceparent should start a new trace")
+	}
+	var parseSpans int
+	for _, s := range exporter.spans {
+		if s.Name != "parse parameters" {
+			continue
+		}
+		parseSpans++
+		if s.SpanContext.TraceID == biffSpan.SpanContext.TraceID &&
+			s.Status != tracing.StatusError {
+			t.Errorf("failed parameter parsing should be an error span")
+		}
+	}
+	if parseSpans != 2 {
+		t.Errorf("expected 2 parse parameter spans, got: %d", parseSpans)
+	}
+}
+
+func TestParameterDefaults(t *testing.T) {
+	serverYaml, err := os.Open("testdata/constraints.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		target    string
+		expCode   int
+		expParams map[string]string
+		expBody   string
+		msg       string
+	}{
+		//0
+		{
+			"http://example.com/search?apn=12345678",
+			http.StatusOK,
+			map[string]string{"Apn": "12345678", "Page": "1", "Doc_type": "deed"},
+			"",
+			"defaults filled in",
+		},
+		//1
+		{
+			"http://example.com/search?apn=12345678&page=3&doc_type=plat",
+			http.StatusOK,
+			map[string]string{"Apn": "12345678", "Page": "3", "Doc_type": "plat"},
+			"",
+			"defaults don't override sent values",
+		},
+		//2
+		{
+			"http://example.com/search?apn=1234",
+			http.StatusBadRequest,
+			nil,
+			"parameter 'apn' is not valid, value '1234' is shorter than the minimum length of 8",
+			"specific error message",
+		},
+		//3
+		{
+			"http://example.com/search?apn=12345678&page=501",
+			http.StatusBadRequest,
+			nil,
+			"greater than the maximum of 500",
+			"page out of range",
+		},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", td.target, nil)
+		testServer.pathHandlers["/search"].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d",
+					td.expCode, w.Code,
+				),
+			)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "body missing '%s', got: '%s'", td.expBody, w.Body.String(),
+				),
+			)
+		}
+		for k, v := range td.expParams {
+			if w.Header().Get(k) != v {
+				t.Errorf(
+					getTestMessage(
+						i, td.msg, "param '%s' mismatch, exp: '%s', got: '%s'",
+						k, v, w.Header().Get(k),
+					),
+				)
+			}
+		}
+	}
+}
+
+func TestUnknownParamsAndAliases(t *testing.T) {
+	serverYaml, err := os.Open("testdata/unknown.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	form := "parcel_id=123&utm_source=mail"
+	testData := []struct {
+		path       string
+		target     string
+		body       *string
+		expCode    int
+		expParams  map[string]string
+		expMissing []string
+		expWarning string
+		msg        string
+	}{
+		//0
+		{
+			"/reject", "http://example.com/reject?parcel_id=123&utm_source=mail", nil,
+			http.StatusBadRequest, nil, nil, "", "unknown params rejected by default",
+		},
+		//1
+		{
+			"/reject", "http://example.com/reject?blarg=123", nil,
+			http.StatusOK, map[string]string{"Parcel_id": "123"}, []string{"Blarg"},
+			`299 - "parameter 'blarg' is deprecated, use 'parcel_id'"`, "alias",
+		},
+		//2
+		{
+			"/reject", "http://example.com/reject?blarg=123&parcel_id=123", nil,
+			http.StatusBadRequest, nil, nil, "", "alias and name both sent",
+		},
+		//3
+		{
+			"/ignore", "http://example.com/ignore?parcel=123&utm_source=mail&_=1700000000", nil,
+			http.StatusOK, map[string]string{"Parcel_id": "123"},
+			[]string{"Utm_source", "_", "Parcel"},
+			`299 - "parameter 'parcel' is deprecated, use 'parcel_id'"`, "unknown params ignored",
+		},
+		//4
+		{
+			"/passthrough", "http://example.com/passthrough?parcel_id=123&utm_source=mail", nil,
+			http.StatusOK, map[string]string{"Parcel_id": "123", "Utm_source": "mail"},
+			nil, "", "unknown query params passed through",
+		},
+		//5
+		{
+			"/passthrough", "http://example.com/passthrough", &form,
+			http.StatusOK, map[string]string{"Parcel_id": "123", "Utm_source": "mail"},
+			nil, "", "unknown form params passed through",
+		},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if td.body != nil {
+			r = httptest.NewRequest("POST", td.target, strings.NewReader(*td.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", td.target, nil)
+		}
+		testServer.pathHandlers[td.path].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		for k, v := range td.expParams {
+			if w.Header().Get(k) != v {
+				t.Errorf(
+					getTestMessage(
+						i, td.msg, "param '%s' mismatch, exp: '%s', got: '%s'",
+						k, v, w.Header().Get(k),
+					),
+				)
+			}
+		}
+		for _, k := range td.expMissing {
+			if _, ok := w.Header()[k]; ok {
+				t.Errorf(getTestMessage(i, td.msg, "param '%s' shouldn't be set", k))
+			}
+		}
+		if got := w.Header().Get(warningHeader); got != td.expWarning {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "warning mismatch, exp: '%s', got: '%s'", td.expWarning, got,
+				),
+			)
+		}
+	}
+}
+
+func TestParameterPrecedence(t *testing.T) {
+	serverYaml, err := os.Open("testdata/precedence.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	form := "id=3"
+	apnForm := "id=12345678"
+	testData := []struct {
+		path    string
+		target  string
+		body    *string
+		expCode int
+		expID   string
+		msg     string
+	}{
+		//0
+		{"/default/", "http://example.com/default/2?id=1", nil, http.StatusOK, "1", "query wins by default"},
+		//1
+		{"/url_first/", "http://example.com/url_first/2?id=1", nil, http.StatusOK, "2", "url listed first"},
+		//2
+		{"/url_first/", "http://example.com/url_first?id=1", &form, http.StatusOK, "1", "unlisted sources keep default order"},
+		//3
+		{"/last/", "http://example.com/last/2?id=1", nil, http.StatusOK, "2", "last takes the lowest precedence"},
+		//4
+		{"/strict/", "http://example.com/strict/2?id=1", nil, http.StatusBadRequest, "", "conflicting values"},
+		//5
+		{"/strict/", "http://example.com/strict/2?id=2", nil, http.StatusOK, "2", "agreeing values aren't a conflict"},
+		//6
+		{"/strict/", "http://example.com/strict/2", nil, http.StatusOK, "2", "a single source"},
+		//7
+		{"/apn", "http://example.com/apn?id=123-456-78", &apnForm, http.StatusOK, "12345678", "same once transformed"},
+		//8
+		{"/apn", "http://example.com/apn?id=123-456-79", &apnForm, http.StatusBadRequest, "", "different once transformed"},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if td.body != nil {
+			r = httptest.NewRequest("POST", td.target, strings.NewReader(*td.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", td.target, nil)
+		}
+		testServer.pathHandlers[td.path].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		if got := w.Header().Get("Id"); got != td.expID {
+			t.Errorf(getTestMessage(i, td.msg, "id exp: '%s', got: '%s'", td.expID, got))
+		}
+	}
+}
@@ -0,0 +1,779 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+server side sessions, WithSessions turns them on for every route. The cookie
+only carries the session's id, signed or encrypted with the first of the
+configured keys, the rest are still accepted so keys can be rotated without
+logging everyone out. Values live in a SessionStore, in memory or one file
+per session unless something else is plugged in.
+
+Callbacks get the request's session from RequestSession, changes are saved
+and the cookie set right before the response's headers go out, later ones,
+eg from a callback still running after its timeout:, are dropped. A login
+should call Rotate once it knows who it is so an id planted before the login
+isn't the one that ends up logged in, Destroy is the logout.
+
+with sessions on, POST and PUT to routes with form params need the
+session's CSRF token back, as the csrf_token form field or the X-CSRF-Token
+header, from CSRFToken. csrf: false on a route turns the check off,
+csrf: true turns it on for routes without form params, proxy routes only
+take the header since their bodies aren't read, builtin and static routes
+can't set it.
+*/
+
+const (
+	defSessionCookie      string        = "landtitle_session"
+	defSessionIdleTimeout time.Duration = 30 * time.Minute
+	defSessionMaxAge      time.Duration = 24 * time.Hour
+	sessionSweepInterval  time.Duration = time.Minute
+	//at least as long as the sha256 the cookies are signed with
+	minSessionKeyLen int = 32
+	sessionIDLen     int = 32
+	csrfTokenLen     int = 32
+	//reserved key in the session's values
+	csrfSessionKey string = "_csrf"
+	csrfFormField  string = "csrf_token"
+	csrfHeader     string = "X-CSRF-Token"
+)
+
+// What a SessionStore keeps for each session
+type SessionRecord struct {
+	Values  map[string]string `json:"values"`
+	Created time.Time         `json:"created"`
+	Expires time.Time         `json:"expires"`
+}
+
+func (s *SessionRecord) clone() *SessionRecord {
+	toRet := *s
+	toRet.Values = make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		toRet.Values[k] = v
+	}
+	return &toRet
+}
+
+// Where session values live between requests, ids are random and only
+// ever come from a cookie that checked out
+type SessionStore interface {
+	//nil and no error when the id is unknown or expired
+	Load(ctx context.Context, id string) (*SessionRecord, error)
+	Save(ctx context.Context, id string, record *SessionRecord) error
+	Delete(ctx context.Context, id string) error
+}
+
+type memorySessionStore struct {
+	mu        sync.Mutex
+	records   map[string]*SessionRecord
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Keeps sessions in this process, they're gone on restart and aren't
+// shared between instances
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		records: make(map[string]*SessionRecord),
+		now:     time.Now,
+	}
+}
+
+func (s *memorySessionStore) Load(ctx context.Context, id string) (*SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, nil
+	}
+	if !s.now().Before(record.Expires) {
+		delete(s.records, id)
+		return nil, nil
+	}
+	return record.clone(), nil
+}
+
+func (s *memorySessionStore) Save(
+	ctx context.Context, id string, record *SessionRecord,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sessionSweepInterval {
+		s.lastSweep = now
+		for k, r := range s.records {
+			if !now.Before(r.Expires) {
+				delete(s.records, k)
+			}
+		}
+	}
+	s.records[id] = record.clone()
+	return nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+type fileSessionStore struct {
+	dir       string
+	mu        sync.Mutex
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Keeps each session as a json file in dir, which is created if it's
+// missing, instances sharing dir share sessions
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create session dir '%s': %w", dir, err)
+	}
+	return &fileSessionStore{dir: dir, now: time.Now}, nil
+}
+
+// the id is hashed so the file names don't give the sessions away to
+// anyone who can list the dir
+func (s *fileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *fileSessionStore) read(path string) (*SessionRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var toRet SessionRecord
+	if err = json.Unmarshal(data, &toRet); err != nil {
+		return nil, fmt.Errorf("session file '%s' is corrupt: %w", path, err)
+	}
+	return &toRet, nil
+}
+
+func (s *fileSessionStore) Load(ctx context.Context, id string) (*SessionRecord, error) {
+	path := s.path(id)
+	record, err := s.read(path)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if !s.now().Before(record.Expires) {
+		os.Remove(path)
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (s *fileSessionStore) Save(
+	ctx context.Context, id string, record *SessionRecord,
+) error {
+	s.sweep()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	//written whole then renamed so a concurrent Load never sees half
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+func (s *fileSessionStore) Delete(ctx context.Context, id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileSessionStore) sweep() {
+	s.mu.Lock()
+	now := s.now()
+	if now.Sub(s.lastSweep) < sessionSweepInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		myLogger.Warnf("could not sweep session dir '%s': '%s'", s.dir, err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		if record, err := s.read(path); err == nil && record != nil &&
+			!now.Before(record.Expires) {
+			os.Remove(path)
+		}
+	}
+}
+
+// signs or seals the session id into the cookie's value, the cookie's name
+// is mixed in so a value can't be moved to another cookie
+type cookieCodec struct {
+	keys  [][]byte
+	aeads []cipher.AEAD
+}
+
+func newCookieCodec(keys [][]byte, encrypt bool) (*cookieCodec, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("sessions need at least one key")
+	}
+	toRet := &cookieCodec{}
+	for i, key := range keys {
+		if len(key) < minSessionKeyLen {
+			return nil, fmt.Errorf(
+				"session key %d is %d bytes, needs at least %d", i, len(key), minSessionKeyLen,
+			)
+		}
+		toRet.keys = append(toRet.keys, key)
+		if !encrypt {
+			continue
+		}
+		sum := sha256.Sum256(key)
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		toRet.aeads = append(toRet.aeads, aead)
+	}
+	return toRet, nil
+}
+
+func (c *cookieCodec) mac(key []byte, name, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name + "|" + value))
+	return h.Sum(nil)
+}
+
+func (c *cookieCodec) encode(name, value string) (string, error) {
+	if len(c.aeads) == 0 {
+		return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+			base64.RawURLEncoding.EncodeToString(c.mac(c.keys[0], name, value)), nil
+	}
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *cookieCodec) decode(name, encoded string) (string, error) {
+	if len(c.aeads) == 0 {
+		rawValue, rawSig, ok := strings.Cut(encoded, ".")
+		if !ok {
+			return "", fmt.Errorf("malformed session cookie")
+		}
+		value, err := base64.RawURLEncoding.DecodeString(rawValue)
+		if err != nil {
+			return "", fmt.Errorf("malformed session cookie")
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(rawSig)
+		if err != nil {
+			return "", fmt.Errorf("malformed session cookie")
+		}
+		for _, key := range c.keys {
+			if hmac.Equal(sig, c.mac(key, name, string(value))) {
+				return string(value), nil
+			}
+		}
+		return "", fmt.Errorf("session cookie signature doesn't match")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed session cookie")
+	}
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize() {
+			break
+		}
+		nonce, text := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if value, err := aead.Open(nil, nonce, text, []byte(name)); err == nil {
+			return string(value), nil
+		}
+	}
+	return "", fmt.Errorf("session cookie doesn't decrypt")
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		//the os is out of randomness, nothing sensible to carry on with
+		panic(fmt.Sprintf("could not read random bytes: '%s'", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// How WithSessions sets up sessions, only Keys is required
+type SessionConfig struct {
+	//defaults to NewMemorySessionStore
+	Store SessionStore
+	//the first signs or encrypts new cookies, all of them are accepted,
+	//each at least 32 bytes
+	Keys [][]byte
+	//encrypts the cookie's value rather than only signing it
+	Encrypt bool
+	//defaults to landtitle_session
+	CookieName string
+	//defaults to /
+	CookiePath   string
+	CookieDomain string
+	//leaves Secure off the cookie, for plain http in development
+	Insecure bool
+	//defaults to lax
+	SameSite http.SameSite
+	//how long an unused session lasts, 30m by default
+	IdleTimeout time.Duration
+	//how long any session lasts, 24h by default
+	MaxAge time.Duration
+}
+
+type sessionManager struct {
+	store    SessionStore
+	codec    *cookieCodec
+	name     string
+	path     string
+	domain   string
+	secure   bool
+	sameSite http.SameSite
+	idle     time.Duration
+	maxAge   time.Duration
+	now      func() time.Time
+}
+
+func newSessionManager(c SessionConfig) (*sessionManager, error) {
+	codec, err := newCookieCodec(c.Keys, c.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &sessionManager{
+		store:    c.Store,
+		codec:    codec,
+		name:     c.CookieName,
+		path:     c.CookiePath,
+		domain:   c.CookieDomain,
+		secure:   !c.Insecure,
+		sameSite: c.SameSite,
+		idle:     c.IdleTimeout,
+		maxAge:   c.MaxAge,
+		now:      time.Now,
+	}
+	if toRet.store == nil {
+		toRet.store = NewMemorySessionStore()
+	}
+	if toRet.name == "" {
+		toRet.name = defSessionCookie
+	}
+	if toRet.path == "" {
+		toRet.path = "/"
+	}
+	if toRet.sameSite == 0 {
+		toRet.sameSite = http.SameSiteLaxMode
+	}
+	if toRet.idle == 0 {
+		toRet.idle = defSessionIdleTimeout
+	}
+	if toRet.maxAge == 0 {
+		toRet.maxAge = defSessionMaxAge
+	}
+	if toRet.idle < 0 || toRet.maxAge < 0 {
+		return nil, fmt.Errorf("session timeouts can't be negative")
+	}
+	return toRet, nil
+}
+
+// A visitor's session, see RequestSession. Values are saved at the end of
+// the request they were set in
+type Session struct {
+	mu     sync.Mutex
+	id     string
+	record *SessionRecord
+	dirty  bool
+	//ids Rotate replaced, deleted from the store on save
+	retired   []string
+	destroyed bool
+	//a cookie came in that didn't check out or had expired
+	stale bool
+	//the CSRF token was handed out, the response is this session's own
+	tokenUsed bool
+	//saved with the response's headers or the callbacks timed out, later
+	//changes can't go anywhere
+	sealed bool
+}
+
+// stops any more changes, nil s is fine
+func (s *Session) seal() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed = true
+}
+
+// caller holds mu, true when s can still change
+func (s *Session) changeable(op string) bool {
+	if s.sealed {
+		myLogger.Debugf("dropping session %s made after the response started", op)
+	}
+	return !s.sealed
+}
+
+// Get returns the value for key and whether it was set
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	toRet, ok := s.record.Values[key]
+	return toRet, ok
+}
+
+// Set stores value under key, keys starting with _ are the server's
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changeable("set") {
+		return
+	}
+	s.record.Values[key] = value
+	s.dirty = true
+}
+
+// Delete removes key
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changeable("delete") {
+		return
+	}
+	if _, ok := s.record.Values[key]; ok {
+		delete(s.record.Values, key)
+		s.dirty = true
+	}
+}
+
+// Rotate moves the values to a new id and CSRF token, call it whenever
+// who the session belongs to changes, logins mostly
+func (s *Session) Rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changeable("rotate") {
+		return
+	}
+	if s.id != "" {
+		s.retired = append(s.retired, s.id)
+		s.id = ""
+	}
+	delete(s.record.Values, csrfSessionKey)
+	s.destroyed = false
+	s.dirty = true
+}
+
+// Destroy drops the session from the store and clears the cookie, values
+// set after it start a new session
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changeable("destroy") {
+		return
+	}
+	if s.id != "" {
+		s.retired = append(s.retired, s.id)
+		s.id = ""
+	}
+	s.record.Values = make(map[string]string)
+	s.destroyed = true
+	s.dirty = false
+}
+
+func (s *Session) csrfToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenUsed = true
+	toRet := s.record.Values[csrfSessionKey]
+	if toRet == "" && s.changeable("csrf token") {
+		toRet = randomToken(csrfTokenLen)
+		s.record.Values[csrfSessionKey] = toRet
+		s.destroyed = false
+		s.dirty = true
+	}
+	return toRet
+}
+
+// whether the response belongs to this session alone, it sets the cookie
+// or carries the CSRF token, false for a nil s
+func (s *Session) private() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty || s.destroyed || s.stale || len(s.retired) > 0 || s.tokenUsed
+}
+
+func (sm *sessionManager) newRecord(now time.Time) *SessionRecord {
+	return &SessionRecord{
+		Values:  make(map[string]string),
+		Created: now,
+		Expires: now.Add(sm.idle),
+	}
+}
+
+// the session the request's cookie points at or a new one, new sessions
+// aren't stored until something is set
+func (sm *sessionManager) load(r *http.Request) *Session {
+	now := sm.now()
+	cookie, err := r.Cookie(sm.name)
+	if err != nil {
+		return &Session{record: sm.newRecord(now)}
+	}
+	id, err := sm.codec.decode(sm.name, cookie.Value)
+	if err != nil {
+		myLogger.Debugf("ignoring session cookie: '%s'", err)
+		return &Session{record: sm.newRecord(now), stale: true}
+	}
+	record, err := sm.store.Load(r.Context(), id)
+	if err != nil {
+		myLogger.Errorf("failed loading session with error: '%s'", err)
+	}
+	if record == nil {
+		return &Session{record: sm.newRecord(now), stale: true}
+	}
+	if record.Values == nil {
+		record.Values = make(map[string]string)
+	}
+	toRet := &Session{id: id, record: record}
+	//pushed out once it's half used so busy sessions aren't saved on
+	//every request
+	if record.Expires.Sub(now) < sm.idle/2 {
+		toRet.dirty = true
+	}
+	return toRet
+}
+
+func (sm *sessionManager) cookie(value string, expires time.Time) *http.Cookie {
+	toRet := &http.Cookie{
+		Name:     sm.name,
+		Value:    value,
+		Path:     sm.path,
+		Domain:   sm.domain,
+		Secure:   sm.secure,
+		HttpOnly: true,
+		SameSite: sm.sameSite,
+	}
+	if expires.IsZero() {
+		toRet.MaxAge = -1
+	} else {
+		toRet.Expires = expires.UTC()
+	}
+	return toRet
+}
+
+// stores what changed and sets the cookie on w, the response's headers
+// haven't gone out yet, s can't change after. Failures are logged, it's
+// too late to fail the request
+func (sm *sessionManager) save(ctx context.Context, w http.ResponseWriter, s *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed = true
+	for _, id := range s.retired {
+		if err := sm.store.Delete(ctx, id); err != nil {
+			myLogger.Errorf("failed deleting session with error: '%s'", err)
+		}
+	}
+	s.retired = nil
+	if !s.dirty {
+		if s.destroyed || s.stale {
+			http.SetCookie(w, sm.cookie("", time.Time{}))
+			s.stale = false
+		}
+		return
+	}
+	now := sm.now()
+	//new and rotated sessions count max age from now
+	if s.id == "" {
+		s.id = randomToken(sessionIDLen)
+		s.record.Created = now
+	}
+	s.record.Expires = now.Add(sm.idle)
+	if end := s.record.Created.Add(sm.maxAge); end.Before(s.record.Expires) {
+		s.record.Expires = end
+	}
+	value, err := sm.codec.encode(sm.name, s.id)
+	if err == nil {
+		err = sm.store.Save(ctx, s.id, s.record)
+	}
+	if err != nil {
+		myLogger.Errorf("failed saving session with error: '%s'", err)
+		return
+	}
+	s.dirty = false
+	http.SetCookie(w, sm.cookie(value, s.record.Expires))
+}
+
+type sessionKey struct{}
+
+// RequestSession returns the request's session, nil when the server
+// wasn't given WithSessions
+func RequestSession(r *http.Request) *Session {
+	if r == nil {
+		return nil
+	}
+	toRet, _ := r.Context().Value(sessionKey{}).(*Session)
+	return toRet
+}
+
+// CSRFToken returns the token POST and PUT requests from this session need
+// to send back, "" without sessions
+func CSRFToken(r *http.Request) string {
+	s := RequestSession(r)
+	if s == nil {
+		return ""
+	}
+	return s.csrfToken()
+}
+
+// saves the session right before anything is written, callbacks write
+// straight to the ResponseWriter so this is the last chance to set the
+// cookie
+type sessionWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	manager *sessionManager
+	session *Session
+	once    sync.Once
+}
+
+func (s *sessionWriter) commit() {
+	s.once.Do(func() {
+		s.manager.save(s.ctx, s.ResponseWriter, s.session)
+	})
+}
+
+func (s *sessionWriter) WriteHeader(code int) {
+	s.commit()
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *sessionWriter) Write(data []byte) (int, error) {
+	s.commit()
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *sessionWriter) Flush() {
+	s.commit()
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *sessionWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// nil writer when the server has no sessions, the caller commits once the
+// callbacks are done in case they never wrote
+func (m *myHandler) startSession(
+	w http.ResponseWriter, r *http.Request,
+) (*http.Request, *sessionWriter) {
+	if m.sessions == nil {
+		return r, nil
+	}
+	session := m.sessions.load(r)
+	r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+	return r, &sessionWriter{
+		ResponseWriter: w,
+		ctx:            context.WithoutCancel(r.Context()),
+		manager:        m.sessions,
+		session:        session,
+	}
+}
+
+// builtin and static routes never get here, proxy routes have no params so
+// only csrf: turns it on for them
+func (r *route) checksCSRF() bool {
+	if r.csrf != nil {
+		return *r.csrf
+	}
+	if !r.params.fromForm() {
+		return false
+	}
+	for _, method := range r.methods {
+		if method == postMethod || method == putMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// form is the request's form values, the token field is taken out of it
+// either way so it doesn't trip unknown_params
+func (m *myHandler) checkCSRF(r *http.Request, form url.Values) *handlerError {
+	if m.sessions == nil {
+		return nil
+	}
+	token := form.Get(csrfFormField)
+	form.Del(csrfFormField)
+	if !m.route.checksCSRF() {
+		return nil
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return nil
+	}
+	if token == "" {
+		token = r.Header.Get(csrfHeader)
+	}
+	var expected string
+	if s := RequestSession(r); s != nil {
+		expected, _ = s.Get(csrfSessionKey)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		myLogger.Debugf("csrf token missing or wrong for path: '%s'", r.URL.Path)
+		return &handlerError{http.StatusForbidden, "missing or invalid csrf token"}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSessionKey []byte = []byte("0123456789abcdef0123456789abcdef")
+
+func TestCookieCodec(t *testing.T) {
+	oldKey := []byte(strings.Repeat("o", minSessionKeyLen))
+	testData := []struct {
+		encrypt bool
+		msg     string
+	}{
+		//0
+		{false, "signed"},
+		//1
+		{true, "encrypted"},
+	}
+	for i, td := range testData {
+		codec, err := newCookieCodec([][]byte{testSessionKey, oldKey}, td.encrypt)
+		if err != nil {
+			t.Fatalf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+		encoded, err := codec.encode("sid", "abc")
+		if err != nil {
+			t.Fatalf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+		if got, err := codec.decode("sid", encoded); err != nil || got != "abc" {
+			t.Errorf(getTestMessage(i, td.msg, "round trip got: '%s', '%v'", got, err))
+		}
+		if strings.Contains(encoded, "YWJj") == td.encrypt {
+			t.Errorf(getTestMessage(i, td.msg, "id readable: %t", !td.encrypt))
+		}
+		if _, err = codec.decode("other", encoded); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "value moved to another cookie decoded"))
+		}
+		tampered := []byte(encoded)
+		tampered[len(tampered)-2] ^= 1
+		if _, err = codec.decode("sid", string(tampered)); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "tampered value decoded"))
+		}
+		//cookies from before the key was rotated in
+		old, _ := newCookieCodec([][]byte{oldKey}, td.encrypt)
+		encoded, _ = old.encode("sid", "abc")
+		if got, err := codec.decode("sid", encoded); err != nil || got != "abc" {
+			t.Errorf(getTestMessage(i, td.msg, "old key got: '%s', '%v'", got, err))
+		}
+	}
+	if _, err := newCookieCodec([][]byte{[]byte("short")}, false); err == nil {
+		t.Errorf("expected an error for a short key")
+	}
+	if _, err := newCookieCodec(nil, false); err == nil {
+		t.Errorf("expected an error without keys")
+	}
+}
+
+func TestSessionStores(t *testing.T) {
+	now := time.Now()
+	mem := NewMemorySessionStore()
+	mem.(*memorySessionStore).now = func() time.Time { return now }
+	file, err := NewFileSessionStore(t.TempDir() + "/sessions")
+	if err != nil {
+		t.Fatalf("failed creating file store with error: '%s'", err)
+	}
+	file.(*fileSessionStore).now = func() time.Time { return now }
+	ctx := context.Background()
+	for name, store := range map[string]SessionStore{"memory": mem, "file": file} {
+		record := &SessionRecord{
+			Values:  map[string]string{"user": "clerk"},
+			Created: now,
+			Expires: now.Add(time.Minute),
+		}
+		if err = store.Save(ctx, "a", record); err != nil {
+			t.Fatalf("%s: failed saving with error: '%s'", name, err)
+		}
+		record.Values["user"] = "changed after save"
+		got, err := store.Load(ctx, "a")
+		if err != nil || got == nil || got.Values["user"] != "clerk" {
+			t.Errorf("%s: exp the saved record, got: %+v, '%v'", name, got, err)
+		}
+		if got, _ = store.Load(ctx, "b"); got != nil {
+			t.Errorf("%s: exp nothing for an unknown id, got: %+v", name, got)
+		}
+		store.Save(ctx, "expired", &SessionRecord{Expires: now})
+		if got, _ = store.Load(ctx, "expired"); got != nil {
+			t.Errorf("%s: exp nothing for an expired id, got: %+v", name, got)
+		}
+		if err = store.Delete(ctx, "a"); err != nil {
+			t.Errorf("%s: failed deleting with error: '%s'", name, err)
+		}
+		if got, _ = store.Load(ctx, "a"); got != nil {
+			t.Errorf("%s: exp nothing after delete, got: %+v", name, got)
+		}
+		if err = store.Delete(ctx, "a"); err != nil {
+			t.Errorf("%s: deleting twice failed with error: '%s'", name, err)
+		}
+	}
+}
+
+// a browser's worth of cookie handling for the session tests
+type testBrowser struct {
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func (b *testBrowser) do(
+	method, target string, form url.Values, header http.Header,
+) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://example.com"+target, nil)
+	if form != nil {
+		r = httptest.NewRequest(
+			method, "http://example.com"+target, strings.NewReader(form.Encode()),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for k, vals := range header {
+		for _, v := range vals {
+			r.Header.Add(k, v)
+		}
+	}
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.handler.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+			continue
+		}
+		b.cookies[c.Name] = c
+	}
+	return w
+}
+
+func TestServerSessions(t *testing.T) {
+	store := NewMemorySessionStore()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	tmpServer, err := NewServer(
+		strings.NewReader(`/session:
+  methods: [get, post]
+  params:
+    set:
+      type: string
+      required: false
+  callbacks: [session]
+/form:
+  methods: [get, post]
+  params:
+    name:
+      source: form
+      required: false
+  callbacks: [session]
+/optout:
+  methods: [post]
+  csrf: false
+  params:
+    name:
+      source: form
+  callbacks: [session]
+/api:
+  csrf: true
+  proxy:
+    upstream: `+upstream.URL+`
+`),
+		map[string]Callback{
+			"session": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				s := RequestSession(r)
+				switch p["set"] {
+				case "":
+				case "login":
+					s.Rotate()
+					s.Set("user", "clerk")
+				case "logout":
+					s.Destroy()
+					return true, nil
+				default:
+					s.Set("user", p["set"])
+				}
+				user, _ := s.Get("user")
+				w.Header().Set("X-User", user)
+				w.Header().Set("X-CSRF", CSRFToken(r))
+				return true, nil
+			},
+		},
+		WithSessions(SessionConfig{Store: store, Keys: [][]byte{testSessionKey}}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	mux := http.NewServeMux()
+	for path, h := range testServer.pathHandlers {
+		mux.Handle(path, h)
+	}
+	b := &testBrowser{handler: mux, cookies: make(map[string]*http.Cookie)}
+
+	w := b.do(http.MethodGet, "/session?set=visitor", nil, nil)
+	first := b.cookies[defSessionCookie]
+	if first == nil {
+		t.Fatalf("exp a session cookie, got headers: %v", w.Header())
+	}
+	if !first.HttpOnly || !first.Secure || first.SameSite != http.SameSiteLaxMode {
+		t.Errorf("exp an HttpOnly, Secure, lax cookie, got: %+v", first)
+	}
+	if w = b.do(http.MethodGet, "/session", nil, nil); w.Header().Get("X-User") != "visitor" {
+		t.Errorf("exp the value from the last request, got: '%s'", w.Header().Get("X-User"))
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("exp no cookie when nothing changed, got: %v", w.Result().Cookies())
+	}
+
+	w = b.do(http.MethodGet, "/session?set=login", nil, nil)
+	rotated := b.cookies[defSessionCookie]
+	if rotated == nil || rotated.Value == first.Value {
+		t.Fatalf("exp login to rotate the session, got: %+v", rotated)
+	}
+	id, _ := testServer.sessions.codec.decode(defSessionCookie, first.Value)
+	if got, _ := store.Load(context.Background(), id); got != nil {
+		t.Errorf("exp the old session gone after rotating, got: %+v", got)
+	}
+	stolen := &testBrowser{
+		handler: mux, cookies: map[string]*http.Cookie{defSessionCookie: first},
+	}
+	if w = stolen.do(http.MethodGet, "/session", nil, nil); w.Header().Get("X-User") != "" {
+		t.Errorf("exp nothing from the pre-login id, got: '%s'", w.Header().Get("X-User"))
+	}
+	if c := stolen.cookies[defSessionCookie]; c != nil && c.Value == first.Value {
+		t.Errorf("exp the stale cookie replaced")
+	}
+
+	//csrf, the token comes from a get and goes back with the post
+	token := b.do(http.MethodGet, "/form", nil, nil).Header().Get("X-CSRF")
+	if token == "" {
+		t.Fatalf("exp a csrf token")
+	}
+	testData := []struct {
+		target  string
+		form    url.Values
+		header  http.Header
+		expCode int
+		msg     string
+	}{
+		//0
+		{"/form", url.Values{"name": {"a"}}, nil, http.StatusForbidden, "no token"},
+		//1
+		{
+			"/form", url.Values{"name": {"a"}, csrfFormField: {"nope"}}, nil,
+			http.StatusForbidden, "wrong token",
+		},
+		//2
+		{
+			"/form", url.Values{"name": {"a"}, csrfFormField: {token}}, nil,
+			http.StatusOK, "form token",
+		},
+		//3
+		{
+			"/form", url.Values{"name": {"a"}}, http.Header{csrfHeader: {token}},
+			http.StatusOK, "header token",
+		},
+		//4
+		{"/optout", url.Values{"name": {"a"}}, nil, http.StatusOK, "opted out"},
+		//5
+		{
+			"/optout", url.Values{"name": {"a"}, csrfFormField: {token}}, nil,
+			http.StatusOK, "token field isn't an unknown param",
+		},
+		//6
+		{"/session", url.Values{}, nil, http.StatusOK, "no form params"},
+		//7
+		{"/api/deeds", url.Values{}, nil, http.StatusForbidden, "proxy without a token"},
+		//8
+		{
+			"/api/deeds", url.Values{csrfFormField: {token}}, nil,
+			http.StatusForbidden, "proxy bodies aren't read",
+		},
+		//9
+		{
+			"/api/deeds", url.Values{}, http.Header{csrfHeader: {token}},
+			http.StatusOK, "proxy header token",
+		},
+	}
+	for i, td := range testData {
+		w = b.do(http.MethodPost, td.target, td.form, td.header)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+	}
+
+	w = b.do(http.MethodGet, "/session?set=logout", nil, nil)
+	if _, ok := b.cookies[defSessionCookie]; ok {
+		t.Errorf("exp logout to clear the cookie, got headers: %v", w.Header())
+	}
+	id, _ = testServer.sessions.codec.decode(defSessionCookie, rotated.Value)
+	if got, _ := store.Load(context.Background(), id); got != nil {
+		t.Errorf("exp the session gone after logout, got: %+v", got)
+	}
+}
+
+func TestSessionLoading(t *testing.T) {
+	noop := map[string]Callback{
+		"cb1": func(p map[string]string, w http.ResponseWriter, r *http.Request) (bool, error) {
+			return true, nil
+		},
+	}
+	csrfRoute := "/a:\n  methods: [post]\n  csrf: true\n  callbacks: [cb1]\n"
+	testData := []struct {
+		yamlString string
+		opts       []Option
+		expError   bool
+		msg        string
+	}{
+		//0
+		{csrfRoute, nil, true, "csrf without sessions"},
+		//1
+		{
+			csrfRoute, []Option{WithSessions(SessionConfig{Keys: [][]byte{testSessionKey}})},
+			false, "csrf with sessions",
+		},
+		//2
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithSessions(SessionConfig{Keys: [][]byte{[]byte("short")}})},
+			true, "short key",
+		},
+		//3
+		{
+			"/a:\n  callbacks: [cb1]\n",
+			[]Option{WithSessions(SessionConfig{
+				Keys: [][]byte{testSessionKey}, IdleTimeout: -time.Second,
+			})},
+			true, "negative timeout",
+		},
+	}
+	for i, td := range testData {
+		_, err := NewServer(strings.NewReader(td.yamlString), noop, td.opts...)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
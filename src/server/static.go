@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+files served straight from a directory or an fs.FS, the route's path is a
+prefix, everything under it maps to a file
+
+	/assets:
+	  auth: []
+	  static:
+	    dir: web/dist
+	    max_age: 1h
+	/:
+	  auth: []
+	  static:
+	    fs: app
+	    spa: true
+
+fs: names an fs.FS given to WithStaticFS, eg an embed.FS. Files get a
+content hash ETag and Last-Modified when the FS has mod times, conditional
+and range requests are handled. app.js.br and app.js.gz next to app.js are
+sent in its place to clients that accept them.
+
+Fingerprinted names, app.<16 hex of sha256>.js, serve app.js cached for a
+year as immutable, the asset template func builds them,
+{{asset "/assets/app.js"}}, a hash that's gone stale serves the current
+file with the normal caching. Other files are revalidated every time unless
+max_age is set.
+
+Directories serve their index, index.html by default, listing is off
+unless listing: true. With spa: paths that aren't files and have no
+extension get the root index so a client side router can take them.
+Dot files are never served.
+*/
+
+const (
+	defStaticIndex   string = "index.html"
+	fingerprintLen   int    = 16
+	immutableCaching string = "public, max-age=31536000, immutable"
+)
+
+var fingerprintRegex *regexp.Regexp = regexp.MustCompile(
+	fmt.Sprintf(`^(.+)\.([0-9a-f]{%d})(\.[^.]+)$`, fingerprintLen),
+)
+
+// the precompressed variants looked for, in order of preference
+var staticEncodings []struct{ name, ext string } = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type StaticYaml struct {
+	//a directory on disk, or
+	Dir string `yaml:"dir,omitempty"`
+	//the name of an fs.FS given to WithStaticFS
+	FS string `yaml:"fs,omitempty"`
+	//served for directories, default index.html
+	Index   string `yaml:"index,omitempty"`
+	Listing bool   `yaml:"listing,omitempty"`
+	//paths without a file or extension get the root index
+	SPA bool `yaml:"spa,omitempty"`
+	//go duration, Cache-Control max-age for files that aren't
+	//fingerprinted, revalidated every time when not set
+	MaxAge string `yaml:"max_age,omitempty"`
+}
+
+type staticRoute struct {
+	dir     string
+	fsName  string
+	index   string
+	listing bool
+	spa     bool
+	//nil for no-cache
+	maxAge *time.Duration
+}
+
+func newStaticRoute(r *RouteYaml) (*route, error) {
+	s := r.Static
+	if r.Builtin != "" {
+		return nil, fmt.Errorf("a route can't be both builtin and static")
+	}
+	if len(r.Callbacks) > 0 || len(r.Params) > 0 || len(r.Rules) > 0 {
+		return nil, fmt.Errorf("static routes can't have callbacks, params or rules")
+	}
+	if r.Render != "" || len(r.Produces) > 0 {
+		return nil, fmt.Errorf("static routes can't have render or produces")
+	}
+	//only ever GET and HEAD, nothing to protect
+	if r.CSRF != nil {
+		return nil, fmt.Errorf("static routes can't set csrf")
+	}
+	if (s.Dir == "") == (s.FS == "") {
+		return nil, fmt.Errorf("static routes need one of dir or fs")
+	}
+	index := s.Index
+	if index == "" {
+		index = defStaticIndex
+	}
+	if strings.Contains(index, "/") {
+		return nil, fmt.Errorf("static index must be a file name, got: '%s'", index)
+	}
+	maxAge, err := parseLimitDuration("max_age", s.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	methods := []httpMethod{getMethod, headMethod}
+	if len(r.Methods) > 0 {
+		if methods, err = newMethods(r.Methods); err != nil {
+			return nil, err
+		}
+		for _, m := range methods {
+			if m != getMethod && m != headMethod {
+				return nil, fmt.Errorf("static routes only serve get and head, got: '%s'", m)
+			}
+		}
+	}
+	limits, err := newRouteLimits(r.Limits)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := newRouteRateLimit(r.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := newConcurrencyLimiter(r.MaxConcurrent, r.Queue)
+	if err != nil {
+		return nil, err
+	}
+	return &route{
+		methods:     methods,
+		callbacks:   []string{},
+		params:      routeParameterMap{},
+		aliases:     map[string]string{},
+		limits:      limits,
+		rateLimit:   rateLimit,
+		concurrency: concurrency,
+		static: &staticRoute{
+			dir:     s.Dir,
+			fsName:  s.FS,
+			index:   index,
+			listing: s.Listing,
+			spa:     s.SPA,
+			maxAge:  maxAge,
+		},
+	}, nil
+}
+
+type staticHash struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+type staticHandler struct {
+	//the route's path without a trailing slash
+	prefix string
+	fsys   fs.FS
+	config *staticRoute
+	//by file name, redone when the mod time or size changes
+	hashes sync.Map
+	//codings the route compresses with, they end up on the etag
+	etagSuffixes []string
+}
+
+// named are the file systems from WithStaticFS
+func newStaticHandler(
+	routePath string, s *staticRoute, named map[string]fs.FS,
+) (*staticHandler, error) {
+	toRet := &staticHandler{prefix: strings.TrimSuffix(routePath, "/"), config: s}
+	if s.fsName != "" {
+		var ok bool
+		if toRet.fsys, ok = named[s.fsName]; !ok {
+			return nil, fmt.Errorf("no static fs named '%s', see WithStaticFS", s.fsName)
+		}
+		return toRet, nil
+	}
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("static dir '%s' isn't a directory", s.dir)
+	}
+	toRet.fsys = os.DirFS(s.dir)
+	return toRet, nil
+}
+
+// the file name in the FS a request path maps to, false for paths outside
+// the route or through dot files
+func (s *staticHandler) fileName(urlPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, s.prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	name := strings.TrimPrefix(path.Clean("/"+rest), "/")
+	if name == "" {
+		return ".", true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func (s *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.fileName(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cacheControl := "no-cache"
+	if s.config.maxAge != nil {
+		cacheControl = fmt.Sprintf("public, max-age=%d", int(s.config.maxAge.Seconds()))
+	}
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		s.serveMissing(w, r, name, cacheControl)
+		return
+	}
+	if !info.IsDir() {
+		s.serveFile(w, r, name, cacheControl)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	index := path.Join(name, s.config.index)
+	if info, err = fs.Stat(s.fsys, index); err == nil && !info.IsDir() {
+		s.serveFile(w, r, index, "no-cache")
+		return
+	}
+	if s.config.listing {
+		s.serveListing(w, r, name)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// fingerprinted names and the spa fallback
+func (s *staticHandler) serveMissing(
+	w http.ResponseWriter, r *http.Request, name, cacheControl string,
+) {
+	if m := fingerprintRegex.FindStringSubmatch(name); m != nil {
+		plain := m[1] + m[3]
+		if info, err := fs.Stat(s.fsys, plain); err == nil && !info.IsDir() {
+			if h, err := s.hash(plain); err == nil && h.sum == m[2] {
+				cacheControl = immutableCaching
+			}
+			s.serveFile(w, r, plain, cacheControl)
+			return
+		}
+	}
+	if s.config.spa && path.Ext(name) == "" {
+		if info, err := fs.Stat(s.fsys, s.config.index); err == nil && !info.IsDir() {
+			s.serveFile(w, r, s.config.index, "no-cache")
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *staticHandler) hash(name string) (*staticHash, error) {
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := s.hashes.Load(name); ok {
+		h := cached.(*staticHash)
+		if h.modTime.Equal(info.ModTime()) && h.size == info.Size() {
+			return h, nil
+		}
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err = io.Copy(sum, f); err != nil {
+		return nil, err
+	}
+	toRet := &staticHash{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		sum:     hex.EncodeToString(sum.Sum(nil))[:fingerprintLen],
+	}
+	s.hashes.Store(name, toRet)
+	return toRet, nil
+}
+
+// the content codings the request accepts out of staticEncodings, best
+// first
+func acceptedEncodings(header string) []string {
+	offers := make([]string, 0, len(staticEncodings))
+	for _, e := range staticEncodings {
+		offers = append(offers, e.name)
+	}
+	return acceptedCodings(header, offers)
+}
+
+// the offers the Accept-Encoding header allows, in the offers' order
+func acceptedCodings(header string, offers []string) []string {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if raw, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		qs[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	var toRet []string
+	for _, o := range offers {
+		q, ok := qs[o]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > 0 {
+			toRet = append(toRet, o)
+		}
+	}
+	return toRet
+}
+
+// a precompressed variant of name the request accepts, "" for none,
+// varies is whether name has any variants at all
+func (s *staticHandler) variant(r *http.Request, name string) (
+	file, encoding string, varies bool,
+) {
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	for _, e := range staticEncodings {
+		info, err := fs.Stat(s.fsys, name+e.ext)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		varies = true
+		for _, a := range accepted {
+			if a == e.name && file == "" {
+				file, encoding = name+e.ext, e.name
+			}
+		}
+	}
+	return file, encoding, varies
+}
+
+func (s *staticHandler) serveFile(
+	w http.ResponseWriter, r *http.Request, name, cacheControl string,
+) {
+	h, err := s.hash(name)
+	if err != nil {
+		myLogger.Errorf("hashing static file '%s' failed with error: '%s'", name, err)
+		Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	etag := h.sum
+	served, encoding, varies := s.variant(r, name)
+	if varies {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if served == "" {
+		served = name
+	} else {
+		w.Header().Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+	f, err := s.fsys.Open(served)
+	if err != nil {
+		myLogger.Errorf("opening static file '%s' failed with error: '%s'", served, err)
+		Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			Error(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	//ServeContent only knows the etag before compression adds its coding
+	if r.Header.Get("If-None-Match") != "" &&
+		notModified(r, `"`+etag+`"`, time.Time{}, s.etagSuffixes) {
+		writeNotModified(w)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+func (s *staticHandler) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		Error(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	var body bytes.Buffer
+	body.WriteString("<!DOCTYPE html>\n<pre>\n")
+	for _, e := range entries {
+		entry := e.Name()
+		if strings.HasPrefix(entry, ".") {
+			continue
+		}
+		if e.IsDir() {
+			entry += "/"
+		}
+		//./ so a name with a colon isn't taken for a scheme
+		fmt.Fprintf(
+			&body, "<a href=\"./%s\">%s</a>\n",
+			(&url.URL{Path: entry}).EscapedPath(), html.EscapeString(entry),
+		)
+	}
+	body.WriteString("</pre>\n")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeBody(w, http.StatusOK, MediaHTML+"; charset=utf-8", body.Bytes())
+}
+
+// the asset template func's work, the fingerprinted url for a file under
+// one of handlers
+func assetURL(handlers []*staticHandler) func(string) (string, error) {
+	return func(urlPath string) (string, error) {
+		for _, s := range handlers {
+			name, ok := s.fileName(urlPath)
+			if !ok || name == "." {
+				continue
+			}
+			h, err := s.hash(name)
+			if err != nil {
+				continue
+			}
+			ext := path.Ext(urlPath)
+			if ext == "" {
+				return "", fmt.Errorf("asset: '%s' needs an extension to fingerprint", urlPath)
+			}
+			return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(urlPath, ext), h.sum, ext), nil
+		}
+		return "", fmt.Errorf("asset: no static file for '%s'", urlPath)
+	}
+}
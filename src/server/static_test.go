@@ -0,0 +1,309 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestServerStatic(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	css := []byte("body{color:red}")
+	sum := sha256.Sum256(css)
+	hash := hex.EncodeToString(sum[:])[:fingerprintLen]
+	assets := fstest.MapFS{
+		"app.css":          {Data: css, ModTime: modTime},
+		"app.css.gz":       {Data: []byte("gz bytes"), ModTime: modTime},
+		"app.css.br":       {Data: []byte("br bytes"), ModTime: modTime},
+		"plain.txt":        {Data: []byte("0123456789"), ModTime: modTime},
+		".env":             {Data: []byte("SECRET=1")},
+		"img/logo.svg":     {Data: []byte("<svg/>")},
+		"docs/index.html":  {Data: []byte("<p>docs</p>")},
+		"docs/a b.txt":     {Data: []byte("a")},
+		"empty/readme.txt": {Data: []byte("r")},
+	}
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/sub", 0o755)
+	os.WriteFile(dir+"/sub/x.txt", []byte("x"), 0o644)
+	os.WriteFile(dir+"/index.html", []byte("<p>app</p>"), 0o644)
+	tmpServer, err := NewServer(
+		strings.NewReader(`/assets:
+  static:
+    fs: assets
+/files:
+  static:
+    dir: `+dir+`
+    listing: true
+    max_age: 1h
+/:
+  static:
+    dir: `+dir+`
+    spa: true
+/page:
+  render: page.html
+`),
+		nil,
+		WithStaticFS("assets", assets),
+		WithTemplates(TemplateConfig{FS: fstest.MapFS{
+			"pages/page.html": {Data: []byte(`<link href="{{asset "/assets/app.css"}}">`)},
+		}}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range tmpServer.(*server).pathHandlers {
+		mux.Handle(path, h)
+	}
+	etag := `"` + hash + `"`
+	testData := []struct {
+		method  string
+		target  string
+		header  http.Header
+		expCode int
+		expBody string
+		expHdr  http.Header
+		msg     string
+	}{
+		//0
+		{
+			http.MethodGet, "/assets/app.css", nil, http.StatusOK, string(css),
+			http.Header{
+				"Etag": {etag}, "Cache-Control": {"no-cache"}, "Vary": {"Accept-Encoding"},
+				"Content-Type":  {"text/css; charset=utf-8"},
+				"Last-Modified": {modTime.Format(http.TimeFormat)},
+			},
+			"plain file",
+		},
+		//1
+		{
+			http.MethodGet, "/assets/app.css", http.Header{"If-None-Match": {etag}},
+			http.StatusNotModified, "", nil, "etag matches",
+		},
+		//2
+		{
+			http.MethodGet, "/assets/app.css",
+			http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}},
+			http.StatusNotModified, "", nil, "not modified since",
+		},
+		//3
+		{
+			http.MethodGet, "/assets/app.css", http.Header{"Accept-Encoding": {"gzip"}},
+			http.StatusOK, "gz bytes",
+			http.Header{
+				"Content-Encoding": {"gzip"}, "Etag": {`"` + hash + `-gzip"`},
+				"Content-Type": {"text/css; charset=utf-8"},
+			},
+			"gzip variant",
+		},
+		//4
+		{
+			http.MethodGet, "/assets/app.css", http.Header{"Accept-Encoding": {"gzip, br"}},
+			http.StatusOK, "br bytes", http.Header{"Content-Encoding": {"br"}}, "br preferred",
+		},
+		//5
+		{
+			http.MethodGet, "/assets/app.css",
+			http.Header{"Accept-Encoding": {"br;q=0, *"}},
+			http.StatusOK, "gz bytes", http.Header{"Content-Encoding": {"gzip"}}, "br refused",
+		},
+		//6
+		{
+			http.MethodGet, "/assets/app." + hash + ".css", nil, http.StatusOK, string(css),
+			http.Header{"Cache-Control": {immutableCaching}}, "fingerprinted",
+		},
+		//7
+		{
+			http.MethodGet, "/assets/app.0123456789abcdef.css", nil, http.StatusOK,
+			string(css), http.Header{"Cache-Control": {"no-cache"}}, "stale fingerprint",
+		},
+		//8
+		{
+			http.MethodGet, "/assets/plain.txt", http.Header{"Range": {"bytes=2-4"}},
+			http.StatusPartialContent, "234", nil, "range",
+		},
+		//9
+		{http.MethodGet, "/assets/.env", nil, http.StatusNotFound, "", nil, "dot file"},
+		//10
+		{http.MethodGet, "/assets/img/", nil, http.StatusNotFound, "", nil, "no listing"},
+		//11
+		{http.MethodGet, "/assets/docs/", nil, http.StatusOK, "<p>docs</p>", nil, "index"},
+		//12
+		{
+			http.MethodGet, "/assets/docs?a=1", nil, http.StatusMovedPermanently, "",
+			http.Header{"Location": {"/assets/docs/?a=1"}}, "directory without a slash",
+		},
+		//13
+		{http.MethodGet, "/assets/missing.css", nil, http.StatusNotFound, "", nil, "missing"},
+		//14
+		{http.MethodPost, "/assets/app.css", nil, http.StatusMethodNotAllowed, "", nil, "post"},
+		//15
+		{
+			http.MethodGet, "/files/sub/", nil, http.StatusOK, `<a href="./x.txt">x.txt</a>`,
+			http.Header{"Cache-Control": {"no-cache"}}, "listing",
+		},
+		//16
+		{
+			http.MethodGet, "/files/sub/x.txt", nil, http.StatusOK, "x",
+			http.Header{"Cache-Control": {"public, max-age=3600"}}, "dir with max age",
+		},
+		//17
+		{http.MethodGet, "/deeds/7", nil, http.StatusOK, "<p>app</p>", nil, "spa fallback"},
+		//18
+		{http.MethodGet, "/deeds/7.json", nil, http.StatusNotFound, "", nil, "spa with ext"},
+		//19
+		{http.MethodHead, "/sub/x.txt", nil, http.StatusOK, "", nil, "head"},
+		//20
+		{
+			http.MethodGet, "/page", nil, http.StatusOK,
+			`<link href="/assets/app.` + hash + `.css">`, nil, "asset func",
+		},
+	}
+	for i, td := range testData {
+		r := httptest.NewRequest(td.method, "http://example.com"+td.target, nil)
+		for k, vals := range td.header {
+			r.Header[k] = vals
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if !strings.Contains(w.Body.String(), td.expBody) {
+			t.Errorf(getTestMessage(i, td.msg, "exp '%s' in: '%s'", td.expBody, w.Body))
+		}
+		for k := range td.expHdr {
+			if got := w.Header().Get(k); got != td.expHdr.Get(k) {
+				t.Errorf(getTestMessage(
+					i, td.msg, "exp %s: '%s', got: '%s'", k, td.expHdr.Get(k), got,
+				))
+			}
+		}
+	}
+}
+
+func TestServerStaticCompressed(t *testing.T) {
+	js := []byte(strings.Repeat("console.log('lot 7');\n", 100))
+	tmpServer, err := NewServer(
+		strings.NewReader("/assets:\n  static:\n    fs: assets\n"),
+		nil,
+		WithStaticFS("assets", fstest.MapFS{"app.js": {Data: js, ModTime: time.Now()}}),
+		WithCompression(CompressionConfig{}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	h := tmpServer.(*server).pathHandlers["/assets/"]
+	etag := ""
+	for i, enc := range []string{"gzip", "gzip", "br", "br"} {
+		r := httptest.NewRequest(http.MethodGet, "/assets/app.js", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		exp := http.StatusOK
+		//revalidates with what the previous response sent
+		if i%2 == 1 {
+			r.Header.Set("If-None-Match", etag)
+			exp = http.StatusNotModified
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != exp {
+			t.Errorf(getTestMessage(i, enc, "exp code: %d, got: %d", exp, w.Code))
+		}
+		if w.Code == http.StatusOK {
+			etag = w.Header().Get("Etag")
+			if !strings.HasSuffix(etag, "-"+enc+`"`) {
+				t.Errorf(getTestMessage(i, enc, "exp a %s etag, got: '%s'", enc, etag))
+			}
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() > 0 {
+			t.Errorf(getTestMessage(i, enc, "exp no body, got %d bytes", w.Body.Len()))
+		}
+	}
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	testData := []struct {
+		header string
+		exp    string
+		msg    string
+	}{
+		//0
+		{"", "", "none"},
+		//1
+		{"gzip, deflate, br", "br,gzip", "both"},
+		//2
+		{"GZIP;q=0.5", "gzip", "case and quality"},
+		//3
+		{"*;q=0", "", "star refused"},
+		//4
+		{"identity, *", "br,gzip", "star"},
+	}
+	for i, td := range testData {
+		if got := strings.Join(acceptedEncodings(td.header), ","); got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp: '%s', got: '%s'", td.exp, got))
+		}
+	}
+}
+
+func TestStaticLoading(t *testing.T) {
+	dir := t.TempDir()
+	withFS := []Option{WithStaticFS("assets", fstest.MapFS{})}
+	testData := []struct {
+		yamlString string
+		opts       []Option
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"/a:\n  static:\n    fs: assets\n", withFS, false, "fs"},
+		//1
+		{"/a:\n  static:\n    dir: " + dir + "\n", nil, false, "dir"},
+		//2
+		{"/a:\n  static:\n    fs: other\n", withFS, true, "unknown fs"},
+		//3
+		{"/a:\n  static:\n    dir: " + dir + "/missing\n", nil, true, "missing dir"},
+		//4
+		{"/a:\n  static:\n    dir: a\n    fs: assets\n", withFS, true, "dir and fs"},
+		//5
+		{"/a:\n  static: {}\n", nil, true, "neither"},
+		//6
+		{"/a:\n  callbacks: [cb1]\n  static:\n    fs: assets\n", withFS, true, "callbacks"},
+		//7
+		{"/a/{id}:\n  static:\n    fs: assets\n", withFS, true, "dynamic path"},
+		//8
+		{"/a:\n  methods: [post]\n  static:\n    fs: assets\n", withFS, true, "post"},
+		//9
+		{"/a:\n  static:\n    fs: assets\n    max_age: soon\n", withFS, true, "bad max age"},
+		//10
+		{"/a:\n  static:\n    fs: assets\n    index: a/b.html\n", withFS, true, "index path"},
+		//11
+		{
+			"/a:\n  render: p.html\n",
+			[]Option{WithTemplates(TemplateConfig{
+				FS: fstest.MapFS{"pages/p.html": {Data: []byte("x")}},
+				Funcs: template.FuncMap{
+					"asset": func(string) string { return "" },
+				},
+			})},
+			true, "replaced asset func",
+		},
+		//12
+		{"/a:\n  csrf: false\n  static:\n    fs: assets\n", withFS, true, "csrf"},
+	}
+	for i, td := range testData {
+		_, err := NewServer(strings.NewReader(td.yamlString), nil, td.opts...)
+		if td.expError && err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+		if !td.expError && err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+		}
+	}
+}
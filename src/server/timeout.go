@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+timeout: on a route puts a deadline on the request's context, eg
+
+	/analyze:
+	  timeout: 30s
+
+it covers parsing and every callback, parsing that runs past it, uploads
+mostly, gets a 504. Callbacks see the context cancelled, the client gets a
+504 when nothing was written yet and the request is done either way. A
+callback that ignores the cancellation keeps running in the background
+holding its max_concurrent slot and uploads until it returns, anything it
+writes or changes in the session after the timeout is dropped.
+*/
+
+// keeps the callbacks' writes away from the response once the handler has
+// timed out, headers are their own until something is written
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	mu       sync.Mutex
+	header   http.Header
+	wrote    bool
+	timedOut bool
+}
+
+func newTimeoutWriter(w http.ResponseWriter) *timeoutWriter {
+	return &timeoutWriter{
+		w:      w,
+		header: w.Header().Clone(),
+	}
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.header
+}
+
+// caller holds mu
+func (t *timeoutWriter) copyHeader() {
+	dst := t.w.Header()
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, v := range t.header {
+		dst[k] = v
+	}
+}
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return
+	}
+	if !t.wrote {
+		t.copyHeader()
+	}
+	t.wrote = true
+	t.w.WriteHeader(code)
+}
+
+func (t *timeoutWriter) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !t.wrote {
+		t.copyHeader()
+	}
+	t.wrote = true
+	return t.w.Write(data)
+}
+
+func (t *timeoutWriter) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return
+	}
+	if !t.wrote {
+		t.copyHeader()
+	}
+	t.wrote = true
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController get at the underlying writer
+func (t *timeoutWriter) Unwrap() http.ResponseWriter {
+	return t.w
+}
+
+// the callbacks returned in time, headers they set without writing still
+// go out with the default 200
+func (t *timeoutWriter) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.wrote {
+		t.copyHeader()
+	}
+}
+
+// stops any more writes, true when nothing was written so the handler can
+// still send an error
+func (t *timeoutWriter) timeout() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timedOut = true
+	return !t.wrote
+}
+
+// parsing failed because the route's timeout passed, the sink or the body
+// gave up, hErr is returned as is otherwise
+func (m *myHandler) parseTimedOut(r *http.Request, hErr *handlerError) *handlerError {
+	if hErr == nil || m.route.timeout == 0 || r.Context().Err() != context.DeadlineExceeded {
+		return hErr
+	}
+	myLogger.Errorf("route '%s' timed out after %s parsing the request", m.path, m.route.timeout)
+	m.metrics.limitExceeded(m.path, timeoutLimit)
+	return &handlerError{http.StatusGatewayTimeout, "request timed out"}
+}
+
+// the callbacks in order then the route's render: if none of them wrote,
+// running tracks which callback is going when it isn't nil
+func (m *myHandler) runChain(
+	w http.ResponseWriter, r *http.Request,
+	parameterValues map[string]string, running *atomic.Int64,
+) {
+	var rw *renderWriter
+	if m.route.render != "" {
+		rw = &renderWriter{ResponseWriter: w}
+		w = rw
+	}
+	for i := range m.callbacks {
+		if running != nil {
+			running.Store(int64(i))
+		}
+		if !m.runCallback(i, parameterValues, w, r) {
+			return
+		}
+	}
+	if rw != nil && !rw.wrote {
+		m.renderPage(rw.ResponseWriter, r)
+	}
+}
+
+// runs the callback chain, cleanup is called once it's done, which with a
+// timeout might be after the request is
+func (m *myHandler) runCallbacks(
+	w http.ResponseWriter, r *http.Request,
+	parameterValues map[string]string, cleanup func(),
+) {
+	if m.route.timeout == 0 {
+		defer cleanup()
+		m.runChain(w, r, parameterValues, nil)
+		return
+	}
+	tw := newTimeoutWriter(w)
+	var running atomic.Int64
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer cleanup()
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+				return
+			}
+			close(done)
+		}()
+		m.runChain(tw, r, parameterValues, &running)
+	}()
+	select {
+	case <-done:
+		tw.finish()
+		return
+	case p := <-panicked:
+		//same as the callback panicking in the handler's goroutine
+		panic(p)
+	case <-r.Context().Done():
+		//finished right as the deadline hit
+		select {
+		case <-done:
+			tw.finish()
+			return
+		default:
+		}
+	}
+	//what the session holds now is what's saved, whatever still runs
+	//can't change it under the save
+	RequestSession(r).seal()
+	name := m.callbackName(int(running.Load()))
+	if r.Context().Err() != context.DeadlineExceeded {
+		myLogger.Debugf("request cancelled while running callback '%s'", name)
+		tw.timeout()
+		return
+	}
+	myLogger.Errorf(
+		"route '%s' timed out after %s while running callback '%s'",
+		m.path, m.route.timeout, name,
+	)
+	m.metrics.limitExceeded(m.path, timeoutLimit)
+	if tw.timeout() {
+		m.writeError(w, r, &handlerError{http.StatusGatewayTimeout, "request timed out"})
+	}
+}
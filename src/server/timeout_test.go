@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimeout(t *testing.T) {
+	serverYaml, err := os.Open("testdata/timeout.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	//what the stuck callback saw once it gave up
+	type stuckResult struct {
+		ctxErr   error
+		writeErr error
+	}
+	stuck := make(chan stuckResult, 1)
+	tmpServer, err := NewServer(serverYaml, map[string]Callback{
+		"cb1": makeCallback(myLogger, "cb1", true, nil, nil),
+		"stuck": func(
+			p map[string]string, w http.ResponseWriter, r *http.Request,
+		) (bool, error) {
+			<-r.Context().Done()
+			//give the handler time to answer first
+			time.Sleep(10 * time.Millisecond)
+			_, err := w.Write([]byte("too late"))
+			stuck <- stuckResult{r.Context().Err(), err}
+			return true, nil
+		},
+		"partial": func(
+			p map[string]string, w http.ResponseWriter, r *http.Request,
+		) (bool, error) {
+			w.Write([]byte("partial"))
+			<-r.Context().Done()
+			time.Sleep(10 * time.Millisecond)
+			return false, r.Context().Err()
+		},
+		"fast": func(
+			p map[string]string, w http.ResponseWriter, r *http.Request,
+		) (bool, error) {
+			if _, ok := r.Context().Deadline(); !ok {
+				return false, errors.New("no deadline")
+			}
+			w.Header().Set("X-Done", "yes")
+			return true, nil
+		},
+	}, WithMetricsPath("/metrics"))
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		handlePath string
+		expCode    int
+		expBody    string
+		expHeader  string
+		msg        string
+	}{
+		//0
+		{"/stuck", http.StatusGatewayTimeout, "request timed out\n", "", "nothing written"},
+		//1
+		{"/partial", http.StatusOK, "partial", "", "already written"},
+		//2
+		{"/fast", http.StatusOK, "", "yes", "in time"},
+	}
+	for i, td := range testData {
+		w := httptest.NewRecorder()
+		testServer.pathHandlers[td.handlePath].ServeHTTP(
+			w, httptest.NewRequest(http.MethodGet, "http://example.com"+td.handlePath, nil),
+		)
+		if w.Code != td.expCode {
+			t.Errorf(getTestMessage(i, td.msg, "exp code: %d, got: %d", td.expCode, w.Code))
+		}
+		if w.Body.String() != td.expBody {
+			t.Errorf(getTestMessage(i, td.msg, "exp body: '%s', got: '%s'", td.expBody, w.Body))
+		}
+		if w.Header().Get("X-Done") != td.expHeader {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected X-Done: '%s'", w.Header().Get("X-Done")))
+		}
+	}
+	select {
+	case res := <-stuck:
+		if res.ctxErr != context.DeadlineExceeded {
+			t.Errorf("stuck callback exp a deadline error, got: '%v'", res.ctxErr)
+		}
+		if res.writeErr != http.ErrHandlerTimeout {
+			t.Errorf("late write exp ErrHandlerTimeout, got: '%v'", res.writeErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("stuck callback never returned")
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandlers["/metrics"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil),
+	)
+	for _, line := range []string{
+		`landtitle_limit_rejections_total{route="/stuck",limit="timeout"} 1`,
+		`landtitle_limit_rejections_total{route="/partial",limit="timeout"} 1`,
+		`landtitle_http_requests_total{route="/stuck",method="get",status="504"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics missing line: '%s'", line)
+		}
+	}
+}
+
+func TestServerTimeoutPanic(t *testing.T) {
+	tmpServer, err := NewServer(
+		strings.NewReader("/panic:\n  timeout: 1s\n  callbacks:\n    - panic\n"),
+		map[string]Callback{
+			"panic": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				panic("boom")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("exp the callback's panic, got: '%v'", p)
+		}
+	}()
+	tmpServer.(*server).pathHandlers["/panic"].ServeHTTP(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/panic", nil),
+	)
+}
+
+// holds uploads until the request gives up
+type stuckSink struct {
+	*memorySink
+}
+
+func (s stuckSink) Store(ctx context.Context, upload *FileUpload, content io.Reader) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestServerTimeoutParsing(t *testing.T) {
+	tmpServer, err := NewServer(
+		strings.NewReader(`/deeds:
+  methods: [post]
+  timeout: 50ms
+  params:
+    deed:
+      type: file
+  callbacks: [cb1]
+`),
+		map[string]Callback{"cb1": makeCallback(myLogger, "cb1", true, nil, nil)},
+		WithUploadSink(stuckSink{newMemorySink()}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	body, contentType := multipartBody(t, []testPart{{"deed", "deed.pdf", testPDF}})
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/deeds", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	tmpServer.(*server).pathHandlers["/deeds"].ServeHTTP(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("exp code: %d, got: %d, body: '%s'", http.StatusGatewayTimeout, w.Code, w.Body)
+	}
+}
+
+func TestServerTimeoutSession(t *testing.T) {
+	late := make(chan struct{})
+	tmpServer, err := NewServer(
+		strings.NewReader(`/stuck:
+  timeout: 50ms
+  callbacks: [stuck]
+/read:
+  callbacks: [read]
+`),
+		map[string]Callback{
+			"stuck": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				RequestSession(r).Set("a", "1")
+				<-r.Context().Done()
+				//give the handler time to answer first
+				time.Sleep(10 * time.Millisecond)
+				RequestSession(r).Set("b", "2")
+				close(late)
+				return true, nil
+			},
+			"read": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				a, _ := RequestSession(r).Get("a")
+				b, _ := RequestSession(r).Get("b")
+				w.Write([]byte(a + b))
+				return true, nil
+			},
+		},
+		WithSessions(SessionConfig{Keys: [][]byte{testSessionKey}}),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	handlers := tmpServer.(*server).pathHandlers
+	w := httptest.NewRecorder()
+	handlers["/stuck"].ServeHTTP(
+		w, httptest.NewRequest(http.MethodGet, "http://example.com/stuck", nil),
+	)
+	if w.Code != http.StatusGatewayTimeout || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("exp a 504 with the session's cookie, got: %d %v", w.Code, w.Header())
+	}
+	select {
+	case <-late:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stuck callback never returned")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/read", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	handlers["/read"].ServeHTTP(w, r)
+	if w.Body.String() != "1" {
+		t.Errorf("exp only what was set before the timeout, got: '%s'", w.Body)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+Normalization applied to a param's raw value, in order, before defaults and
+validation, eg for APNs typed every which way
+
+	apn:
+	  transform: [trim, digits]
+	name:
+	  transform:
+	    - collapse_whitespace
+	    - nfc
+	    - replace: '[^\w ]'
+	      with: ''
+
+callbacks get the normalized value, the value as sent is in RawParams
+*/
+
+type transformType string
+
+const (
+	trimTransform               transformType = "trim"
+	lowerTransform                            = "lower"
+	upperTransform                            = "upper"
+	digitsTransform                           = "digits"
+	collapseWhitespaceTransform               = "collapse_whitespace"
+	nfcTransform                              = "nfc"
+	replaceTransform                          = "replace"
+)
+
+// either a bare transform name or a regex replace
+type TransformYaml struct {
+	Name    string `yaml:"-"`
+	Replace string `yaml:"replace,omitempty"`
+	With    string `yaml:"with"`
+}
+
+func (t *TransformYaml) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.Name); err == nil {
+		return nil
+	}
+	type plain TransformYaml
+	return unmarshal((*plain)(t))
+}
+
+func (t TransformYaml) MarshalYAML() (interface{}, error) {
+	if t.Name != "" {
+		return t.Name, nil
+	}
+	type plain TransformYaml
+	return plain(t), nil
+}
+
+type transform func(string) string
+
+var whitespaceRegex *regexp.Regexp = regexp.MustCompile(`\s+`)
+
+var namedTransforms map[transformType]transform = map[transformType]transform{
+	trimTransform:  strings.TrimSpace,
+	lowerTransform: strings.ToLower,
+	upperTransform: strings.ToUpper,
+	digitsTransform: func(val string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, val)
+	},
+	collapseWhitespaceTransform: func(val string) string {
+		return whitespaceRegex.ReplaceAllString(strings.TrimFunc(val, unicode.IsSpace), " ")
+	},
+	nfcTransform: norm.NFC.String,
+}
+
+func newTransform(t *TransformYaml) (transform, error) {
+	if t == nil {
+		return nil, fmt.Errorf("transform can't be empty")
+	}
+	if t.Name == "" {
+		if t.Replace == "" {
+			return nil, fmt.Errorf("replace transform requires a pattern")
+		}
+		regex, err := regexp.Compile(t.Replace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace pattern '%s': %w", t.Replace, err)
+		}
+		with := t.With
+		return func(val string) string {
+			return regex.ReplaceAllString(val, with)
+		}, nil
+	}
+	toRet, ok := namedTransforms[transformType(t.Name)]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized transform: '%s'", t.Name)
+	}
+	return toRet, nil
+}
+
+type transforms []transform
+
+func newTransforms(ts []*TransformYaml) (transforms, error) {
+	toRet := make(transforms, len(ts))
+	for i, t := range ts {
+		tmp, err := newTransform(t)
+		if err != nil {
+			return nil, err
+		}
+		toRet[i] = tmp
+	}
+	return toRet, nil
+}
+
+func (ts transforms) apply(val string) string {
+	for _, t := range ts {
+		val = t(val)
+	}
+	return val
+}
+
+// normalizes values in place, bracketed keys use their nested param's
+// transforms
+func (r routeParameterMap) transform(values map[string]string) {
+	for k, v := range values {
+		if param := r.lookup(k); param != nil && len(param.transforms) > 0 {
+			values[k] = param.transforms.apply(v)
+		}
+	}
+}
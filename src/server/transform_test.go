@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestTransforms(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		val        string
+		exp        string
+		expError   bool
+		msg        string
+	}{
+		//0
+		{"[trim]", "  123 ", "123", false, "trim"},
+		//1
+		{"[digits]", "123-456-78", "12345678", false, "digits"},
+		//2
+		{"[trim, digits]", " 123 456 78 ", "12345678", false, "chained"},
+		//3
+		{"[lower]", "MiXeD", "mixed", false, "lower"},
+		//4
+		{"[upper]", "MiXeD", "MIXED", false, "upper"},
+		//5
+		{"[collapse_whitespace]", " a \t b\n\nc ", "a b c", false, "collapse whitespace"},
+		//6
+		{"[nfc]", "cafe\u0301", "caf\u00e9", false, "nfc composes"},
+		//7
+		{"[{replace: '-+', with: '_'}]", "a--b-c", "a_b_c", false, "regex replace"},
+		//8
+		{"[{replace: '(\\w+)@(\\w+)', with: '$2@$1'}]", "a@b", "b@a", false, "replace groups"},
+		//9
+		{"[{replace: '[', with: ''}]", "", "", true, "bad pattern"},
+		//10
+		{"[{with: 'x'}]", "", "", true, "replace needs a pattern"},
+		//11
+		{"[titlecase]", "", "", true, "unknown transform"},
+		//12
+		{"[upper, {replace: 'A', with: 'b'}, lower]", "aaa", "bbb", false, "order matters"},
+	}
+	for i, td := range testData {
+		tYaml := make([]*TransformYaml, 0)
+		if err := yaml.Unmarshal([]byte(td.yamlString), &tYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		ts, err := newTransforms(tYaml)
+		if td.expError {
+			if err == nil {
+				t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected error: '%s'", err))
+			continue
+		}
+		if got := ts.apply(td.val); got != td.exp {
+			t.Errorf(getTestMessage(i, td.msg, "exp: '%s', got: '%s'", td.exp, got))
+		}
+	}
+}
+
+func TestServerTransforms(t *testing.T) {
+	serverYaml, err := os.Open("testdata/transform.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	var params, raw map[string]string
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				params, raw = p, RawParams(r)
+				return true, nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		target    string
+		expCode   int
+		expParams map[string]string
+		expRaw    map[string]string
+		msg       string
+	}{
+		//0
+		{
+			"http://example.com/parcel?apn=123-456-78",
+			http.StatusOK,
+			map[string]string{"apn": "12345678"},
+			map[string]string{"apn": "123-456-78"},
+			"dashes stripped",
+		},
+		//1
+		{
+			"http://example.com/parcel?apn=+123+456+78+&county=maricopa++co",
+			http.StatusOK,
+			map[string]string{"apn": "12345678", "county": "MARICOPA COUNTY"},
+			map[string]string{"apn": " 123 456 78 ", "county": "maricopa  co"},
+			"spaces stripped",
+		},
+		//2
+		{
+			"http://example.com/parcel?apn=12345678",
+			http.StatusOK,
+			map[string]string{"apn": "12345678"},
+			map[string]string{"apn": "12345678"},
+			"already normal",
+		},
+		//3
+		{
+			"http://example.com/parcel?apn=123-456-7",
+			http.StatusBadRequest,
+			nil,
+			nil,
+			"validation runs on the normalized value",
+		},
+	}
+	for i, td := range testData {
+		params, raw = nil, nil
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", td.target, nil)
+		testServer.pathHandlers["/parcel"].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		if len(params) != len(td.expParams) || len(raw) != len(td.expRaw) {
+			t.Errorf(
+				getTestMessage(i, td.msg, "params: '%v', raw: '%v'", params, raw),
+			)
+			continue
+		}
+		for k, v := range td.expParams {
+			if params[k] != v {
+				t.Errorf(
+					getTestMessage(
+						i, td.msg, "param '%s' exp: '%s', got: '%s'", k, v, params[k],
+					),
+				)
+			}
+		}
+		for k, v := range td.expRaw {
+			if raw[k] != v {
+				t.Errorf(
+					getTestMessage(
+						i, td.msg, "raw param '%s' exp: '%s', got: '%s'", k, v, raw[k],
+					),
+				)
+			}
+		}
+	}
+}
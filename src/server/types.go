@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the default layouts for date params, ISO first then US, a layout: on the
+// param replaces both
+var defDateLayouts []string = []string{"2006-01-02", "1/2/2006"}
+
+var defDateTimeLayouts []string = []string{time.RFC3339Nano}
+
+type UUID [16]byte
+
+func (u UUID) String() string {
+	b := hex.EncodeToString(u[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", b[0:8], b[8:12], b[12:16], b[16:20], b[20:])
+}
+
+var uuidRegex *regexp.Regexp = regexp.MustCompile(
+	`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+)
+
+func parseUUID(val string) (UUID, error) {
+	var toRet UUID
+	if !uuidRegex.MatchString(val) {
+		return toRet, fmt.Errorf("value '%s' is not a valid uuid", val)
+	}
+	_, err := hex.Decode(toRet[:], []byte(strings.ReplaceAll(val, "-", "")))
+	return toRet, err
+}
+
+func parseTime(val string, layouts []string, pType httpParameterType) (time.Time, error) {
+	for _, layout := range layouts {
+		if toRet, err := time.Parse(layout, val); err == nil {
+			return toRet, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(
+		"value '%s' is not a valid %s, expected layout(s): '%s'",
+		val, pType, strings.Join(layouts, "', '"),
+	)
+}
+
+// turns a raw value into the type callbacks see in TypedParams, the regex
+// for the type, if any, has already matched
+type typeParser func(*routeParameter, string) (interface{}, error)
+
+var parameterParsers map[httpParameterType]typeParser = map[httpParameterType]typeParser{
+	stringParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return val, nil
+	},
+	numberParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return strconv.ParseFloat(val, 64)
+	},
+	integerParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return strconv.ParseInt(val, 10, 64)
+	},
+	booleanParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return strings.EqualFold(val, "true"), nil
+	},
+	dateParameterType: func(r *routeParameter, val string) (interface{}, error) {
+		return parseTime(val, r.layouts, r.pType)
+	},
+	dateTimeParameterType: func(r *routeParameter, val string) (interface{}, error) {
+		return parseTime(val, r.layouts, r.pType)
+	},
+	uuidParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return parseUUID(val)
+	},
+	emailParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		addr, err := mail.ParseAddress(val)
+		if err != nil {
+			return nil, err
+		}
+		//ParseAddress happily takes "Bob <bob@example.com>", bare addresses only
+		if addr.Name != "" || addr.Address != val {
+			return nil, fmt.Errorf("value '%s' is not a bare email address", val)
+		}
+		return addr.Address, nil
+	},
+	durationParameterType: func(_ *routeParameter, val string) (interface{}, error) {
+		return time.ParseDuration(val)
+	},
+}
+
+// typed parameter values as handed to callbacks, see TypedParams,
+// the concrete type for each parameter type is:
+//
+//	string, email -> string
+//	number        -> float64
+//	integer       -> int64
+//	boolean       -> bool
+//	date/datetime -> time.Time
+//	uuid          -> UUID
+//	duration      -> time.Duration
+//	object        -> Values
+//	array         -> []interface{}
+//	file          -> []*FileUpload
+type Values map[string]interface{}
+
+func (v Values) String(name string) (string, bool) {
+	toRet, ok := v[name].(string)
+	return toRet, ok
+}
+
+func (v Values) Float(name string) (float64, bool) {
+	toRet, ok := v[name].(float64)
+	return toRet, ok
+}
+
+func (v Values) Int(name string) (int64, bool) {
+	toRet, ok := v[name].(int64)
+	return toRet, ok
+}
+
+func (v Values) Bool(name string) (bool, bool) {
+	toRet, ok := v[name].(bool)
+	return toRet, ok
+}
+
+func (v Values) Time(name string) (time.Time, bool) {
+	toRet, ok := v[name].(time.Time)
+	return toRet, ok
+}
+
+func (v Values) Duration(name string) (time.Duration, bool) {
+	toRet, ok := v[name].(time.Duration)
+	return toRet, ok
+}
+
+func (v Values) UUID(name string) (UUID, bool) {
+	toRet, ok := v[name].(UUID)
+	return toRet, ok
+}
+
+func (v Values) Object(name string) (Values, bool) {
+	toRet, ok := v[name].(Values)
+	return toRet, ok
+}
+
+func (v Values) Array(name string) ([]interface{}, bool) {
+	toRet, ok := v[name].([]interface{})
+	return toRet, ok
+}
+
+func (v Values) Files(name string) ([]*FileUpload, bool) {
+	toRet, ok := v[name].([]*FileUpload)
+	return toRet, ok
+}
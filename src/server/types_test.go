@@ -0,0 +1,216 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParameterTypes(t *testing.T) {
+	testData := []struct {
+		param    *ParamYaml
+		value    string
+		expValid bool
+		expTyped interface{}
+		msg      string
+	}{
+		//0
+		{&ParamYaml{Type: "integer"}, "42", true, int64(42), "integer"},
+		//1
+		{&ParamYaml{Type: "integer"}, "-7", true, int64(-7), "negative integer"},
+		//2
+		{&ParamYaml{Type: "integer"}, "4.2", false, nil, "floats aren't integers"},
+		//3
+		{&ParamYaml{Type: "integer"}, "42abc", false, nil, "trailing garbage"},
+		//4
+		{&ParamYaml{Type: "number"}, "12.5", true, 12.5, "number"},
+		//5
+		{&ParamYaml{Type: "number"}, "12.5.5", false, nil, "number full match"},
+		//6
+		{&ParamYaml{Type: "number"}, "NaN", false, nil, "no NaN"},
+		//7
+		{&ParamYaml{Type: "boolean"}, "TRUE", true, true, "boolean"},
+		//8
+		{&ParamYaml{Type: "boolean"}, "falsey", false, nil, "boolean full match"},
+		//9
+		{
+			&ParamYaml{Type: "date"}, "1952-03-04", true,
+			time.Date(1952, 3, 4, 0, 0, 0, 0, time.UTC), "iso date",
+		},
+		//10
+		{
+			&ParamYaml{Type: "date"}, "3/4/1952", true,
+			time.Date(1952, 3, 4, 0, 0, 0, 0, time.UTC), "us date",
+		},
+		//11
+		{
+			&ParamYaml{Type: "date"}, "03/04/1952", true,
+			time.Date(1952, 3, 4, 0, 0, 0, 0, time.UTC), "zero padded us date",
+		},
+		//12
+		{&ParamYaml{Type: "date"}, "1952-02-30", false, nil, "no such day"},
+		//13
+		{
+			&ParamYaml{Type: "date", Layout: "02.01.2006"}, "04.03.1952", true,
+			time.Date(1952, 3, 4, 0, 0, 0, 0, time.UTC), "custom layout",
+		},
+		//14
+		{
+			&ParamYaml{Type: "date", Layout: "02.01.2006"}, "1952-03-04", false,
+			nil, "custom layout replaces the defaults",
+		},
+		//15
+		{
+			&ParamYaml{Type: "datetime"}, "2024-01-31T10:00:00Z", true,
+			time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC), "rfc 3339",
+		},
+		//16
+		{&ParamYaml{Type: "datetime"}, "2024-01-31", false, nil, "dates aren't datetimes"},
+		//17
+		{
+			&ParamYaml{Type: "uuid"}, "6BA7B810-9DAD-11D1-80B4-00C04FD430C8", true,
+			UUID{
+				0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1,
+				0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+			},
+			"uuid",
+		},
+		//18
+		{&ParamYaml{Type: "uuid"}, "6ba7b8109dad11d180b400c04fd430c8", false, nil, "uuid needs dashes"},
+		//19
+		{&ParamYaml{Type: "email"}, "clerk@kern.ca.gov", true, "clerk@kern.ca.gov", "email"},
+		//20
+		{&ParamYaml{Type: "email"}, "Clerk <clerk@kern.ca.gov>", false, nil, "bare addresses only"},
+		//21
+		{&ParamYaml{Type: "email"}, "not an email", false, nil, "garbage email"},
+		//22
+		{&ParamYaml{Type: "duration"}, "1h30m", true, 90 * time.Minute, "duration"},
+		//23
+		{&ParamYaml{Type: "duration"}, "90", false, nil, "durations need units"},
+		//24
+		{&ParamYaml{Type: "string"}, "foo bar!", false, nil, "string full match"},
+		//25
+		{&ParamYaml{Type: "integer", Regex: `\d{3}`}, "1234", false, nil, "regex on top of type"},
+	}
+	for i, td := range testData {
+		param, err := newParam(td.param)
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected newParam error: '%s'", err))
+			continue
+		}
+		err = param.isValid(td.value)
+		if (err == nil) != td.expValid {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "validity mismatch, exp: %t, got error: '%v'",
+					td.expValid, err,
+				),
+			)
+			continue
+		}
+		if !td.expValid {
+			continue
+		}
+		typed, err := param.typedValue(td.value)
+		if err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "unexpected parse error: '%s'", err))
+			continue
+		}
+		if !reflect.DeepEqual(typed, td.expTyped) {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "typed value mismatch, exp: %#v, got: %#v",
+					td.expTyped, typed,
+				),
+			)
+		}
+	}
+	if _, err := newParam(&ParamYaml{Type: "string", Layout: "2006"}); err == nil {
+		t.Errorf("layout on a non date type should error")
+	}
+}
+
+func TestTypedParams(t *testing.T) {
+	serverYaml, err := os.Open("testdata/types.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	var got Values
+	tmpServer, err := NewServer(serverYaml, map[string]Callback{
+		"typed": func(
+			params map[string]string, w http.ResponseWriter, r *http.Request,
+		) (bool, error) {
+			got = TypedParams(r)
+			return true, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	handler := tmpServer.(*server).pathHandlers["/record/"]
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(
+		"GET",
+		"http://example.com/record/6ba7b810-9dad-11d1-80b4-00c04fd430c8"+
+			"?count=3&recorded=1952-03-04&filed=05.03.1952"+
+			"&updated=2024-01-31T10:00:00-08:00&owner=clerk@kern.ca.gov"+
+			"&ttl=5m&ratio=0.25&active=True",
+		nil,
+	))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response code: %d, body: '%s'", w.Code, w.Body.String())
+	}
+	if id, ok := got.UUID("id"); !ok || id.String() != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+		t.Errorf("uuid not typed: %#v", got["id"])
+	}
+	if count, ok := got.Int("count"); !ok || count != 3 {
+		t.Errorf("integer not typed: %#v", got["count"])
+	}
+	if recorded, ok := got.Time("recorded"); !ok || recorded.Year() != 1952 {
+		t.Errorf("date not typed: %#v", got["recorded"])
+	}
+	if filed, ok := got.Time("filed"); !ok || filed.Day() != 5 {
+		t.Errorf("custom layout date not typed: %#v", got["filed"])
+	}
+	if updated, ok := got.Time("updated"); !ok || updated.UTC().Hour() != 18 {
+		t.Errorf("datetime not typed: %#v", got["updated"])
+	}
+	if owner, ok := got.String("owner"); !ok || owner != "clerk@kern.ca.gov" {
+		t.Errorf("email not typed: %#v", got["owner"])
+	}
+	if ttl, ok := got.Duration("ttl"); !ok || ttl != 5*time.Minute {
+		t.Errorf("duration not typed: %#v", got["ttl"])
+	}
+	if ratio, ok := got.Float("ratio"); !ok || ratio != 0.25 {
+		t.Errorf("number not typed: %#v", got["ratio"])
+	}
+	if active, ok := got.Bool("active"); !ok || !active {
+		t.Errorf("boolean not typed: %#v", got["active"])
+	}
+
+	got = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(
+		"GET", "http://example.com/record/6ba7b810-9dad-11d1-80b4-00c04fd430c8", nil,
+	))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response code: %d, body: '%s'", w.Code, w.Body.String())
+	}
+	if len(got) != 1 {
+		t.Errorf("missing optional params shouldn't be typed, got: %#v", got)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(
+		"GET", "http://example.com/record/not-a-uuid", nil,
+	))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad uuid should be a 400, got: %d", w.Code)
+	}
+	if TypedParams(httptest.NewRequest("GET", "http://example.com/", nil)) != nil {
+		t.Errorf("requests that weren't handled shouldn't have typed params")
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"landtitle/aws"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+file params, only from multipart/form-data bodies, eg
+
+	deed:
+	  type: file
+	  max_size: 20971520
+	  max_count: 4
+	  accept: [application/pdf, image/*]
+
+uploads are streamed part by part to the server's UploadSink, see
+WithUploadSink, nothing is held in memory beyond the sniffing buffer.
+Callbacks get them as []*FileUpload in TypedParams.
+*/
+
+const (
+	multipartContentType string = "multipart/form-data"
+	//http.DetectContentType never looks further
+	sniffLength int = 512
+	//total for the non file fields of a multipart body, same as net/http
+	maxMultipartFieldBytes int64 = 10 << 20
+	defMaxFileCount        int   = 1
+)
+
+type FileUpload struct {
+	Param string
+	//as sent by the client, never use it as a path
+	Filename string
+	//sniffed from the content, not the client's Content-Type
+	ContentType string
+	Size        int64
+	//set by the sink, a file path for NewTempDirSink, an object key for
+	//NewS3Sink
+	Location string
+}
+
+// An UploadSink is where file params are streamed to
+type UploadSink interface {
+	//streams content somewhere and sets upload.Location
+	Store(ctx context.Context, upload *FileUpload, content io.Reader) error
+	//removes a stored upload when the request fails after it was stored
+	Discard(ctx context.Context, upload *FileUpload) error
+}
+
+// sinks that clean up after the request is done, whether it succeeded or not
+type uploadFinisher interface {
+	Finish(ctx context.Context, upload *FileUpload) error
+}
+
+type tempDirSink struct {
+	dir string
+}
+
+// Stores uploads as files in dir, os.TempDir() when empty, the files are
+// removed once the callbacks return, rename them to keep them
+func NewTempDirSink(dir string) UploadSink {
+	return &tempDirSink{dir}
+}
+
+func (t *tempDirSink) Store(ctx context.Context, upload *FileUpload, content io.Reader) error {
+	f, err := os.CreateTemp(t.dir, "upload-*")
+	if err != nil {
+		return err
+	}
+	upload.Location = f.Name()
+	_, err = io.Copy(f, content)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (t *tempDirSink) Discard(ctx context.Context, upload *FileUpload) error {
+	return os.Remove(upload.Location)
+}
+
+func (t *tempDirSink) Finish(ctx context.Context, upload *FileUpload) error {
+	if err := os.Remove(upload.Location); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type s3Sink struct {
+	client aws.S3Client
+	bucket string
+	prefix string
+}
+
+// Stores uploads in bucket under prefix with a random key, they're kept
+// after the request
+func NewS3Sink(client aws.S3Client, bucket, prefix string) UploadSink {
+	return &s3Sink{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+func (s *s3Sink) Store(ctx context.Context, upload *FileUpload, content io.Reader) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	upload.Location = path.Join(s.prefix, hex.EncodeToString(id))
+	return s.client.Upload(ctx, s.bucket, upload.Location, upload.ContentType, content)
+}
+
+func (s *s3Sink) Discard(ctx context.Context, upload *FileUpload) error {
+	return s.client.Delete(ctx, s.bucket, upload.Location)
+}
+
+// counts as it goes and stops the sink once max is passed
+type sizeLimitedReader struct {
+	reader   io.Reader
+	max      *int64
+	read     int64
+	exceeded bool
+}
+
+var errUploadTooLarge error = errors.New("upload exceeds max_size")
+
+func (s *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.read += int64(n)
+	if s.max != nil && s.read > *s.max {
+		s.exceeded = true
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// http.DetectContentType plus the formats scanners produce that it misses
+func sniffContentType(head []byte) string {
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	return http.DetectContentType(head)
+}
+
+// accept entries are exact media types or type/* wildcards
+func (r *routeParameter) accepts(contentType string) bool {
+	if len(r.accept) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range r.accept {
+		if a == mediaType ||
+			strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, a[:len(a)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *routeParameter) checkFileConstraints() error {
+	if r.pType != fileParameterType {
+		if r.maxSize != nil || r.maxCount != nil || len(r.accept) > 0 {
+			return fmt.Errorf("max_size, max_count and accept only apply to file parameters")
+		}
+		return nil
+	}
+	if r.source != sourceForm {
+		return fmt.Errorf("file parameters only come from the form")
+	}
+	if r.regex != nil || len(r.enum) > 0 || r.def != nil || len(r.transforms) > 0 ||
+		r.minLength != nil || r.maxLength != nil {
+		return fmt.Errorf(
+			"regex, enum, default, transform and lengths don't apply to file parameters",
+		)
+	}
+	if r.maxSize != nil && *r.maxSize <= 0 {
+		return fmt.Errorf("max_size must be positive")
+	}
+	if r.maxCount != nil && *r.maxCount <= 0 {
+		return fmt.Errorf("max_count must be positive")
+	}
+	for _, a := range r.accept {
+		if _, _, err := mime.ParseMediaType(a); err != nil || !strings.Contains(a, "/") {
+			return fmt.Errorf("invalid accept media type: '%s'", a)
+		}
+	}
+	return nil
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == multipartContentType
+}
+
+func (m *myHandler) uploadSink() UploadSink {
+	if m == nil || m.sink == nil {
+		return NewTempDirSink("")
+	}
+	return m.sink
+}
+
+// walks a multipart body part by part, fields come back as form values for
+// the usual handling, files are streamed to the sink as they arrive
+func (m *myHandler) parseMultipart(
+	r *http.Request, aliases map[string]string,
+) (url.Values, map[string][]*FileUpload, *handlerError) {
+	fields := make(url.Values)
+	uploads := make(map[string][]*FileUpload)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, &handlerError{http.StatusBadRequest, "invalid multipart body"}
+	}
+	fieldBytes := maxMultipartFieldBytes
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields, uploads, nil
+		}
+		if err != nil {
+			m.discardUploads(r.Context(), uploads)
+			if m.bodyTooLarge(err) {
+				return nil, nil, &handlerError{
+					http.StatusRequestEntityTooLarge, "request body too large",
+				}
+			}
+			return nil, nil, &handlerError{http.StatusBadRequest, "invalid multipart body"}
+		}
+		if part.FileName() == "" {
+			data, err := io.ReadAll(io.LimitReader(part, fieldBytes+1))
+			part.Close()
+			fieldBytes -= int64(len(data))
+			if err != nil && m.bodyTooLarge(err) {
+				m.discardUploads(r.Context(), uploads)
+				return nil, nil, &handlerError{
+					http.StatusRequestEntityTooLarge, "request body too large",
+				}
+			}
+			if err != nil || fieldBytes < 0 {
+				m.discardUploads(r.Context(), uploads)
+				return nil, nil, &handlerError{
+					http.StatusRequestEntityTooLarge, "multipart fields too large",
+				}
+			}
+			fields.Add(part.FormName(), string(data))
+			continue
+		}
+		hErr := m.storeUpload(r.Context(), part, aliases, uploads)
+		part.Close()
+		if hErr != nil {
+			m.discardUploads(r.Context(), uploads)
+			return nil, nil, hErr
+		}
+	}
+}
+
+func (m *myHandler) storeUpload(
+	ctx context.Context, part *multipart.Part,
+	aliases map[string]string, uploads map[string][]*FileUpload,
+) *handlerError {
+	name := part.FormName()
+	if canonical, ok := m.route.aliases[name]; ok {
+		aliases[name] = canonical
+		name = canonical
+	}
+	param, ok := m.route.params[name]
+	if !ok {
+		if m.route.unknownParams == rejectUnknownParams {
+			return &handlerError{
+				http.StatusBadRequest,
+				fmt.Sprintf("%s not found in parameter values for route", name),
+			}
+		}
+		myLogger.Tracef("dropping file for unknown parameter '%s'", name)
+		return nil
+	}
+	if param.pType != fileParameterType {
+		return &handlerError{
+			http.StatusBadRequest, fmt.Sprintf("parameter '%s' doesn't take files", name),
+		}
+	}
+	maxCount := defMaxFileCount
+	if param.maxCount != nil {
+		maxCount = *param.maxCount
+	}
+	if len(uploads[name]) >= maxCount {
+		return &handlerError{
+			http.StatusBadRequest,
+			fmt.Sprintf("parameter '%s' takes at most %d file(s)", name, maxCount),
+		}
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(part, head)
+	if err != nil && m.bodyTooLarge(err) {
+		return &handlerError{http.StatusRequestEntityTooLarge, "request body too large"}
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return &handlerError{http.StatusBadRequest, "invalid multipart body"}
+	}
+	head = head[:n]
+	upload := &FileUpload{
+		Param:       name,
+		Filename:    part.FileName(),
+		ContentType: sniffContentType(head),
+	}
+	if !param.accepts(upload.ContentType) {
+		m.metrics.validationFailed(m.path, name)
+		return &handlerError{
+			http.StatusUnsupportedMediaType,
+			fmt.Sprintf(
+				"parameter '%s' doesn't accept '%s'", name, upload.ContentType,
+			),
+		}
+	}
+	content := &sizeLimitedReader{
+		reader: io.MultiReader(bytes.NewReader(head), part),
+		max:    param.maxSize,
+	}
+	err = m.uploadSink().Store(ctx, upload, content)
+	upload.Size = content.read
+	if content.exceeded {
+		if err == nil {
+			m.uploadSink().Discard(ctx, upload)
+		}
+		m.metrics.validationFailed(m.path, name)
+		return &handlerError{
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf(
+				"parameter '%s' is larger than the max_size of %d bytes",
+				name, *param.maxSize,
+			),
+		}
+	}
+	if err != nil && m.bodyTooLarge(err) {
+		return &handlerError{http.StatusRequestEntityTooLarge, "request body too large"}
+	}
+	if err != nil {
+		myLogger.Errorf("storing upload for '%s' failed with error: '%s'", name, err)
+		return &handlerError{http.StatusInternalServerError, "failed storing upload"}
+	}
+	uploads[name] = append(uploads[name], upload)
+	return nil
+}
+
+// required file params that didn't show up, whatever the content type
+func (params routeParameterMap) checkUploads(uploads map[string][]*FileUpload) error {
+	for pName, param := range params {
+		if param.pType == fileParameterType && param.required && len(uploads[pName]) == 0 {
+			return &parameterError{
+				pName, fmt.Sprintf("required parameter '%s' missing", pName),
+			}
+		}
+	}
+	return nil
+}
+
+func (m *myHandler) discardUploads(ctx context.Context, uploads map[string][]*FileUpload) {
+	for _, files := range uploads {
+		for _, f := range files {
+			if err := m.uploadSink().Discard(ctx, f); err != nil {
+				myLogger.Errorf(
+					"discarding upload '%s' failed with error: '%s'", f.Location, err,
+				)
+			}
+		}
+	}
+}
+
+func (m *myHandler) finishUploads(ctx context.Context, uploads map[string][]*FileUpload) {
+	finisher, ok := m.uploadSink().(uploadFinisher)
+	if !ok {
+		return
+	}
+	for _, files := range uploads {
+		for _, f := range files {
+			if err := finisher.Finish(ctx, f); err != nil {
+				myLogger.Errorf(
+					"finishing upload '%s' failed with error: '%s'", f.Location, err,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+type memorySink struct {
+	sync.Mutex
+	stored    map[string][]byte
+	discarded []string
+	count     int
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{stored: make(map[string][]byte)}
+}
+
+func (m *memorySink) Store(ctx context.Context, upload *FileUpload, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.count++
+	upload.Location = fmt.Sprintf("mem/%d", m.count)
+	m.stored[upload.Location] = data
+	return nil
+}
+
+func (m *memorySink) Discard(ctx context.Context, upload *FileUpload) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.stored, upload.Location)
+	m.discarded = append(m.discarded, upload.Location)
+	return nil
+}
+
+type testPart struct {
+	field    string
+	filename string
+	content  string
+}
+
+func multipartBody(t *testing.T, parts []testPart) (*bytes.Buffer, string) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for _, p := range parts {
+		var w io.Writer
+		var err error
+		if p.filename == "" {
+			w, err = writer.CreateFormField(p.field)
+		} else {
+			w, err = writer.CreateFormFile(p.field, p.filename)
+		}
+		if err != nil {
+			t.Fatalf("failed building multipart body: '%s'", err)
+		}
+		io.WriteString(w, p.content)
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+const (
+	testPDF  string = "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n"
+	testTIFF        = "II*\x00\x08\x00\x00\x00"
+)
+
+func TestUploads(t *testing.T) {
+	serverYaml, err := os.Open("testdata/upload.yaml")
+	if err != nil {
+		t.Fatalf("failed opening test yaml with error: '%s'", err)
+	}
+	defer serverYaml.Close()
+	sink := newMemorySink()
+	var files []*FileUpload
+	var params map[string]string
+	tmpServer, err := NewServer(
+		serverYaml,
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				params = p
+				files, _ = TypedParams(r).Files("deed")
+				return true, nil
+			},
+		},
+		WithUploadSink(sink),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	testServer := tmpServer.(*server)
+	testData := []struct {
+		parts        []testPart
+		expCode      int
+		expTypes     []string
+		expNote      string
+		expDiscarded int
+		msg          string
+	}{
+		//0
+		{
+			[]testPart{{"deed", "deed.pdf", testPDF}, {"note", "", "recorded 1952"}},
+			http.StatusOK, []string{"application/pdf"}, "recorded 1952", 0, "pdf and a field",
+		},
+		//1
+		{
+			[]testPart{{"deed", "a.tif", testTIFF}, {"deed", "b.pdf", testPDF}},
+			http.StatusOK, []string{"image/tiff", "application/pdf"}, "", 0, "two files",
+		},
+		//2
+		{
+			[]testPart{{"deed", "deed.pdf", "<html><body>not a pdf</body></html>"}},
+			http.StatusUnsupportedMediaType, nil, "", 0, "sniffed type not accepted",
+		},
+		//3
+		{
+			[]testPart{{"deed", "a.pdf", testPDF}, {"deed", "big.pdf", testPDF + strings.Repeat("x", 1024)}},
+			http.StatusRequestEntityTooLarge, nil, "", 1, "too large, earlier files discarded",
+		},
+		//4
+		{
+			[]testPart{{"deed", "a.pdf", testPDF}, {"deed", "b.pdf", testPDF}, {"deed", "c.pdf", testPDF}},
+			http.StatusBadRequest, nil, "", 2, "too many files",
+		},
+		//5
+		{
+			[]testPart{{"note", "", "no file"}},
+			http.StatusBadRequest, nil, "", 0, "required file missing",
+		},
+		//6
+		{
+			[]testPart{{"deed", "a.pdf", testPDF}, {"other", "b.pdf", testPDF}},
+			http.StatusBadRequest, nil, "", 1, "unknown file param",
+		},
+		//7
+		{
+			[]testPart{{"note", "note.pdf", testPDF}},
+			http.StatusBadRequest, nil, "", 0, "file for a non file param",
+		},
+		//8
+		{
+			[]testPart{{"deed", "", "just text"}},
+			http.StatusBadRequest, nil, "", 0, "field for a file param",
+		},
+		//9
+		{
+			[]testPart{{"deed", "a.pdf", testPDF}, {"note", "", ""}},
+			http.StatusOK, []string{"application/pdf"}, "", 0, "later validation passes",
+		},
+	}
+	for i, td := range testData {
+		files, params = nil, nil
+		sink.discarded = nil
+		body, contentType := multipartBody(t, td.parts)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://example.com/deeds", body)
+		r.Header.Set("Content-Type", contentType)
+		testServer.pathHandlers["/deeds"].ServeHTTP(w, r)
+		if w.Code != td.expCode {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "unexpected response code, exp: %d, got: %d, body: '%s'",
+					td.expCode, w.Code, w.Body.String(),
+				),
+			)
+			continue
+		}
+		if len(sink.discarded) != td.expDiscarded {
+			t.Errorf(
+				getTestMessage(
+					i, td.msg, "exp %d discarded, got: %v", td.expDiscarded, sink.discarded,
+				),
+			)
+		}
+		if td.expCode != http.StatusOK {
+			continue
+		}
+		if len(files) != len(td.expTypes) {
+			t.Errorf(getTestMessage(i, td.msg, "exp %d files, got: %d", len(td.expTypes), len(files)))
+			continue
+		}
+		for j, f := range files {
+			if f.ContentType != td.expTypes[j] {
+				t.Errorf(
+					getTestMessage(
+						i, td.msg, "file %d type exp: '%s', got: '%s'", j, td.expTypes[j], f.ContentType,
+					),
+				)
+			}
+			if stored := sink.stored[f.Location]; int64(len(stored)) != f.Size {
+				t.Errorf(
+					getTestMessage(i, td.msg, "file %d size %d, stored %d", j, f.Size, len(stored)),
+				)
+			}
+		}
+		if params["note"] != td.expNote {
+			t.Errorf(getTestMessage(i, td.msg, "note exp: '%s', got: '%s'", td.expNote, params["note"]))
+		}
+	}
+}
+
+func TestTempDirSink(t *testing.T) {
+	dir := t.TempDir()
+	yamlString := "/deeds:\n  methods: [post]\n  params:\n    deed:\n      type: file\n  callbacks: [cb1]\n"
+	var location string
+	var content []byte
+	tmpServer, err := NewServer(
+		strings.NewReader(yamlString),
+		map[string]Callback{
+			"cb1": func(
+				p map[string]string, w http.ResponseWriter, r *http.Request,
+			) (bool, error) {
+				files, _ := TypedParams(r).Files("deed")
+				location = files[0].Location
+				content, _ = os.ReadFile(location)
+				return true, nil
+			},
+		},
+		WithUploadSink(NewTempDirSink(dir)),
+	)
+	if err != nil {
+		t.Fatalf("failed creating server with error: '%s'", err)
+	}
+	body, contentType := multipartBody(t, []testPart{{"deed", "deed.pdf", testPDF}})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/deeds", body)
+	r.Header.Set("Content-Type", contentType)
+	tmpServer.(*server).pathHandlers["/deeds"].ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response code: %d, body: '%s'", w.Code, w.Body.String())
+	}
+	if filepath.Dir(location) != dir || string(content) != testPDF {
+		t.Errorf("upload not readable in the callback, location: '%s'", location)
+	}
+	if _, err = os.Stat(location); !os.IsNotExist(err) {
+		t.Errorf("temp upload should be removed after the request")
+	}
+}
+
+type fakeS3Client struct {
+	uploads map[string][]byte
+	types   map[string]string
+	deleted []string
+}
+
+func (f *fakeS3Client) Upload(
+	ctx context.Context, bucket, key, contentType string, body io.Reader,
+) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.uploads[bucket+"/"+key] = data
+	f.types[bucket+"/"+key] = contentType
+	return nil
+}
+
+func (f *fakeS3Client) Delete(ctx context.Context, bucket, key string) error {
+	f.deleted = append(f.deleted, bucket+"/"+key)
+	return nil
+}
+
+func TestS3Sink(t *testing.T) {
+	client := &fakeS3Client{uploads: make(map[string][]byte), types: make(map[string]string)}
+	sink := NewS3Sink(client, "deeds", "incoming")
+	upload := &FileUpload{Param: "deed", ContentType: "application/pdf"}
+	if err := sink.Store(context.Background(), upload, strings.NewReader(testPDF)); err != nil {
+		t.Fatalf("store failed with error: '%s'", err)
+	}
+	if !strings.HasPrefix(upload.Location, "incoming/") {
+		t.Errorf("key missing prefix: '%s'", upload.Location)
+	}
+	key := "deeds/" + upload.Location
+	if string(client.uploads[key]) != testPDF || client.types[key] != "application/pdf" {
+		t.Errorf("object not uploaded as expected: %v", client.types)
+	}
+	if err := sink.Discard(context.Background(), upload); err != nil || client.deleted[0] != key {
+		t.Errorf("discard didn't delete the object: %v", client.deleted)
+	}
+}
+
+func TestFileParamLoading(t *testing.T) {
+	testData := []struct {
+		yamlString string
+		msg        string
+	}{
+		//0
+		{"type: file\nsource: query", "files only from the form"},
+		//1
+		{"type: string\nmax_size: 10", "max_size on a string"},
+		//2
+		{"type: file\nsource: form\nmax_size: 0", "zero max_size"},
+		//3
+		{"type: file\nsource: form\naccept: [pdf]", "bad media type"},
+		//4
+		{"type: file\nsource: form\nregex: x", "regex on a file"},
+		//5
+		{"type: array\nsource: form\nitems: {type: file}", "nested files"},
+	}
+	for i, td := range testData {
+		pYaml := &ParamYaml{}
+		if err := yaml.Unmarshal([]byte(td.yamlString), pYaml); err != nil {
+			t.Errorf(getTestMessage(i, td.msg, "bad test yaml: '%s'", err))
+			continue
+		}
+		if _, err := newParam(pYaml); err == nil {
+			t.Errorf(getTestMessage(i, td.msg, "expected an error"))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exporter ships finished spans somewhere, ExportSpans is only ever called
+// from the tracer's batching goroutine so implementations needn't worry
+// about concurrent exports
+type Exporter interface {
+	ExportSpans(context.Context, []SpanData) error
+	Shutdown(context.Context) error
+}
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+func (s StatusCode) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusError:
+		return "error"
+	}
+	return "unset"
+}
+
+// the shape written by the writer/file exporters, one object per line
+type jsonSpan struct {
+	Name          string                 `json:"name"`
+	Service       string                 `json:"service,omitempty"`
+	Kind          string                 `json:"kind"`
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	TraceState    string                 `json:"trace_state,omitempty"`
+	Start         time.Time              `json:"start"`
+	End           time.Time              `json:"end"`
+	DurationMS    float64                `json:"duration_ms"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Status        string                 `json:"status"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+}
+
+func newJSONSpan(data SpanData) *jsonSpan {
+	toRet := &jsonSpan{
+		Name:          data.Name,
+		Service:       data.Service,
+		Kind:          data.Kind.String(),
+		TraceID:       data.SpanContext.TraceID.String(),
+		SpanID:        data.SpanContext.SpanID.String(),
+		TraceState:    data.SpanContext.TraceState,
+		Start:         data.Start,
+		End:           data.End,
+		DurationMS:    float64(data.End.Sub(data.Start)) / float64(time.Millisecond),
+		Status:        data.Status.String(),
+		StatusMessage: data.StatusMessage,
+	}
+	if data.Parent.IsValid() {
+		toRet.ParentSpanID = data.Parent.String()
+	}
+	if len(data.Attributes) > 0 {
+		toRet.Attributes = make(map[string]interface{})
+		for _, a := range data.Attributes {
+			toRet.Attributes[a.Key] = a.Value
+		}
+	}
+	return toRet
+}
+
+type writerExporter struct {
+	sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// JSON lines to w, NewWriterExporter(os.Stdout) for local debugging
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// JSON lines appended to the file at path, created if missing
+func NewFileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerExporter{
+		encoder: json.NewEncoder(f),
+		closer:  f,
+	}, nil
+}
+
+func (w *writerExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	w.Lock()
+	defer w.Unlock()
+	for _, s := range spans {
+		if err := w.encoder.Encode(newJSONSpan(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *writerExporter) Shutdown(ctx context.Context) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closer == nil {
+		return nil
+	}
+	err := w.closer.Close()
+	w.closer = nil
+	return err
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type transport struct {
+	base http.RoundTripper
+}
+
+// NewTransport wraps base so every outgoing request gets a client span and
+// a traceparent header, eg for calls from the frontend to the controller,
+// a nil base is http.DefaultTransport
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(
+		req.Context(),
+		fmt.Sprintf("HTTP %s", req.Method),
+		WithKind(SpanKindClient),
+		WithAttributes(
+			Attribute{"http.method", req.Method},
+			Attribute{"http.url", req.URL.String()},
+		),
+	)
+	defer span.End()
+	//RoundTrippers must not modify the request they're handed
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		span.SetStatus(StatusError, res.Status)
+	}
+	return res, nil
+}
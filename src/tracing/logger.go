@@ -0,0 +1,20 @@
+package tracing
+
+import (
+	logger "github.com/buhduh42/go-logger"
+)
+
+// exporters fail in the background with nobody to return an error to,
+// package global for the same reasons as the server's
+var myLogger logger.Logger
+
+func init() {
+	myLogger = logger.NopLogger()
+}
+
+func AddGlobalLogger(pLogger logger.Logger) {
+	if pLogger == nil {
+		return
+	}
+	myLogger = logger.MultiLogger(myLogger, pLogger)
+}
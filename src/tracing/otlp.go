@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLP over HTTP with the JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+// the proto JSON mapping is small enough to hand roll, trace and span ids
+// are hex rather than base64 per the OTLP spec
+
+const (
+	DefOTLPEndpoint string        = "http://localhost:4318"
+	otlpTracesPath                = "/v1/traces"
+	otlpScopeName                 = "landtitle/tracing"
+	defOTLPTimeout  time.Duration = 10 * time.Second
+)
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPValue(val interface{}) otlpAnyValue {
+	var toRet otlpAnyValue
+	switch v := val.(type) {
+	case string:
+		toRet.StringValue = &v
+	case bool:
+		toRet.BoolValue = &v
+	case int:
+		toRet.IntValue = strPtr(strconv.FormatInt(int64(v), 10))
+	case int64:
+		toRet.IntValue = strPtr(strconv.FormatInt(v, 10))
+	case float64:
+		toRet.DoubleValue = &v
+	default:
+		toRet.StringValue = strPtr(fmt.Sprint(v))
+	}
+	return toRet
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func newOTLPSpan(data SpanData) otlpSpan {
+	toRet := otlpSpan{
+		TraceID:           data.SpanContext.TraceID.String(),
+		SpanID:            data.SpanContext.SpanID.String(),
+		TraceState:        data.SpanContext.TraceState,
+		Name:              data.Name,
+		Kind:              data.Kind,
+		StartTimeUnixNano: strconv.FormatInt(data.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(data.End.UnixNano(), 10),
+		Status: otlpStatus{
+			Code:    data.Status,
+			Message: data.StatusMessage,
+		},
+	}
+	if data.Parent.IsValid() {
+		toRet.ParentSpanID = data.Parent.String()
+	}
+	for _, a := range data.Attributes {
+		toRet.Attributes = append(
+			toRet.Attributes, otlpKeyValue{a.Key, newOTLPValue(a.Value)},
+		)
+	}
+	return toRet
+}
+
+// spans are grouped by service since each is its own resource
+func newOTLPRequest(spans []SpanData) *otlpRequest {
+	byService := make(map[string][]otlpSpan)
+	order := make([]string, 0)
+	for _, s := range spans {
+		if _, ok := byService[s.Service]; !ok {
+			order = append(order, s.Service)
+		}
+		byService[s.Service] = append(byService[s.Service], newOTLPSpan(s))
+	}
+	toRet := &otlpRequest{}
+	for _, service := range order {
+		resource := otlpResource{Attributes: []otlpKeyValue{}}
+		if service != "" {
+			resource.Attributes = append(
+				resource.Attributes,
+				otlpKeyValue{"service.name", newOTLPValue(service)},
+			)
+		}
+		toRet.ResourceSpans = append(toRet.ResourceSpans, otlpResourceSpans{
+			Resource: resource,
+			ScopeSpans: []otlpScopeSpans{
+				{
+					Scope: otlpScope{Name: otlpScopeName},
+					Spans: byService[service],
+				},
+			},
+		})
+	}
+	return toRet
+}
+
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// endpoint is the collector's base url, eg DefOTLPEndpoint, /v1/traces is
+// appended, headers are sent with every export, eg for collector auth
+func NewOTLPExporter(endpoint string, headers map[string]string) (Exporter, error) {
+	if endpoint == "" {
+		endpoint = DefOTLPEndpoint
+	}
+	if !strings.HasPrefix(endpoint, "http://") &&
+		!strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf(
+			"otlp endpoint must be an http(s) url, got: '%s'", endpoint,
+		)
+	}
+	return &otlpExporter{
+		url:     strings.TrimRight(endpoint, "/") + otlpTracesPath,
+		headers: headers,
+		client:  &http.Client{Timeout: defOTLPTimeout},
+	}, nil
+}
+
+func (o *otlpExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, o.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf(
+			"otlp collector returned status %d: '%s'", res.StatusCode, msg,
+		)
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+func (o *otlpExporter) Shutdown(ctx context.Context) error {
+	o.client.CloseIdleConnections()
+	return nil
+}
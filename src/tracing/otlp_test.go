@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	received := make([]*otlpRequest, 0)
+	headers := make([]http.Header, 0)
+	collector := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != otlpTracesPath {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			req := &otlpRequest{}
+			if err := json.Unmarshal(body, req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			received = append(received, req)
+			headers = append(headers, r.Header.Clone())
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(
+		collector.URL+"/", map[string]string{"X-Collector-Key": "secret"},
+	)
+	if err != nil {
+		t.Fatalf("failed creating exporter: '%s'", err)
+	}
+	tracer := NewTracer("frontend", exporter)
+	ctx, root := tracer.Start(context.Background(), "GET /", WithKind(SpanKindServer))
+	_, child := tracer.Start(
+		ctx, "callback", WithAttributes(
+			Attribute{"ok", true}, Attribute{"count", 2}, Attribute{"ratio", 0.5},
+		),
+	)
+	child.SetStatus(StatusError, "nope")
+	child.End()
+	root.End()
+	if err = tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed with error: '%s'", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expected a single export, got: %d", len(received))
+	}
+	if headers[0].Get("X-Collector-Key") != "secret" {
+		t.Errorf("custom headers not sent")
+	}
+	if headers[0].Get("Content-Type") != "application/json" {
+		t.Errorf("wrong content type: '%s'", headers[0].Get("Content-Type"))
+	}
+	rs := received[0].ResourceSpans
+	if len(rs) != 1 || len(rs[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected resource spans: %+v", rs)
+	}
+	if attr := rs[0].Resource.Attributes; len(attr) != 1 ||
+		attr[0].Key != "service.name" || *attr[0].Value.StringValue != "frontend" {
+		t.Errorf("service name resource attribute missing: %+v", attr)
+	}
+	spans := rs[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got: %d", len(spans))
+	}
+	cSpan, rSpan := spans[0], spans[1]
+	if cSpan.ParentSpanID != rSpan.SpanID || cSpan.TraceID != rSpan.TraceID {
+		t.Errorf("child not parented on root: %+v, %+v", cSpan, rSpan)
+	}
+	if rSpan.Kind != SpanKindServer || cSpan.Kind != SpanKindInternal {
+		t.Errorf("span kinds wrong, root: %d, child: %d", rSpan.Kind, cSpan.Kind)
+	}
+	if cSpan.Status.Code != StatusError || cSpan.Status.Message != "nope" {
+		t.Errorf("child status wrong: %+v", cSpan.Status)
+	}
+	if len(cSpan.Attributes) != 3 ||
+		!*cSpan.Attributes[0].Value.BoolValue ||
+		*cSpan.Attributes[1].Value.IntValue != "2" ||
+		*cSpan.Attributes[2].Value.DoubleValue != 0.5 {
+		t.Errorf("child attributes wrong: %+v", cSpan.Attributes)
+	}
+}
+
+func TestOTLPExporterErrors(t *testing.T) {
+	if _, err := NewOTLPExporter("localhost:4318", nil); err == nil {
+		t.Errorf("endpoints without a scheme should error")
+	}
+	collector := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		},
+	))
+	defer collector.Close()
+	exporter, err := NewOTLPExporter(collector.URL, nil)
+	if err != nil {
+		t.Fatalf("failed creating exporter: '%s'", err)
+	}
+	err = exporter.ExportSpans(context.Background(), []SpanData{{Name: "x"}})
+	if err == nil {
+		t.Errorf("non 2xx collector responses should error")
+	}
+}
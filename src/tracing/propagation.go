@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context, https://www.w3.org/TR/trace-context/
+const (
+	TraceparentHeader  string = "traceparent"
+	TracestateHeader          = "tracestate"
+	traceparentVersion        = "00"
+	//tracestate is capped at 32 list members by the spec, 512 bytes is the
+	//size vendors are required to propagate at minimum
+	maxTracestateLength int = 512
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+type TraceFlags byte
+
+const FlagSampled TraceFlags = 0x01
+
+func (f TraceFlags) Sampled() bool {
+	return f&FlagSampled == FlagSampled
+}
+
+// everything that crosses a process boundary
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      TraceFlags
+	TraceState string
+	//set when the context came in over the wire
+	Remote bool
+}
+
+func (s SpanContext) IsValid() bool {
+	return s.TraceID.IsValid() && s.SpanID.IsValid()
+}
+
+func (s SpanContext) Traceparent() string {
+	return fmt.Sprintf(
+		"%s-%s-%s-%02x", traceparentVersion, s.TraceID, s.SpanID, byte(s.Flags),
+	)
+}
+
+func decodeHex(dst []byte, src string) error {
+	if len(src) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("expected %d hex characters, got: '%s'", len(dst)*2, src)
+	}
+	//the spec only allows lowercase
+	if strings.ToLower(src) != src {
+		return fmt.Errorf("hex must be lowercase, got: '%s'", src)
+	}
+	_, err := hex.Decode(dst, []byte(src))
+	return err
+}
+
+// version-traceid-parentid-flags, eg
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(header string) (SpanContext, error) {
+	toRet := SpanContext{Remote: true}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return toRet, fmt.Errorf("malformed traceparent: '%s'", header)
+	}
+	if len(parts[0]) != 2 || parts[0] == "ff" {
+		return toRet, fmt.Errorf("invalid traceparent version: '%s'", parts[0])
+	}
+	//future versions may append fields, version 00 may not
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return toRet, fmt.Errorf("malformed traceparent: '%s'", header)
+	}
+	if err := decodeHex(toRet.TraceID[:], parts[1]); err != nil {
+		return toRet, fmt.Errorf("invalid trace id: %w", err)
+	}
+	if err := decodeHex(toRet.SpanID[:], parts[2]); err != nil {
+		return toRet, fmt.Errorf("invalid parent id: %w", err)
+	}
+	flags := make([]byte, 1)
+	if err := decodeHex(flags, parts[3]); err != nil {
+		return toRet, fmt.Errorf("invalid trace flags: %w", err)
+	}
+	toRet.Flags = TraceFlags(flags[0])
+	if !toRet.IsValid() {
+		return toRet, fmt.Errorf("all zero trace or parent id: '%s'", header)
+	}
+	return toRet, nil
+}
+
+// Extract pulls a remote span context out of incoming request headers,
+// ok is false when there is none or it's garbage, in which case the caller
+// should start a new trace
+func Extract(header http.Header) (SpanContext, bool) {
+	raw := header.Get(TraceparentHeader)
+	if raw == "" {
+		return SpanContext{}, false
+	}
+	toRet, err := ParseTraceparent(raw)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	//multiple tracestate headers are combined as a single list
+	state := strings.Join(header.Values(TracestateHeader), ",")
+	if len(state) <= maxTracestateLength {
+		toRet.TraceState = state
+	}
+	return toRet, true
+}
+
+// Inject writes the span context active in ctx onto outgoing headers,
+// does nothing when ctx carries no trace
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		header.Set(TracestateHeader, sc.TraceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+func newTraceID() TraceID {
+	var toRet TraceID
+	for !toRet.IsValid() {
+		rand.Read(toRet[:])
+	}
+	return toRet
+}
+
+func newSpanID() SpanID {
+	var toRet SpanID
+	for !toRet.IsValid() {
+		rand.Read(toRet[:])
+	}
+	return toRet
+}
@@ -0,0 +1,162 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	testData := []struct {
+		header   string
+		expTrace string
+		expSpan  string
+		expFlags TraceFlags
+		isError  bool
+		msg      string
+	}{
+		//0
+		{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+			"00f067aa0ba902b7",
+			FlagSampled,
+			false,
+			"spec example",
+		},
+		//1
+		{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+			"00f067aa0ba902b7",
+			0,
+			false,
+			"not sampled",
+		},
+		//2
+		{
+			"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+			"4bf92f3577b34da6a3ce929d0e0e4736",
+			"00f067aa0ba902b7",
+			FlagSampled,
+			false,
+			"future versions may append fields",
+		},
+		//3
+		{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+			"", "", 0, true,
+			"version 00 can't have extra fields",
+		},
+		//4
+		{
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"", "", 0, true,
+			"version ff is invalid",
+		},
+		//5
+		{
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"", "", 0, true,
+			"zero trace id",
+		},
+		//6
+		{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"", "", 0, true,
+			"zero parent id",
+		},
+		//7
+		{
+			"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"", "", 0, true,
+			"uppercase hex",
+		},
+		//8
+		{
+			"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+			"", "", 0, true,
+			"short trace id",
+		},
+		//9
+		{
+			"garbage",
+			"", "", 0, true,
+			"garbage",
+		},
+	}
+	for i, td := range testData {
+		sc, err := ParseTraceparent(td.header)
+		if td.isError {
+			if err == nil {
+				t.Errorf("index: %d, expected error, msg: '%s'", i, td.msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("index: %d, unexpected error: '%s', msg: '%s'", i, err, td.msg)
+			continue
+		}
+		if sc.TraceID.String() != td.expTrace {
+			t.Errorf(
+				"index: %d, trace id mismatch, exp: '%s', got: '%s', msg: '%s'",
+				i, td.expTrace, sc.TraceID, td.msg,
+			)
+		}
+		if sc.SpanID.String() != td.expSpan {
+			t.Errorf(
+				"index: %d, span id mismatch, exp: '%s', got: '%s', msg: '%s'",
+				i, td.expSpan, sc.SpanID, td.msg,
+			)
+		}
+		if sc.Flags != td.expFlags {
+			t.Errorf(
+				"index: %d, flags mismatch, exp: %d, got: %d, msg: '%s'",
+				i, td.expFlags, sc.Flags, td.msg,
+			)
+		}
+		if !sc.Remote {
+			t.Errorf("index: %d, parsed context should be remote, msg: '%s'", i, td.msg)
+		}
+	}
+}
+
+func TestExtractInject(t *testing.T) {
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	in := http.Header{}
+	in.Set(TraceparentHeader, parent)
+	in.Add(TracestateHeader, "congo=t61rcWkgMzE")
+	in.Add(TracestateHeader, "rojo=00f067aa0ba902b7")
+	sc, ok := Extract(in)
+	if !ok {
+		t.Fatalf("failed extracting valid traceparent")
+	}
+	if sc.TraceState != "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7" {
+		t.Errorf("tracestate not combined, got: '%s'", sc.TraceState)
+	}
+	tracer := NewTracer("test", nil)
+	ctx, span := tracer.Start(context.Background(), "child", WithRemoteParent(sc))
+	out := http.Header{}
+	Inject(ctx, out)
+	outSC, err := ParseTraceparent(out.Get(TraceparentHeader))
+	if err != nil {
+		t.Fatalf("injected traceparent not parseable: '%s'", err)
+	}
+	if outSC.TraceID != sc.TraceID {
+		t.Errorf("trace id not propagated, exp: '%s', got: '%s'", sc.TraceID, outSC.TraceID)
+	}
+	if outSC.SpanID != span.SpanContext().SpanID {
+		t.Errorf("injected parent should be the local span")
+	}
+	if out.Get(TracestateHeader) != sc.TraceState {
+		t.Errorf("tracestate not propagated, got: '%s'", out.Get(TracestateHeader))
+	}
+	if _, ok = Extract(http.Header{}); ok {
+		t.Errorf("empty headers shouldn't extract")
+	}
+	empty := http.Header{}
+	Inject(context.Background(), empty)
+	if len(empty) != 0 {
+		t.Errorf("nothing should be injected without a trace, got: %v", empty)
+	}
+}
@@ -0,0 +1,378 @@
+/*
+Minimal distributed tracing, spans are propagated with W3C traceparent
+headers and handed to a pluggable Exporter in batches.  Kept dependency free
+on purpose, the OTLP exporter speaks the JSON flavor of OTLP/HTTP so it can
+point at any collector.
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// values match the OTLP enum
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+type StatusCode int
+
+// values match the OTLP enum
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// immutable snapshot of a finished span, what exporters receive
+type SpanData struct {
+	Name          string
+	Service       string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+}
+
+type Span struct {
+	sync.Mutex
+	tracer *Tracer
+	data   SpanData
+	ended  bool
+}
+
+// nil safe so callers never need to check what Start handed back
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i, a := range s.data.Attributes {
+		if a.Key == key {
+			s.data.Attributes[i].Value = value
+			return
+		}
+	}
+	s.data.Attributes = append(s.data.Attributes, Attribute{key, value})
+}
+
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data.Status = code
+	s.data.StatusMessage = msg
+}
+
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// safe to call more than once, only the first counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = append([]Attribute(nil), s.data.Attributes...)
+	s.Unlock()
+	if data.SpanContext.Flags.Sampled() {
+		s.tracer.export(data)
+	}
+}
+
+type StartOption func(*SpanData)
+
+func WithKind(kind SpanKind) StartOption {
+	return func(d *SpanData) {
+		d.Kind = kind
+	}
+}
+
+func WithAttributes(attrs ...Attribute) StartOption {
+	return func(d *SpanData) {
+		d.Attributes = append(d.Attributes, attrs...)
+	}
+}
+
+// parent a span on an extracted remote context instead of whatever
+// is in the context passed to Start
+func WithRemoteParent(sc SpanContext) StartOption {
+	return func(d *SpanData) {
+		if !sc.IsValid() {
+			return
+		}
+		d.SpanContext.TraceID = sc.TraceID
+		d.SpanContext.Flags = sc.Flags
+		d.SpanContext.TraceState = sc.TraceState
+		d.Parent = sc.SpanID
+	}
+}
+
+type spanContextKey struct{}
+
+type remoteContextKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	toRet, _ := ctx.Value(spanContextKey{}).(*Span)
+	return toRet
+}
+
+// carries a remote span context without a local span, eg a proxy
+// that only forwards
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteContextKey{}, sc)
+}
+
+// the active local span's context, falling back to a remote one
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	if ctx == nil {
+		return SpanContext{}
+	}
+	toRet, _ := ctx.Value(remoteContextKey{}).(SpanContext)
+	return toRet
+}
+
+const (
+	defBatchSize     int           = 512
+	defQueueSize                   = 2048
+	defBatchInterval time.Duration = 5 * time.Second
+)
+
+type Tracer struct {
+	service  string
+	exporter Exporter
+	queue    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// a nil exporter is fine, ids are still generated and propagated but
+// nothing leaves the process
+func NewTracer(service string, exporter Exporter) *Tracer {
+	toRet := &Tracer{
+		service:  service,
+		exporter: exporter,
+	}
+	if exporter != nil {
+		toRet.queue = make(chan SpanData, defQueueSize)
+		toRet.flush = make(chan chan struct{})
+		toRet.done = make(chan struct{})
+		go toRet.run()
+	}
+	return toRet
+}
+
+// Start begins a span parented on whatever span is in ctx, or a new trace
+// if there isn't one, the returned context carries the new span, a nil
+// Tracer falls back to the global one
+func (t *Tracer) Start(
+	ctx context.Context, name string, opts ...StartOption,
+) (context.Context, *Span) {
+	if t == nil {
+		t = GetTracer()
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	data := SpanData{
+		Name:    name,
+		Service: t.service,
+		Kind:    SpanKindInternal,
+		Start:   time.Now(),
+	}
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		data.SpanContext.TraceID = parent.TraceID
+		data.SpanContext.Flags = parent.Flags
+		data.SpanContext.TraceState = parent.TraceState
+		data.Parent = parent.SpanID
+	}
+	for _, opt := range opts {
+		opt(&data)
+	}
+	if !data.SpanContext.TraceID.IsValid() {
+		//root span, always sampled
+		data.SpanContext.TraceID = newTraceID()
+		data.SpanContext.Flags = FlagSampled
+	}
+	data.SpanContext.SpanID = newSpanID()
+	span := &Span{
+		tracer: t,
+		data:   data,
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) export(data SpanData) {
+	if t == nil || t.queue == nil {
+		return
+	}
+	select {
+	case <-t.done:
+	case t.queue <- data:
+	default:
+		//never block a request on tracing, drop it
+	}
+}
+
+func (t *Tracer) exportBatch(batch []SpanData) {
+	if err := t.exporter.ExportSpans(context.Background(), batch); err != nil {
+		myLogger.Errorf("exporting %d spans failed with error: '%s'", len(batch), err)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(defBatchInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, defBatchSize)
+	//exporters are free to hang onto what they're handed, new slice each time
+	exportBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		t.exportBatch(batch)
+		batch = make([]SpanData, 0, defBatchSize)
+	}
+	add := func(data SpanData) {
+		batch = append(batch, data)
+		if len(batch) >= defBatchSize {
+			exportBatch()
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case data := <-t.queue:
+				add(data)
+			default:
+				exportBatch()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case data := <-t.queue:
+			add(data)
+		case <-ticker.C:
+			exportBatch()
+		case ack := <-t.flush:
+			drain()
+			close(ack)
+		case <-t.done:
+			drain()
+			return
+		}
+	}
+}
+
+// ForceFlush blocks until everything queued so far has been exported
+func (t *Tracer) ForceFlush(ctx context.Context) error {
+	if t == nil || t.queue == nil {
+		return nil
+	}
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-t.done:
+		return fmt.Errorf("tracer is shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports whatever is queued then shuts the exporter down,
+// spans ended afterwards are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil || t.queue == nil {
+		return nil
+	}
+	if err := t.ForceFlush(ctx); err != nil {
+		return err
+	}
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+	return t.exporter.Shutdown(ctx)
+}
+
+// package global for ease, same as the server's logger, libs like the aws
+// clients don't take a tracer, main() sets this once
+var globalTracer *Tracer = NewTracer("", nil)
+
+var globalMu sync.RWMutex
+
+func SetTracer(t *Tracer) {
+	if t == nil {
+		return
+	}
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	globalTracer = t
+}
+
+func GetTracer() *Tracer {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return globalTracer
+}
+
+// Start on the global tracer
+func Start(
+	ctx context.Context, name string, opts ...StartOption,
+) (context.Context, *Span) {
+	return GetTracer().Start(ctx, name, opts...)
+}
@@ -0,0 +1,160 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingExporter struct {
+	sync.Mutex
+	spans    []SpanData
+	shutdown bool
+}
+
+func (r *recordingExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *recordingExporter) Shutdown(ctx context.Context) error {
+	r.Lock()
+	defer r.Unlock()
+	r.shutdown = true
+	return nil
+}
+
+func TestTracerParenting(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer("test", exporter)
+	ctx, root := tracer.Start(context.Background(), "root", WithKind(SpanKindServer))
+	childCtx, child := tracer.Start(ctx, "child")
+	_, grandChild := tracer.Start(childCtx, "grandchild")
+	grandChild.RecordError(errors.New("boom"))
+	grandChild.End()
+	child.SetAttribute("foo", "bar")
+	child.SetAttribute("foo", "baz")
+	child.End()
+	root.End()
+	//second end is a no-op
+	root.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed with error: '%s'", err)
+	}
+	if !exporter.shutdown {
+		t.Errorf("exporter was not shut down")
+	}
+	if len(exporter.spans) != 3 {
+		t.Fatalf("expected 3 spans, got: %d", len(exporter.spans))
+	}
+	byName := make(map[string]SpanData)
+	for _, s := range exporter.spans {
+		byName[s.Name] = s
+	}
+	traceID := byName["root"].SpanContext.TraceID
+	for name, s := range byName {
+		if s.SpanContext.TraceID != traceID {
+			t.Errorf("span '%s' not in the root trace", name)
+		}
+		if s.Service != "test" {
+			t.Errorf("span '%s' service mismatch, got: '%s'", name, s.Service)
+		}
+	}
+	if byName["root"].Parent.IsValid() {
+		t.Errorf("root span should not have a parent")
+	}
+	if byName["root"].Kind != SpanKindServer {
+		t.Errorf("root kind mismatch, got: %d", byName["root"].Kind)
+	}
+	if byName["child"].Parent != byName["root"].SpanContext.SpanID {
+		t.Errorf("child not parented on root")
+	}
+	if byName["grandchild"].Parent != byName["child"].SpanContext.SpanID {
+		t.Errorf("grandchild not parented on child")
+	}
+	if byName["grandchild"].Status != StatusError ||
+		byName["grandchild"].StatusMessage != "boom" {
+		t.Errorf("grandchild error not recorded")
+	}
+	if len(byName["child"].Attributes) != 1 ||
+		byName["child"].Attributes[0].Value != "baz" {
+		t.Errorf("child attributes wrong: %v", byName["child"].Attributes)
+	}
+	//ended after shutdown, dropped
+	_, late := tracer.Start(context.Background(), "late")
+	late.End()
+	if len(exporter.spans) != 3 {
+		t.Errorf("spans ended after shutdown should be dropped")
+	}
+}
+
+func TestUnsampledParent(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer("test", exporter)
+	sc, err := ParseTraceparent(
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+	)
+	if err != nil {
+		t.Fatalf("failed parsing traceparent: '%s'", err)
+	}
+	_, span := tracer.Start(context.Background(), "unsampled", WithRemoteParent(sc))
+	span.End()
+	tracer.Shutdown(context.Background())
+	if len(exporter.spans) != 0 {
+		t.Errorf("unsampled spans should not be exported")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("failed creating file exporter: '%s'", err)
+	}
+	tracer := NewTracer("file", exporter)
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child", WithAttributes(Attribute{"count", 3}))
+	child.End()
+	parent.End()
+	if err = tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed with error: '%s'", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed opening exported spans: '%s'", err)
+	}
+	defer f.Close()
+	lines := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := make(map[string]interface{})
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("bad json line: '%s'", scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got: %d", len(lines))
+	}
+	if lines[0]["name"] != "child" || lines[0]["parent_span_id"] != lines[1]["span_id"] {
+		t.Errorf("child span not parented on parent: %v", lines)
+	}
+	attrs, _ := lines[0]["attributes"].(map[string]interface{})
+	if attrs["count"] != float64(3) {
+		t.Errorf("attributes not written: %v", lines[0])
+	}
+	if _, ok := lines[1]["parent_span_id"]; ok {
+		t.Errorf("root span should omit parent: %v", lines[1])
+	}
+	if strings.Count(lines[1]["trace_id"].(string), "") != 33 {
+		t.Errorf("trace id should be 32 hex chars: %v", lines[1]["trace_id"])
+	}
+}